@@ -0,0 +1,199 @@
+package downloader
+
+import (
+	"time"
+)
+
+const PieceOrderAdaptive = "adaptive"
+
+var (
+	// AdaptiveShare is the share of the bytes nobody works on yet that a
+	// connection of the adaptive order takes, as one over AdaptiveShare
+	// times the connections: pieces start large and shrink as the file
+	// completes.
+	AdaptiveShare = 2
+	// AdaptiveLatencyFactor keeps adaptive pieces large enough to take this
+	// many times the latency of a request to fetch, so waiting for responses
+	// costs at most a small part of the download.
+	AdaptiveLatencyFactor = 10
+)
+
+// TuningStats tells how the adaptive order cut the file, to judge it by.
+type TuningStats struct {
+	Pieces int `json:"pieces"`
+	// Steals counts the pieces taken off the end of a running one when no
+	// bytes were left to start on.
+	Steals        int   `json:"steals"`
+	FirstPiece    int64 `json:"first_piece"`
+	LastPiece     int64 `json:"last_piece"`
+	SmallestPiece int64 `json:"smallest_piece"`
+	// MinPiece is the smallest piece the latency and speed measured allow.
+	MinPiece int64 `json:"min_piece"`
+	// Latency is the average time to the response of a request, in
+	// seconds, and ConnectionSpeed the average speed of one connection.
+	Latency         float64 `json:"latency"`
+	ConnectionSpeed int64   `json:"connection_speed"`
+	// Tail is the time from the first connection running out of bytes to
+	// start on to the last one finishing, in seconds.
+	Tail float64 `json:"tail"`
+}
+
+type adaptiveTuning struct {
+	stats     TuningStats
+	latency   time.Duration
+	speed     float64
+	bytes     int64
+	busy      time.Duration
+	tailStart time.Time
+	lastAsk   time.Time
+}
+
+// ewma is the weight a new measurement gets in the average latency.
+const ewma = 0.25
+
+// Tuning returns how the adaptive order cut the file so far.
+func (f *File) Tuning() (TuningStats, bool) {
+	if f.pieceOrder != PieceOrderAdaptive {
+		return TuningStats{}, false
+	}
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	t := &f.tuning
+	s := t.stats
+	s.MinPiece = f.adaptiveFloor()
+	s.Latency = t.latency.Seconds()
+	s.ConnectionSpeed = int64(t.speed)
+	if !t.tailStart.IsZero() && t.lastAsk.After(t.tailStart) {
+		s.Tail = t.lastAsk.Sub(t.tailStart).Seconds()
+	}
+	return s, true
+}
+
+// adaptiveFloor is the smallest piece worth a request: one a connection
+// spends AdaptiveLatencyFactor times the request latency on, but no larger
+// than the first piece and not below the minimum split size. f.blockMu is
+// held.
+func (f *File) adaptiveFloor() int64 {
+	t := &f.tuning
+	latency := int64(t.speed * t.latency.Seconds() * float64(AdaptiveLatencyFactor))
+	return max(f.minSplitSize, min(latency, (f.Size-f.skip)/int64(AdaptiveShare*max(f.connections, 1))))
+}
+
+// startTransfer notes that block id got its response latency after the
+// request was sent.
+func (f *File) startTransfer(id int, latency time.Duration) {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	b := &f.BlockList[id]
+	b.since, b.sinceBegin = time.Now(), b.Begin
+	t := &f.tuning
+	if t.latency == 0 {
+		t.latency = latency
+	} else {
+		t.latency += time.Duration(ewma * float64(latency-t.latency))
+	}
+}
+
+// endTransfer notes a connection reading bytes over elapsed. The speed of a
+// connection is that of all transfers together, so short bursts, as a rate
+// limit allows at first, do not skew it.
+func (f *File) endTransfer(bytes int64, elapsed time.Duration) {
+	if bytes <= 0 || elapsed <= 0 {
+		return
+	}
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	t := &f.tuning
+	t.bytes += bytes
+	t.busy += elapsed
+	t.speed = float64(t.bytes) / t.busy.Seconds()
+}
+
+// blockSpeed estimates how fast block b is being fetched, from its own
+// transfer once it has one. f.blockMu is held.
+func (f *File) blockSpeed(b Block) float64 {
+	if elapsed := time.Since(b.since).Seconds(); !b.since.IsZero() && elapsed > 0.5 && b.Begin > b.sinceBegin {
+		return float64(b.Begin-b.sinceBegin) / elapsed
+	}
+	return f.tuning.speed
+}
+
+// nextAdaptive gives a worker the front of the first bytes nobody works
+// on, a piece of 1/(AdaptiveShare*connections) of all of them. When none are
+// left it takes the end off the running piece expected to finish last,
+// sized so both finish together. f.blockMu is held.
+func (f *File) nextAdaptive() (int, bool) {
+	t := &f.tuning
+	now := time.Now()
+	t.lastAsk = now
+	floor := f.adaptiveFloor()
+	first, left := -1, int64(0)
+	for i, b := range f.BlockList {
+		if !b.busy && !b.done() {
+			left += b.End - b.Begin + 1
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	if first >= 0 {
+		size := max(left/int64(AdaptiveShare*f.allowed()), floor)
+		if b := f.BlockList[first]; b.End-b.Begin+1 >= size+floor {
+			f.BlockList = append(f.BlockList, Block{Begin: b.Begin + size, End: b.End, start: b.Begin + size})
+			f.BlockList[first].End = b.Begin + size - 1
+		}
+		f.BlockList[first].busy = true
+		f.countBusy()
+		f.notePiece(f.BlockList[first].End - f.BlockList[first].Begin + 1)
+		return first, true
+	}
+	if t.tailStart.IsZero() {
+		t.tailStart = now
+	}
+
+	best, bestEta, bestSpeed := -1, 0.0, 0.0
+	for i, b := range f.BlockList {
+		if !b.busy || b.End == -1 || b.done() {
+			continue
+		}
+		speed := f.blockSpeed(b)
+		eta := float64(b.End - b.Begin + 1)
+		if speed > 0 {
+			eta /= speed
+		}
+		if eta > bestEta {
+			best, bestEta, bestSpeed = i, eta, speed
+		}
+	}
+	if best < 0 || f.Strategy() != StrategyParallel {
+		f.workers--
+		return -1, false
+	}
+	remaining := f.BlockList[best].End - f.BlockList[best].Begin + 1
+	tail := remaining / 2
+	if bestSpeed > 0 && t.speed > 0 {
+		tail = int64(float64(remaining) * t.speed / (t.speed + bestSpeed))
+	}
+	if tail < floor || remaining-tail < floor {
+		f.workers--
+		return -1, false
+	}
+	mid := f.BlockList[best].End - tail + 1
+	f.BlockList = append(f.BlockList, Block{Begin: mid, End: f.BlockList[best].End, start: mid, busy: true})
+	f.BlockList[best].End = mid - 1
+	f.countBusy()
+	t.stats.Steals++
+	f.notePiece(tail)
+	return len(f.BlockList) - 1, true
+}
+
+// notePiece counts a piece handed out. f.blockMu is held.
+func (f *File) notePiece(size int64) {
+	s := &f.tuning.stats
+	if s.Pieces == 0 {
+		s.FirstPiece, s.SmallestPiece = size, size
+	}
+	s.Pieces++
+	s.LastPiece = size
+	s.SmallestPiece = min(s.SmallestPiece, size)
+}
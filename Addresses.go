@@ -0,0 +1,262 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ConnectionAttemptDelay is how long a connection attempt runs alone
+	// before the next address of the host is tried alongside it, as in Happy
+	// Eyeballs (RFC 8305).
+	ConnectionAttemptDelay = 250 * time.Millisecond
+
+	// AddressFailurePenalty is how long an address that refused or timed out
+	// is tried after the others.
+	AddressFailurePenalty = 30 * time.Second
+)
+
+type addressStats struct {
+	connect  time.Duration
+	speed    int64
+	failedAt time.Time
+}
+
+// addressBook remembers how the addresses of the hosts a download connects
+// to performed, so that block connections go to the best one first.
+type addressBook struct {
+	mu    sync.Mutex
+	stats map[string]*addressStats
+}
+
+func (b *addressBook) get(ip string) *addressStats {
+	if b.stats == nil {
+		b.stats = map[string]*addressStats{}
+	}
+	s, ok := b.stats[ip]
+	if !ok {
+		s = &addressStats{}
+		b.stats[ip] = s
+	}
+	return s
+}
+
+func (b *addressBook) connected(ip string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.get(ip)
+	if s.connect == 0 {
+		s.connect = d
+	} else {
+		s.connect = (s.connect*3 + d) / 4
+	}
+	s.failedAt = time.Time{}
+}
+
+func (b *addressBook) failed(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.get(ip).failedAt = time.Now()
+}
+
+func (b *addressBook) measured(ip string, speed int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.get(ip)
+	if s.speed == 0 {
+		s.speed = speed
+	} else {
+		s.speed = (s.speed*3 + speed) / 4
+	}
+}
+
+// order interleaves IPv6 and IPv4 addresses, then moves the fastest ones,
+// by measured throughput and then by connect time, to the front and the
+// ones that failed recently to the back.
+func (b *addressBook) order(ips []net.IP) []string {
+	var v6, v4, list []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			list = append(list, v6[i])
+		}
+		if i < len(v4) {
+			list = append(list, v4[i])
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := make(map[string]addressStats, len(list))
+	for _, ip := range list {
+		if s, ok := b.stats[ip]; ok {
+			stats[ip] = *s
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, c := stats[list[i]], stats[list[j]]
+		aFailed, cFailed := time.Since(a.failedAt) < AddressFailurePenalty, time.Since(c.failedAt) < AddressFailurePenalty
+		switch {
+		case aFailed != cFailed:
+			return cFailed
+		case a.speed != c.speed:
+			return a.speed > c.speed
+		case a.connect == 0 || c.connect == 0:
+			return c.connect == 0 && a.connect != 0
+		default:
+			return a.connect < c.connect
+		}
+	})
+	return list
+}
+
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "ip4"
+	case "tcp6":
+		return "ip6"
+	}
+	return "ip"
+}
+
+func (f *File) lookupHost(ctx context.Context, d *net.Dialer, host, network string) ([]net.IP, error) {
+	if f.doh != "" {
+		addrs, err := lookupDoH(ctx, f.doh, host, network)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupIP(ctx, ipNetwork(network), host)
+}
+
+// dialHost connects to one of the addresses of host, best first. When an
+// attempt does not succeed within ConnectionAttemptDelay, or fails, the next
+// address is tried while the earlier attempts keep running, and the first
+// connection wins.
+func (f *File) dialHost(ctx context.Context, d *net.Dialer, network, host, port string) (net.Conn, error) {
+	ips, err := f.lookupHost(ctx, d, host, network)
+	if err != nil {
+		return nil, err
+	}
+	addrs := f.addresses.order(ips)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		ip   string
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var next, pending int
+	attempt := func() {
+		ip := addrs[next]
+		next++
+		pending++
+		go func() {
+			start := time.Now()
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				f.addresses.connected(ip, time.Since(start))
+			}
+			results <- result{conn, ip, err}
+		}()
+	}
+	attempt()
+	timer := time.NewTimer(ConnectionAttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return &measuredConn{Conn: r.conn, ip: r.ip, book: &f.addresses}, nil
+			}
+			if ctx.Err() != nil {
+				return nil, r.err
+			}
+			f.addresses.failed(r.ip)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				slog.Debug("connection failed, trying the next address", "host", host, "address", r.ip, "err", r.err)
+				attempt()
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				attempt()
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// measuredConn reports the throughput of a connection to its address when
+// it is closed, counting from the first to the last read.
+type measuredConn struct {
+	net.Conn
+	ip    string
+	book  *addressBook
+	read  int64
+	first atomic.Int64
+	last  atomic.Int64
+	once  sync.Once
+}
+
+func (c *measuredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		c.first.CompareAndSwap(0, now)
+		c.last.Store(now)
+		atomic.AddInt64(&c.read, int64(n))
+	}
+	return n, err
+}
+
+func (c *measuredConn) Close() error {
+	c.once.Do(func() {
+		read := atomic.LoadInt64(&c.read)
+		if elapsed := time.Duration(c.last.Load() - c.first.Load()); read >= 1<<20 && elapsed > 0 {
+			c.book.measured(c.ip, int64(float64(read)/elapsed.Seconds()))
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,219 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntries is how many entries an audit log without a file keeps.
+var AuditEntries = 1000
+
+// AuditEntry records one control action: who sent which request, from
+// where, and what it did to which downloads.
+type AuditEntry struct {
+	Time    time.Time     `json:"time"`
+	Who     string        `json:"who"`
+	Tenant  string        `json:"tenant,omitempty"`
+	Address string        `json:"address"`
+	Action  string        `json:"action"`
+	Query   string        `json:"query,omitempty"`
+	Status  int           `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Targets []AuditTarget `json:"targets,omitempty"`
+}
+
+type AuditTarget struct {
+	Id  int    `json:"id"`
+	Url string `json:"url,omitempty"`
+}
+
+type AuditFilter struct {
+	Who    string
+	Tenant string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+func AuditFilterFromQuery(q url.Values) AuditFilter {
+	f := AuditFilter{Who: q.Get("who"), Tenant: q.Get("tenant"), Action: q.Get("action")}
+	f.Since, _ = time.Parse(time.RFC3339, q.Get("since"))
+	f.Limit, _ = strconv.Atoi(q.Get("limit"))
+	return f
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.Who == "" || e.Who == f.Who) && (f.Tenant == "" || e.Tenant == f.Tenant) && (f.Action == "" || strings.Contains(e.Action, f.Action)) && !e.Time.Before(f.Since)
+}
+
+// AuditLog appends an entry for every request of the daemon that is not a
+// GET, including refused ones, to a JSON lines file, or keeps the last
+// AuditEntries of them in memory when it has none.
+type AuditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	recent []AuditEntry
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path}
+	if path == "" {
+		return a, nil
+	}
+	var err error
+	if a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Record(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		a.recent = append(a.recent, e)
+		if len(a.recent) > AuditEntries {
+			a.recent = a.recent[len(a.recent)-AuditEntries:]
+		}
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(b, '\n'))
+	return err
+}
+
+// Find returns the entries matching filter, oldest first, the last
+// filter.Limit of them when it is set.
+func (a *AuditLog) Find(filter AuditFilter) ([]AuditEntry, error) {
+	var entries = []AuditEntry{}
+	add := func(e AuditEntry) {
+		if filter.matches(e) {
+			entries = append(entries, e)
+			if filter.Limit > 0 && len(entries) > 2*filter.Limit {
+				entries = append(entries[:0], entries[len(entries)-filter.Limit:]...)
+			}
+		}
+	}
+	a.mu.Lock()
+	recent := a.recent
+	a.mu.Unlock()
+	if a.path == "" {
+		for _, e := range recent {
+			add(e)
+		}
+	} else {
+		file, err := os.Open(a.path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				add(e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+type auditWhoKey struct{}
+
+// setAuditWho tells the audit log who sent the request, once the API key
+// is known.
+func setAuditWho(r *http.Request, who string) {
+	if p, ok := r.Context().Value(auditWhoKey{}).(*string); ok {
+		*p = who
+	}
+}
+
+// Audit records the requests to h that change something.
+func (a *AuditLog) Audit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		who := "anonymous"
+		address := r.RemoteAddr
+		if local, _ := r.Context().Value(localConnKey{}).(bool); local {
+			who, address = "local", "unix"
+		}
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditWhoKey{}, &who)))
+
+		entry := AuditEntry{
+			Time:    time.Now(),
+			Who:     who,
+			Tenant:  tenantOf(r),
+			Address: address,
+			Action:  r.Method + " " + r.URL.Path,
+			Query:   r.URL.RawQuery,
+			Status:  recorder.status,
+		}
+		body := recorder.body.Bytes()
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if recorder.status >= 400 && json.Unmarshal(body, &failure) == nil {
+			entry.Error = failure.Error
+		} else if json.Unmarshal(body, &entry.Targets) != nil {
+			var target AuditTarget
+			if json.Unmarshal(body, &target) == nil && target.Id != 0 {
+				entry.Targets = []AuditTarget{target}
+			}
+		}
+		if err := a.Record(entry); err != nil {
+			slog.Warn("can not write the audit log", "err", err)
+		}
+	})
+}
+
+// auditRecorder keeps the status and the start of the response body, where
+// the downloads an action touched are listed.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if r.body.Len() < 1<<20 {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
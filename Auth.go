@@ -0,0 +1,228 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	PermissionRead    = "read"
+	PermissionControl = "control"
+)
+
+var (
+	ErrUnauthorized  = errors.New("missing or invalid API key")
+	ErrForbidden     = errors.New("the API key may only read")
+	ErrForeignHost   = errors.New("requests for this host name are not served, see -allow-host")
+	ErrForeignOrigin = errors.New("requests from other origins are not served, see -allow-origin")
+)
+
+// APIKey is a credential of the daemon's TCP API: a token sent as
+// "Authorization: Bearer" or X-Api-Key, or user:password for basic auth.
+type APIKey struct {
+	Key        string
+	Permission string
+	// Tenant is who the key adds downloads for, overriding X-Cdm-Tenant.
+	Tenant string
+}
+
+func (k APIKey) basic() bool {
+	return strings.Contains(k.Key, ":")
+}
+
+// name identifies the key without giving it away: the user of basic auth,
+// or the start of the token's SHA-256.
+func (k APIKey) name() string {
+	if user, _, ok := strings.Cut(k.Key, ":"); ok {
+		return user
+	}
+	sum := sha256.Sum256([]byte(k.Key))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+// ParseAPIKeys reads one key per line: the token or user:password, then
+// read or control, then optionally the tenant. Empty lines and lines
+// starting with # are skipped.
+func ParseAPIKeys(r io.Reader) ([]APIKey, error) {
+	var keys []APIKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected key, read or control, and optionally a tenant", line)
+		}
+		key := APIKey{Key: fields[0], Permission: fields[1]}
+		if len(fields) == 3 {
+			key.Tenant = fields[2]
+		}
+		if key.Permission != PermissionRead && key.Permission != PermissionControl {
+			return nil, fmt.Errorf("line %d: unknown permission %q, expected read or control", line, key.Permission)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no API keys")
+	}
+	return keys, nil
+}
+
+func LoadAPIKeys(name string) ([]APIKey, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys, err := ParseAPIKeys(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return keys, nil
+}
+
+type localConnKey struct{}
+
+// MarkLocal is an http.Server ConnContext that marks connections over unix
+// sockets, which only their owner can open, so they need no key.
+func MarkLocal(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, localConnKey{}, true)
+	}
+	return ctx
+}
+
+// GuardRequests keeps web pages from using the API through the browser of
+// someone who can reach it. Over TCP, a request must be for a host name that
+// is an IP address, localhost or one of hosts, so a page can not reach the
+// API under a name of its own by DNS rebinding, and a request with an Origin
+// header must come from the API itself, like the web panel, or one of
+// origins. Requests that change anything must be application/json, and
+// POST /handoff multipart/mixed, which browsers send to another origin only
+// after asking it, which the API never allows.
+func GuardRequests(h http.Handler, hosts, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if local, _ := r.Context().Value(localConnKey{}).(bool); !local {
+			if !allowedHost(r.Host, hosts) {
+				writeError(w, http.StatusForbidden, ErrForeignHost)
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) && !slices.Contains(origins, origin) {
+				writeError(w, http.StatusForbidden, ErrForeignOrigin)
+				return
+			}
+		}
+		switch r.Method {
+		case "POST", "PUT", "PATCH":
+			want := "application/json"
+			if r.URL.Path == "/handoff" {
+				want = "multipart/mixed"
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != want {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%s %s must be %s", r.Method, r.URL.Path, want))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func allowedHost(host string, hosts []string) bool {
+	if host == "" {
+		return true
+	}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.ToLower(strings.Trim(name, "[]"))
+	if net.ParseIP(name) != nil || name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return true
+	}
+	return slices.ContainsFunc(hosts, func(h string) bool { return strings.EqualFold(h, name) || strings.EqualFold(h, host) })
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+	scheme := "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+	return strings.EqualFold(origin, scheme+r.Host)
+}
+
+// RequireAPIKeys lets requests through h only with one of keys, and keys
+// with the read permission only for GET and HEAD. Requests on unix sockets
+// need none.
+func RequireAPIKeys(h http.Handler, keys []APIKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if local, _ := r.Context().Value(localConnKey{}).(bool); local {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Probes of an orchestrator carry no key, and learn nothing else.
+		if r.Method == "GET" && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key, ok := findAPIKey(r, keys)
+		if !ok {
+			challenge := `Bearer realm="cdm"`
+			for _, k := range keys {
+				if k.basic() {
+					challenge = `Basic realm="cdm"`
+				}
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		setAuditWho(r, key.name())
+		if key.Permission != PermissionControl && r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		if key.Tenant != "" {
+			r.Header.Set(TenantHeader, key.Tenant)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func findAPIKey(r *http.Request, keys []APIKey) (APIKey, bool) {
+	token := r.Header.Get("X-Api-Key")
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	}
+	user, password, basic := r.BasicAuth()
+	var found APIKey
+	var ok bool
+	for _, k := range keys {
+		credential := token
+		if k.basic() {
+			credential = ""
+			if basic {
+				credential = user + ":" + password
+			}
+		}
+		if credential != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(k.Key)) == 1 && !ok {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
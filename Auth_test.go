@@ -0,0 +1,216 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAPIKeys = []APIKey{
+	{Key: "control-token", Permission: PermissionControl},
+	{Key: "read-token", Permission: PermissionRead},
+	{Key: "admin:secret", Permission: PermissionControl},
+}
+
+// apiServer serves the daemon of a new manager behind the API keys and the
+// guard, the way the daemon command does.
+func apiServer(t *testing.T, keys []APIKey, hosts, origins []string) *httptest.Server {
+	m := NewManager(t.TempDir(), Config{})
+	t.Cleanup(m.Stop)
+	var handler http.Handler = NewDaemon(m)
+	if keys != nil {
+		handler = RequireAPIKeys(handler, keys)
+	}
+	server := httptest.NewUnstartedServer(GuardRequests(handler, hosts, origins))
+	server.Config.ConnContext = MarkLocal
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func apiStatus(t *testing.T, r *http.Request) (int, http.Header) {
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard(resp)
+	return resp.StatusCode, resp.Header
+}
+
+func TestRequireAPIKeys(t *testing.T) {
+	server := apiServer(t, testAPIKeys, nil, nil)
+	for _, test := range []struct {
+		name   string
+		method string
+		path   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{"no key", "GET", "/downloads", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong key", "GET", "/downloads", func(r *http.Request) { r.Header.Set("X-Api-Key", "guess") }, http.StatusUnauthorized},
+		{"basic credentials as a token", "GET", "/downloads", func(r *http.Request) { r.Header.Set("X-Api-Key", "admin:secret") }, http.StatusUnauthorized},
+		{"wrong password", "GET", "/downloads", func(r *http.Request) { r.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized},
+		{"bearer", "GET", "/downloads", func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusOK},
+		{"header", "GET", "/downloads", func(r *http.Request) { r.Header.Set("X-Api-Key", "control-token") }, http.StatusOK},
+		{"basic", "GET", "/downloads", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"probe", "GET", "/healthz", func(*http.Request) {}, http.StatusOK},
+		{"read key changing", "POST", "/downloads/1/pause", func(r *http.Request) { r.Header.Set("X-Api-Key", "read-token") }, http.StatusForbidden},
+		{"read key adding", "POST", "/downloads", func(r *http.Request) { r.Header.Set("X-Api-Key", "read-token") }, http.StatusForbidden},
+		{"read key removing", "DELETE", "/downloads/1", func(r *http.Request) { r.Header.Set("X-Api-Key", "read-token") }, http.StatusForbidden},
+		{"control key", "POST", "/downloads/1/pause", func(r *http.Request) { r.Header.Set("X-Api-Key", "control-token") }, http.StatusNotFound},
+	} {
+		r, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/json")
+		test.auth(r)
+		status, header := apiStatus(t, r)
+		if status != test.status {
+			t.Errorf("%s: %s %s answered %d, want %d", test.name, test.method, test.path, status, test.status)
+		}
+		if status == http.StatusUnauthorized && header.Get("WWW-Authenticate") != `Basic realm="cdm"` {
+			t.Errorf("%s: challenged with %q", test.name, header.Get("WWW-Authenticate"))
+		}
+	}
+
+	// Without basic credentials among the keys, clients are asked for a token.
+	server = apiServer(t, testAPIKeys[:2], nil, nil)
+	r, _ := http.NewRequest("GET", server.URL+"/downloads", nil)
+	if _, header := apiStatus(t, r); header.Get("WWW-Authenticate") != `Bearer realm="cdm"` {
+		t.Errorf("challenged with %q", header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestAPIKeysUnixSocket(t *testing.T) {
+	m := NewManager(t.TempDir(), Config{})
+	defer m.Stop()
+	socket := filepath.Join(t.TempDir(), "cdm.sock")
+	l, err := ListenUnix(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: GuardRequests(RequireAPIKeys(NewDaemon(m), testAPIKeys), nil, nil), ConnContext: MarkLocal}
+	go server.Serve(l)
+	defer server.Close()
+
+	// Neither a key nor a host name of the API is needed on the socket.
+	c := NewControlClient(socket)
+	if _, err := c.List(Filter{}); err != nil {
+		t.Fatalf("listed over the socket: %v", err)
+	}
+	if _, err := c.Pause(1); err == nil || strings.Contains(err.Error(), ErrUnauthorized.Error()) {
+		t.Fatalf("paused over the socket: %v", err)
+	}
+}
+
+func TestGuardRequests(t *testing.T) {
+	server := apiServer(t, testAPIKeys, []string{"cdm.internal"}, []string{"https://dashboard.example.com"})
+	for _, test := range []struct {
+		name        string
+		method      string
+		path        string
+		host        string
+		origin      string
+		contentType string
+		status      int
+	}{
+		{"IP address", "GET", "/downloads", "", "", "", http.StatusOK},
+		{"localhost", "GET", "/downloads", "localhost:7000", "", "", http.StatusOK},
+		{"allowed host", "GET", "/downloads", "cdm.internal:7000", "", "", http.StatusOK},
+		{"foreign host", "GET", "/downloads", "attacker.example.com", "", "", http.StatusForbidden},
+		{"rebound host", "POST", "/downloads/1/pause", "attacker.example.com:7000", "", "application/json", http.StatusForbidden},
+		{"same origin", "GET", "/downloads", "", "self", "", http.StatusOK},
+		{"allowed origin", "GET", "/downloads", "", "https://dashboard.example.com", "", http.StatusOK},
+		{"foreign origin", "GET", "/downloads", "", "https://attacker.example.com", "", http.StatusForbidden},
+		{"foreign origin changing", "POST", "/downloads/1/pause", "", "https://attacker.example.com", "application/json", http.StatusForbidden},
+		{"json", "POST", "/downloads/1/pause", "", "", "application/json; charset=utf-8", http.StatusNotFound},
+		{"text", "POST", "/downloads/1/pause", "", "", "text/plain", http.StatusUnsupportedMediaType},
+		{"form", "POST", "/downloads", "", "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"multipart form", "POST", "/downloads", "", "", "multipart/form-data; boundary=x", http.StatusUnsupportedMediaType},
+		{"no content type", "POST", "/downloads", "", "", "", http.StatusUnsupportedMediaType},
+		{"json handoff", "POST", "/handoff", "", "", "application/json", http.StatusUnsupportedMediaType},
+	} {
+		r, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Api-Key", "control-token")
+		if test.host != "" {
+			r.Host = test.host
+		}
+		switch test.origin {
+		case "":
+		case "self":
+			r.Header.Set("Origin", server.URL)
+		default:
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		if status, _ := apiStatus(t, r); status != test.status {
+			t.Errorf("%s: %s %s answered %d, want %d", test.name, test.method, test.path, status, test.status)
+		}
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(strings.NewReader("# keys\n\ntoken read\nadmin:secret control team-a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []APIKey{{Key: "token", Permission: PermissionRead}, {Key: "admin:secret", Permission: PermissionControl, Tenant: "team-a"}}
+	if len(keys) != len(want) || keys[0] != want[0] || keys[1] != want[1] {
+		t.Fatalf("parsed %+v", keys)
+	}
+	for _, input := range []string{"", "# only a comment\n", "token\n", "token write\n", "token read team extra\n"} {
+		if _, err := ParseAPIKeys(strings.NewReader(input)); err == nil {
+			t.Errorf("parsed %q", input)
+		}
+	}
+}
+
+func TestDaemonTLS(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	config, fingerprint, err := DaemonTLS("", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is generated once and kept, so clients can pin it.
+	_, again, err := DaemonTLS("", "", "127.0.0.1")
+	if err != nil || again != fingerprint {
+		t.Fatalf("the second start has fingerprint %s, want %s: %v", again, fingerprint, err)
+	}
+	dir, _ := os.UserConfigDir()
+	if info, err := os.Stat(filepath.Join(dir, "cdm", "tls.key")); err != nil || info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("the key is kept with mode %v: %v", info.Mode(), err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(tls.NewListener(l, config))
+	defer server.Close()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := DaemonTLS(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"), ""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loaded a missing certificate: %v", err)
+	}
+}
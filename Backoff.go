@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	BackoffRecover = 30 * time.Second
+	MaxRetryAfter  = time.Minute
+
+	// RetryDelay is the wait before the first retry of a failed range. It
+	// doubles with each failure in a row, up to MaxRetryDelay, and is
+	// jittered down by up to half so connections do not retry in step.
+	RetryDelay    = 250 * time.Millisecond
+	MaxRetryDelay = 30 * time.Second
+	// MaxAttempts is how many times in a row a connection may fail before
+	// the download fails with the last error.
+	MaxAttempts = 10
+)
+
+// retryDelay is the backoff before retry attempt, from 1.
+func retryDelay(attempt int) time.Duration {
+	delay := RetryDelay
+	for i := 1; i < attempt && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, MaxRetryDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay - rand.N(delay/2+1)
+}
+
+func WithRampUp(interval time.Duration) Option {
+	return func(f *File) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid ramp-up interval %s", interval)
+		}
+		f.rampInterval = interval
+		return nil
+	}
+}
+
+func (f *File) allowed() int {
+	n := f.connections
+	if f.splitLimit > 0 && f.splitLimit < n {
+		n = f.splitLimit
+	}
+	if f.throttle > 0 && f.throttle < n {
+		return f.throttle
+	}
+	return n
+}
+
+func (f *File) spawnDelay() time.Duration {
+	if f.rampInterval <= 0 {
+		return 0
+	}
+	now := time.Now()
+	at := now
+	if f.nextSpawn.After(now) {
+		at = f.nextSpawn
+	}
+	f.nextSpawn = at.Add(f.rampInterval)
+	return at.Sub(now)
+}
+
+// backOff halves the connections when the server is rate limiting, and
+// waits delay before the failed range is tried again.
+func (f *File) backOff(ctx context.Context, err error, delay time.Duration) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+		f.blockMu.Lock()
+		now := time.Now()
+		f.limitedAt = now
+		if now.Sub(f.throttledAt) >= time.Second && f.allowed() > 1 {
+			f.throttle = max(f.allowed()/2, 1)
+			f.throttledAt = now
+			slog.Warn("server is rate limiting, reducing connections", "url", f.Url, "connections", f.throttle)
+		}
+		f.blockMu.Unlock()
+	}
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+}
+
+func (f *File) recoverConnections() {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if f.throttle == 0 || time.Since(f.limitedAt) < BackoffRecover || time.Since(f.throttledAt) < BackoffRecover {
+		return
+	}
+	f.throttle++
+	f.throttledAt = time.Now()
+	if f.throttle >= f.connections {
+		f.throttle = 0
+	}
+	if f.runCtx != nil && f.workers > 0 {
+		f.spawnWorkers()
+	}
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,275 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupKeep is how many backups of a file a backup directory keeps when
+// none is given, the oldest are deleted first. Zero keeps them all.
+var BackupKeep = 5
+
+const (
+	BackupSaved    = "backup"
+	BackupRestored = "restore"
+	BackupExpired  = "expire"
+)
+
+var ErrNoBackup = errors.New("no backup of the file")
+
+// BackupEntry records one move in the history of a backup directory: a
+// destination about to be overwritten moved into it, a backup moved back by
+// Restore, or a backup deleted to stay under the limit.
+type BackupEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Backup string    `json:"backup"`
+	Size   int64     `json:"size"`
+	// Url is what the download that replaced the file fetched.
+	Url string `json:"url,omitempty"`
+}
+
+// Backups moves files that a download would overwrite into a directory
+// instead of truncating them, keeping the Keep newest backups of every
+// path, and appends what it did to history.jsonl in it so that cdm restore
+// can undo it.
+type Backups struct {
+	Dir  string
+	Keep int
+
+	mu sync.Mutex
+}
+
+func OpenBackups(dir string, keep int) (*Backups, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Backups{Dir: dir, Keep: keep}, nil
+}
+
+func (b *Backups) historyPath() string {
+	return filepath.Join(b.Dir, "history.jsonl")
+}
+
+// Save moves path into the backup directory if it exists, and returns
+// where it went. It is not an error for path not to exist.
+func (b *Backups) Save(path, url string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.save(path, url)
+}
+
+func (b *Backups) save(path, url string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	now := time.Now()
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext) + "." + now.Format("20060102-150405.000000000") + ext
+	backup := filepath.Join(b.Dir, name)
+	if err := moveFile(path, backup); err != nil {
+		return "", err
+	}
+	if err := b.record(BackupEntry{Time: now, Action: BackupSaved, Path: path, Backup: backup, Size: info.Size(), Url: url}); err != nil {
+		return backup, err
+	}
+	return backup, b.rotate(path)
+}
+
+// rotate deletes the oldest backups of path beyond Keep.
+func (b *Backups) rotate(path string) error {
+	if b.Keep <= 0 {
+		return nil
+	}
+	kept, err := b.list(path)
+	if err != nil {
+		return err
+	}
+	for len(kept) > b.Keep {
+		e := kept[0]
+		kept = kept[1:]
+		if err := os.Remove(e.Backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		e.Time, e.Action = time.Now(), BackupExpired
+		if err := b.record(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore moves the newest backup of path back in its place. What is at
+// path then is backed up in turn, so a restore can be undone too.
+func (b *Backups) Restore(path string) (BackupEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	kept, err := b.list(path)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	if len(kept) == 0 {
+		return BackupEntry{}, fmt.Errorf("%s: %w", path, ErrNoBackup)
+	}
+	e := kept[len(kept)-1]
+	if _, err := b.save(path, ""); err != nil {
+		return e, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return e, err
+	}
+	if err := moveFile(e.Backup, path); err != nil {
+		return e, err
+	}
+	e.Time, e.Action = time.Now(), BackupRestored
+	return e, b.record(e)
+}
+
+// List returns the backups of path that are still in the directory, the
+// oldest first, or those of every path when it is empty.
+func (b *Backups) List(path string) ([]BackupEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if path != "" {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+	}
+	return b.list(path)
+}
+
+func (b *Backups) list(path string) ([]BackupEntry, error) {
+	history, err := b.History()
+	if err != nil {
+		return nil, err
+	}
+	var kept []BackupEntry
+	for _, e := range history {
+		if path != "" && e.Path != path {
+			continue
+		}
+		if e.Action == BackupSaved {
+			kept = append(kept, e)
+		} else {
+			kept = slices.DeleteFunc(kept, func(k BackupEntry) bool { return k.Backup == e.Backup })
+		}
+	}
+	return kept, nil
+}
+
+// History returns every entry of the history, the oldest first.
+func (b *Backups) History() ([]BackupEntry, error) {
+	file, err := os.Open(b.historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var history []BackupEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e BackupEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			history = append(history, e)
+		}
+	}
+	return history, scanner.Err()
+}
+
+func (b *Backups) record(e BackupEntry) error {
+	file, err := os.OpenFile(b.historyPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	line, _ := json.Marshal(e)
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// moveFile renames src to dest, copying it when they are on different file
+// systems.
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func RunRestore(b *Backups, args []string, out io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: cdm -backup-dir dir restore [--list] [file]")
+		return ExitUsage
+	}
+	var path string
+	var list bool
+	for ; len(args) > 0; args = args[1:] {
+		switch opt := args[0]; {
+		case opt == "--list" || opt == "-list":
+			list = true
+		case path == "" && !strings.HasPrefix(opt, "-"):
+			path = opt
+		default:
+			return usage()
+		}
+	}
+	if b == nil || path == "" && !list {
+		return usage()
+	}
+	if list {
+		kept, err := b.List(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailure
+		}
+		for _, e := range kept {
+			fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Size, e.Path, e.Backup)
+		}
+		return ExitOK
+	}
+	e, err := b.Restore(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailure
+	}
+	fmt.Fprintf(out, "restored %s from %s\n", e.Path, e.Backup)
+	return ExitOK
+}
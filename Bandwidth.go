@@ -0,0 +1,123 @@
+package downloader
+
+import "errors"
+
+const DefaultPriority = 1
+
+var ErrInvalidPriority = errors.New("priority must be at least 1")
+
+func (m *Manager) SetPriority(id, priority int) error {
+	if priority < 1 {
+		return ErrInvalidPriority
+	}
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	d.priority = priority
+	if d.file != nil {
+		d.file.SetWritePriority(priority)
+	}
+	m.mu.Unlock()
+	m.rebalance()
+	return nil
+}
+
+func (m *Manager) rebalance() {
+	m.mu.Lock()
+	var files []*File
+	var limits []int64
+	var connections, weights []int
+	var groups, tenants []string
+	for _, d := range m.downloads {
+		if d.file != nil && d.state == StateDownloading {
+			files = append(files, d.file)
+			limits = append(limits, d.rateLimit)
+			connections = append(connections, d.connections)
+			weights = append(weights, d.priority)
+			groups = append(groups, d.group)
+			tenants = append(tenants, d.tenant)
+		}
+	}
+	weights = tenantWeights(m.config, tenants, weights)
+	groupCaps, tenantCaps := map[string]int64{}, map[string]int64{}
+	for name, g := range m.groups {
+		groupCaps[name] = g.RateLimit
+	}
+	for _, t := range m.config.Tenants {
+		tenantCaps[t.Name] = t.RateLimit
+	}
+	limits = capRates(groupCaps, groups, limits, weights)
+	limits = capRates(tenantCaps, tenants, limits, weights)
+	total, totalConnections := m.config.TotalRateLimit, m.config.TotalConnections
+	m.mu.Unlock()
+
+	for i, rate := range allocate(total, limits, weights) {
+		files[i].SetRateLimit(rate)
+	}
+	for i, n := range shareConnections(totalConnections, connections, weights) {
+		files[i].SetConnections(n)
+	}
+}
+
+func shareConnections(total int, limits, weights []int) []int {
+	conns := append([]int(nil), limits...)
+	if total <= 0 {
+		return conns
+	}
+	left := total
+	for i := range conns {
+		conns[i] = 1
+		left--
+	}
+	for ; left > 0; left-- {
+		best := -1
+		for i := range conns {
+			if conns[i] < limits[i] && (best < 0 || conns[i]*weights[best] < conns[best]*weights[i]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		conns[best]++
+	}
+	return conns
+}
+
+func allocate(total int64, limits []int64, weights []int) []int64 {
+	rates := append([]int64(nil), limits...)
+	if total <= 0 {
+		return rates
+	}
+	open := make([]int, len(limits))
+	for i := range open {
+		open[i] = i
+	}
+	left := float64(total)
+	for len(open) > 0 {
+		var sum float64
+		for _, i := range open {
+			sum += float64(weights[i])
+		}
+		var uncapped []int
+		var capped float64
+		for _, i := range open {
+			if share := left * float64(weights[i]) / sum; limits[i] <= 0 || float64(limits[i]) > share {
+				uncapped = append(uncapped, i)
+			} else {
+				capped += float64(limits[i])
+			}
+		}
+		if len(uncapped) == len(open) {
+			for _, i := range open {
+				rates[i] = max(int64(left*float64(weights[i])/sum), 1)
+			}
+			break
+		}
+		left -= capped
+		open = uncapped
+	}
+	return rates
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxNativeMessage = 1 << 20
+
+type CaptureRequest struct {
+	Url       string `json:"url"`
+	Filename  string `json:"filename"`
+	Dir       string `json:"dir"`
+	Referer   string `json:"referer"`
+	Cookies   string `json:"cookies"`
+	UserAgent string `json:"user_agent"`
+}
+
+func (c CaptureRequest) options() []Option {
+	var opts []Option
+	if c.Referer != "" {
+		opts = append(opts, WithReferer(c.Referer))
+	}
+	if c.Cookies != "" {
+		opts = append(opts, WithCookies(c.Cookies))
+	}
+	if c.UserAgent != "" {
+		opts = append(opts, WithUserAgent(c.UserAgent))
+	}
+	return opts
+}
+
+func (d *Daemon) capture(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("capture requests must be application/json"))
+		return
+	}
+	var req CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Url == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+	if err := d.Manager.checkDir(req.Dir); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	download, err := d.Manager.add(req.Url, req.Dir, req.Filename, func(added *Download) {
+		added.tenant = tenantOf(r)
+	}, req.options()...)
+	if writeRefused(w, err) {
+		return
+	}
+	status := http.StatusCreated
+	if errors.Is(err, ErrDuplicate) {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, download)
+}
+
+func IsNativeMessagingLaunch(args []string) bool {
+	switch {
+	case len(args) > 0 && strings.HasPrefix(args[0], "chrome-extension://"):
+		return true
+	case len(args) == 2 && filepath.IsAbs(args[0]) && strings.HasSuffix(args[0], ".json"):
+		_, err := os.Stat(args[0])
+		return err == nil
+	}
+	return false
+}
+
+func NativeHostDaemon() string {
+	if addr := os.Getenv("CDM_DAEMON"); addr != "" {
+		return addr
+	}
+	return "127.0.0.1:8800"
+}
+
+func RunNativeHost(in io.Reader, out io.Writer, daemon string) error {
+	for {
+		msg, err := readNativeMessage(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeNativeMessage(out, forwardCapture(daemon, msg)); err != nil {
+			return err
+		}
+	}
+}
+
+func forwardCapture(daemon string, msg []byte) interface{} {
+	resp, err := http.Post("http://"+daemon+"/capture", "application/json", bytes.NewReader(msg))
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	defer resp.Body.Close()
+	var reply json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxNativeMessage)).Decode(&reply); err != nil {
+		return map[string]string{"error": fmt.Sprintf("daemon answered %s", resp.Status)}
+	}
+	return reply
+}
+
+func readNativeMessage(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxNativeMessage {
+		return nil, fmt.Errorf("native message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeNativeMessage(w io.Writer, v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(msg))); err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBudget bounds the bytes of read and write buffers held by block
+// workers at once, across every download sharing it. A worker waits for
+// room before it opens its connection.
+type MemoryBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, changed: make(chan struct{})}
+}
+
+func WithMemoryBudget(b *MemoryBudget) Option {
+	return func(f *File) error {
+		f.memory = b
+		return nil
+	}
+}
+
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.mu.Lock()
+	b.limit = limit
+	b.signal()
+	b.mu.Unlock()
+}
+
+func (b *MemoryBudget) Limit() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+func (b *MemoryBudget) InUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Acquire waits until n bytes fit in the budget and reserves them. A request
+// larger than the whole budget waits for it to be empty. It returns the
+// bytes to pass to Release.
+func (b *MemoryBudget) Acquire(ctx context.Context, n int64) (int64, error) {
+	b.mu.Lock()
+	for {
+		if b.limit <= 0 || b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return n, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-changed:
+		}
+		b.mu.Lock()
+	}
+}
+
+func (b *MemoryBudget) Release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.signal()
+	b.mu.Unlock()
+}
+
+func (b *MemoryBudget) signal() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (f *File) bufferSize() int64 {
+	size := int64(CacheSize)
+	if _, mapped := f.writer.(*mmapWriter); !mapped {
+		size += int64(f.writeBuffer)
+	}
+	return size
+}
@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type Filter struct {
+	State  string `json:"state,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Meta   string `json:"meta,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func FilterFromQuery(q url.Values) Filter {
+	return Filter{State: q.Get("state"), Host: q.Get("host"), Tag: q.Get("tag"), Meta: q.Get("meta"), Group: q.Get("group"), Tenant: q.Get("tenant")}
+}
+
+func (f Filter) Query() url.Values {
+	q := url.Values{}
+	if f.State != "" {
+		q.Set("state", f.State)
+	}
+	if f.Host != "" {
+		q.Set("host", f.Host)
+	}
+	if f.Tag != "" {
+		q.Set("tag", f.Tag)
+	}
+	if f.Meta != "" {
+		q.Set("meta", f.Meta)
+	}
+	if f.Group != "" {
+		q.Set("group", f.Group)
+	}
+	if f.Tenant != "" {
+		q.Set("tenant", f.Tenant)
+	}
+	return q
+}
+
+func (f Filter) matches(d *Download) bool {
+	return f.match(d.state, d.Url, d.tags, d.metadata, d.group, d.tenant)
+}
+
+func (f Filter) matchesInfo(info DownloadInfo) bool {
+	return f.match(info.State, info.Url, info.Tags, info.Metadata, info.Group, info.Tenant)
+}
+
+func (f Filter) match(state, rawUrl string, tags []string, metadata map[string]string, group, tenant string) bool {
+	if f.State != "" && state != f.State {
+		return false
+	}
+	if f.Host != "" {
+		u, err := url.Parse(rawUrl)
+		if err != nil || !strings.EqualFold(u.Hostname(), f.Host) {
+			return false
+		}
+	}
+	if f.Tag != "" && !slices.Contains(tags, f.Tag) {
+		return false
+	}
+	if f.Group != "" && group != f.Group {
+		return false
+	}
+	if f.Tenant != "" && tenant != f.Tenant {
+		return false
+	}
+	if f.Meta != "" {
+		key, value, hasValue := strings.Cut(f.Meta, "=")
+		if v, ok := metadata[key]; !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) Find(filter Filter) []DownloadInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list = []DownloadInfo{}
+	for _, d := range m.downloads {
+		if filter.matches(d) {
+			list = append(list, d.info())
+		}
+	}
+	return list
+}
+
+func (m *Manager) PauseAll(filter Filter) []DownloadInfo {
+	return m.each(filter, m.Pause)
+}
+
+func (m *Manager) ResumeAll(filter Filter) []DownloadInfo {
+	return m.each(filter, m.Resume)
+}
+
+func (m *Manager) CancelAll(filter Filter) []DownloadInfo {
+	return m.each(filter, m.Cancel)
+}
+
+func (m *Manager) each(filter Filter, action func(int) error) []DownloadInfo {
+	var list = []DownloadInfo{}
+	for _, info := range m.Find(filter) {
+		if action(info.Id) != nil {
+			continue
+		}
+		if info, err := m.Get(info.Id); err == nil {
+			list = append(list, info)
+		}
+	}
+	return list
+}
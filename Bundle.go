@@ -0,0 +1,319 @@
+package downloader
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotBundle = errors.New("not a directory or zip archive")
+
+	// RemoteFSConcurrency is how many files RemoteFS.Fetch downloads at
+	// once.
+	RemoteFSConcurrency = 4
+)
+
+// OpenBundle returns the content of a finished download at path as an
+// fs.FS: the directory itself, like the one the extract step makes, or the
+// entries of a zip archive. The FS of an archive is an io.Closer that keeps
+// it open until closed.
+func OpenBundle(path string) (fs.FS, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return os.DirFS(path), nil
+	}
+	archive, err := zip.OpenReader(path)
+	if errors.Is(err, zip.ErrFormat) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotBundle)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// BundleFS returns the content of the finished download id as OpenBundle
+// does, where its pipeline left it.
+func (m *Manager) BundleFS(id int) (fs.FS, error) {
+	info, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != StateFinished {
+		return nil, fmt.Errorf("download %d is %s, not finished", id, info.State)
+	}
+	return OpenBundle(info.Path)
+}
+
+// RemoteFS is a remote directory, listed as ListRemote does, as an fs.FS.
+// The listing is taken once, when it is made, and answers Stat and ReadDir;
+// a file is downloaded into Dir, keeping the remote structure, the first
+// time it is opened, and read from there after. Files already in Dir with
+// the listed size are not downloaded again.
+type RemoteFS struct {
+	Dir string
+
+	ctx   context.Context
+	opts  []Option
+	files map[string]*remoteFile
+	dirs  map[string][]fs.DirEntry
+}
+
+type remoteFile struct {
+	RemoteEntry
+	local string
+
+	mu   sync.Mutex
+	done bool
+}
+
+// NewRemoteFS lists rawUrl and returns its files, to be downloaded into dir
+// with opts under ctx.
+func NewRemoteFS(ctx context.Context, rawUrl, dir string, opts ...Option) (*RemoteFS, error) {
+	entries, err := ListRemote(ctx, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := &RemoteFS{Dir: dir, ctx: ctx, opts: opts, files: map[string]*remoteFile{}, dirs: map[string][]fs.DirEntry{".": nil}}
+	for _, e := range entries {
+		rel := path.Clean(e.Path)
+		if rel == "." || !fs.ValidPath(rel) || r.files[rel] != nil || r.dirs[rel] != nil {
+			continue
+		}
+		local := dir
+		for _, segment := range strings.Split(rel, "/") {
+			local = filepath.Join(local, SanitizeFilename(segment))
+		}
+		e.Path = rel
+		r.files[rel] = &remoteFile{RemoteEntry: e, local: local}
+		r.add(rel, remoteInfo{name: path.Base(rel), size: e.Size})
+	}
+	for _, entries := range r.dirs {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return r, nil
+}
+
+// add lists info under the directory of name, adding the directories above
+// it.
+func (r *RemoteFS) add(name string, info remoteInfo) {
+	parent := path.Dir(name)
+	if _, ok := r.dirs[parent]; !ok {
+		r.dirs[parent] = nil
+		r.add(parent, remoteInfo{name: path.Base(parent), dir: true})
+	}
+	r.dirs[parent] = append(r.dirs[parent], fs.FileInfoToDirEntry(info))
+}
+
+func (r *RemoteFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entries, ok := r.dirs[name]; ok {
+		return &remoteDir{info: remoteInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+	}
+	file, ok := r.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := r.fetch(file); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	local, err := os.Open(file.local)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteOpenFile{local, remoteInfo{name: path.Base(name), size: file.Size}}, nil
+}
+
+func (r *RemoteFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := r.dirs[name]; ok {
+		return remoteInfo{name: path.Base(name), dir: true}, nil
+	}
+	if file, ok := r.files[name]; ok {
+		return remoteInfo{name: path.Base(name), size: file.Size}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (r *RemoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, ok := r.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(entries), nil
+}
+
+// Local returns where the file name is, or will be, downloaded to.
+func (r *RemoteFS) Local(name string) (string, bool) {
+	file, ok := r.files[name]
+	if !ok {
+		return "", false
+	}
+	return file.local, true
+}
+
+// Fetch downloads the named files, or all of them when none is named, that
+// are not in Dir yet, RemoteFSConcurrency at a time, so that opening them
+// later does not wait.
+func (r *RemoteFS) Fetch(names ...string) error {
+	if len(names) == 0 {
+		for name := range r.files {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	var errs = make([]error, len(names))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(RemoteFSConcurrency, 1))
+	for i, name := range names {
+		file, ok := r.files[name]
+		if !ok {
+			errs[i] = &fs.PathError{Op: "fetch", Path: name, Err: fs.ErrNotExist}
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := r.fetch(file); err != nil {
+				errs[i] = &fs.PathError{Op: "fetch", Path: name, Err: err}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// fetch downloads file into a temporary file next to where it goes, moved
+// there once complete, so an interrupted download is never taken for the
+// file.
+func (r *RemoteFS) fetch(file *remoteFile) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.done {
+		return nil
+	}
+	if info, err := os.Stat(file.local); err == nil && info.Mode().IsRegular() && (file.Size < 0 || info.Size() == file.Size) {
+		file.done = true
+		return nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file.local), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file.local), "."+filepath.Base(file.local)+".*")
+	if err != nil {
+		return err
+	}
+	download, err := New(file.Url, tmp, r.opts...)
+	if err == nil {
+		if err = download.Run(r.ctx); err != nil {
+			download.Cancel()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil && !errors.Is(closeErr, os.ErrClosed) {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if err := os.Rename(tmp.Name(), file.local); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	file.done = true
+	return nil
+}
+
+// remoteInfo describes a file of the listing, or a directory above one.
+type remoteInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i remoteInfo) Name() string { return i.name }
+
+func (i remoteInfo) Size() int64 { return max(i.size, 0) }
+
+func (i remoteInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i remoteInfo) ModTime() time.Time { return time.Time{} }
+
+func (i remoteInfo) IsDir() bool { return i.dir }
+
+func (i remoteInfo) Sys() any { return nil }
+
+// remoteOpenFile is a downloaded file, described as the listing has it.
+type remoteOpenFile struct {
+	*os.File
+	info remoteInfo
+}
+
+func (f *remoteOpenFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.info.size = info.Size()
+	return f.info, nil
+}
+
+type remoteDir struct {
+	info    remoteInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *remoteDir) Close() error { return nil }
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return slices.Clone(rest), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(n, len(rest))]
+	d.offset += len(rest)
+	return slices.Clone(rest), nil
+}
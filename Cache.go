@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Cache struct {
+	Dir string
+}
+
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+func (c *Cache) path(sum string) string {
+	return filepath.Join(c.Dir, "sha256", sum[:2], sum)
+}
+
+func (c *Cache) Has(sum string) bool {
+	_, err := os.Stat(c.path(sum))
+	return err == nil
+}
+
+func (c *Cache) Open(sum string) (*os.File, error) {
+	return os.Open(c.path(sum))
+}
+
+func (c *Cache) Link(sum, dest string) error {
+	src := c.path(sum)
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+func (c *Cache) Insert(path string) (string, error) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	dest := c.path(sum)
+	if c.Has(sum) {
+		return sum, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return sum, err
+	}
+	if err := os.Link(path, dest); err == nil {
+		return sum, nil
+	}
+	tmp := dest + ".tmp"
+	if err := copyFile(path, tmp); err != nil {
+		os.Remove(tmp)
+		return sum, err
+	}
+	return sum, os.Rename(tmp, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func ParseChecksum(s string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "sha256:"), "sha256="))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 checksum %q", s)
+	}
+	return sum, nil
+}
+
+func headerSHA256(header http.Header) string {
+	for _, name := range []string{"Repr-Digest", "Digest"} {
+		for _, field := range strings.Split(header.Get(name), ",") {
+			algorithm, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok || !strings.EqualFold(algorithm, "sha-256") {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+			if err == nil && len(b) == sha256.Size {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+	return ""
+}
+
+// ServerSHA256 is the SHA-256 the server sent for the file in a Repr-Digest
+// or Digest header, in hex, or "" without one.
+func (f *File) ServerSHA256() string {
+	return headerSHA256(f.header)
+}
+
+func VerifySHA256(path, want string) (string, error) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	if sum != want {
+		return sum, fmt.Errorf("%w: got sha256 %s, want %s", ErrChecksumMismatch, sum, want)
+	}
+	return sum, nil
+}
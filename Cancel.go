@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	CleanupAll   = "all"
+	CleanupState = "state"
+	CleanupNone  = "none"
+)
+
+// WithCancelCleanup sets what Cancel removes: the output file and its resume
+// file (all, the default), only the resume file (state) or nothing (none).
+func WithCancelCleanup(policy string) Option {
+	return func(f *File) error {
+		switch policy {
+		case CleanupAll, CleanupState, CleanupNone:
+		default:
+			return errors.New("unknown cancel cleanup " + policy)
+		}
+		f.cancelCleanup = policy
+		return nil
+	}
+}
+
+// Cancel stops the download for good, unlike Pause: the workers stop, the
+// file ends in StateCanceled, Wait returns ErrCanceled and the files are
+// removed as set by WithCancelCleanup. It does nothing once the download
+// finished, failed or was canceled.
+func (f *File) Cancel() error {
+	f.mu.Lock()
+	for f.state == StatePausing {
+		done := f.done
+		f.mu.Unlock()
+		<-done
+		f.mu.Lock()
+	}
+	switch f.state {
+	case StateFinished, StateFailed, StateCanceled:
+		f.mu.Unlock()
+		return nil
+	}
+	f.defaultCallbacks()
+	running := f.state == StateDownloading
+	f.state = StateCanceled
+	f.err = ErrCanceled
+	if running {
+		f.cancel()
+		done := f.done
+		f.mu.Unlock()
+		<-done
+	} else {
+		close(f.finished)
+		f.mu.Unlock()
+		f.closeIdleConnections()
+		go f.OnCancel()
+	}
+	return f.cleanup()
+}
+
+func (f *File) cleanup() error {
+	if f.Stream == nil || f.cancelCleanup == CleanupNone {
+		return nil
+	}
+	path := f.Stream.Name()
+	RemoveResume(path)
+	if f.cancelCleanup != CleanupAll {
+		return nil
+	}
+	f.Stream.Close()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package downloader
+
+// catalogES is the Spanish translation of the messages of the progress
+// bars, the TUI, the report at exit, cdm verify and the notifications.
+var catalogES = Catalog{
+	StateIdle:        "inactiva",
+	StateQueued:      "en cola",
+	StateDownloading: "descargando",
+	StatePausing:     "pausando",
+	StatePaused:      "en pausa",
+	StateFinished:    "terminada",
+	StateFailed:      "fallida",
+	StateCanceled:    "cancelada",
+	StateUpToDate:    "al día",
+	StateDeferred:    "aplazada",
+	StatePruned:      "eliminada",
+
+	"ETA":                                    "falta",
+	"%d/%d done":                             "%d/%d listas",
+	"%v so far, size unknown %v byte/s [%v]": "%v hasta ahora, tamaño desconocido %v byte/s [%v]",
+	"Add %s from the clipboard? [a] add  [x] ignore":                       "¿Añadir %s del portapapeles? [a] añadir  [x] ignorar",
+	"[j/k] select  [p] pause/resume  [c] cancel  [+/-] priority  [q] quit": "[j/k] elegir  [p] pausar/reanudar  [c] cancelar  [+/-] prioridad  [q] salir",
+	"%s: finished, %s": "%s: terminada, %s",
+	"%s: failed: %s":   "%s: fallida: %s",
+
+	"Download Results:": "Resultados de las descargas:",
+	"id\t state\t bytes\t of file\t avg speed\t peak speed\t retries\t conns\t elapsed\t active\t stalled\t paused\t path": "id\t estado\t bytes\t del archivo\t vel. media\t vel. máxima\t reintentos\t conex.\t duración\t actividad\t espera\t en pausa\t ruta",
+	"%d: %s from %s": "%d: %s de %s",
+	"%d finished, %d failed, %s, %d retries, %s active, %s stalled, %s paused": "%d terminadas, %d fallidas, %s, %d reintentos, %s en actividad, %s de espera, %s en pausa",
+	"%s: FAILED": "%s: FALLÓ",
+	"%s: OK, %d of %d bytes sampled in %d blocks, %d hashed by the server": "%s: OK, %d de %d bytes comprobados en %d bloques, %d con el hash del servidor",
+
+	"%s finished (%d bytes)":                               "%s terminada (%d bytes)",
+	"%s failed: %s":                                        "%s falló: %s",
+	"%s paused (%d bytes)":                                 "%s en pausa (%d bytes)",
+	"%s paused, the disk is full: %s":                      "%s en pausa, el disco está lleno: %s",
+	"%s is slowed down to the request quota of the server": "%s va más despacio para respetar el límite de peticiones del servidor",
+	"%s stuck: %s":                                         "%s atascada: %s",
+	"%s removed to stay under its quota":                   "%s eliminada para no superar su cuota",
+	"group %s completed (%d bytes) in %s":                  "grupo %s completado (%d bytes) en %s",
+
+	"block checksum mismatch":                 "la suma de comprobación de un bloque no coincide",
+	"download canceled":                       "descarga cancelada",
+	"download incomplete":                     "descarga incompleta",
+	"checksum mismatch":                       "la suma de comprobación no coincide",
+	"server ignored the range request":        "el servidor ignoró la petición de rango",
+	"connection stalled":                      "conexión detenida",
+	"connection below the low speed limit":    "conexión por debajo de la velocidad mínima",
+	"file is larger than the maximum size":    "el archivo supera el tamaño máximo",
+	"file is smaller than the minimum size":   "el archivo no llega al tamaño mínimo",
+	"quota exceeded":                          "cuota superada",
+	"download exceeded its maximum lifetime":  "la descarga superó su tiempo máximo",
+	"download made no progress":               "la descarga no avanzó",
+	"redirect refused":                        "redirección rechazada",
+	"connection to a private address refused": "conexión a una dirección privada rechazada",
+	"unexpected response content":             "contenido inesperado en la respuesta",
+	"no space left on device":                 "no queda espacio en el dispositivo",
+	"no checksum to verify against, pass --checksum or download with -xattr-checksum": "no hay suma de comprobación con la que verificar, indique --checksum o descargue con -xattr-checksum",
+}
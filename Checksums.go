@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ChecksumAlgorithm is a digest files can be verified with.
+type ChecksumAlgorithm struct {
+	Name string
+	// Size is the length of a digest in bytes.
+	Size int
+	New  func() hash.Hash
+}
+
+var checksums = struct {
+	mu         sync.RWMutex
+	algorithms map[string]ChecksumAlgorithm
+}{algorithms: map[string]ChecksumAlgorithm{}}
+
+func init() {
+	for _, a := range []ChecksumAlgorithm{
+		{"sha256", sha256.Size, sha256.New},
+		{"sha512", sha512.Size, sha512.New},
+		{"sha1", sha1.Size, sha1.New},
+		{"md5", md5.Size, md5.New},
+		{"crc32", crc32.Size, func() hash.Hash { return crc32.NewIEEE() }},
+		{"crc32c", crc32.Size, crc32c},
+	} {
+		if err := RegisterChecksum(a.Name, a.Size, a.New); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// checksumName folds the spellings of an algorithm, SHA-256 and sha256,
+// into one.
+func checksumName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "-", ""))
+}
+
+// RegisterChecksum adds an algorithm -checksum, input files, jobs, cdm
+// verify and registry digests accept by name, for example xxh64 or blake3
+// from code embedding the downloader. A name can be registered once.
+func RegisterChecksum(name string, size int, newHash func() hash.Hash) error {
+	key := checksumName(name)
+	if key == "" || strings.ContainsAny(key, ":=") || size <= 0 || newHash == nil {
+		return fmt.Errorf("invalid checksum algorithm %q", name)
+	}
+	checksums.mu.Lock()
+	defer checksums.mu.Unlock()
+	if _, ok := checksums.algorithms[key]; ok {
+		return fmt.Errorf("checksum algorithm %q is already registered", name)
+	}
+	checksums.algorithms[key] = ChecksumAlgorithm{key, size, newHash}
+	return nil
+}
+
+func LookupChecksum(name string) (ChecksumAlgorithm, bool) {
+	checksums.mu.RLock()
+	defer checksums.mu.RUnlock()
+	a, ok := checksums.algorithms[checksumName(name)]
+	return a, ok
+}
+
+// ChecksumAlgorithms returns the names of the registered algorithms.
+func ChecksumAlgorithms() []string {
+	checksums.mu.RLock()
+	defer checksums.mu.RUnlock()
+	var names []string
+	for name := range checksums.algorithms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// parseDigest reads algorithm:hex or algorithm=hex, and plain hex as a
+// SHA-256.
+func parseDigest(s string) (expectedSum, error) {
+	algorithm, value, ok := strings.Cut(s, ":")
+	if !ok {
+		algorithm, value, ok = strings.Cut(s, "=")
+	}
+	if !ok {
+		algorithm, value = "sha256", s
+	}
+	return newExpectedSum(algorithm, value)
+}
+
+// ParseDigest reads a checksum the way -checksum takes it and returns the
+// name its algorithm is registered under and the digest in hex.
+func ParseDigest(s string) (string, string, error) {
+	sum, err := parseDigest(s)
+	if err != nil {
+		return "", "", err
+	}
+	return sum.name, hex.EncodeToString(sum.want), nil
+}
+
+// WithChecksum fails the download unless the finished file has the digest
+// value, in hex, under a registered algorithm.
+func WithChecksum(algorithm, value string) Option {
+	return func(f *File) error {
+		sum, err := newExpectedSum(algorithm, value)
+		if err != nil {
+			return err
+		}
+		f.expected = append(f.expected, sum)
+		return nil
+	}
+}
+
+func (e expectedSum) String() string {
+	return e.name + ":" + hex.EncodeToString(e.want)
+}
+
+// checksumOptions verifies the digests sums, as parseDigest reads them.
+func checksumOptions(sums []string) []Option {
+	var opts []Option
+	for _, s := range sums {
+		opts = append(opts, func(f *File) error {
+			sum, err := parseDigest(s)
+			if err == nil {
+				f.expected = append(f.expected, sum)
+			}
+			return err
+		})
+	}
+	return opts
+}
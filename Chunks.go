@@ -0,0 +1,201 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrNoChunks = errors.New("no chunk files found")
+
+func ChunkPath(base string, i int) string {
+	return fmt.Sprintf("%s.%03d", base, i)
+}
+
+// ChunkWriter writes a download as consecutive files of size bytes,
+// base.000, base.001 and so on, for file systems with a file size limit or
+// for uploading the parts one by one.
+type ChunkWriter struct {
+	base string
+	size int64
+
+	mu    sync.Mutex
+	files []*os.File
+}
+
+func NewChunkWriter(base string, size int64) (*ChunkWriter, error) {
+	if size <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	for i := 0; ; i++ {
+		if err := os.Remove(ChunkPath(base, i)); err != nil {
+			break
+		}
+	}
+	c := &ChunkWriter{base: base, size: size}
+	if _, err := c.chunk(0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ChunkWriter) chunk(i int) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.files) <= i {
+		c.files = append(c.files, nil)
+	}
+	if c.files[i] == nil {
+		file, err := os.OpenFile(ChunkPath(c.base, i), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		c.files[i] = file
+	}
+	return c.files[i], nil
+}
+
+func (c *ChunkWriter) WriteAt(p []byte, off int64) (int, error) {
+	var written int
+	for len(p) > 0 {
+		file, err := c.chunk(int(off / c.size))
+		if err != nil {
+			return written, err
+		}
+		pos := off % c.size
+		n, err := file.WriteAt(p[:min(int64(len(p)), c.size-pos)], pos)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return written, nil
+}
+
+func (c *ChunkWriter) Chunks() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for i := range c.files {
+		names = append(names, ChunkPath(c.base, i))
+	}
+	return names
+}
+
+func (c *ChunkWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, file := range c.files {
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+	}
+	return err
+}
+
+func chunkNames(base string) []string {
+	var names []string
+	for i := 0; ; i++ {
+		if _, err := os.Stat(ChunkPath(base, i)); err != nil {
+			return names
+		}
+		names = append(names, ChunkPath(base, i))
+	}
+}
+
+// JoinChunks copies base.000, base.001 and so on, up to the first missing
+// one, to w.
+func JoinChunks(base string, w io.Writer) (int64, error) {
+	names := chunkNames(base)
+	if len(names) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoChunks, ChunkPath(base, 0))
+	}
+	var total int64
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return total, err
+		}
+		n, err := io.Copy(w, file)
+		file.Close()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func ChunksSHA256(base string) (string, error) {
+	h := sha256.New()
+	if _, err := JoinChunks(base, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func RunJoin(args []string, out io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: cdm join [--remove] base [output]")
+		return ExitUsage
+	}
+	var remove bool
+	var paths []string
+	for _, arg := range args {
+		switch {
+		case arg == "--remove" || arg == "-remove":
+			remove = true
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return usage()
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 || len(paths) > 2 {
+		return usage()
+	}
+	base, output := paths[0], paths[0]
+	if len(paths) == 2 {
+		output = paths[1]
+	}
+	names := chunkNames(base)
+	if len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "%v: %s\n", ErrNoChunks, ChunkPath(base, 0))
+		return ExitFailure
+	}
+
+	var w io.Writer = out
+	var file *os.File
+	if output != "-" {
+		var err error
+		if file, err = os.Create(output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailure
+		}
+		w = file
+	}
+	n, err := JoinChunks(base, w)
+	if file != nil {
+		err = errors.Join(err, file.Close())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCode(err)
+	}
+	if remove {
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	if file != nil {
+		fmt.Fprintf(out, "%s: %d chunks, %s\n", output, len(names), FormatBytes(n))
+	}
+	return ExitOK
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var ClipboardInterval = time.Second
+
+var clipboardUrl = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s"'<>]+`)
+
+type ClipboardWatcher struct {
+	Patterns []*regexp.Regexp
+	Interval time.Duration
+	Read     func() (string, error)
+	OnUrl    func(url string)
+}
+
+func NewClipboardWatcher(patterns []string, onUrl func(string)) (*ClipboardWatcher, error) {
+	w := &ClipboardWatcher{Interval: ClipboardInterval, Read: readClipboard, OnUrl: onUrl}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		w.Patterns = append(w.Patterns, re)
+	}
+	return w, nil
+}
+
+func (w *ClipboardWatcher) Run(ctx context.Context) error {
+	tick := time.NewTicker(w.Interval)
+	defer tick.Stop()
+	last, err := w.Read()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+	seen := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+		text, err := w.Read()
+		if err != nil || text == last {
+			continue
+		}
+		last = text
+		for _, url := range w.urls(text) {
+			if !seen[url] {
+				seen[url] = true
+				w.OnUrl(url)
+			}
+		}
+	}
+}
+
+func (w *ClipboardWatcher) urls(text string) []string {
+	var urls []string
+	for _, url := range clipboardUrl.FindAllString(text, -1) {
+		url = strings.TrimRight(url, ".,;:!?)]}")
+		if w.matches(url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func (w *ClipboardWatcher) matches(url string) bool {
+	if len(w.Patterns) == 0 {
+		return true
+	}
+	for _, re := range w.Patterns {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+func readClipboard() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbpaste")
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		switch {
+		case os.Getenv("WAYLAND_DISPLAY") != "":
+			cmd = exec.Command("wl-paste", "--no-newline")
+		case lookPath("xclip"):
+			cmd = exec.Command("xclip", "-selection", "clipboard", "-o")
+		default:
+			cmd = exec.Command("xsel", "--clipboard", "--output")
+		}
+	default:
+		return "", errors.New("clipboard is not supported on " + runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func lookPath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
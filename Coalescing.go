@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	CoalesceKeepAlive = "keep-alive"
+	CoalesceHTTP2     = "http2"
+)
+
+var (
+	// SmallFileSize is the size up to which a download with a connection
+	// pool takes the file from its probe response instead of requesting it
+	// again.
+	SmallFileSize int64 = 256 << 10
+	// PoolIdleConns is how many idle connections a pool keeps per host.
+	PoolIdleConns = 16
+)
+
+func validCoalesce(mode string) bool {
+	switch mode {
+	case "", CoalesceKeepAlive, CoalesceHTTP2:
+		return true
+	}
+	return false
+}
+
+// ConnectionPool lets downloads share their connections, so a job of many
+// small files from one host does not pay a handshake for each. With
+// CoalesceKeepAlive the downloads reuse idle HTTP/1.1 connections, with
+// CoalesceHTTP2 they multiplex their requests over one HTTP/2 connection
+// per host where the server speaks it over TLS.
+type ConnectionPool struct {
+	mode string
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func NewConnectionPool(mode string) (*ConnectionPool, error) {
+	if mode == "" || !validCoalesce(mode) {
+		return nil, fmt.Errorf("unknown coalesce mode %q, want %s or %s", mode, CoalesceKeepAlive, CoalesceHTTP2)
+	}
+	return &ConnectionPool{mode: mode, transports: map[string]*http.Transport{}}, nil
+}
+
+// WithConnectionPool makes the download share the connections of pool with
+// the other downloads using it, and download a file of up to SmallFileSize
+// with the request that probes it, in a single request.
+func WithConnectionPool(pool *ConnectionPool) Option {
+	return func(f *File) error {
+		f.pool = pool
+		return nil
+	}
+}
+
+// transport returns the transport of the pool for the host of f and the
+// settings it connects with, made by build the first time, or nil when f
+// needs one of its own.
+func (p *ConnectionPool) transport(f *File, build func() *http.Transport) *http.Transport {
+	if p == nil || f.pieceOrder == PieceOrderPipeline {
+		return nil
+	}
+	u, err := url.Parse(f.Url)
+	if err != nil {
+		return nil
+	}
+	var proxy string
+	if f.proxy != nil {
+		proxy = fmt.Sprint(f.proxy, f.proxyAuth, f.proxyCredentials)
+	}
+	key := fmt.Sprint(u.Scheme, u.Host, f.network, f.localAddr, f.resolve, f.sockets, f.dnsServer, f.doh, f.blockPrivate, proxy)
+	key += fmt.Sprintf("%p", f.shaper)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.transports[key]; ok {
+		return t
+	}
+	t := build()
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = PoolIdleConns
+	t.IdleConnTimeout = 90 * time.Second
+	if p.mode == CoalesceKeepAlive {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	p.transports[key] = t
+	return t
+}
+
+// CloseIdleConnections closes the idle connections of every host.
+func (p *ConnectionPool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// prefetch reads the body of the probe response of a small file, so that it
+// is not requested again and the connection goes back to the pool.
+func (f *File) prefetch(resp *http.Response) {
+	if f.pool == nil || resp.StatusCode != http.StatusOK || f.ranged || f.Size <= 0 || f.Size > SmallFileSize || resp.ContentLength != f.Size {
+		return
+	}
+	if f.stallTimeout > 0 {
+		stop := time.AfterFunc(f.stallTimeout, func() { resp.Body.Close() })
+		defer stop.Stop()
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.Size+1))
+	if err != nil || int64(len(body)) != f.Size {
+		return
+	}
+	f.prefetched = body
+}
+
+// prefetchedBlock returns the part of the prefetched file from begin to
+// end, if it has it.
+func (f *File) prefetchedBlock(begin, end int64) (io.Reader, bool) {
+	if f.prefetched == nil || begin < 0 || end < begin || end >= int64(len(f.prefetched)) {
+		return nil, false
+	}
+	return bytes.NewReader(f.prefetched[begin : end+1]), true
+}
@@ -0,0 +1,325 @@
+package downloader
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var DocCommands = map[string]bool{"completion": true, "gen-docs": true, "__complete": true}
+
+func commandNames() []string {
+	return append(slices.Sorted(maps.Keys(ControlCommands)), "verify", "join", "restore", "bench", "speedtest", "self-update", "completion", "gen-docs")
+}
+
+func idCommands() string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(ControlCommands)) {
+		if name != "add" && name != "events" {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func RunDocs(args []string, socket string, out io.Writer) int {
+	switch {
+	case args[0] == "completion" && len(args) == 2:
+		switch args[1] {
+		case "bash":
+			writeBashCompletion(out)
+		case "zsh":
+			writeZshCompletion(out)
+		case "fish":
+			writeFishCompletion(out)
+		default:
+			fmt.Fprintln(os.Stderr, "usage: cdm completion bash|zsh|fish")
+			return ExitUsage
+		}
+	case args[0] == "gen-docs" && len(args) <= 2:
+		dir := "."
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		if err := writeManPage(filepath.Join(dir, "cdm.1")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailure
+		}
+	case args[0] == "__complete" && len(args) == 2:
+		completeValues(args[1], socket, out)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: cdm completion bash|zsh|fish | cdm gen-docs [dir]")
+		return ExitUsage
+	}
+	return ExitOK
+}
+
+func completeValues(kind, socket string, out io.Writer) {
+	switch kind {
+	case "ids":
+		c := NewControlClient(socket)
+		if !c.Running() {
+			return
+		}
+		list, err := c.List(Filter{})
+		if err != nil {
+			return
+		}
+		for _, d := range list {
+			fmt.Fprintln(out, d.Id)
+		}
+	case "urls":
+		text, err := readClipboard()
+		if err != nil {
+			return
+		}
+		for _, url := range (&ClipboardWatcher{}).urls(text) {
+			fmt.Fprintln(out, url)
+		}
+	}
+}
+
+func writeBashCompletion(w io.Writer) {
+	var flags, valueFlags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+		if !isBoolFlag(f) {
+			valueFlags = append(valueFlags, "-"+f.Name)
+		}
+	})
+	fmt.Fprintf(w, `_cdm() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local COMP_WORDBREAKS="${COMP_WORDBREAKS//:}"
+	case " %s " in
+	*" $prev "*)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	local i command
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		if [[ ${COMP_WORDS[i]} != -* ]]; then
+			command=${COMP_WORDS[i]}
+			break
+		fi
+	done
+	case "$command" in
+	"")
+		COMPREPLY=($(compgen -W "%s $(cdm __complete urls 2>/dev/null)" -- "$cur"))
+		;;
+	%s)
+		COMPREPLY=($(compgen -W "$(cdm __complete ids 2>/dev/null)" -- "$cur"))
+		;;
+	completion)
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+		;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		;;
+	esac
+}
+complete -F _cdm cdm
+`, strings.Join(valueFlags, " "), strings.Join(flags, " "), strings.Join(commandNames(), " "), strings.ReplaceAll(idCommands(), " ", "|"))
+}
+
+func writeZshCompletion(w io.Writer) {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	fmt.Fprintln(w, "#compdef cdm\n\n_cdm() {\n\tlocal state\n\t_arguments -s \\")
+	flag.VisitAll(func(f *flag.Flag) {
+		spec := "'-" + f.Name + "[" + escape.Replace(f.Usage) + "]"
+		if !isBoolFlag(f) {
+			name, _ := flag.UnquoteUsage(f)
+			spec += ":" + escape.Replace(name) + ":_files"
+		}
+		fmt.Fprintf(w, "\t\t%s' \\\n", spec)
+	})
+	fmt.Fprintf(w, `		'1: :->first' \
+		'*: :->rest'
+	case $state in
+	first)
+		compadd -- %s ${(f)"$(cdm __complete urls 2>/dev/null)"}
+		;;
+	rest)
+		case ${words[(r)[^-]*~cdm]} in
+		%s)
+			compadd -- ${(f)"$(cdm __complete ids 2>/dev/null)"}
+			;;
+		completion)
+			compadd -- bash zsh fish
+			;;
+		*)
+			_files
+			;;
+		esac
+		;;
+	esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+	_cdm "$@"
+else
+	compdef _cdm cdm
+fi
+`, strings.Join(commandNames(), " "), strings.ReplaceAll(idCommands(), " ", "|"))
+}
+
+func writeFishCompletion(w io.Writer) {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	fmt.Fprintln(w, "complete -c cdm -f")
+	flag.VisitAll(func(f *flag.Flag) {
+		line := "complete -c cdm -o " + f.Name + " -d '" + escape.Replace(f.Usage) + "'"
+		if !isBoolFlag(f) {
+			line += " -r -F"
+		}
+		fmt.Fprintln(w, line)
+	})
+	ids := idCommands()
+	fmt.Fprintf(w, `complete -c cdm -n __fish_use_subcommand -a '%s'
+complete -c cdm -n __fish_use_subcommand -a '(cdm __complete urls 2>/dev/null)'
+complete -c cdm -n '__fish_seen_subcommand_from %s' -a '(cdm __complete ids 2>/dev/null)'
+complete -c cdm -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'
+complete -c cdm -n 'not __fish_use_subcommand; and not __fish_seen_subcommand_from %s completion events' -F
+`, strings.Join(commandNames(), " "), ids, ids)
+}
+
+func writeManPage(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	escape := strings.NewReplacer(`\`, `\e`, "-", `\-`, "'", `\(aq`)
+	line := func(s string) string {
+		s = escape.Replace(s)
+		if strings.HasPrefix(s, ".") {
+			s = `\&` + s
+		}
+		return s
+	}
+	fmt.Fprint(f, `.TH CDM 1 "" "cdm" "User Commands"
+.SH NAME
+cdm \- concurrent download manager
+.SH SYNOPSIS
+.B cdm
+[\fIflags\fR] \fIurl\fR \fIfilename\fR
+.br
+.B cdm
+[\fIflags\fR] \fIurl\fR \fIurl\fR...
+.br
+.B cdm \-tui
+[\fIflags\fR] \fIurl\fR...
+.br
+.B cdm \-daemon
+[\fIflags\fR]
+.br
+.B cdm
+\fIcommand\fR [\fIargs\fR]
+.SH DESCRIPTION
+.B cdm
+downloads a file over several connections at once, each fetching a range of it.
+With \fB\-daemon\fR it runs a download queue controlled over a REST API and a unix socket,
+and the commands below talk to that daemon.
+.SH COMMANDS
+.TP
+.B add \fIurl\fR [\fIfilename\fR] [\-\-tag \fItag\fR]... [\-\-meta \fIkey=value\fR]...
+queue a download
+.TP
+.B status\fR [\fIid\fR | \fIfilters\fR] [\-\-follow]
+show downloads, or with \-\-follow watch them as they progress until interrupted
+.TP
+.B pause\fR|\fBresume\fR|\fBcancel\fR \fIid\fR|\-\-all [\fIfilters\fR]
+control downloads
+.TP
+.B retry \fIid\fR|\-\-all\-failed
+requeue failed or canceled downloads
+.TP
+.B remove \fIid\fR
+remove a download from the queue
+.TP
+.B events
+print download events as JSON lines
+.TP
+.B verify \fIfile\fR [\-\-checksum \fIsha256\fR]
+check the SHA\-256 of a downloaded file against the given one, or the one stored by \fB\-xattr\-checksum\fR
+.TP
+.B join\fR [\-\-remove] \fIbase\fR [\fIoutput\fR]
+concatenate the chunks \fIbase\fR.000, \fIbase\fR.001, ... written by \fB\-split\-size\fR into \fIoutput\fR (default \fIbase\fR, \- for stdout)
+.TP
+.B bench\fR [\-size \fIbytes\fR] [\-latency \fIduration\fR] [\-bandwidth \fIbytes\fR] [\-error\-rate \fIfraction\fR] [\-connections \fIn,n,...\fR]
+download a synthetic file from a built\-in test server with each connection count and print the throughput
+.TP
+.B speedtest\fR [\-url \fIurl\fR]... [\-connections \fIn,n,...\fR] [\-duration \fIduration\fR] [\-write\-config \fIfile\fR]
+download test files from the internet with each connection count and recommend the fastest
+.TP
+.B self\-update\fR [\-channel stable|beta] [\-check] [\-force] [\-source \fIurl\fR] [\-key \fIbase64\fR]
+replace the executable with the latest release for this platform, checked against its published checksum
+.TP
+.B completion bash\fR|\fBzsh\fR|\fBfish
+print a shell completion script
+.TP
+.B gen\-docs\fR [\fIdir\fR]
+write this manual page to \fIdir\fR/cdm.1
+.SH OPTIONS
+`)
+	flag.VisitAll(func(fl *flag.Flag) {
+		name, usage := flag.UnquoteUsage(fl)
+		fmt.Fprintf(f, ".TP\n.B \\-%s", line(fl.Name))
+		if !isBoolFlag(fl) && name != "" {
+			fmt.Fprintf(f, " \\fI%s\\fR", line(name))
+		}
+		fmt.Fprintf(f, "\n%s", line(usage))
+		switch fl.DefValue {
+		case "", "0", "0s", "false", "[]":
+		default:
+			fmt.Fprintf(f, " (default %s)", line(strconv.Quote(fl.DefValue)))
+		}
+		fmt.Fprintln(f)
+	})
+	fmt.Fprint(f, `.SH EXIT STATUS
+.TP
+.B 0
+download finished
+.TP
+.B 1
+other failure
+.TP
+.B 2
+invalid command line
+.TP
+.B 3
+network failure
+.TP
+.B 4
+HTTP 4xx response or refused redirect
+.TP
+.B 5
+HTTP 5xx response
+.TP
+.B 6
+checksum mismatch
+.TP
+.B 7
+disk full
+.TP
+.B 8
+canceled
+.TP
+.B 9
+partial download
+`)
+	return f.Close()
+}
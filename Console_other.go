@@ -0,0 +1,10 @@
+//go:build !windows
+
+package downloader
+
+import "os"
+
+func AnsiTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
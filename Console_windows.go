@@ -0,0 +1,25 @@
+package downloader
+
+import (
+	"os"
+	"syscall"
+)
+
+const enableVirtualTerminalProcessing = 0x4
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// AnsiTerminal reports whether f is a console, turning on escape sequence
+// processing, which Windows 10 and later support, so that the progress bars
+// can be redrawn in place.
+func AnsiTerminal(f *os.File) bool {
+	var mode uint32
+	if err := syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode); err != nil {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	ok, _, _ := procSetConsoleMode.Call(f.Fd(), uintptr(mode|enableVirtualTerminalProcessing))
+	return ok != 0
+}
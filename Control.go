@@ -0,0 +1,635 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var ControlCommands = map[string]bool{"add": true, "status": true, "pause": true, "resume": true, "cancel": true, "retry": true, "remove": true, "events": true, "export": true, "import": true, "handoff": true, "drain": true, "undrain": true, "wait": true}
+
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "cdm.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cdm-%d.sock", os.Getuid()))
+}
+
+func ListenUnix(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS == "windows" {
+		return l, nil
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+type ControlClient struct {
+	Socket string
+	// Tenant is who downloads are added for, $CDM_TENANT by default.
+	Tenant string
+	client *http.Client
+}
+
+func NewControlClient(socket string) *ControlClient {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &ControlClient{
+		Socket: socket,
+		Tenant: os.Getenv("CDM_TENANT"),
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+func (c *ControlClient) Running() bool {
+	conn, err := net.DialTimeout("unix", c.Socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (c *ControlClient) call(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://cdm"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Tenant != "" {
+		req.Header.Set(TenantHeader, c.Tenant)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return &HTTPError{Url: path, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ControlClient) Add(url, name string, tags []string, metadata map[string]string, group string) (DownloadInfo, error) {
+	var info DownloadInfo
+	req := map[string]interface{}{"url": url, "name": name, "tags": tags, "metadata": metadata, "group": group}
+	err := c.call("POST", "/downloads", req, &info)
+	return info, err
+}
+
+func (c *ControlClient) AddInput(input io.Reader) ([]DownloadInfo, error) {
+	b, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	var list []DownloadInfo
+	req := struct {
+		Input string `json:"input"`
+	}{string(b)}
+	err = c.call("POST", "/input", req, &list)
+	return list, err
+}
+
+func (c *ControlClient) AddDirectory(url, dir string, filter DirectoryFilter, tag, group string) ([]DownloadInfo, error) {
+	var list []DownloadInfo
+	req := struct {
+		DirectoryFilter
+		Url   string `json:"url"`
+		Dir   string `json:"dir"`
+		Tag   string `json:"tag"`
+		Group string `json:"group"`
+	}{filter, url, dir, tag, group}
+	err := c.call("POST", "/directory", req, &list)
+	return list, err
+}
+
+func (c *ControlClient) Export(id int) (Job, error) {
+	var job Job
+	err := c.call("GET", "/downloads/"+strconv.Itoa(id)+"/job", nil, &job)
+	return job, err
+}
+
+func (c *ControlClient) Import(job Job) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/jobs", job, &info)
+	return info, err
+}
+
+func (c *ControlClient) Handoff(id int, to, key string) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/downloads/"+strconv.Itoa(id)+"/handoff", map[string]string{"to": to, "key": key}, &info)
+	return info, err
+}
+
+func (c *ControlClient) JobProgress(filter Filter) (JobProgress, error) {
+	var p JobProgress
+	err := c.call("GET", "/progress?"+filter.Query().Encode(), nil, &p)
+	return p, err
+}
+
+func (c *ControlClient) List(filter Filter) ([]DownloadInfo, error) {
+	var list []DownloadInfo
+	err := c.call("GET", "/downloads?"+filter.Query().Encode(), nil, &list)
+	return list, err
+}
+
+func (c *ControlClient) Get(id int) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("GET", "/downloads/"+strconv.Itoa(id), nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Pause(id int) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/downloads/"+strconv.Itoa(id)+"/pause", nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Resume(id int) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/downloads/"+strconv.Itoa(id)+"/resume", nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Cancel(id int) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/downloads/"+strconv.Itoa(id)+"/cancel", nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Retry(id int) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("POST", "/downloads/"+strconv.Itoa(id)+"/retry", nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Remove(id int) error {
+	return c.call("DELETE", "/downloads/"+strconv.Itoa(id), nil, nil)
+}
+
+func (c *ControlClient) Wait(id int, timeout time.Duration) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call("GET", "/downloads/"+strconv.Itoa(id)+"/wait?timeout="+timeout.String(), nil, &info)
+	return info, err
+}
+
+func (c *ControlClient) Drain(timeout time.Duration, exit bool) (DrainReport, error) {
+	var report DrainReport
+	query := url.Values{"timeout": {timeout.String()}}
+	if exit {
+		query.Set("exit", "true")
+	}
+	err := c.call("POST", "/drain?"+query.Encode(), nil, &report)
+	return report, err
+}
+
+func (c *ControlClient) Undrain() error {
+	return c.call("DELETE", "/drain", nil, nil)
+}
+
+func (c *ControlClient) RetryFailed() ([]DownloadInfo, error) {
+	var list []DownloadInfo
+	err := c.call("POST", "/retry", nil, &list)
+	return list, err
+}
+
+func (c *ControlClient) Bulk(action string, filter Filter) ([]DownloadInfo, error) {
+	var list []DownloadInfo
+	err := c.call("POST", "/"+action+"?"+filter.Query().Encode(), nil, &list)
+	return list, err
+}
+
+func parseFilter(args []string) (Filter, bool) {
+	var filter Filter
+	for ; len(args) > 0; args = args[1:] {
+		switch strings.TrimLeft(args[0], "-") {
+		case "all":
+			continue
+		case "state":
+			if len(args) < 2 {
+				return filter, false
+			}
+			filter.State, args = args[1], args[1:]
+		case "host":
+			if len(args) < 2 {
+				return filter, false
+			}
+			filter.Host, args = args[1], args[1:]
+		case "tag":
+			if len(args) < 2 {
+				return filter, false
+			}
+			filter.Tag, args = args[1], args[1:]
+		case "meta":
+			if len(args) < 2 {
+				return filter, false
+			}
+			filter.Meta, args = args[1], args[1:]
+		case "group":
+			if len(args) < 2 {
+				return filter, false
+			}
+			filter.Group, args = args[1], args[1:]
+		default:
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+func RunControl(c *ControlClient, args []string, out io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: cdm add url [filename] [--tag tag] [--meta key=value] [--group group] | cdm add --input file | cdm add --recursive url [dir] [--include glob] [--exclude glob] [--include-regex re] [--exclude-regex re] [--min-size size] [--max-size size] [--level n] [--tag tag] [--group group] | cdm status [id|filters] [--follow] | cdm pause|resume|cancel id|--all [filters] | cdm retry id|--all-failed | cdm remove id | cdm export id | cdm import file | cdm handoff id --to host [--key key] | cdm events | cdm wait id [--timeout 60s] | cdm drain [--timeout 30s] [--exit] | cdm undrain\nfilters: --state state --host host --tag tag --meta key[=value] --group group")
+		return ExitUsage
+	}
+	if !c.Running() {
+		fmt.Fprintf(os.Stderr, "no daemon is listening on %s\n", c.Socket)
+		return ExitFailure
+	}
+
+	var list []DownloadInfo
+	var err error
+	switch {
+	case args[0] == "events" && len(args) == 1:
+		if err := c.Events(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCode(err)
+		}
+		return ExitOK
+	case args[0] == "drain":
+		timeout, exit := 30*time.Second, false
+		for rest := args[1:]; len(rest) > 0; rest = rest[1:] {
+			switch opt := rest[0]; {
+			case opt == "--exit" || opt == "-exit":
+				exit = true
+			case (opt == "--timeout" || opt == "-timeout") && len(rest) > 1:
+				var err error
+				if timeout, err = time.ParseDuration(rest[1]); err != nil || timeout < 0 {
+					return usage()
+				}
+				rest = rest[1:]
+			default:
+				return usage()
+			}
+		}
+		report, err := c.Drain(timeout, exit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCode(err)
+		}
+		fmt.Fprintf(out, "drained in %s: %d ended, %d paused\n", report.Waited.Round(time.Millisecond), len(report.Ended), len(report.Paused))
+		writeDownloads(out, report.Paused)
+		return ExitOK
+	case args[0] == "wait" && len(args) >= 2:
+		id, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return usage()
+		}
+		var timeout time.Duration
+		for rest := args[2:]; len(rest) > 0; rest = rest[2:] {
+			if opt := rest[0]; (opt != "--timeout" && opt != "-timeout") || len(rest) < 2 {
+				return usage()
+			}
+			var err error
+			if timeout, err = time.ParseDuration(rest[1]); err != nil || timeout < 0 {
+				return usage()
+			}
+		}
+		// Without a timeout the wait goes on for as long as the download,
+		// a minute of it per request.
+		deadline := time.Now().Add(timeout)
+		for {
+			wait := time.Minute
+			if timeout > 0 {
+				wait = min(wait, time.Until(deadline))
+			}
+			info, err := c.Wait(id, max(wait, 0))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return ExitCode(err)
+			}
+			switch {
+			case info.State == StateFinished || info.State == StateUpToDate:
+				writeDownloads(out, []DownloadInfo{info})
+				return ExitOK
+			case info.State == StateCanceled:
+				writeDownloads(out, []DownloadInfo{info})
+				return ExitCanceled
+			case ended(info.State):
+				writeDownloads(out, []DownloadInfo{info})
+				if info.Error != "" {
+					fmt.Fprintln(os.Stderr, info.Error)
+				}
+				return ExitFailure
+			case timeout > 0 && !time.Now().Before(deadline):
+				fmt.Fprintf(os.Stderr, "download %d is still %s after %s\n", id, info.State, timeout)
+				return ExitPartial
+			}
+		}
+	case args[0] == "undrain" && len(args) == 1:
+		if err := c.Undrain(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCode(err)
+		}
+		return ExitOK
+	case args[0] == "remove" && len(args) == 2:
+		id, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return usage()
+		}
+		if err := c.Remove(id); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCode(err)
+		}
+		return ExitOK
+	case args[0] == "export" && len(args) == 2:
+		id, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return usage()
+		}
+		job, err := c.Export(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCode(err)
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(job)
+		return ExitOK
+	case args[0] == "handoff" && len(args) >= 4:
+		id, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return usage()
+		}
+		var to string
+		key := os.Getenv("CDM_HANDOFF_KEY")
+		for rest := args[2:]; len(rest) > 0; rest = rest[2:] {
+			switch opt := rest[0]; {
+			case (opt == "--to" || opt == "-to") && len(rest) > 1:
+				to = rest[1]
+			case (opt == "--key" || opt == "-key") && len(rest) > 1:
+				key = rest[1]
+			default:
+				return usage()
+			}
+		}
+		if to == "" {
+			return usage()
+		}
+		var info DownloadInfo
+		info, err = c.Handoff(id, to, key)
+		list = []DownloadInfo{info}
+	case args[0] == "import" && len(args) == 2:
+		input := io.Reader(os.Stdin)
+		if args[1] != "-" {
+			f, openErr := os.Open(args[1])
+			if openErr != nil {
+				fmt.Fprintln(os.Stderr, openErr)
+				return ExitUsage
+			}
+			defer f.Close()
+			input = f
+		}
+		// A file may hold several jobs one after the other, as exports
+		// appended to each other.
+		dec := json.NewDecoder(input)
+		for {
+			var job Job
+			if decodeErr := dec.Decode(&job); decodeErr == io.EOF {
+				break
+			} else if decodeErr != nil {
+				fmt.Fprintln(os.Stderr, decodeErr)
+				return ExitUsage
+			}
+			var info DownloadInfo
+			if info, err = c.Import(job); err != nil {
+				break
+			}
+			list = append(list, info)
+		}
+	case args[0] == "add" && len(args) == 3 && (args[1] == "--input" || args[1] == "-input" || args[1] == "-i"):
+		input := io.Reader(os.Stdin)
+		if args[2] != "-" {
+			f, openErr := os.Open(args[2])
+			if openErr != nil {
+				fmt.Fprintln(os.Stderr, openErr)
+				return ExitUsage
+			}
+			defer f.Close()
+			input = f
+		}
+		list, err = c.AddInput(input)
+	case args[0] == "add" && len(args) >= 3 && (args[1] == "--recursive" || args[1] == "-recursive" || args[1] == "-r"):
+		var dir, tag, group string
+		var filter DirectoryFilter
+		for rest := args[3:]; len(rest) > 0; rest = rest[1:] {
+			switch opt := rest[0]; {
+			case (opt == "--include" || opt == "-include") && len(rest) > 1:
+				filter.Include = append(filter.Include, rest[1])
+				rest = rest[1:]
+			case (opt == "--exclude" || opt == "-exclude") && len(rest) > 1:
+				filter.Exclude = append(filter.Exclude, rest[1])
+				rest = rest[1:]
+			case (opt == "--include-regex" || opt == "-include-regex") && len(rest) > 1:
+				filter.IncludeRegex = append(filter.IncludeRegex, rest[1])
+				rest = rest[1:]
+			case (opt == "--exclude-regex" || opt == "-exclude-regex") && len(rest) > 1:
+				filter.ExcludeRegex = append(filter.ExcludeRegex, rest[1])
+				rest = rest[1:]
+			case (opt == "--min-size" || opt == "-min-size" || opt == "--max-size" || opt == "-max-size") && len(rest) > 1:
+				size, err := ParseBytes(rest[1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "invalid %s %q\n", opt, rest[1])
+					return ExitUsage
+				}
+				if strings.HasSuffix(opt, "min-size") {
+					filter.MinSize = size
+				} else {
+					filter.MaxSize = size
+				}
+				rest = rest[1:]
+			case (opt == "--level" || opt == "-level") && len(rest) > 1:
+				level, err := strconv.Atoi(rest[1])
+				if err != nil || level < 0 {
+					fmt.Fprintf(os.Stderr, "invalid %s %q\n", opt, rest[1])
+					return ExitUsage
+				}
+				filter.Level = level
+				rest = rest[1:]
+			case (opt == "--tag" || opt == "-tag") && len(rest) > 1 && tag == "":
+				tag = rest[1]
+				rest = rest[1:]
+			case (opt == "--group" || opt == "-group") && len(rest) > 1 && group == "":
+				group = rest[1]
+				rest = rest[1:]
+			case dir == "" && !strings.HasPrefix(opt, "-"):
+				dir = opt
+			default:
+				return usage()
+			}
+		}
+		if dir != "" && !filepath.IsAbs(dir) {
+			if abs, err := filepath.Abs(dir); err == nil {
+				dir = abs
+			}
+		}
+		list, err = c.AddDirectory(args[2], dir, filter, tag, group)
+	case args[0] == "add" && len(args) >= 2:
+		var name, group string
+		var tags []string
+		var metadata map[string]string
+		for rest := args[2:]; len(rest) > 0; rest = rest[1:] {
+			switch opt := rest[0]; {
+			case (opt == "--tag" || opt == "-tag") && len(rest) > 1:
+				tags = append(tags, rest[1])
+				rest = rest[1:]
+			case (opt == "--meta" || opt == "-meta") && len(rest) > 1:
+				key, value, err := ParseMetadata(rest[1])
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return ExitUsage
+				}
+				if metadata == nil {
+					metadata = map[string]string{}
+				}
+				metadata[key] = value
+				rest = rest[1:]
+			case (opt == "--group" || opt == "-group") && len(rest) > 1 && group == "":
+				group = rest[1]
+				rest = rest[1:]
+			case name == "" && !strings.HasPrefix(opt, "-"):
+				name = opt
+			default:
+				return usage()
+			}
+		}
+		var info DownloadInfo
+		info, err = c.Add(args[1], name, tags, metadata, group)
+		list = []DownloadInfo{info}
+	case args[0] == "status" && (len(args) == 1 || strings.HasPrefix(args[1], "-")):
+		follow := slices.ContainsFunc(args[1:], func(a string) bool { return a == "--follow" || a == "-follow" })
+		filter, ok := parseFilter(slices.DeleteFunc(args[1:], func(a string) bool { return a == "--follow" || a == "-follow" }))
+		if !ok {
+			return usage()
+		}
+		if follow {
+			f, ok := out.(*os.File)
+			return followStatus(c, filter, out, ok && AnsiTerminal(f))
+		}
+		if list, err = c.List(filter); err == nil && filter != (Filter{}) {
+			var p JobProgress
+			if p, err = c.JobProgress(filter); err == nil {
+				writeDownloads(out, list)
+				writeJobProgress(out, p)
+				return ExitOK
+			}
+		}
+	case args[0] != "add" && args[0] != "retry" && len(args) > 1 && strings.TrimLeft(args[1], "-") == "all":
+		filter, ok := parseFilter(args[1:])
+		if !ok {
+			return usage()
+		}
+		list, err = c.Bulk(args[0], filter)
+	case args[0] == "retry" && len(args) == 2 && (args[1] == "--all-failed" || args[1] == "-all-failed"):
+		list, err = c.RetryFailed()
+	case len(args) == 2:
+		id, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return usage()
+		}
+		var info DownloadInfo
+		switch args[0] {
+		case "status":
+			info, err = c.Get(id)
+		case "pause":
+			info, err = c.Pause(id)
+		case "resume":
+			info, err = c.Resume(id)
+		case "cancel":
+			info, err = c.Cancel(id)
+		case "retry":
+			info, err = c.Retry(id)
+		}
+		list = []DownloadInfo{info}
+	default:
+		return usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCode(err)
+	}
+	writeDownloads(out, list)
+	return ExitOK
+}
+
+func writeJobProgress(w io.Writer, p JobProgress) {
+	size, done := "?", "?"
+	if p.Total >= 0 {
+		size = FormatBytes(p.Total)
+		if p.Total > 0 {
+			done = fmt.Sprintf("%.1f%%", float64(p.Downloaded)*100/float64(p.Total))
+		}
+	}
+	fmt.Fprintf(w, "\n%d files, %d finished, %d failed, %s of %s, %s/s\n", p.Files, p.Finished, p.Failed, done, size, FormatBytes(p.Speed))
+}
+
+func writeDownloads(w io.Writer, list []DownloadInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "id\tstate\tdone\tsize\tspeed\tpath\t")
+	for _, d := range list {
+		size, done := "?", "?"
+		if d.Total >= 0 {
+			size = FormatBytes(d.Total)
+			if d.Total > 0 {
+				done = fmt.Sprintf("%.1f%%", float64(d.Downloaded)*100/float64(d.Total))
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s/s\t%s\t\n", d.Id, d.State, done, size, FormatBytes(d.Speed), d.Path)
+	}
+	tw.Flush()
+}
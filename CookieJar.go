@@ -0,0 +1,357 @@
+package downloader
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jarMagic starts an encrypted cookie jar, followed by the salt and
+	// iteration count of the key, the nonce and the AES-GCM sealed JSON.
+	jarMagic = "cdm-jar-aes-v2\n"
+	// legacyJarMagic started jars sealed under the plain SHA-256 of the
+	// passphrase. They are read, and saved in the current format.
+	legacyJarMagic = "cdm-jar-aes-gcm\n"
+)
+
+var ErrJarKey = errors.New("the cookie jar is encrypted: wrong or missing key")
+
+type jarCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	HostOnly bool      `json:"host_only,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (c *jarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+func (c *jarCookie) matches(u *url.URL) bool {
+	host := canonicalHost(u.Hostname())
+	if c.HostOnly && host != c.Domain || !c.HostOnly && !domainMatch(host, c.Domain) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	return p == c.Path || strings.HasPrefix(p, c.Path) && (strings.HasSuffix(c.Path, "/") || p[len(c.Path)] == '/')
+}
+
+// CookieJar is an http.CookieJar kept in a file, so the cookies a server
+// set, session cookies included, are sent by every later download and
+// survive restarts. With a key the file is encrypted with AES-256-GCM.
+type CookieJar struct {
+	mu         sync.Mutex
+	path       string
+	aead       cipher.AEAD
+	salt       []byte
+	iterations int
+	cookies    []jarCookie
+}
+
+// OpenCookieJar loads the jar at name, or starts an empty one there. An
+// empty key keeps the file in plain JSON; a key is stretched into the AES
+// key with the salt of the file.
+func OpenCookieJar(name, key string) (*CookieJar, error) {
+	j := &CookieJar{path: name}
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(string(data), jarMagic):
+		data, err = j.open(key, data[len(jarMagic):])
+	case strings.HasPrefix(string(data), legacyJarMagic):
+		if data, err = openLegacyJar(key, data[len(legacyJarMagic):]); err == nil {
+			err = j.newKey(key)
+		}
+	default:
+		err = j.newKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(data) == 0 {
+		return j, nil
+	}
+	if err := json.Unmarshal(data, &j.cookies); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	j.cookies = j.live(time.Now())
+	return j, nil
+}
+
+// newKey derives the key the jar is saved with from key and a new salt.
+// An empty key keeps the jar plain.
+func (j *CookieJar) newKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	j.salt, j.iterations = salt, PassphraseIterations
+	j.aead, err = passphraseCipher(key, salt, j.iterations)
+	return err
+}
+
+func (j *CookieJar) open(key string, sealed []byte) ([]byte, error) {
+	if key == "" || len(sealed) < saltSize+4 {
+		return nil, ErrJarKey
+	}
+	salt, iterations := sealed[:saltSize], int(binary.BigEndian.Uint32(sealed[saltSize:]))
+	aead, err := passphraseCipher(key, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[saltSize+4:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrJarKey
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(jarMagic))
+	if err != nil {
+		return nil, ErrJarKey
+	}
+	j.aead, j.salt, j.iterations = aead, salt, iterations
+	return plain, nil
+}
+
+// openLegacyJar opens a jar of the format sealed under the SHA-256 of key.
+func openLegacyJar(key string, sealed []byte) ([]byte, error) {
+	if key == "" {
+		return nil, ErrJarKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrJarKey
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(legacyJarMagic))
+	if err != nil {
+		return nil, ErrJarKey
+	}
+	return plain, nil
+}
+
+func (j *CookieJar) live(now time.Time) []jarCookie {
+	var live []jarCookie
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			live = append(live, c)
+		}
+	}
+	return live
+}
+
+// save writes the jar to a temporary file renamed over it, readable only by
+// its owner. j.mu is held.
+func (j *CookieJar) save() error {
+	data, err := json.MarshalIndent(j.cookies, "", "  ")
+	if err != nil {
+		return err
+	}
+	if j.aead != nil {
+		nonce := make([]byte, j.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := append([]byte(jarMagic), j.salt...)
+		sealed = binary.BigEndian.AppendUint32(sealed, uint32(j.iterations))
+		sealed = append(sealed, nonce...)
+		data = j.aead.Seal(sealed, nonce, data, []byte(jarMagic))
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	now := time.Now()
+	host := canonicalHost(u.Hostname())
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	changed := false
+	for _, c := range cookies {
+		jc := jarCookie{Name: c.Name, Value: c.Value, Path: c.Path, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		if domain := canonicalHost(strings.TrimPrefix(c.Domain, ".")); domain == "" || domain == host {
+			jc.Domain, jc.HostOnly = host, domain == ""
+		} else if domainMatch(host, domain) && strings.Contains(domain, ".") && net.ParseIP(host) == nil {
+			jc.Domain = domain
+		} else {
+			continue
+		}
+		if !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u.EscapedPath())
+		}
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = now
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires
+		}
+		j.put(jc)
+		changed = true
+	}
+	if changed {
+		j.cookies = j.live(now)
+		if err := j.save(); err != nil {
+			slog.Warn("can not save the cookie jar", "path", j.path, "err", err)
+		}
+	}
+}
+
+// put replaces the cookie of the same name, domain and path. j.mu is held.
+func (j *CookieJar) put(c jarCookie) {
+	for i, old := range j.cookies {
+		if old.Name == c.Name && old.Domain == c.Domain && old.Path == c.Path {
+			j.cookies[i] = c
+			return
+		}
+	}
+	j.cookies = append(j.cookies, c)
+}
+
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	now := time.Now()
+	j.mu.Lock()
+	var matched []jarCookie
+	for _, c := range j.cookies {
+		if !c.expired(now) && c.matches(u) {
+			matched = append(matched, c)
+		}
+	}
+	j.mu.Unlock()
+	sort.SliceStable(matched, func(a, b int) bool { return len(matched[a].Path) > len(matched[b].Path) })
+	cookies := make([]*http.Cookie, len(matched))
+	for i, c := range matched {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+// Import adds the cookies of a Netscape cookies.txt file, as browsers and
+// curl export them, and returns how many it read.
+func (j *CookieJar) Import(r io.Reader) (int, error) {
+	var imported []jarCookie
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(text, "#HttpOnly_")
+		text = strings.TrimPrefix(text, "#HttpOnly_")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return 0, fmt.Errorf("line %d: expected 7 tab separated fields", line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid expiry %q", line, fields[4])
+		}
+		c := jarCookie{
+			Domain:   canonicalHost(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		imported = append(imported, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range imported {
+		j.put(c)
+	}
+	j.cookies = j.live(time.Now())
+	return len(imported), j.save()
+}
+
+func ImportCookies(j *CookieJar, name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	n, err := j.Import(file)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n, nil
+}
+
+// WithCookieJar sends and keeps cookies in jar, shared by every download
+// given it.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(f *File) error {
+		f.jar = jar
+		return nil
+	}
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+func defaultCookiePath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.Count(p, "/") == 1 {
+		return "/"
+	}
+	return path.Dir(p)
+}
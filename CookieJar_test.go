@@ -0,0 +1,148 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func cookieNames(cookies []*http.Cookie) string {
+	var names []string
+	for _, c := range cookies {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestCookieJarMatching(t *testing.T) {
+	j, err := OpenCookieJar(filepath.Join(t.TempDir(), "jar"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := url.Parse("https://www.example.com/files/a.iso")
+	j.SetCookies(set, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Secure: true, Path: "/"},
+		{Name: "deep", Value: "4", Path: "/files/isos"},
+		{Name: "foreign", Value: "5", Domain: "other.com"},
+		{Name: "gone", Value: "6", MaxAge: -1},
+	})
+	for u, want := range map[string]string{
+		"https://www.example.com/files/b.iso":      "host=1 domain=2 secure=3",
+		"https://www.example.com/files/isos/c.iso": "deep=4 host=1 domain=2 secure=3",
+		"http://www.example.com/files/b.iso":       "host=1 domain=2",
+		"https://cdn.example.com/files/b.iso":      "domain=2",
+		"https://www.example.com/filesx":           "domain=2 secure=3",
+		"https://other.com/":                       "",
+	} {
+		parsed, _ := url.Parse(u)
+		if got := cookieNames(j.Cookies(parsed)); got != want {
+			t.Errorf("%s: sent %q, want %q", u, got, want)
+		}
+	}
+}
+
+func TestCookieJarFile(t *testing.T) {
+	fastPassphrases(t)
+	name := filepath.Join(t.TempDir(), "jar")
+	j, err := OpenCookieJar(name, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://example.com/login")
+	j.SetCookies(u, []*http.Cookie{{Name: "session", Value: "token-value"}})
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(jarMagic)) || bytes.Contains(data, []byte("token-value")) {
+		t.Fatal("the jar was saved in plain text")
+	}
+	if info, _ := os.Stat(name); info.Mode().Perm() != 0o600 {
+		t.Fatalf("the jar is saved with mode %s", info.Mode())
+	}
+	for _, key := range []string{"", "wrong"} {
+		if _, err := OpenCookieJar(name, key); !errors.Is(err, ErrJarKey) {
+			t.Errorf("opened with key %q: %v", key, err)
+		}
+	}
+	reopened, err := OpenCookieJar(name, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cookieNames(reopened.Cookies(u)); got != "session=token-value" {
+		t.Fatalf("the reopened jar sends %q", got)
+	}
+
+	// Another jar under the same passphrase is sealed under another key.
+	other, err := OpenCookieJar(name+"2", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.salt, reopened.salt) {
+		t.Fatal("two jars share a salt")
+	}
+}
+
+func TestCookieJarLegacy(t *testing.T) {
+	fastPassphrases(t)
+	name := filepath.Join(t.TempDir(), "jar")
+	sum := sha256.Sum256([]byte("secret"))
+	block, _ := aes.NewCipher(sum[:])
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	plain := `[{"name": "session", "value": "old", "domain": "example.com", "path": "/", "host_only": true}]`
+	sealed := append([]byte(legacyJarMagic), aead.Seal(nonce, nonce, []byte(plain), []byte(legacyJarMagic))...)
+	if err := os.WriteFile(name, sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := OpenCookieJar(name, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://example.com/")
+	if got := cookieNames(j.Cookies(u)); got != "session=old" {
+		t.Fatalf("the legacy jar sends %q", got)
+	}
+	j.SetCookies(u, []*http.Cookie{{Name: "other", Value: "new"}})
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(jarMagic)) {
+		t.Fatal("the legacy jar was not saved in the current format")
+	}
+}
+
+func TestCookieJarImport(t *testing.T) {
+	j, err := OpenCookieJar(filepath.Join(t.TempDir(), "jar"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := j.Import(strings.NewReader("# Netscape HTTP Cookie File\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tsid\tabc\n" +
+		"#HttpOnly_example.com\tFALSE\t/dl\tTRUE\t1\texpired\tx\n"))
+	if err != nil || n != 2 {
+		t.Fatalf("imported %d cookies: %v", n, err)
+	}
+	u, _ := url.Parse("https://sub.example.com/dl/file")
+	if got := cookieNames(j.Cookies(u)); got != "sid=abc" {
+		t.Fatalf("sent %q after import", got)
+	}
+	if _, err := j.Import(strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Fatal("imported a line of three fields")
+	}
+}
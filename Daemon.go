@@ -0,0 +1,632 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Daemon struct {
+	Manager *Manager
+	// Audit is served at /audit when set.
+	Audit *AuditLog
+	// Exit, if set, stops the daemon after POST /drain?exit=true.
+	Exit func()
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDaemon(m *Manager) *Daemon {
+	return &Daemon{Manager: m, closing: make(chan struct{})}
+}
+
+// Close ends the event streams and the waits, which a graceful shutdown of
+// the server would otherwise wait for without end.
+func (d *Daemon) Close() {
+	d.closeOnce.Do(func() { close(d.closing) })
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "groups" {
+		d.groups(w, r, parts[1:])
+		return
+	}
+	route := r.Method + " " + parts[0]
+	var id int
+	if len(parts) > 1 {
+		var err error
+		if id, err = strconv.Atoi(parts[1]); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid download id"))
+			return
+		}
+		route += "/{id}"
+	}
+	if len(parts) > 2 {
+		route += "/" + strings.Join(parts[2:], "/")
+	}
+
+	switch route {
+	case "GET downloads":
+		d.list(w, r)
+	case "POST downloads":
+		d.add(w, r)
+	case "POST input":
+		var req struct {
+			Input string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		entries, err := ParseInput(strings.NewReader(req.Input))
+		for _, e := range entries {
+			if err == nil {
+				err = d.Manager.checkDir(e.Dir)
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		list, err := d.Manager.addEntries(entries, tenantOf(r))
+		if writeRefused(w, err) {
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, list)
+	case "POST capture":
+		d.capture(w, r)
+	case "POST directory":
+		d.addDirectory(w, r)
+	case "GET progress":
+		writeJSON(w, http.StatusOK, d.Manager.JobProgress(FilterFromQuery(r.URL.Query())))
+	case "GET downloads/{id}":
+		d.get(w, r, id)
+	case "GET downloads/{id}/history":
+		history, err := d.Manager.History(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, history)
+	case "GET downloads/{id}/wait":
+		d.wait(w, r, id)
+	case "GET downloads/{id}/job":
+		job, err := d.Manager.Export(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case "POST jobs":
+		d.importJob(w, r)
+	case "POST downloads/{id}/handoff":
+		d.handoff(w, r, id)
+	case "POST handoff":
+		d.receiveHandoff(w, r)
+	case "GET downloads/{id}/content":
+		d.content(w, r, id)
+	case "GET downloads/{id}/summary":
+		summary, err := d.Manager.Summary(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, summary)
+	case "GET summary":
+		writeJSON(w, http.StatusOK, NewReport(d.Manager.Summaries(FilterFromQuery(r.URL.Query()))))
+	case "PATCH downloads/{id}":
+		d.update(w, r, id)
+	case "POST downloads/{id}/pause":
+		d.control(w, id, d.Manager.Pause)
+	case "POST downloads/{id}/resume":
+		d.control(w, id, d.Manager.Resume)
+	case "POST downloads/{id}/cancel":
+		d.control(w, id, d.Manager.Cancel)
+	case "DELETE downloads/{id}":
+		if err := d.Manager.Remove(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST downloads/{id}/retry":
+		d.retry(w, id)
+	case "POST pause":
+		writeJSON(w, http.StatusOK, d.Manager.PauseAll(FilterFromQuery(r.URL.Query())))
+	case "POST resume":
+		writeJSON(w, http.StatusOK, d.Manager.ResumeAll(FilterFromQuery(r.URL.Query())))
+	case "POST cancel":
+		writeJSON(w, http.StatusOK, d.Manager.CancelAll(FilterFromQuery(r.URL.Query())))
+	case "POST retry":
+		writeJSON(w, http.StatusOK, d.Manager.RetryFailed())
+	case "GET scheduled":
+		writeJSON(w, http.StatusOK, d.Manager.ListScheduled())
+	case "POST scheduled":
+		d.schedule(w, r)
+	case "DELETE scheduled/{id}":
+		if err := d.Manager.CancelScheduled(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "GET events":
+		d.events(w, r)
+	case "GET ui":
+		d.panel(w, r)
+	case "GET audit":
+		d.audit(w, r)
+	case "GET quotas":
+		writeJSON(w, http.StatusOK, d.Manager.Quotas())
+	case "GET healthz":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case "GET readyz":
+		d.ready(w)
+	case "POST drain":
+		d.drain(w, r)
+	case "DELETE drain":
+		d.Manager.Undrain()
+		w.WriteHeader(http.StatusNoContent)
+	case "GET config":
+		d.getConfig(w, r)
+	case "PATCH config":
+		d.setConfig(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
+
+func (d *Daemon) groups(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case r.Method == "GET" && len(parts) == 0:
+		writeJSON(w, http.StatusOK, d.Manager.Groups())
+	case r.Method == "GET" && len(parts) == 1:
+		info, err := d.Manager.GetGroup(parts[0])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case r.Method == "PUT" && len(parts) == 1:
+		var group Group
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		group.Name = parts[0]
+		info, err := d.Manager.SetGroup(group)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
+
+func (d *Daemon) audit(w http.ResponseWriter, r *http.Request) {
+	if d.Audit == nil {
+		writeError(w, http.StatusNotFound, errors.New("no audit log"))
+		return
+	}
+	entries, err := d.Audit.Find(AuditFilterFromQuery(r.URL.Query()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (d *Daemon) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Manager.Find(FilterFromQuery(r.URL.Query())))
+}
+
+func (d *Daemon) addDirectory(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DirectoryFilter
+		Url   string `json:"url"`
+		Dir   string `json:"dir"`
+		Tag   string `json:"tag"`
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Url == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+	if err := d.Manager.checkDir(req.Dir); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := req.DirectoryFilter.matcher(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	list, err := d.Manager.addDirectory(r.Context(), req.Url, req.Dir, req.DirectoryFilter, req.Tag, req.Group, tenantOf(r))
+	if writeRefused(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, list)
+}
+
+func (d *Daemon) add(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Url         string            `json:"url"`
+		Dir         string            `json:"dir"`
+		Name        string            `json:"name"`
+		Connections int               `json:"connections"`
+		RateLimit   int64             `json:"rate_limit"`
+		Priority    int               `json:"priority"`
+		Tags        []string          `json:"tags"`
+		Metadata    map[string]string `json:"metadata"`
+		Group       string            `json:"group"`
+		Strategy    string            `json:"strategy"`
+		PieceOrder  string            `json:"piece_order"`
+		PieceWindow int64             `json:"piece_window"`
+		MaxLifetime int               `json:"max_lifetime"`
+		NoProgress  int               `json:"no_progress"`
+		Post        []string          `json:"post"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Url == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+	if err := d.Manager.checkDir(req.Dir); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Strategy != "" && !validStrategy(req.Strategy) {
+		writeError(w, http.StatusBadRequest, errors.New("unknown download strategy "+req.Strategy))
+		return
+	}
+	if req.PieceOrder != "" && !validPieceOrder(req.PieceOrder) {
+		writeError(w, http.StatusBadRequest, errors.New("unknown piece order "+req.PieceOrder))
+		return
+	}
+	if _, err := parseJobPipeline(req.Post); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	download, err := d.Manager.add(req.Url, req.Dir, req.Name, func(added *Download) {
+		added.setLabels(req.Tags, req.Metadata)
+		added.group = strings.TrimSpace(req.Group)
+		added.tenant = tenantOf(r)
+		added.job = Job{Dir: req.Dir, Strategy: req.Strategy, PieceOrder: req.PieceOrder, PieceWindow: req.PieceWindow, Post: req.Post}
+		if req.Strategy != "" {
+			added.options = append(added.options, WithStrategy(req.Strategy))
+		}
+		if req.PieceOrder != "" {
+			added.options = append(added.options, WithPieceOrder(req.PieceOrder, req.PieceWindow))
+		}
+	})
+	if errors.Is(err, ErrDuplicate) {
+		if d.Manager.Config().Duplicates == DuplicateError {
+			writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "id": download.Id})
+			return
+		}
+		writeJSON(w, http.StatusOK, download)
+		return
+	}
+	if writeRefused(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Connections > 0 {
+		d.Manager.SetConnections(download.Id, req.Connections)
+	}
+	if req.RateLimit > 0 {
+		d.Manager.SetRateLimit(download.Id, req.RateLimit)
+	}
+	if req.Priority > 0 {
+		d.Manager.SetPriority(download.Id, req.Priority)
+	}
+	if req.MaxLifetime > 0 || req.NoProgress > 0 {
+		config := d.Manager.Config()
+		maxLifetime, noProgress := config.MaxLifetime, config.NoProgress
+		if req.MaxLifetime > 0 {
+			maxLifetime = req.MaxLifetime
+		}
+		if req.NoProgress > 0 {
+			noProgress = req.NoProgress
+		}
+		d.Manager.SetTimeouts(download.Id, time.Duration(maxLifetime)*time.Second, time.Duration(noProgress)*time.Second)
+	}
+	info, _ := d.Manager.Get(download.Id)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (d *Daemon) importJob(w http.ResponseWriter, r *http.Request) {
+	var job Job
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := d.Manager.checkDir(job.Dir); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, err := d.Manager.importJob(job, tenantOf(r), nil)
+	d.added(w, info, err)
+}
+
+func (d *Daemon) handoff(w http.ResponseWriter, r *http.Request, id int) {
+	var req struct {
+		To  string `json:"to"`
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.To == "" {
+		writeError(w, http.StatusBadRequest, errors.New("to is required"))
+		return
+	}
+	info, err := d.Manager.Handoff(r.Context(), id, req.To, req.Key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrHandoffFinished):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func (d *Daemon) receiveHandoff(w http.ResponseWriter, r *http.Request) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, err := d.Manager.receiveHandoff(form, tenantOf(r))
+	if errors.Is(err, ErrDuplicate) {
+		// The sender must not drop its download for one already here.
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "id": info.Id})
+		return
+	}
+	d.added(w, info, err)
+}
+
+// added answers a request that added a download from a job.
+func (d *Daemon) added(w http.ResponseWriter, info DownloadInfo, err error) {
+	switch {
+	case errors.Is(err, ErrDuplicate):
+		if d.Manager.Config().Duplicates == DuplicateError {
+			writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "id": info.Id})
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case writeRefused(w, err):
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusCreated, info)
+	}
+}
+
+func (d *Daemon) schedule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Url     string `json:"url"`
+		Name    string `json:"name"`
+		StartAt string `json:"start_at"`
+		Cron    string `json:"cron"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Url == "" || (req.StartAt == "") == (req.Cron == "") {
+		writeError(w, http.StatusBadRequest, errors.New("url and exactly one of start_at or cron are required"))
+		return
+	}
+
+	if req.Cron != "" {
+		s, err := d.Manager.ScheduleCron(req.Url, req.Name, req.Cron)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s)
+		return
+	}
+	at, err := ParseStartAt(req.StartAt, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, d.Manager.ScheduleAt(req.Url, req.Name, at))
+}
+
+func (d *Daemon) get(w http.ResponseWriter, r *http.Request, id int) {
+	info, err := d.Manager.Get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// content serves the part of the file downloaded so far, or with ?follow
+// streams it while the rest arrives.
+func (d *Daemon) content(w http.ResponseWriter, r *http.Request, id int) {
+	preview, err := d.Manager.Preview(id)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer preview.Close()
+	available, _ := preview.Available()
+	w.Header().Set("X-Cdm-Available", strconv.FormatInt(available, 10))
+	if total := preview.Total(); total >= 0 {
+		w.Header().Set("X-Cdm-Total", strconv.FormatInt(total, 10))
+	}
+	if r.URL.Query().Get("follow") == "" {
+		http.ServeContent(w, r, filepath.Base(preview.Name()), time.Time{}, io.NewSectionReader(preview, 0, available))
+		return
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(preview.Name())); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 256<<10)
+	var sent int64
+	for {
+		available, ended := preview.Available()
+		for sent < available {
+			n, err := preview.ReadAt(buf[:min(int64(len(buf)), available-sent)], sent)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return
+				}
+				sent += int64(n)
+			}
+			if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if ended {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(PreviewInterval):
+		}
+	}
+}
+
+func (d *Daemon) update(w http.ResponseWriter, r *http.Request, id int) {
+	info, err := d.Manager.Get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	var req = struct {
+		Connections int               `json:"connections"`
+		RateLimit   int64             `json:"rate_limit"`
+		Priority    int               `json:"priority"`
+		Tags        []string          `json:"tags"`
+		Metadata    map[string]string `json:"metadata"`
+	}{Connections: info.Connections, RateLimit: info.RateLimit, Priority: info.Priority}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := d.Manager.SetPriority(id, req.Priority); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.Manager.SetConnections(id, req.Connections)
+	d.Manager.SetRateLimit(id, req.RateLimit)
+	d.Manager.SetLabels(id, req.Tags, req.Metadata)
+	info, _ = d.Manager.Get(id)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (d *Daemon) control(w http.ResponseWriter, id int, action func(int) error) {
+	if err := action(id); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	info, _ := d.Manager.Get(id)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (d *Daemon) retry(w http.ResponseWriter, id int) {
+	err := d.Manager.Retry(id)
+	switch {
+	case errors.Is(err, ErrNotRetryable):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	info, _ := d.Manager.Get(id)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (d *Daemon) getConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Manager.Config().redacted())
+}
+
+func (d *Daemon) setConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	old := d.Manager.Config()
+	// The domain rules are decoded afresh, not into those in use, and kept
+	// when the patch has none.
+	config := old
+	config.Domains = nil
+	var patch struct {
+		Domains *[]DomainRule `json:"domains"`
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if json.Unmarshal(body, &patch); patch.Domains == nil {
+		config.Domains = old.Domains
+	}
+	config.unredact(old)
+	if addsCommand(old.Post, config.Post) {
+		writeError(w, http.StatusForbidden, ErrCommandStep)
+		return
+	}
+	if err := config.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.Manager.Configure(config)
+	writeJSON(w, http.StatusOK, d.Manager.Config().redacted())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,134 @@
+package downloader
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DropNewest = "newest"
+	DropOldest = "oldest"
+	DropNever  = "never"
+)
+
+// Delivery decides on which goroutine callbacks run. A nil Delivery, the
+// default, calls them synchronously on the downloader's goroutines. Progress
+// updates are dropped by the drop policy when the queue is full; other
+// events wait for room, until Close. DropOldest only drops queued progress
+// updates, so while an event is queued the newest update is dropped.
+type Delivery struct {
+	queue chan func()
+	drop  string
+
+	mu      sync.Mutex
+	closed  chan struct{}
+	once    sync.Once
+	dropped int64
+	events  int64
+}
+
+// DeliverAsync runs callbacks in order on a goroutine of its own, with up to
+// capacity of them waiting.
+func DeliverAsync(capacity int, drop string) (*Delivery, error) {
+	d, err := newDelivery(make(chan func(), max(capacity, 1)), drop)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case fn := <-d.queue:
+				fn()
+			case <-d.closed:
+				return
+			}
+		}
+	}()
+	return d, nil
+}
+
+// DeliverTo sends callbacks into ch, whose capacity bounds the queue, for
+// the caller to run on its own goroutine, for example the event loop of a
+// GUI toolkit:
+//
+//	for fn := range ch { fn() }
+func DeliverTo(ch chan func(), drop string) (*Delivery, error) {
+	if ch == nil {
+		return nil, errors.New("delivery channel is nil")
+	}
+	return newDelivery(ch, drop)
+}
+
+func newDelivery(ch chan func(), drop string) (*Delivery, error) {
+	switch drop {
+	case DropNewest, DropOldest, DropNever:
+	default:
+		return nil, errors.New("unknown drop policy " + drop)
+	}
+	return &Delivery{queue: ch, drop: drop, closed: make(chan struct{})}, nil
+}
+
+// WithDelivery delivers the OnProgress callbacks through d.
+func WithDelivery(d *Delivery) Option {
+	return func(f *File) error {
+		f.delivery = d
+		return nil
+	}
+}
+
+// Close stops the delivery: queued callbacks of DeliverAsync are discarded,
+// callbacks waiting for room return and later ones are dropped. It does not
+// close a channel passed to DeliverTo.
+func (d *Delivery) Close() {
+	d.once.Do(func() { close(d.closed) })
+}
+
+// Dropped is the number of callbacks dropped so far.
+func (d *Delivery) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+func (d *Delivery) deliver(fn func(), droppable bool) {
+	if d == nil {
+		fn()
+		return
+	}
+	select {
+	case <-d.closed:
+		atomic.AddInt64(&d.dropped, 1)
+		return
+	default:
+	}
+	if droppable && d.drop != DropNever {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for {
+			select {
+			case d.queue <- fn:
+				return
+			default:
+			}
+			if d.drop == DropNewest || atomic.LoadInt64(&d.events) > 0 {
+				atomic.AddInt64(&d.dropped, 1)
+				return
+			}
+			select {
+			case <-d.queue:
+				atomic.AddInt64(&d.dropped, 1)
+			default:
+			}
+		}
+	}
+	atomic.AddInt64(&d.events, 1)
+	event := func() {
+		atomic.AddInt64(&d.events, -1)
+		fn()
+	}
+	select {
+	case d.queue <- event:
+	case <-d.closed:
+		atomic.AddInt64(&d.events, -1)
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
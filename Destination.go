@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ExistsOverwrite = "overwrite"
+	ExistsSkip      = "skip"
+	ExistsRename    = "rename"
+	ExistsContinue  = "continue"
+)
+
+var (
+	ErrSkipped  = errors.New("destination already exists, skipped")
+	ErrUpToDate = errors.New("destination is up to date")
+)
+
+func OpenDestination(path, policy string) (*os.File, string, error) {
+	switch policy {
+	case "", ExistsOverwrite:
+		file, err := os.Create(path)
+		return file, path, err
+	case ExistsSkip:
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return nil, path, ErrSkipped
+		}
+		return file, path, err
+	case ExistsRename:
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		candidate := path
+		for i := 1; ; i++ {
+			file, err := os.OpenFile(candidate, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+			if !errors.Is(err, os.ErrExist) {
+				return file, candidate, err
+			}
+			candidate = fmt.Sprintf("%s.%d%s", base, i, ext)
+		}
+	case ExistsContinue:
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		return file, path, err
+	}
+	return nil, path, fmt.Errorf("unknown policy %q for existing files", policy)
+}
+
+func etagPath(path string) string {
+	return path + ".etag"
+}
+
+func LoadETag(path string) string {
+	state, _ := LoadResume(path)
+	return state.ETag
+}
@@ -0,0 +1,221 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// WithDiagnostics records every block request, the connection it used, its
+// time to first byte and how it ended, for Diagnostics.
+func WithDiagnostics() Option {
+	return func(f *File) error {
+		f.diagnostics = &requestLog{}
+		return nil
+	}
+}
+
+type requestRecord struct {
+	block     int
+	begin     int64
+	conn      string
+	start     time.Time
+	firstByte time.Duration
+	duration  time.Duration
+	bytes     int64
+	failed    bool
+}
+
+type requestLog struct {
+	mu       sync.Mutex
+	requests []*requestRecord
+}
+
+func (l *requestLog) begin(ctx context.Context, block int, begin int64) (context.Context, *requestRecord) {
+	if l == nil {
+		return ctx, nil
+	}
+	r := &requestRecord{block: block, begin: begin, start: time.Now()}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			l.mu.Lock()
+			r.conn = info.Conn.LocalAddr().String()
+			l.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			l.mu.Lock()
+			r.firstByte = time.Since(r.start)
+			l.mu.Unlock()
+		},
+	})
+	return ctx, r
+}
+
+func (l *requestLog) end(r *requestRecord, bytes int64, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.duration = time.Since(r.start)
+	r.bytes = bytes
+	r.failed = err != nil && !errors.Is(err, errRetired) && !errors.Is(err, context.Canceled)
+	l.requests = append(l.requests, r)
+}
+
+type ConnectionStats struct {
+	Connection string  `json:"connection"`
+	Requests   int     `json:"requests"`
+	Bytes      int64   `json:"bytes"`
+	Active     float64 `json:"active"`
+	Speed      int64   `json:"speed"`
+	FirstByte  float64 `json:"first_byte"`
+	Errors     int     `json:"errors"`
+}
+
+type BlockStats struct {
+	Block     int     `json:"block"`
+	Begin     int64   `json:"begin"`
+	Bytes     int64   `json:"bytes"`
+	FirstByte float64 `json:"first_byte"`
+	Retries   int     `json:"retries"`
+}
+
+type Diagnostics struct {
+	Bytes       int64             `json:"bytes"`
+	Elapsed     float64           `json:"elapsed"`
+	Speed       int64             `json:"speed"`
+	Retries     int64             `json:"retries"`
+	Connections []ConnectionStats `json:"connections"`
+	Blocks      []BlockStats      `json:"blocks"`
+	// SingleElapsed estimates the time one connection at the speed of the
+	// fastest one would have taken, and Speedup how much faster the download
+	// was. Connections sharing a saturated link each get a fraction of it, so
+	// both are upper bounds.
+	SingleElapsed float64 `json:"single_elapsed"`
+	Speedup       float64 `json:"speedup"`
+	// RateLimit is set when the rate limit held the download back.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+	// Tuning tells how the adaptive piece order cut the file.
+	Tuning *TuningStats `json:"tuning,omitempty"`
+}
+
+// Diagnostics reports how the connections of a download recorded with
+// WithDiagnostics performed.
+func (f *File) Diagnostics() Diagnostics {
+	s := f.Summary()
+	d := Diagnostics{Bytes: s.Bytes, Elapsed: s.Elapsed, Speed: s.AverageSpeed, Retries: s.Retries}
+	if tuning, ok := f.Tuning(); ok {
+		d.Tuning = &tuning
+	}
+	if f.diagnostics == nil {
+		return d
+	}
+	f.diagnostics.mu.Lock()
+	requests := append([]*requestRecord(nil), f.diagnostics.requests...)
+	f.diagnostics.mu.Unlock()
+
+	conns := map[string]*ConnectionStats{}
+	blocks := map[int]*BlockStats{}
+	var order []string
+	for i, r := range requests {
+		name := r.conn
+		if name == "" {
+			name = fmt.Sprintf("request %d", i+1)
+		}
+		c, ok := conns[name]
+		if !ok {
+			c = &ConnectionStats{Connection: name}
+			conns[name] = c
+			order = append(order, name)
+		}
+		c.Requests++
+		c.Bytes += r.bytes
+		c.Active += r.duration.Seconds()
+		c.FirstByte += r.firstByte.Seconds()
+		if r.failed {
+			c.Errors++
+		}
+
+		b, ok := blocks[r.block]
+		if !ok {
+			b = &BlockStats{Block: r.block, Begin: r.begin - f.offset, FirstByte: r.firstByte.Seconds()}
+			blocks[r.block] = b
+		}
+		b.Begin = min(b.Begin, r.begin-f.offset)
+		b.Bytes += r.bytes
+		if r.failed {
+			b.Retries++
+		}
+	}
+
+	var fastest int64
+	for _, name := range order {
+		c := conns[name]
+		c.FirstByte /= float64(c.Requests)
+		if c.Active > 0 {
+			c.Speed = int64(float64(c.Bytes) / c.Active)
+		}
+		fastest = max(fastest, c.Speed)
+		d.Connections = append(d.Connections, *c)
+	}
+	for _, b := range blocks {
+		d.Blocks = append(d.Blocks, *b)
+	}
+	sort.Slice(d.Blocks, func(i, j int) bool { return d.Blocks[i].Begin < d.Blocks[j].Begin })
+	if fastest > 0 && d.Elapsed > 0 {
+		d.SingleElapsed = float64(d.Bytes) / float64(fastest)
+		d.Speedup = d.SingleElapsed / d.Elapsed
+	}
+	if rate := f.limiter.Rate(); rate > 0 && d.Speed*10 >= rate*9 {
+		d.RateLimit = rate
+	}
+	return d
+}
+
+func (d Diagnostics) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	print := func(w io.Writer, format string, args ...interface{}) {
+		m, _ := fmt.Fprintf(w, format, args...)
+		n += int64(m)
+	}
+	seconds := func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+	}
+	print(tw, "\nConnections:\n")
+	print(tw, "connection\t requests\t bytes\t speed\t first byte\t errors\n")
+	for _, c := range d.Connections {
+		print(tw, "%s\t %d\t %s\t %s/s\t %s\t %d\n", c.Connection, c.Requests, FormatBytes(c.Bytes), FormatBytes(c.Speed), seconds(c.FirstByte), c.Errors)
+	}
+	print(tw, "\nBlocks:\n")
+	print(tw, "block\t begin\t bytes\t first byte\t retries\n")
+	for _, b := range d.Blocks {
+		print(tw, "%d\t %d\t %s\t %s\t %d\n", b.Block, b.Begin, FormatBytes(b.Bytes), seconds(b.FirstByte), b.Retries)
+	}
+	tw.Flush()
+
+	print(w, "%s in %s at %s/s over %d connections, %d retries\n", FormatBytes(d.Bytes), seconds(d.Elapsed), FormatBytes(d.Speed), len(d.Connections), d.Retries)
+	switch {
+	case d.Speedup == 0:
+	case len(d.Connections) < 2:
+		print(w, "one connection was used\n")
+	case d.RateLimit > 0:
+		print(w, "the rate limit of %s/s held the download back, so one connection would likely have done as well\n", FormatBytes(d.RateLimit))
+	case d.Speedup < 1.25:
+		print(w, "one connection at the speed of the fastest would have taken %s: parallel connections did not help, fewer will do\n", seconds(d.SingleElapsed))
+	default:
+		print(w, "one connection at the speed of the fastest would have taken %s: parallel connections were up to %.1fx faster\n", seconds(d.SingleElapsed), d.Speedup)
+	}
+	if t := d.Tuning; t != nil {
+		print(w, "adaptive pieces: %d from %s down to %s (smallest %s, floor %s), %d taken off running ones, %s tail; requests answered in %s, %s/s per connection\n",
+			t.Pieces, FormatBytes(t.FirstPiece), FormatBytes(t.LastPiece), FormatBytes(t.SmallestPiece), FormatBytes(t.MinPiece), t.Steals, seconds(t.Tail), seconds(t.Latency), FormatBytes(t.ConnectionSpeed))
+	}
+	return n, nil
+}
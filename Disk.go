@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DiskSchedulerOff = "off"
+	// DiskSchedulerHDD schedules the writes to disks the system reports as
+	// rotational, which only Linux tells.
+	DiskSchedulerHDD = "hdd"
+	DiskSchedulerAll = "all"
+)
+
+// DiskMaxWait is how long a write may be passed over for writes of higher
+// priority or further along the disk before it goes first.
+var DiskMaxWait = 500 * time.Millisecond
+
+func validDiskScheduler(mode string) error {
+	switch mode {
+	case DiskSchedulerOff, DiskSchedulerHDD, DiskSchedulerAll:
+		return nil
+	}
+	return fmt.Errorf("unknown disk scheduler %q", mode)
+}
+
+// DiskScheduler serializes the writes of all downloads to the same device
+// and orders them like an elevator: ascending through each file and from
+// one file to the next, so a spinning disk seeks forward instead of back
+// and forth between the connections. Writes of downloads with a higher
+// priority go first.
+type DiskScheduler struct {
+	mode   string
+	mu     sync.Mutex
+	queues map[string]*diskQueue
+}
+
+func NewDiskScheduler(mode string) (*DiskScheduler, error) {
+	if err := validDiskScheduler(mode); err != nil {
+		return nil, err
+	}
+	return &DiskScheduler{mode: mode, queues: map[string]*diskQueue{}}, nil
+}
+
+// WithDiskScheduler has the writes of the download to its output file go
+// through s.
+func WithDiskScheduler(s *DiskScheduler) Option {
+	return func(f *File) error {
+		if s != nil && s.mode != DiskSchedulerOff {
+			f.disks = s
+		}
+		return nil
+	}
+}
+
+// WithWritePriority gives the writes of the download priority under a
+// disk scheduler, higher going first. It is DefaultPriority otherwise.
+func WithWritePriority(priority int) Option {
+	return func(f *File) error {
+		f.SetWritePriority(priority)
+		return nil
+	}
+}
+
+func (f *File) SetWritePriority(priority int) {
+	atomic.StoreInt64(&f.writePriority, int64(priority))
+}
+
+// queue returns the queue of the device name is on, or nil when its
+// writes are not scheduled.
+func (s *DiskScheduler) queue(name string) *diskQueue {
+	device, rotational, err := diskDevice(name)
+	if err != nil {
+		slog.Debug("can not tell the disk of the output, not scheduling its writes", "path", name, "err", err)
+		return nil
+	}
+	if s.mode == DiskSchedulerHDD && !rotational {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[device]
+	if q == nil {
+		q = &diskQueue{}
+		s.queues[device] = q
+		slog.Debug("scheduling the writes to a disk", "device", device, "rotational", rotational)
+	}
+	return q
+}
+
+type diskWrite struct {
+	w        io.WriterAt
+	file     string
+	p        []byte
+	off      int64
+	priority int64
+	queued   time.Time
+	n        int
+	err      error
+	done     chan struct{}
+}
+
+type diskQueue struct {
+	mu      sync.Mutex
+	pending []*diskWrite
+	running bool
+	// file and pos are where the last write ended.
+	file string
+	pos  int64
+}
+
+// scheduledWriter writes to the output file of a download through the queue
+// of its disk.
+type scheduledWriter struct {
+	f     *File
+	queue *diskQueue
+	name  string
+}
+
+func (f *File) scheduledWriter(w io.WriterAt) io.WriterAt {
+	if f.disks == nil || f.Stream == nil || w != io.WriterAt(f.Stream) {
+		return w
+	}
+	f.diskOnce.Do(func() { f.diskQueue = f.disks.queue(f.Stream.Name()) })
+	if f.diskQueue == nil {
+		return w
+	}
+	return &scheduledWriter{f: f, queue: f.diskQueue, name: f.Stream.Name()}
+}
+
+func (s *scheduledWriter) WriteAt(p []byte, off int64) (int, error) {
+	w := &diskWrite{
+		w:        s.f.Stream,
+		file:     s.name,
+		p:        p,
+		off:      off,
+		priority: atomic.LoadInt64(&s.f.writePriority),
+		queued:   time.Now(),
+		done:     make(chan struct{}),
+	}
+	s.queue.submit(w)
+	<-w.done
+	return w.n, w.err
+}
+
+func (q *diskQueue) submit(w *diskWrite) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, w)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+// run writes until nothing is pending, one write at a time.
+func (q *diskQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		i := q.next()
+		w := q.pending[i]
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.mu.Unlock()
+
+		w.n, w.err = w.w.WriteAt(w.p, w.off)
+		q.mu.Lock()
+		q.file, q.pos = w.file, w.off+int64(w.n)
+		q.mu.Unlock()
+		close(w.done)
+	}
+}
+
+// next picks the pending write to do: the oldest one when it waited longer
+// than DiskMaxWait, otherwise of the highest priority the one next along
+// the disk from where the last write ended, starting over from the lowest
+// file and offset past the end. q.mu is held.
+func (q *diskQueue) next() int {
+	now := time.Now()
+	oldest := 0
+	for i, w := range q.pending {
+		if w.queued.Before(q.pending[oldest].queued) {
+			oldest = i
+		}
+	}
+	if now.Sub(q.pending[oldest].queued) > DiskMaxWait {
+		return oldest
+	}
+	var top int64
+	for _, w := range q.pending {
+		top = max(top, w.priority)
+	}
+	ahead, lowest := -1, -1
+	for i, w := range q.pending {
+		if w.priority != top {
+			continue
+		}
+		if lowest < 0 || diskBefore(w, q.pending[lowest]) {
+			lowest = i
+		}
+		if (w.file > q.file || w.file == q.file && w.off >= q.pos) && (ahead < 0 || diskBefore(w, q.pending[ahead])) {
+			ahead = i
+		}
+	}
+	if ahead >= 0 {
+		return ahead
+	}
+	return lowest
+}
+
+func diskBefore(a, b *diskWrite) bool {
+	return a.file < b.file || a.file == b.file && a.off < b.off
+}
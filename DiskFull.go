@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+const EventDiskFull = "disk_full"
+
+// outputError is a failed write of the output, pos being the first byte of
+// it not written.
+type outputError struct {
+	pos int64
+	err error
+}
+
+func (e *outputError) Error() string {
+	return "writing the output: " + e.err.Error()
+}
+
+func (e *outputError) Unwrap() error {
+	return e.err
+}
+
+func diskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// unwrite gives block id back the bytes from where a write of it failed, so
+// they are downloaded again, and returns err.
+func (f *File) unwrite(id int, err error, read *int64) error {
+	var w *outputError
+	if !errors.As(err, &w) {
+		return err
+	}
+	f.blockMu.Lock()
+	block := &f.BlockList[id]
+	lost := max(block.Begin-(w.pos+f.offset), 0)
+	block.Begin -= lost
+	f.blockMu.Unlock()
+	atomic.AddInt64(&f.status.Downloaded, -lost)
+	atomic.AddInt64(read, -lost)
+	return err
+}
+
+// pauseDiskFull stops every block when the disk is full, keeping what was
+// written, so the download can resume once there is space again.
+func (f *File) pauseDiskFull(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state != StateDownloading {
+		return
+	}
+	f.state = StatePausing
+	f.diskFull = err
+	f.cancel()
+}
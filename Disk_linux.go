@@ -0,0 +1,33 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// diskDevice returns the device the file name is on and whether it is a
+// rotational disk, as sysfs tells for the disk or the disk a partition is
+// on.
+func diskDevice(name string) (string, bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil {
+		return "", false, err
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	device := fmt.Sprintf("%d:%d", major, minor)
+	block, err := filepath.EvalSymlinks("/sys/dev/block/" + device)
+	if err != nil {
+		return device, false, nil
+	}
+	for _, dir := range []string{block, filepath.Dir(block)} {
+		if b, err := os.ReadFile(filepath.Join(dir, "queue", "rotational")); err == nil {
+			return device, strings.TrimSpace(string(b)) == "1", nil
+		}
+	}
+	return device, false, nil
+}
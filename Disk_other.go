@@ -0,0 +1,15 @@
+//go:build !linux
+
+package downloader
+
+import "path/filepath"
+
+// diskDevice tells the volume the file name is on, one for everything where
+// there are no volume names. Whether it is rotational is not known.
+func diskDevice(name string) (string, bool, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.VolumeName(abs), false, nil
+}
@@ -0,0 +1,204 @@
+package downloader
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// redactedSecret stands for a credential of a domain rule in what the API
+// returns; sent back, it keeps the credential as it is.
+const redactedSecret = "<redacted>"
+
+// DomainRule holds the settings of downloads added from a host, so that
+// they need not be given with each: a token always sent to an API, fewer
+// connections for a server that limits them. Domain is a glob pattern
+// matched against the host without the port, like files.example.com or
+// *.example.com.
+type DomainRule struct {
+	Domain  string            `json:"domain"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Token is sent as "Authorization: Bearer", User and Password with
+	// basic auth.
+	Token     string `json:"token,omitempty"`
+	User      string `json:"user,omitempty"`
+	Password  string `json:"password,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Connections and RateLimit replace those of the queue when set.
+	Connections int   `json:"connections,omitempty"`
+	RateLimit   int64 `json:"rate_limit,omitempty"`
+	// Dir is where downloads added without a directory go, before routes
+	// and data directories are considered.
+	Dir string `json:"dir,omitempty"`
+}
+
+// ParseDomainRule parses DOMAIN:KEY=VALUE,... with the keys connections,
+// rate, dir, user_agent, token, user (USER:PASSWORD) and header (NAME:
+// VALUE), like files.example.com:connections=2,token=abc. Values can not
+// hold commas; a configuration file takes any.
+func ParseDomainRule(s string) (DomainRule, error) {
+	domain, settings, ok := strings.Cut(s, ":")
+	if !ok {
+		return DomainRule{}, fmt.Errorf("invalid domain rule %q, expected domain:key=value,...", s)
+	}
+	r := DomainRule{Domain: strings.TrimSpace(domain)}
+	for _, field := range strings.Split(settings, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch key {
+		case "connections":
+			_, err = fmt.Sscan(value, &r.Connections)
+		case "rate":
+			r.RateLimit, err = ParseBytes(value)
+		case "dir":
+			r.Dir = value
+		case "user_agent":
+			r.UserAgent = value
+		case "token":
+			r.Token = value
+		case "user":
+			r.User, r.Password, _ = strings.Cut(value, ":")
+		case "header":
+			name, v, ok := strings.Cut(value, ":")
+			if !ok {
+				return DomainRule{}, fmt.Errorf("invalid header %q in domain rule, expected name:value", value)
+			}
+			if r.Headers == nil {
+				r.Headers = map[string]string{}
+			}
+			r.Headers[strings.TrimSpace(name)] = strings.TrimSpace(v)
+		default:
+			return DomainRule{}, fmt.Errorf("invalid domain rule %q, expected connections=, rate=, dir=, user_agent=, token=, user= or header=", s)
+		}
+		if err != nil {
+			return DomainRule{}, fmt.Errorf("invalid domain rule %q: %w", s, err)
+		}
+	}
+	return r, r.validate()
+}
+
+func (r DomainRule) validate() error {
+	if r.Domain == "" {
+		return errors.New("domain rule needs a domain")
+	}
+	if _, err := path.Match(r.Domain, ""); err != nil {
+		return fmt.Errorf("invalid domain pattern %q: %w", r.Domain, err)
+	}
+	if r.Connections < 0 || r.RateLimit < 0 {
+		return fmt.Errorf("domain %s: connections and rate_limit can not be negative", r.Domain)
+	}
+	if r.Token != "" && r.User != "" {
+		return fmt.Errorf("domain %s: give a token or a user, not both", r.Domain)
+	}
+	return nil
+}
+
+func (r DomainRule) matches(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(r.Domain), strings.ToLower(u.Hostname()))
+	return ok
+}
+
+// options returns the request settings of the rule.
+func (r DomainRule) options() []Option {
+	var opts []Option
+	for name, value := range r.Headers {
+		opts = append(opts, WithHeader(name, value))
+	}
+	switch {
+	case r.Token != "":
+		opts = append(opts, WithHeader("Authorization", "Bearer "+r.Token))
+	case r.User != "":
+		credentials := base64.StdEncoding.EncodeToString([]byte(r.User + ":" + r.Password))
+		opts = append(opts, WithHeader("Authorization", "Basic "+credentials))
+	}
+	if r.UserAgent != "" {
+		opts = append(opts, WithUserAgent(r.UserAgent))
+	}
+	return opts
+}
+
+// domainRule returns the first rule matching the host of rawUrl.
+func (c Config) domainRule(rawUrl string) (DomainRule, bool) {
+	for _, r := range c.Domains {
+		if r.matches(rawUrl) {
+			return r, true
+		}
+	}
+	return DomainRule{}, false
+}
+
+// limits returns the connections and rate limit of a download from rawUrl.
+func (c Config) limits(rawUrl string) (int, int64) {
+	connections, rateLimit := c.Connections, c.RateLimit
+	if r, ok := c.domainRule(rawUrl); ok {
+		if r.Connections > 0 {
+			connections = r.Connections
+		}
+		if r.RateLimit > 0 {
+			rateLimit = r.RateLimit
+		}
+	}
+	return connections, rateLimit
+}
+
+// redacted returns the configuration with the credentials of its domain
+// rules replaced, for showing it.
+func (c Config) redacted() Config {
+	domains := make([]DomainRule, len(c.Domains))
+	for i, r := range c.Domains {
+		if r.Token != "" {
+			r.Token = redactedSecret
+		}
+		if r.Password != "" {
+			r.Password = redactedSecret
+		}
+		headers := map[string]string{}
+		for name, value := range r.Headers {
+			if secretHeader(name) {
+				value = redactedSecret
+			}
+			headers[name] = value
+		}
+		if r.Headers != nil {
+			r.Headers = headers
+		}
+		domains[i] = r
+	}
+	if c.Domains != nil {
+		c.Domains = domains
+	}
+	return c
+}
+
+// unredact puts the credentials of old back into the rules of c that came
+// back redacted, matching the rules by domain.
+func (c *Config) unredact(old Config) {
+	for i := range c.Domains {
+		r := &c.Domains[i]
+		var was DomainRule
+		for _, o := range old.Domains {
+			if o.Domain == r.Domain {
+				was = o
+				break
+			}
+		}
+		if r.Token == redactedSecret {
+			r.Token = was.Token
+		}
+		if r.Password == redactedSecret {
+			r.Password = was.Password
+		}
+		for name, value := range r.Headers {
+			if value == redactedSecret {
+				r.Headers[name] = was.Headers[name]
+			}
+		}
+	}
+}
@@ -0,0 +1,1101 @@
+// Package downloader downloads files over several connections at once, one
+// range of the file each, and keeps a queue of downloads behind a REST API.
+// The cdm command in cmd/cdm is built on it.
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	MaxThread = 5
+	CacheSize = 1024
+)
+
+var (
+	ErrNoDestination  = errors.New("no destination file or writer")
+	ErrAlreadyStarted = errors.New("download already started")
+	ErrNotStarted     = errors.New("download not started")
+)
+
+const (
+	ErrDownload = iota
+	ErrBlock
+	ErrDiskFull
+)
+
+type Status struct {
+	// Downloaded is the bytes of the file in place, Session those received
+	// since the download was created, which data written again does not
+	// take back.
+	Downloaded int64
+	Session    int64
+	Speeds     int64
+	PeakSpeed  int64
+	Retries    int64
+}
+
+type Block struct {
+	Begin int64
+	End   int64
+
+	start      int64
+	busy       bool
+	mismatches int
+	since      time.Time
+	sinceBegin int64
+}
+
+func (b Block) done() bool {
+	return b.End != -1 && b.Begin > b.End
+}
+
+type File struct {
+	Url             string
+	Size            int64
+	ETag            string
+	ContentType     string
+	ContentEncoding string
+	LastModified    time.Time
+	Stream          *os.File
+
+	BlockList []Block
+
+	// The callbacks are set before Start. OnError is given ErrBlock for a
+	// range that is retried, ErrDiskFull when the disk is full and
+	// ErrDownload when the download failed.
+	OnStart  func()
+	OnPause  func()
+	OnResume func()
+	OnFinish func()
+	OnCancel func()
+	OnError  func(int, error)
+	// OnThrottle is called when requests are held back to the request
+	// quota the server advertises.
+	OnThrottle func(ServerLimit)
+	pauseState func(ResumeState) error
+
+	disks         *DiskScheduler
+	diskOnce      sync.Once
+	diskQueue     *diskQueue
+	writePriority int64
+
+	mu       sync.Mutex
+	state    string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	finished chan struct{}
+	err      error
+	diskFull error
+	status   Status
+
+	userAgents   []string
+	userAgent    uint32
+	referer      string
+	cookies      string
+	jar          http.CookieJar
+	headers      http.Header
+	localAddr    *net.TCPAddr
+	network      string
+	resolve      map[string]string
+	addresses    addressBook
+	sockets      SocketOptions
+	ipfs         *ipfsSource
+	ipfsGateways []string
+
+	mavenRepository string
+	pypiIndex       string
+	expected        []expectedSum
+	verifiers       []Verifier
+	googleAPIKey    string
+	faults          *faultInjector
+	shaper          *shaper
+	socketWarn      sync.Once
+	dnsServer       string
+	doh             string
+	client          *http.Client
+	ownClient       bool
+	transport       *http.Transport
+	pool            *ConnectionPool
+	prefetched      []byte
+
+	proxy            *url.URL
+	proxyAuth        string
+	proxyCredentials ntlmCredentials
+
+	ranged   bool
+	offset   int64
+	rangeEnd int64
+	ranges   []Block
+
+	resume      bool
+	resumeState *ResumeState
+	restored    []ResumeBlock
+	resumeETag  string
+	verifySeed  bool
+	skip        int64
+	tee         *tee
+
+	ifModifiedSince time.Time
+	ifNoneMatch     string
+
+	remoteTime    bool
+	xattrs        bool
+	xattrChecksum bool
+
+	maxRedirects   int
+	redirectScheme string
+	redirectAuth   bool
+	contentTypes   []string
+	rejectHTML     bool
+	minSize        int64
+	maxSize        int64
+
+	writer   io.WriterAt
+	relay    *Relay
+	finalUrl string
+	header   http.Header
+
+	refresh   func(ctx context.Context, expired string) (string, error)
+	refreshMu sync.Mutex
+	freshUrl  string
+	refreshes int
+
+	acceptEncoding string
+	decompress     bool
+	unpack         bool
+	payload        string
+	noRanges       bool
+	strategy       string
+	pieceOrder     string
+	pieceWindow    int64
+	tuning         adaptiveTuning
+	noBaseline     bool
+	splitLimit     int
+	split          SplitDecision
+	capabilities   Capabilities
+	cancelCleanup  string
+	blockPrivate   bool
+	allowedSchemes []string
+
+	stallTimeout time.Duration
+	speedLimit   int64
+	speedTime    time.Duration
+
+	writeBuffer   int
+	writeInterval time.Duration
+	mmap          bool
+	syncPolicy    string
+	syncInterval  time.Duration
+
+	memory          *MemoryBudget
+	serverChecksums bool
+	serverLimits    bool
+
+	onProgress       func(Progress)
+	delivery         *Delivery
+	diagnostics      *requestLog
+	progressInterval time.Duration
+	progressDelta    int64
+	progressMark     int64
+	progressKick     chan struct{}
+
+	blockMu      sync.Mutex
+	connections  int
+	minSplitSize int64
+	workers      int
+	runCtx       context.Context
+	group        *group
+	limiter      *TokenBucket
+	throttlers   []Throttler
+	retryPolicy  RetryPolicy
+	rampInterval time.Duration
+	nextSpawn    time.Time
+	throttle     int
+	throttledAt  time.Time
+	limitedAt    time.Time
+	serverLimit  *ServerLimit
+	limitWait    time.Time
+	limitSent    int64
+
+	prefixMu sync.Mutex
+	prefix   frontier
+
+	history     *SpeedHistory
+	peakWorkers int
+	runStart    time.Time
+	elapsed     time.Duration
+	active      int64
+	startedAt   time.Time
+	endedAt     time.Time
+
+	protocol Protocol
+	mirrors  *mirrors
+	tracer   Tracer
+	traceCtx context.Context
+
+	requestHooks      []func(*http.Request) error
+	transportWrappers []func(http.RoundTripper) http.RoundTripper
+}
+
+func New(url string, file *os.File, opts ...Option) (*File, error) {
+	f := &File{
+		Url:      url,
+		Stream:   file,
+		state:    StateIdle,
+		finished: make(chan struct{}),
+
+		progressInterval: ProgressInterval,
+		progressKick:     make(chan struct{}, 1),
+
+		stallTimeout:    StallTimeout,
+		maxRedirects:    MaxRedirects,
+		redirectScheme:  RedirectUpgrade,
+		writeBuffer:     WriteBufferSize,
+		writeInterval:   WriteBufferInterval,
+		syncPolicy:      SyncNever,
+		syncInterval:    SyncInterval,
+		strategy:        StrategyAuto,
+		cancelCleanup:   CleanupAll,
+		serverChecksums: true,
+		serverLimits:    true,
+		connections:     MaxThread,
+		minSplitSize:    MinSplitSize,
+		limiter:         NewTokenBucket(0),
+		retryPolicy:     DefaultRetryPolicy{},
+		history:         NewSpeedHistory(HistorySize),
+		writePriority:   DefaultPriority,
+	}
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.writer == nil && file != nil {
+		f.writer = file
+	}
+	if f.writer == nil {
+		return nil, ErrNoDestination
+	}
+	if f.client == nil {
+		f.client = f.newClient()
+		// A pooled transport is not the download's to close.
+		f.ownClient = f.transport != nil
+	} else if len(f.transportWrappers) > 0 {
+		client := *f.client
+		client.Transport = f.wrapTransport(client.Transport)
+		f.client = &client
+	}
+	if f.jar != nil {
+		client := *f.client
+		client.Jar = f.jar
+		f.client = &client
+	}
+
+	if err := f.resolveIPFS(); err != nil {
+		return nil, err
+	}
+	if err := f.resolveRegistry(); err != nil {
+		return nil, err
+	}
+	if err := f.resolveShareLink(); err != nil {
+		return nil, err
+	}
+	if err := f.checkSchemes(); err != nil {
+		return nil, err
+	}
+	var acceptRanges bool
+	protocol, err := lookupProtocol(f.Url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := f.startSpan(f.parentContext(), "probe", Attr("url.full", f.Url))
+	if _, native := protocol.(*httpProtocol); native {
+		acceptRanges, err = f.probeHTTP(ctx)
+	} else {
+		f.protocol = protocol
+		acceptRanges, err = f.probeProtocol(ctx)
+	}
+	span.SetAttributes(Attr("cdm.size", f.Size), Attr("cdm.accept_ranges", acceptRanges))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	f.probeCapabilities(acceptRanges)
+	if f.mirrors != nil {
+		if f.protocol != nil || !acceptRanges || f.noRanges || f.Size <= 0 {
+			slog.Warn("mirrors need a file of known size with range support, using only the first URL", "url", f.Url)
+			f.mirrors = nil
+		} else {
+			f.probeMirrors(f.parentContext())
+		}
+	}
+	if f.ranged {
+		if f.rangeEnd < 0 || (f.Size >= 0 && f.rangeEnd >= f.Size) {
+			f.rangeEnd = f.Size - 1
+		}
+		f.Size = -1
+		if f.rangeEnd >= 0 {
+			if f.rangeEnd < f.offset {
+				return nil, errors.New("requested range is outside the remote file")
+			}
+			f.Size = f.rangeEnd - f.offset + 1
+		}
+	}
+	if err := f.checkSize(f.Size, true); err != nil {
+		f.closeIdleConnections()
+		return nil, err
+	}
+	if f.resume {
+		if err := f.continueExisting(acceptRanges && !f.noRanges); err != nil {
+			return nil, err
+		}
+	}
+	f.decideSplit(ctx)
+	return f, nil
+}
+
+func (f *File) probeHTTP(ctx context.Context) (bool, error) {
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !f.ifModifiedSince.IsZero() {
+		request.Header.Set("If-Modified-Since", f.ifModifiedSince.UTC().Format(http.TimeFormat))
+	}
+	if f.ifNoneMatch != "" {
+		request.Header.Set("If-None-Match", f.ifNoneMatch)
+	}
+	resp, err := f.do(request)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	spanFromContext(ctx).SetAttributes(Attr("http.response.status_code", resp.StatusCode))
+	f.noteServerLimit(resp.Header, f.limitSent)
+	if resp.StatusCode == http.StatusNotModified {
+		return false, ErrUpToDate
+	}
+	if resp.StatusCode == http.StatusForbidden && f.refresh != nil {
+		resp.Body.Close()
+		refused := &HTTPError{Url: f.Url, StatusCode: resp.StatusCode, Status: resp.Status}
+		if err := f.refreshUrl(ctx, request.URL.String(), refused); !errors.Is(err, errRefreshed) {
+			f.closeIdleConnections()
+			return false, err
+		}
+		return f.probeHTTP(ctx)
+	}
+	if resp.StatusCode >= 400 {
+		f.closeIdleConnections()
+		return false, responseError(f.Url, resp)
+	}
+	if f.unpack && contentEncoding(resp) == "" {
+		f.payload = sniffPayload(resp)
+	}
+	if err := f.validateResponse(resp); err != nil {
+		f.closeIdleConnections()
+		return false, err
+	}
+	f.finalUrl = resp.Request.URL.String()
+	f.header = resp.Header
+	f.Size = resp.ContentLength
+	f.ETag = resp.Header.Get("ETag")
+	f.ContentType = resp.Header.Get("Content-Type")
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		f.LastModified = t
+	}
+	acceptRanges := resp.Header.Get("Accept-Ranges") == "bytes"
+	f.ContentEncoding = contentEncoding(resp)
+	if f.Size < 0 && f.ContentEncoding == "" && resp.Header.Get("Accept-Ranges") != "none" {
+		if size := f.probeSize(ctx); size >= 0 {
+			slog.Debug("size found with a range request", "url", f.Url, "size", size)
+			f.Size, acceptRanges = size, true
+		}
+	}
+	if f.Size < 0 && !acceptRanges && !f.ranged {
+		f.noRanges = true
+	}
+	if f.ContentEncoding != "" {
+		switch {
+		case f.decompress && !canDecode(f.ContentEncoding):
+			return false, fmt.Errorf("can not decompress content encoding %q", f.ContentEncoding)
+		case f.decompress && f.ranged:
+			return false, errors.New("can not decompress a byte range of the remote file")
+		case f.decompress:
+			f.Size = -1
+			f.noRanges = true
+		case !acceptRanges && !f.ranged:
+			f.noRanges = true
+		}
+	}
+	if f.payload != "" {
+		if f.ranged {
+			return false, errors.New("can not decompress a byte range of the remote file")
+		}
+		f.Size = -1
+		f.noRanges = true
+	}
+	f.prefetch(resp)
+	return acceptRanges, nil
+}
+
+func (f *File) continueExisting(acceptRanges bool) error {
+	store := f.store()
+	existing, err := store.Size()
+	if err != nil {
+		return err
+	}
+	switch {
+	case existing == 0:
+		return nil
+	case !acceptRanges:
+		slog.Warn("server does not support ranges, restarting download", "url", f.Url)
+	case f.resumeETag != "" && f.ETag != "" && f.resumeETag != f.ETag:
+		slog.Warn("remote file changed, restarting download", "url", f.Url, "old", f.resumeETag, "new", f.ETag)
+	case f.Size >= 0 && existing > f.Size:
+		slog.Warn("existing file is larger than the remote file, restarting download", "url", f.Url)
+	case f.resumeState != nil && len(f.resumeState.Blocks) > 0 && f.resumeState.Size != f.Size:
+		slog.Warn("remote file size changed, restarting download", "url", f.Url, "old", f.resumeState.Size, "new", f.Size)
+	case f.resumeState != nil && len(f.resumeState.Blocks) > 0 && f.Size > 0:
+		f.restoreBlocks()
+		return nil
+	default:
+		if err := f.verifyPrefix(existing); err != nil {
+			slog.Warn("existing data does not match the remote file, restarting download", "url", f.Url, "err", err)
+			break
+		}
+		f.skip = existing
+		f.status.Downloaded = existing
+		return nil
+	}
+	return store.Truncate(0)
+}
+
+func (f *File) State() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *File) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state != StateIdle {
+		return ErrAlreadyStarted
+	}
+	f.defaultCallbacks()
+
+	f.startedAt = time.Now()
+	f.BlockList = append(f.BlockList, f.plan()...)
+	f.startPrefix()
+	slog.Debug("download strategy", "url", f.Url, "strategy", f.Strategy(), "blocks", len(f.BlockList))
+	if f.tee != nil {
+		f.startTee()
+	}
+
+	f.run()
+	go f.OnStart()
+	return nil
+}
+
+func (f *File) plan() []Block {
+	if f.ranges != nil {
+		return append([]Block(nil), f.ranges...)
+	}
+	if f.Strategy() != StrategyParallel {
+		end := int64(-1)
+		if f.Size > 0 && !f.noRanges {
+			end = f.offset + f.Size - 1
+		}
+		return []Block{{Begin: f.offset + f.skip, End: end, start: f.offset + f.skip}}
+	}
+	if f.pieceOrder == PieceOrderWindow || f.pieceOrder == PieceOrderPipeline {
+		return f.planPieces()
+	}
+	if f.pieceOrder == PieceOrderAdaptive {
+		return []Block{{Begin: f.offset + f.skip, End: f.offset + f.Size - 1, start: f.offset + f.skip}}
+	}
+	var blocks []Block
+	n := f.splitCount()
+	blockSize := (f.Size - f.skip) / int64(n)
+	var begin = f.offset + f.skip
+	for i := 0; i < n; i++ {
+		var end = begin + blockSize - 1
+		if i == n-1 {
+			end = f.offset + f.Size - 1
+		}
+		blocks = append(blocks, Block{Begin: begin, End: end, start: begin})
+		begin = end + 1
+	}
+	return blocks
+}
+
+func (f *File) parentContext() context.Context {
+	if f.traceCtx != nil {
+		return f.traceCtx
+	}
+	return context.Background()
+}
+
+func (f *File) splitCount() int {
+	n := min(int64(f.allowed()), (f.Size-f.skip)/f.minSplitSize)
+	return int(max(n, 1))
+}
+
+func (f *File) run() {
+	traceCtx, span := f.startSpan(f.parentContext(), "download", Attr("url.full", f.Url), Attr("cdm.connections", f.connections))
+	ctx, cancel := context.WithCancel(context.WithoutCancel(traceCtx))
+	done := make(chan struct{})
+	f.state = StateDownloading
+	f.cancel = cancel
+	f.done = done
+	f.runStart = time.Now()
+	f.recountDownloaded()
+	reporting := f.reportProgress(ctx)
+
+	go func() {
+		err := f.download(ctx)
+		if err == nil && ctx.Err() == nil {
+			err = f.verifyObject()
+		}
+		if err == nil && ctx.Err() == nil {
+			err = f.verifyIPFS(ctx)
+		}
+		if err == nil && ctx.Err() == nil {
+			err = f.verifyExpected(ctx)
+		}
+		if err == nil && ctx.Err() == nil {
+			f.syncFinished()
+			_, metaSpan := f.startSpan(ctx, "metadata")
+			f.applyMetadata()
+			metaSpan.End()
+		}
+		cancel()
+		<-reporting
+
+		f.mu.Lock()
+		f.elapsed += time.Since(f.runStart)
+		var callback func()
+		if f.state != StatePausing {
+			f.closeIdleConnections()
+		}
+		switch {
+		case f.state == StatePausing && f.diskFull != nil:
+			f.state = StatePaused
+			full := f.diskFull
+			f.diskFull = nil
+			callback = func() {
+				f.OnPause()
+				f.OnError(ErrDiskFull, full)
+			}
+		case f.state == StatePausing:
+			f.state = StatePaused
+			callback = f.OnPause
+		case f.state == StateCanceled:
+			callback = f.OnCancel
+		case err != nil:
+			f.state = StateFailed
+			f.err = err
+			callback = func() { f.OnError(ErrDownload, err) }
+		default:
+			f.state = StateFinished
+			callback = f.OnFinish
+		}
+		span.SetAttributes(
+			Attr("cdm.state", f.state),
+			Attr("cdm.bytes", atomic.LoadInt64(&f.status.Downloaded)),
+			Attr("cdm.retries", atomic.LoadInt64(&f.status.Retries)),
+		)
+		endSpan(span, err)
+		if f.state != StatePaused {
+			f.endedAt = time.Now()
+			close(f.finished)
+		}
+		f.mu.Unlock()
+		if f.onProgress != nil {
+			p := f.Progress()
+			f.delivery.deliver(func() { f.onProgress(p) }, false)
+		}
+		close(done)
+		callback()
+	}()
+}
+
+func (f *File) download(ctx context.Context) error {
+	f.startGetSpeeds(ctx)
+	if f.mmap && f.Stream != nil && f.Size > 0 {
+		if mapping, err := mapFile(f.Stream, f.Size); err != nil {
+			slog.Warn("can not map the output file, writing it instead", "err", err)
+		} else {
+			writer := f.writer
+			f.writer = mapping
+			defer func() {
+				mapping.Close()
+				f.writer = writer
+			}()
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	g := &group{cancel: cancel}
+	f.blockMu.Lock()
+	for i := range f.BlockList {
+		f.BlockList[i].busy = false
+	}
+	f.runCtx = ctx
+	f.nextSpawn = time.Time{}
+	f.workers = 0
+	f.group = g
+	f.spawnWorkers()
+	f.blockMu.Unlock()
+	if f.syncPolicy == SyncPeriodic {
+		go f.syncPeriodically(ctx)
+	}
+	if f.mirrors != nil {
+		go f.recheckMirrors(ctx)
+	}
+	err := g.Wait()
+
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	f.runCtx = nil
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	for _, b := range f.BlockList {
+		if !b.done() {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if err := f.truncateStream(); err != nil {
+		return err
+	}
+	return f.checkSize(atomic.LoadInt64(&f.status.Downloaded), true)
+}
+
+// truncateStream cuts a finished stream of unknown length at its end, which
+// is only known at EOF: an attempt restarted from the beginning may end
+// before the bytes an earlier one wrote.
+func (f *File) truncateStream() error {
+	if f.Size >= 0 || f.Stream == nil || f.writer != io.WriterAt(f.Stream) {
+		return nil
+	}
+	if info, err := f.Stream.Stat(); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	return f.Stream.Truncate(atomic.LoadInt64(&f.status.Downloaded))
+}
+
+func (f *File) newRequest(ctx context.Context) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", f.requestUrl(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(f.userAgents); n > 0 {
+		i := atomic.AddUint32(&f.userAgent, 1) - 1
+		request.Header.Set("User-Agent", f.userAgents[int(i%uint32(n))])
+	}
+	if f.referer != "" {
+		request.Header.Set("Referer", f.referer)
+	}
+	if f.cookies != "" {
+		request.Header.Set("Cookie", f.cookies)
+	}
+	if f.acceptEncoding != "" {
+		request.Header.Set("Accept-Encoding", f.acceptEncoding)
+	} else {
+		request.Header.Set("Accept-Encoding", "identity")
+	}
+	for name, values := range f.headers {
+		request.Header[name] = values
+	}
+	return request, nil
+}
+
+func (f *File) downloadBlock(ctx context.Context, id int) (err error) {
+	if f.memory != nil {
+		reserved, err := f.memory.Acquire(ctx, f.bufferSize())
+		if err != nil {
+			return err
+		}
+		defer f.memory.Release(reserved)
+	}
+	f.blockMu.Lock()
+	block := f.BlockList[id]
+	f.blockMu.Unlock()
+	ctx, span := f.startSpan(ctx, "block",
+		Attr("cdm.block", id), Attr("cdm.range.begin", block.Begin), Attr("cdm.range.end", block.End))
+	blockCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var read int64
+	defer func() {
+		span.SetAttributes(Attr("cdm.bytes", atomic.LoadInt64(&read)))
+		if errors.Is(err, errRetired) || ctx.Err() != nil {
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	go f.watchBlock(blockCtx, cancel, &read)
+	err = f.fetchBlock(blockCtx, id, &read)
+	if err != nil && ctx.Err() == nil {
+		if cause := context.Cause(blockCtx); errors.Is(cause, ErrStalled) || errors.Is(cause, ErrTooSlow) {
+			return cause
+		}
+	}
+	return err
+}
+
+// restartBlock takes block id, the only block of a download that can not
+// resume, from the beginning of the file again: whatever was kept of an
+// earlier run is downloaded again too. f.blockMu is held.
+func (f *File) restartBlock(id int) {
+	atomic.AddInt64(&f.status.Downloaded, -f.BlockList[id].Begin)
+	f.BlockList[id].Begin, f.BlockList[id].start = 0, 0
+	f.skip, f.restored = 0, nil
+}
+
+func (f *File) fetchBlock(ctx context.Context, id int, read *int64) (err error) {
+	f.blockMu.Lock()
+	if f.noRanges && f.BlockList[id].Begin > 0 {
+		slog.Warn("server can not resume this stream, restarting from the beginning", "url", f.Url)
+		f.restartBlock(id)
+	}
+	begin := f.BlockList[id].Begin
+	end := f.BlockList[id].End
+	f.blockMu.Unlock()
+	if end != -1 && begin > end {
+		return nil
+	}
+	slog.Debug("block request", "block", id, "begin", begin, "end", end)
+	ctx, record := f.diagnostics.begin(ctx, id, begin)
+	if record != nil {
+		before := atomic.LoadInt64(read)
+		defer func() { f.diagnostics.end(record, atomic.LoadInt64(read)-before, err) }()
+	}
+	if body, ok := f.prefetchedBlock(begin, end); ok {
+		return f.readBlock(ctx, id, body, read)
+	}
+
+	if f.protocol != nil {
+		body, err := f.protocol.OpenRange(ctx, f.Url, begin, end)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return f.readBlock(ctx, id, body, read)
+	}
+
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return err
+	}
+	var mirror *Mirror
+	if f.mirrors != nil {
+		mirror = f.mirrors.pick()
+		if mirror.Url != f.Url {
+			request.URL, request.Host = mirror.url, mirror.url.Host
+		}
+		var slow context.CancelCauseFunc
+		ctx, slow = context.WithCancelCause(ctx)
+		defer slow(nil)
+		request = request.WithContext(ctx)
+		go f.watchMirror(ctx, slow, mirror, read)
+		start, before := time.Now(), atomic.LoadInt64(read)
+		defer func() {
+			result := err
+			switch cause := context.Cause(ctx); {
+			case errors.Is(cause, ErrSlowMirror):
+				result = cause
+				err = cause
+			case errors.Is(cause, ErrStalled), errors.Is(cause, ErrTooSlow):
+				result = cause
+			case ctx.Err() != nil, errors.Is(err, errRetired):
+				result = nil
+			}
+			f.mirrors.done(mirror, atomic.LoadInt64(read)-before, time.Since(start), result)
+		}()
+	}
+	f.setRange(request, begin, end)
+	if f.resume && f.ETag != "" && request.Header.Get("Range") != "" {
+		request.Header.Set("If-Range", f.ETag)
+	}
+
+	seq, err := f.paceRequest(ctx)
+	if err != nil {
+		return err
+	}
+	sent := time.Now()
+	resp, err := f.do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	spanFromContext(ctx).SetAttributes(Attr("http.response.status_code", resp.StatusCode))
+	f.noteServerLimit(resp.Header, seq)
+	secondary := mirror != nil && mirror.Url != f.Url
+	if resp.StatusCode >= 400 && secondary {
+		return &mirrorError{fmt.Sprintf("mirror %s: %s", mirror.url.Redacted(), resp.Status), resp.StatusCode < 500}
+	}
+	if resp.StatusCode >= 400 {
+		refused := &HTTPError{Url: f.Url, StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		if resp.StatusCode == http.StatusForbidden && f.refresh != nil {
+			return f.refreshUrl(ctx, request.URL.String(), refused)
+		}
+		return refused
+	}
+	if f.refresh != nil {
+		f.refreshed()
+	}
+	if f.pieceOrder == PieceOrderAdaptive {
+		f.startTransfer(id, time.Since(sent))
+		received, before := time.Now(), atomic.LoadInt64(read)
+		defer func() { f.endTransfer(atomic.LoadInt64(read)-before, time.Since(received)) }()
+	}
+	if request.Header.Get("Range") != "" && resp.StatusCode != http.StatusPartialContent {
+		if secondary {
+			return &mirrorError{fmt.Sprintf("mirror %s ignored the range request", mirror.url.Redacted()), true}
+		}
+		if resp.StatusCode != http.StatusOK || f.Strategy() != StrategySequential {
+			return ErrRangeIgnored
+		}
+		// A server that does not advertise ranges sent the whole file: it
+		// is taken from the beginning, as a stream would be.
+		slog.Warn("server ignored the range request, restarting from the beginning", "url", f.Url)
+		f.blockMu.Lock()
+		f.restartBlock(id)
+		f.blockMu.Unlock()
+		begin = 0
+	}
+	var body io.Reader = resp.Body
+	if f.decompress {
+		if body, err = decodeBody(resp); err != nil {
+			return err
+		}
+	}
+	if f.payload != "" {
+		payload, err := openPayload(ctx, f.payload, resp.Body)
+		if err != nil {
+			return err
+		}
+		defer payload.Close()
+		body = payload
+	}
+	sums := f.responseSums(resp)
+	if len(sums) == 0 {
+		return f.readBlock(ctx, id, body, read)
+	}
+	hashed := &countingReader{r: io.TeeReader(body, sumWriters(sums))}
+	before := atomic.LoadInt64(read)
+	if err := f.readBlock(ctx, id, hashed, read); err != nil {
+		return err
+	}
+	return f.checkBlock(id, begin, atomic.LoadInt64(read)-before, atomic.LoadInt64(&hashed.n), resp.ContentLength, sums)
+}
+
+func (f *File) readBlock(ctx context.Context, id int, body io.Reader, read *int64) (err error) {
+	if f.faults != nil {
+		f.blockMu.Lock()
+		begin := f.BlockList[id].Begin
+		f.blockMu.Unlock()
+		body = f.faults.reader(f, id, begin-f.offset, body)
+	}
+	var buf = make([]byte, CacheSize)
+	writer := f.newBlockWriter()
+	defer func() {
+		var w *outputError
+		if e := writer.Flush(); e != nil && !errors.As(err, &w) {
+			err = f.unwrite(id, e, read)
+		}
+	}()
+	for {
+		if f.relay != nil {
+			f.blockMu.Lock()
+			next := f.BlockList[id].Begin - f.offset
+			f.blockMu.Unlock()
+			if err := f.relay.wait(ctx, next+int64(len(buf))); err != nil {
+				return err
+			}
+		}
+		n, e := body.Read(buf)
+
+		f.blockMu.Lock()
+		block := &f.BlockList[id]
+		bufSize := int64(len(buf[:n]))
+		if block.End != -1 {
+			needSize := block.End + 1 - block.Begin
+			if bufSize >= needSize {
+				bufSize = needSize
+				n = int(needSize)
+				e = io.EOF
+			}
+		} else if e == io.EOF {
+			block.End = block.Begin + bufSize - 1
+		}
+		pos := block.Begin
+		block.Begin += bufSize
+		unfinished := block.End != -1 && block.Begin <= block.End
+		retire := f.workers > f.allowed()
+		f.blockMu.Unlock()
+
+		written := writer.WriteAt(buf[:n], pos-f.offset)
+		downloaded := atomic.AddInt64(&f.status.Downloaded, bufSize)
+		atomic.AddInt64(&f.status.Session, bufSize)
+		atomic.AddInt64(read, bufSize)
+		if written != nil {
+			return f.unwrite(id, written, read)
+		}
+		f.progressed(downloaded)
+		if err := f.checkSize(downloaded, false); err != nil {
+			return err
+		}
+
+		if e != nil {
+			if e == io.EOF {
+				if unfinished {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			}
+			return e
+		}
+		if retire {
+			return errRetired
+		}
+		if err := f.limiter.Wait(ctx, n); err != nil {
+			return err
+		}
+		for _, t := range f.throttlers {
+			if err := t.Wait(ctx, n); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *File) Pause() {
+	f.mu.Lock()
+	if f.state != StateDownloading {
+		f.mu.Unlock()
+		return
+	}
+	f.state = StatePausing
+	f.cancel()
+	done := f.done
+	f.mu.Unlock()
+
+	<-done
+}
+
+func (f *File) Resume() {
+	f.mu.Lock()
+	for f.state == StatePausing {
+		done := f.done
+		f.mu.Unlock()
+		<-done
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	if f.state != StatePaused {
+		return
+	}
+
+	f.run()
+	go f.OnResume()
+}
+
+func (f *File) Wait() error {
+	if f.State() == StateIdle {
+		return ErrNotStarted
+	}
+	<-f.finished
+	return f.err
+}
+
+func (f *File) Run(ctx context.Context) error {
+	f.mu.Lock()
+	if f.traceCtx == nil {
+		f.traceCtx = ctx
+	}
+	f.mu.Unlock()
+	if err := f.Start(); err != nil {
+		return err
+	}
+	select {
+	case <-f.finished:
+		return f.err
+	case <-ctx.Done():
+		f.Pause()
+		return ctx.Err()
+	}
+}
+
+func (f *File) defaultCallbacks() {
+	if f.OnStart == nil {
+		f.OnStart = func() {}
+	}
+	if f.OnPause == nil {
+		f.OnPause = func() {}
+	}
+	if f.OnResume == nil {
+		f.OnResume = func() {}
+	}
+	if f.OnFinish == nil {
+		f.OnFinish = func() {}
+	}
+	if f.OnCancel == nil {
+		f.OnCancel = func() {}
+	}
+	if f.OnError == nil {
+		f.OnError = func(int, error) {}
+	}
+}
+
+func (f *File) startGetSpeeds(ctx context.Context) {
+	go func() {
+		tick := time.NewTicker(time.Second * 1)
+		defer tick.Stop()
+		// Speeds are taken from the bytes received, which never go back
+		// like the bytes in place do when data is downloaded again.
+		var old = atomic.LoadInt64(&f.status.Session)
+		var last = time.Now()
+		// Intervals in which data arrived count as active time.
+		account := func(now time.Time, downloaded int64) {
+			if downloaded > old {
+				atomic.AddInt64(&f.active, int64(now.Sub(last)))
+			}
+			last = now
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				account(time.Now(), atomic.LoadInt64(&f.status.Session))
+				atomic.StoreInt64(&f.status.Speeds, 0)
+				return
+			case now := <-tick.C:
+				downloaded := atomic.LoadInt64(&f.status.Session)
+				account(now, downloaded)
+				atomic.StoreInt64(&f.status.Speeds, downloaded-old)
+				f.history.Add(downloaded - old)
+				if downloaded-old > atomic.LoadInt64(&f.status.PeakSpeed) {
+					atomic.StoreInt64(&f.status.PeakSpeed, downloaded-old)
+				}
+				old = downloaded
+			}
+		}
+	}()
+}
@@ -0,0 +1,367 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+// newDownload makes a download of url into a file of a temporary directory.
+func newDownload(t *testing.T, url string, opts ...Option) *File {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { out.Close() })
+	f, err := New(url, out, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func checkContent(t *testing.T, f *File, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(f.Stream.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(want))
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := downloadertest.RandomData(1<<20, 1)
+	for name, opts := range map[string][]downloadertest.Option{
+		"ranges":    nil,
+		"no ranges": {downloadertest.WithoutRanges()},
+		"no length": {downloadertest.WithoutRanges(), downloadertest.WithoutLength()},
+		"redirects": {downloadertest.WithRedirects(2)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			origin := downloadertest.NewOrigin(data, opts...)
+			defer origin.Close()
+			f := newDownload(t, origin.URL)
+			if err := f.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if state := f.State(); state != StateFinished {
+				t.Fatalf("state %s, want %s", state, StateFinished)
+			}
+			checkContent(t, f, data)
+		})
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	data := downloadertest.RandomData(1<<20, 2)
+	for _, test := range []struct {
+		name     string
+		opts     []downloadertest.Option
+		strategy string
+	}{
+		{"ranges", nil, StrategyParallel},
+		{"no ranges", []downloadertest.Option{downloadertest.WithoutRanges()}, StrategySequential},
+		{"no length", []downloadertest.Option{downloadertest.WithoutRanges(), downloadertest.WithoutLength()}, StrategyStreaming},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			origin := downloadertest.NewOrigin(data, append(test.opts, downloadertest.WithBandwidth(2<<20))...)
+			defer origin.Close()
+			f := newDownload(t, origin.URL)
+			if strategy := f.Strategy(); strategy != test.strategy {
+				t.Fatalf("strategy %s, want %s", strategy, test.strategy)
+			}
+			if err := f.Start(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the first bytes", func() bool { return f.Progress().Downloaded > 0 })
+			f.Pause()
+			before := map[string]bool{}
+			for _, r := range origin.Ranges() {
+				before[strings.SplitN(r, "-", 2)[0]] = true
+			}
+			if state := f.State(); state != StatePaused {
+				t.Fatalf("state %s after Pause, want %s", state, StatePaused)
+			}
+			paused := f.Progress().Downloaded
+			if paused >= int64(len(data)) {
+				t.Skip("the download finished before it could be paused")
+			}
+			time.Sleep(50 * time.Millisecond)
+			if downloaded := f.Progress().Downloaded; downloaded != paused {
+				t.Fatalf("downloaded %d bytes while paused", downloaded-paused)
+			}
+			f.Resume()
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			checkContent(t, f, data)
+			if test.strategy != StrategyParallel {
+				return
+			}
+			var resumed bool
+			for _, r := range origin.Ranges() {
+				if r != "" && !before[strings.SplitN(r, "-", 2)[0]] {
+					resumed = true
+				}
+			}
+			if !resumed {
+				t.Fatalf("no range was continued where it stopped: %q", origin.Ranges())
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	data := downloadertest.RandomData(4<<20, 3)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithBandwidth(256<<10))
+	defer origin.Close()
+	f := newDownload(t, origin.URL)
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first bytes", func() bool { return f.Progress().Downloaded > 0 })
+	if err := f.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Wait(); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("Wait returned %v, want %v", err, ErrCanceled)
+	}
+	if state := f.State(); state != StateCanceled {
+		t.Fatalf("state %s, want %s", state, StateCanceled)
+	}
+	if _, err := os.Stat(f.Stream.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the output file is still there: %v", err)
+	}
+	f.Resume()
+	if state := f.State(); state != StateCanceled {
+		t.Fatalf("state %s after Resume, want %s", state, StateCanceled)
+	}
+}
+
+type noRetry struct{}
+
+func (noRetry) Retry(error, int) (time.Duration, bool) { return 0, false }
+
+func TestFirstError(t *testing.T) {
+	data := downloadertest.RandomData(4<<20, 4)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithBandwidth(256<<10))
+	defer origin.Close()
+	refused := errors.New("refused")
+	f := newDownload(t, origin.URL, WithConnections(4), WithRetryPolicy(noRetry{}), WithRequestHook(func(r *http.Request) error {
+		if r.Header.Get("Range") != "" && !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			return refused
+		}
+		return nil
+	}))
+	start := time.Now()
+	err := f.Run(context.Background())
+	if !errors.Is(err, refused) {
+		t.Fatalf("Run returned %v, want %v", err, refused)
+	}
+	if state := f.State(); state != StateFailed {
+		t.Fatalf("state %s, want %s", state, StateFailed)
+	}
+	// The other connections stop with it instead of finishing the 16
+	// seconds their ranges take.
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the download failed after %s", elapsed)
+	}
+}
+
+type panicking struct{}
+
+func (panicking) Wait(context.Context, int) error { panic("throttler bug") }
+
+func TestWorkerPanic(t *testing.T) {
+	origin := downloadertest.NewOrigin(downloadertest.RandomData(1<<20, 5))
+	defer origin.Close()
+	f := newDownload(t, origin.URL, WithThrottler(panicking{}))
+	err := f.Run(context.Background())
+	if !errors.Is(err, errPanic) || !strings.Contains(err.Error(), "throttler bug") {
+		t.Fatalf("Run returned %v, want the panic", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = time.Millisecond
+	data := downloadertest.RandomData(1<<20, 6)
+	// The probe is the first request, so every block request fails once.
+	origin := downloadertest.NewOrigin(data, downloadertest.WithFailEvery(2, http.StatusServiceUnavailable))
+	defer origin.Close()
+	f := newDownload(t, origin.URL, WithConnections(1))
+	if err := f.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, f, data)
+	if retries := atomic.LoadInt64(&f.status.Retries); retries != 1 {
+		t.Fatalf("%d retries, want 1", retries)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	defer func(delay time.Duration, attempts int) { RetryDelay, MaxAttempts = delay, attempts }(RetryDelay, MaxAttempts)
+	RetryDelay, MaxAttempts = time.Millisecond, 3
+	origin := downloadertest.NewOrigin(downloadertest.RandomData(1<<20, 7))
+	defer origin.Close()
+	// The probe gets through, every range request fails.
+	var refused int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt64(&refused, 1)
+			http.Error(w, "upstream is down", http.StatusBadGateway)
+			return
+		}
+		origin.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	f := newDownload(t, server.URL+"/file", WithConnections(1))
+	err := f.Run(context.Background())
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Run returned %v, want the last 502", err)
+	}
+	if n := atomic.LoadInt64(&refused); n != int64(MaxAttempts) {
+		t.Fatalf("%d range requests, want %d", n, MaxAttempts)
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	defer func(delay, maxDelay time.Duration, attempts int) {
+		RetryDelay, MaxRetryDelay, MaxAttempts = delay, maxDelay, attempts
+	}(RetryDelay, MaxRetryDelay, MaxAttempts)
+	RetryDelay, MaxRetryDelay, MaxAttempts = 100*time.Millisecond, time.Second, 10
+
+	var policy DefaultRetryPolicy
+	for _, test := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{4, 400 * time.Millisecond, 800 * time.Millisecond},
+		{9, 500 * time.Millisecond, time.Second},
+	} {
+		delay, retry := policy.Retry(ErrStalled, test.attempt)
+		if !retry || delay < test.min || delay > test.max {
+			t.Errorf("attempt %d: retry %v after %s, want between %s and %s", test.attempt, retry, delay, test.min, test.max)
+		}
+	}
+	if _, retry := policy.Retry(ErrStalled, MaxAttempts); retry {
+		t.Errorf("retried after %d attempts", MaxAttempts)
+	}
+	for _, err := range []error{
+		&HTTPError{StatusCode: http.StatusNotFound},
+		ErrRangeIgnored,
+		ErrChecksumMismatch,
+		&outputError{0, os.ErrPermission},
+	} {
+		if _, retry := policy.Retry(err, 1); retry {
+			t.Errorf("retried %v", err)
+		}
+	}
+	for _, test := range []struct {
+		err  *HTTPError
+		want time.Duration
+	}{
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 5 * time.Second}, 5 * time.Second},
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Hour}, MaxRetryAfter},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests}, time.Second},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}, 3 * time.Second},
+	} {
+		if delay, retry := policy.Retry(test.err, 1); !retry || delay != test.want {
+			t.Errorf("%d with Retry-After %s: retry %v after %s, want after %s", test.err.StatusCode, test.err.RetryAfter, retry, delay, test.want)
+		}
+	}
+}
+
+func TestRangeIgnored(t *testing.T) {
+	data := downloadertest.RandomData(1<<20, 8)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	// The server advertises ranges, but answers them with the whole file.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Range")
+		origin.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, data[:300000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	f, err := New(server.URL+"/file", out, WithContinue(""), WithStrategy(StrategySequential))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, f, data)
+	// The part kept from before is downloaded again, and the resume state
+	// counts the block from the beginning.
+	blocks := f.ResumeState().Blocks
+	if len(blocks) != 1 || blocks[0].Begin != 0 || blocks[0].Written != int64(len(data)) {
+		t.Fatalf("resume state %+v after the restart", blocks)
+	}
+	if downloaded := f.Progress().Downloaded; downloaded != int64(len(data)) {
+		t.Fatalf("%d bytes downloaded, want %d", downloaded, len(data))
+	}
+}
+
+func TestStreamRestart(t *testing.T) {
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = time.Millisecond
+	data := downloadertest.RandomData(1<<20, 9)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithoutRanges(), downloadertest.WithoutLength())
+	defer origin.Close()
+	f := newDownload(t, origin.URL, WithFaults(Fault{Kind: FaultOffset, Offset: 300000, Times: 1}))
+	if strategy := f.Strategy(); strategy != StrategyStreaming {
+		t.Fatalf("strategy %s, want %s", strategy, StrategyStreaming)
+	}
+	if err := f.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, f, data)
+	if retries := atomic.LoadInt64(&f.status.Retries); retries != 1 {
+		t.Fatalf("%d retries, want 1", retries)
+	}
+	// The stream started over, so the bytes of the first try are not
+	// counted twice.
+	blocks := f.ResumeState().Blocks
+	if len(blocks) != 1 || blocks[0].Begin != 0 || blocks[0].Written != int64(len(data)) {
+		t.Fatalf("resume state %+v after the restart", blocks)
+	}
+	if downloaded := f.Progress().Downloaded; downloaded != int64(len(data)) {
+		t.Fatalf("%d bytes downloaded, want %d", downloaded, len(data))
+	}
+}
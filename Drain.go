@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+var ErrDraining = errors.New("the daemon is draining and takes no new downloads")
+
+// DrainReport tells what Drain did: the downloads that ended while it
+// waited for them, and those it paused.
+type DrainReport struct {
+	Waited time.Duration  `json:"waited"`
+	Ended  []DownloadInfo `json:"ended"`
+	Paused []DownloadInfo `json:"paused"`
+}
+
+// Drain stops the queue from taking downloads and from starting queued
+// ones, then waits for the running downloads to end until ctx ends, and
+// pauses those still running, keeping their data to be resumed. It returns
+// at once when ctx has already ended. Undrain lets the queue go on.
+func (m *Manager) Drain(ctx context.Context) DrainReport {
+	start := time.Now()
+	m.mu.Lock()
+	m.draining = true
+	var running []*Download
+	for _, d := range m.downloads {
+		if d.state == StateDownloading || d.state == StatePausing {
+			running = append(running, d)
+		}
+	}
+	m.mu.Unlock()
+
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for ctx.Err() == nil && m.anyRunning(running) {
+		select {
+		case <-ctx.Done():
+		case <-tick.C:
+		}
+	}
+
+	report := DrainReport{Ended: []DownloadInfo{}, Paused: []DownloadInfo{}}
+	for _, d := range running {
+		m.mu.Lock()
+		state := d.state
+		m.mu.Unlock()
+		if state == StateDownloading || state == StatePausing {
+			m.Pause(d.Id)
+			m.mu.Lock()
+			d.drained = true
+			report.Paused = append(report.Paused, d.info())
+			m.mu.Unlock()
+			continue
+		}
+		m.mu.Lock()
+		report.Ended = append(report.Ended, d.info())
+		m.mu.Unlock()
+	}
+	report.Waited = time.Since(start)
+	return report
+}
+
+func (m *Manager) anyRunning(downloads []*Download) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range downloads {
+		if d.state == StateDownloading || d.state == StatePausing {
+			return true
+		}
+	}
+	return false
+}
+
+// Undrain takes downloads again, and resumes those Drain paused.
+func (m *Manager) Undrain() {
+	m.mu.Lock()
+	m.draining = false
+	var paused []int
+	for _, d := range m.downloads {
+		if d.drained {
+			d.drained = false
+			paused = append(paused, d.Id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range paused {
+		m.Resume(id)
+	}
+	m.schedule()
+}
+
+func (m *Manager) Draining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining || m.stopped
+}
+
+// ready answers /readyz: 200 while the daemon takes downloads, 503 while it
+// drains or stops, or when its download directory, or one of its data
+// directories when it has them, is gone.
+func (d *Daemon) ready(w http.ResponseWriter) {
+	if d.Manager.Draining() {
+		writeError(w, http.StatusServiceUnavailable, ErrDraining)
+		return
+	}
+	dirs := d.Manager.DataDirs()
+	if len(dirs) == 0 {
+		dirs = []string{d.Manager.Dir}
+	}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			writeError(w, http.StatusServiceUnavailable, errors.New("the download directory "+dir+" is not available"))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// drain answers POST /drain, waiting up to the timeout of the query, 30s
+// by default, before it pauses the downloads still running. With exit=true
+// the daemon then stops.
+func (d *Daemon) drain(w http.ResponseWriter, r *http.Request) {
+	timeout := 30 * time.Second
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid timeout "+s))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	writeJSON(w, http.StatusOK, d.Manager.Drain(ctx))
+	if r.URL.Query().Get("exit") == "true" && d.Exit != nil {
+		d.Exit()
+	}
+}
+
+// writeRefused answers a request to add downloads the queue refused for
+// now, and tells whether it was.
+func writeRefused(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrDraining):
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, ErrTenantQueueFull):
+		writeError(w, http.StatusTooManyRequests, err)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func contentEncoding(resp *http.Response) string {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+func canDecode(enc string) bool {
+	switch enc {
+	case "", "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch enc := contentEncoding(resp); enc {
+	case "":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return zlib.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("can not decompress content encoding %q", enc)
+	}
+}
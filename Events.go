@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	EventAdded    = "added"
+	EventQueued   = "queued"
+	EventStarted  = "started"
+	EventPaused   = "paused"
+	EventResumed  = "resumed"
+	EventCanceled = "canceled"
+	EventDeferred = "deferred"
+	EventRemoved  = "removed"
+	EventProgress = "progress"
+)
+
+var EventBuffer = 256
+
+type StreamEvent struct {
+	Type string `json:"type"`
+	DownloadInfo
+}
+
+func (m *Manager) Subscribe() (<-chan StreamEvent, func()) {
+	ch := make(chan StreamEvent, EventBuffer)
+	m.subMu.Lock()
+	if m.subscribers == nil {
+		m.subscribers = map[chan StreamEvent]bool{}
+	}
+	m.subscribers[ch] = true
+	m.subMu.Unlock()
+	return ch, func() {
+		m.subMu.Lock()
+		delete(m.subscribers, ch)
+		m.subMu.Unlock()
+	}
+}
+
+func (m *Manager) publish(d *Download, typ string) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if len(m.subscribers) == 0 {
+		return
+	}
+	m.mu.Lock()
+	e := StreamEvent{Type: typ, DownloadInfo: d.info()}
+	m.mu.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (d *Daemon) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	interval := time.Second
+	if s := r.URL.Query().Get("interval"); s != "" {
+		var err error
+		if interval, err = time.ParseDuration(s); err != nil || interval < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid interval %q", s))
+			return
+		}
+	}
+	events, unsubscribe := d.Manager.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-d.closing:
+			return
+		case e := <-events:
+			writeEvent(w, e)
+		case <-tick:
+			for _, info := range d.Manager.Find(Filter{State: StateDownloading}) {
+				writeEvent(w, StreamEvent{Type: EventProgress, DownloadInfo: info})
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e StreamEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+}
+
+func (c *ControlClient) Events(out io.Writer) error {
+	return c.stream(context.Background(), "/events", func(data string) {
+		fmt.Fprintln(out, data)
+	})
+}
+
+// Follow calls fn with the events of the daemon, and with the progress of
+// the running downloads every interval, until ctx ends or the daemon closes
+// the stream.
+func (c *ControlClient) Follow(ctx context.Context, interval time.Duration, fn func(StreamEvent)) error {
+	return c.stream(ctx, "/events?interval="+interval.String(), func(data string) {
+		var e StreamEvent
+		if json.Unmarshal([]byte(data), &e) == nil {
+			fn(e)
+		}
+	})
+}
+
+func (c *ControlClient) stream(ctx context.Context, path string, fn func(data string)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://cdm"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return &HTTPError{Url: path, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			fn(data)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ExitOK = iota
+	ExitFailure
+	ExitUsage
+	ExitNetwork
+	ExitHTTPClient
+	ExitHTTPServer
+	ExitChecksum
+	ExitDiskFull
+	ExitCanceled
+	ExitPartial
+)
+
+var (
+	ErrCanceled         = errors.New("download canceled")
+	ErrPartial          = errors.New("download incomplete")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrRangeIgnored     = errors.New("server ignored the range request")
+)
+
+// An HTTPError is one of these, for errors.Is, by its status code.
+var (
+	ErrRemoteNotFound     = errors.New("remote file not found")
+	ErrRemoteUnauthorized = errors.New("remote server wants credentials")
+	ErrRemoteForbidden    = errors.New("remote server refused access")
+	ErrServerError        = errors.New("remote server error")
+)
+
+// SnippetSize is how much of the body of an error response an HTTPError
+// shows.
+var SnippetSize = 200
+
+type HTTPError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+	// Snippet is the start of the body of the response, as text.
+	Snippet string
+}
+
+func (e *HTTPError) Error() string {
+	status := e.Status
+	if status == "" {
+		status = strconv.Itoa(e.StatusCode)
+	}
+	if e.Snippet != "" {
+		return e.Url + ": " + status + ": " + e.Snippet
+	}
+	return e.Url + ": " + status
+}
+
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrRemoteNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrRemoteUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusProxyAuthRequired
+	case ErrRemoteForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrServerError:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// responseError returns the HTTPError of an error response, with the start
+// of its body, markup taken out, so a message from the server shows up.
+func responseError(url string, resp *http.Response) *HTTPError {
+	e := &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if !utf8.Valid(body) {
+		return e
+	}
+	text := string(body)
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") || strings.HasPrefix(strings.TrimSpace(text), "<") {
+		text = stripMarkup(text)
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > SnippetSize {
+		cut := SnippetSize
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "..."
+	}
+	e.Snippet = text
+	return e
+}
+
+// stripMarkup drops the tags of an HTML page, and its head, scripts and
+// styles, keeping the text.
+func stripMarkup(s string) string {
+	var b strings.Builder
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		b.WriteByte(' ')
+		s = s[i:]
+		for _, skip := range []string{"head", "script", "style"} {
+			if len(s) > len(skip)+1 && strings.EqualFold(s[1:1+len(skip)], skip) && strings.IndexByte("> \t\n", s[1+len(skip)]) >= 0 {
+				if end := strings.Index(strings.ToLower(s), "</"+skip+">"); end >= 0 {
+					s = s[end:]
+				}
+				break
+			}
+		}
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			break
+		}
+		s = s[end+1:]
+	}
+	return strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'", "&nbsp;", " ").Replace(b.String())
+}
+
+func ExitCode(err error) int {
+	if err == nil || errors.Is(err, ErrUpToDate) {
+		return ExitOK
+	}
+	var httpErr *HTTPError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCanceled):
+		return ExitCanceled
+	case errors.Is(err, ErrPartial):
+		return ExitPartial
+	case errors.Is(err, ErrChecksumMismatch):
+		return ExitChecksum
+	case errors.Is(err, syscall.ENOSPC):
+		return ExitDiskFull
+	case errors.Is(err, ErrRedirect):
+		return ExitHTTPClient
+	case errors.Is(err, ErrBlockedAddress), errors.Is(err, ErrSchemeRefused):
+		return ExitFailure
+	case errors.As(err, &httpErr):
+		if httpErr.StatusCode >= 500 {
+			return ExitHTTPServer
+		}
+		return ExitHTTPClient
+	case errors.As(err, &netErr):
+		return ExitNetwork
+	}
+	return ExitFailure
+}
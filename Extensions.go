@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// The interfaces in this file let code embedding the downloader replace one
+// behavior of the engine while keeping the rest. They are a stable API:
+// methods are not added to them or changed, new behaviors get new
+// interfaces.
+
+// RetryPolicy decides what happens after a range failed: whether the
+// connection tries again and how long it waits first. attempt counts the
+// failures of the connection in a row, from 1.
+type RetryPolicy interface {
+	Retry(err error, attempt int) (delay time.Duration, retry bool)
+}
+
+// FileNamer picks the file name of a download queued without one, before
+// the path template, routes and the download directory place it.
+type FileNamer interface {
+	FileName(url string) string
+}
+
+// Verifier checks a finished file, of size bytes, before the download is
+// reported finished. An error fails the download.
+type Verifier interface {
+	Verify(ctx context.Context, file io.ReaderAt, size int64) error
+}
+
+// Throttler paces the bytes a download reads, n at a time, by blocking
+// until they may be read or ctx ends.
+type Throttler interface {
+	Wait(ctx context.Context, n int) error
+}
+
+// DefaultRetryPolicy is the RetryPolicy of downloads without another. It
+// gives up on errors that will not go away, such as 4xx statuses other than
+// 408 and 429, checksum mismatches, failed writes or refused redirects, and
+// after MaxAttempts failures in a row. It retries the rest after an
+// exponential, jittered backoff from RetryDelay, or after the Retry-After of
+// a 429 or 503 when that is longer (a second at least after a 429), at most
+// MaxRetryAfter.
+type DefaultRetryPolicy struct{}
+
+func (DefaultRetryPolicy) Retry(err error, attempt int) (time.Duration, bool) {
+	if fatal(err) || (MaxAttempts > 0 && attempt >= MaxAttempts) {
+		return 0, false
+	}
+	delay := retryDelay(attempt)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests:
+			delay = max(delay, min(max(httpErr.RetryAfter, time.Second), MaxRetryAfter))
+		case http.StatusServiceUnavailable:
+			delay = max(delay, min(httpErr.RetryAfter, MaxRetryAfter))
+		}
+	}
+	return delay, true
+}
+
+// DefaultFileNamer names files after the last element of the URL path,
+// without its query, made safe for the file system.
+type DefaultFileNamer struct{}
+
+func (DefaultFileNamer) FileName(url string) string {
+	return urlFilename(url)
+}
+
+func fileName(namer FileNamer, url string) string {
+	if namer == nil {
+		namer = DefaultFileNamer{}
+	}
+	return namer.FileName(url)
+}
+
+// NewChecksumVerifier returns a Verifier comparing the digest of a file
+// with value, in hex, under a registered checksum algorithm.
+func NewChecksumVerifier(algorithm, value string) (Verifier, error) {
+	sum, err := newExpectedSum(algorithm, value)
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+func (e expectedSum) Verify(ctx context.Context, file io.ReaderAt, size int64) error {
+	h := e.newHash()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, e.want) {
+		return fmt.Errorf("%w: %s is %x, want %x", ErrChecksumMismatch, e.name, got, e.want)
+	}
+	return nil
+}
+
+// The TokenBucket of NewTokenBucket is the default Throttler.
+var _ Throttler = (*TokenBucket)(nil)
+
+// WithRetryPolicy replaces DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(f *File) error {
+		if policy == nil {
+			return errors.New("nil retry policy")
+		}
+		f.retryPolicy = policy
+		return nil
+	}
+}
+
+// WithVerifier checks the finished file with v too, after the checksums.
+// Like them it needs the file written to disk as it is downloaded.
+func WithVerifier(v Verifier) Option {
+	return func(f *File) error {
+		if v == nil {
+			return errors.New("nil verifier")
+		}
+		f.verifiers = append(f.verifiers, v)
+		return nil
+	}
+}
+
+// WithThrottler paces the download with t as well as with its own rate
+// limit, for example a TokenBucket shared by several downloads.
+func WithThrottler(t Throttler) Option {
+	return func(f *File) error {
+		if t == nil {
+			return errors.New("nil throttler")
+		}
+		f.throttlers = append(f.throttlers, t)
+		return nil
+	}
+}
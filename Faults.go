@@ -0,0 +1,164 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+const (
+	FaultOffset = "offset"
+	FaultBlock  = "block"
+	FaultTime   = "time"
+)
+
+// Fault is a failure WithFaults simulates, so tests can check how retries,
+// repair and resuming cope with it, deterministically.
+type Fault struct {
+	Kind string
+	// Offset is the byte of the output a FaultOffset response fails at, or
+	// with Corrupt arrives flipped.
+	Offset  int64
+	Corrupt bool
+	// Block is the index of the block whose responses FaultBlock fails.
+	Block int
+	// After is how long after the start FaultTime fails the responses read.
+	After time.Duration
+	// Times is how often the fault fires: once when 0, always when -1.
+	Times int
+	// Err is what the failing read returns, ErrInjected when nil.
+	Err error
+}
+
+// ParseFault parses offset=N[,corrupt], block=N or after=DURATION, each
+// optionally followed by ,times=N.
+func ParseFault(s string) (Fault, error) {
+	var fault Fault
+	for i, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch {
+		case i == 0 && key == "offset":
+			fault.Kind = FaultOffset
+			fault.Offset, err = ParseBytes(value)
+		case i == 0 && key == "block":
+			fault.Kind = FaultBlock
+			fault.Block, err = strconv.Atoi(value)
+		case i == 0 && key == "after":
+			fault.Kind = FaultTime
+			fault.After, err = time.ParseDuration(value)
+		case i > 0 && key == "corrupt" && fault.Kind == FaultOffset:
+			fault.Corrupt = true
+		case i > 0 && key == "times":
+			fault.Times, err = strconv.Atoi(value)
+		default:
+			return Fault{}, fmt.Errorf("invalid fault %q, expected offset=N[,corrupt], block=N or after=DURATION, and [,times=N]", s)
+		}
+		if err != nil {
+			return Fault{}, fmt.Errorf("invalid fault %q: %w", s, err)
+		}
+	}
+	return fault, nil
+}
+
+// WithFaults makes the download fail, or receive corrupt data, as the faults
+// say. It is meant for testing only.
+func WithFaults(faults ...Fault) Option {
+	return func(f *File) error {
+		for _, fault := range faults {
+			switch fault.Kind {
+			case FaultOffset, FaultBlock, FaultTime:
+			default:
+				return errors.New("unknown fault kind " + fault.Kind)
+			}
+		}
+		f.faults = &faultInjector{faults: faults, fired: make([]int, len(faults))}
+		return nil
+	}
+}
+
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []Fault
+	fired  []int
+}
+
+func (i *faultInjector) armed(k int) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	times := i.faults[k].Times
+	return times < 0 || i.fired[k] < max(times, 1)
+}
+
+func (i *faultInjector) fire(k int) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	times := i.faults[k].Times
+	if times >= 0 && i.fired[k] >= max(times, 1) {
+		return false
+	}
+	i.fired[k]++
+	return true
+}
+
+func (i *faultInjector) err(k int) error {
+	if err := i.faults[k].Err; err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrInjected, i.faults[k].Kind)
+}
+
+func (i *faultInjector) reader(f *File, block int, pos int64, body io.Reader) io.Reader {
+	if i == nil {
+		return body
+	}
+	return &faultReader{Reader: body, injector: i, block: block, pos: pos, start: f.startedAt}
+}
+
+// faultReader reads a block's response, at output offset pos, failing it
+// where a fault says.
+type faultReader struct {
+	io.Reader
+	injector *faultInjector
+	block    int
+	pos      int64
+	start    time.Time
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	i := r.injector
+	for k, fault := range i.faults {
+		switch fault.Kind {
+		case FaultBlock:
+			if fault.Block == r.block && i.fire(k) {
+				return 0, i.err(k)
+			}
+		case FaultTime:
+			if time.Since(r.start) >= fault.After && i.fire(k) {
+				return 0, i.err(k)
+			}
+		case FaultOffset:
+			if fault.Corrupt || fault.Offset < r.pos || !i.armed(k) {
+				continue
+			}
+			if fault.Offset == r.pos && i.fire(k) {
+				return 0, i.err(k)
+			}
+			p = p[:min(int64(len(p)), fault.Offset-r.pos)]
+		}
+	}
+	n, err := r.Reader.Read(p)
+	for k, fault := range i.faults {
+		if fault.Kind == FaultOffset && fault.Corrupt && fault.Offset >= r.pos && fault.Offset < r.pos+int64(n) && i.fire(k) {
+			p[fault.Offset-r.pos] ^= 0xff
+		}
+	}
+	r.pos += int64(n)
+	return n, err
+}
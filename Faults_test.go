@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+func TestParseFault(t *testing.T) {
+	for s, want := range map[string]Fault{
+		"offset=1M":                {Kind: FaultOffset, Offset: 1 << 20},
+		"offset=10,corrupt":        {Kind: FaultOffset, Offset: 10, Corrupt: true},
+		"block=2,times=-1":         {Kind: FaultBlock, Block: 2, Times: -1},
+		"after=1.5s,times=3":       {Kind: FaultTime, After: 1500 * time.Millisecond, Times: 3},
+		"offset=0,corrupt,times=2": {Kind: FaultOffset, Corrupt: true, Times: 2},
+	} {
+		got, err := ParseFault(s)
+		if err != nil || got != want {
+			t.Errorf("ParseFault(%q) = %+v, %v, want %+v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "offset=x", "block=1,corrupt", "times=2", "after=1s,offset=3"} {
+		if _, err := ParseFault(s); err == nil {
+			t.Errorf("ParseFault(%q) succeeded", s)
+		}
+	}
+}
+
+func TestFaultRetry(t *testing.T) {
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = time.Millisecond
+	data := downloadertest.RandomData(1<<20, 10)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	const offset = 300000
+	f := newDownload(t, origin.URL, WithConnections(1), WithFaults(Fault{Kind: FaultOffset, Offset: offset, Times: 2}))
+	if err := f.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, f, data)
+	if retries := atomic.LoadInt64(&f.status.Retries); retries != 2 {
+		t.Fatalf("%d retries, want 2", retries)
+	}
+	// The retries continue from the byte that failed, not from the start.
+	want := []string{"", "bytes=0-1048575", "bytes=300000-1048575", "bytes=300000-1048575"}
+	if ranges := origin.Ranges(); len(ranges) != len(want) || ranges[2] != want[2] || ranges[3] != want[3] {
+		t.Fatalf("requested %q, want %q", ranges, want)
+	}
+}
+
+func TestFaultGivesUp(t *testing.T) {
+	defer func(delay time.Duration, attempts int) { RetryDelay, MaxAttempts = delay, attempts }(RetryDelay, MaxAttempts)
+	RetryDelay, MaxAttempts = time.Millisecond, 3
+	origin := downloadertest.NewOrigin(downloadertest.RandomData(1<<20, 11))
+	defer origin.Close()
+	f := newDownload(t, origin.URL, WithConnections(1), WithFaults(Fault{Kind: FaultBlock, Block: 0, Times: -1}))
+	err := f.Run(context.Background())
+	if !errors.Is(err, ErrInjected) {
+		t.Fatalf("Run returned %v, want %v", err, ErrInjected)
+	}
+	if retries := atomic.LoadInt64(&f.status.Retries); retries != int64(MaxAttempts-1) {
+		t.Fatalf("%d retries, want %d", retries, MaxAttempts-1)
+	}
+}
+
+func TestFaultCorrupt(t *testing.T) {
+	data := downloadertest.RandomData(1<<20, 12)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	sum := sha256.Sum256(data)
+	f := newDownload(t, origin.URL, WithChecksum("sha256", hex.EncodeToString(sum[:])), WithFaults(Fault{Kind: FaultOffset, Offset: 1234, Corrupt: true}))
+	if err := f.Run(context.Background()); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Run returned %v, want %v", err, ErrChecksumMismatch)
+	}
+	got, err := os.ReadFile(f.Stream.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1234] != data[1234]^0xff {
+		t.Fatal("the byte at the fault was not flipped")
+	}
+}
+
+func TestFaultResume(t *testing.T) {
+	data := downloadertest.RandomData(1<<20, 13)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	const offset = 400000
+	f := newDownload(t, origin.URL, WithConnections(1), WithRetryPolicy(noRetry{}), WithFaults(Fault{Kind: FaultOffset, Offset: offset}))
+	if err := f.Run(context.Background()); !errors.Is(err, ErrInjected) {
+		t.Fatalf("Run returned %v, want %v", err, ErrInjected)
+	}
+	out, err := os.OpenFile(f.Stream.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	info, err := out.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != offset {
+		t.Fatalf("the failed download left %d bytes, want %d", info.Size(), offset)
+	}
+	resumed, err := New(origin.URL, out, WithConnections(1), WithContinue(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, resumed, data)
+	ranges := origin.Ranges()
+	if last := ranges[len(ranges)-1]; last != "bytes="+strconv.Itoa(offset)+"-1048575" {
+		t.Fatalf("resumed with %q, want from byte %d", last, offset)
+	}
+	// The bytes kept from the failed run are a range of the resume state,
+	// as a handoff needs them.
+	if err := checkHandoffRanges(resumed.ResumeState()); err != nil {
+		t.Fatalf("resume state %+v: %v", resumed.ResumeState().Blocks, err)
+	}
+}
@@ -0,0 +1,33 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTooLarge = errors.New("file is larger than the maximum size")
+	ErrTooSmall = errors.New("file is smaller than the minimum size")
+)
+
+func WithSizeLimits(minSize, maxSize int64) Option {
+	return func(f *File) error {
+		if minSize < 0 || maxSize < 0 || (maxSize > 0 && minSize > maxSize) {
+			return fmt.Errorf("invalid file size limits %d-%d", minSize, maxSize)
+		}
+		f.minSize, f.maxSize = minSize, maxSize
+		return nil
+	}
+}
+
+func (f *File) checkSize(size int64, final bool) error {
+	switch {
+	case size < 0:
+		return nil
+	case f.maxSize > 0 && size > f.maxSize:
+		return fmt.Errorf("%w: %d > %d bytes", ErrTooLarge, size, f.maxSize)
+	case f.minSize > 0 && size < f.minSize && final:
+		return fmt.Errorf("%w: %d < %d bytes", ErrTooSmall, size, f.minSize)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// followStatus shows the downloads matching filter that are not over yet,
+// and those added later, as the daemon reports on them, until interrupted
+// or the daemon stops. It only watches: downloads are started, paused and
+// canceled elsewhere. On a terminal it draws a bar per download like
+// RunBars does, elsewhere it prints a line when one ends.
+func followStatus(c *ControlClient, filter Filter, out io.Writer, terminal bool) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events := make(chan StreamEvent, EventBuffer)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Follow(ctx, 500*time.Millisecond, func(e StreamEvent) {
+			select {
+			case events <- e:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	list, err := c.List(filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCode(err)
+	}
+	var ids []int
+	var downloads = map[int]DownloadInfo{}
+	for _, info := range list {
+		if !ended(info.State) {
+			ids = append(ids, info.Id)
+			downloads[info.Id] = info
+		}
+	}
+	reported := map[int]bool{}
+	report := func(info DownloadInfo) {
+		switch {
+		case reported[info.Id]:
+		case info.State == StateFinished:
+			fmt.Fprintln(out, trf("%s: finished, %s", info.Path, FormatBytes(info.Downloaded)))
+		case info.State == StateFailed:
+			fmt.Fprintln(out, trf("%s: failed: %s", info.Path, trError(info.Error)))
+		case ended(info.State) || info.State == EventRemoved:
+			fmt.Fprintf(out, "%s: %s\n", info.Path, tr(info.State))
+		default:
+			delete(reported, info.Id)
+			return
+		}
+		reported[info.Id] = true
+	}
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	var drawn int
+	draw := func() {
+		if !terminal {
+			return
+		}
+		var bars []bar
+		for _, id := range ids {
+			info := downloads[id]
+			p := info.Progress
+			if len(p.Blocks) == 0 && p.Total > 0 {
+				p.Blocks = []BlockProgress{{Begin: 0, End: p.Total - 1, Downloaded: p.Downloaded}}
+			}
+			bars = append(bars, bar{filepath.Base(info.Path), p, info.State})
+		}
+		drawn = writeBars(out, drawn, bars)
+	}
+	for {
+		select {
+		case e := <-events:
+			info, known := downloads[e.Id]
+			switch {
+			case known && e.Type == EventProgress && ended(info.State):
+				// A tick taken before the download ended.
+				continue
+			case known && e.Type == EventRemoved:
+				info.State = EventRemoved
+			case known:
+				info = e.DownloadInfo
+			case e.Type != EventRemoved && !ended(e.State) && filter.matchesInfo(e.DownloadInfo):
+				info = e.DownloadInfo
+				ids = append(ids, e.Id)
+			default:
+				continue
+			}
+			downloads[e.Id] = info
+			if !terminal {
+				report(info)
+			}
+		case <-tick.C:
+			draw()
+		case err := <-done:
+			draw()
+			if ctx.Err() != nil {
+				return ExitOK
+			}
+			if err == nil {
+				err = fmt.Errorf("the daemon on %s closed the event stream", c.Socket)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailure
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package downloader
+
+import (
+	"errors"
+	"runtime"
+)
+
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space is not known on " + runtime.GOOS)
+}
@@ -0,0 +1,188 @@
+package downloader
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	EventCompleted = "completed"
+
+	GroupCompleted = "completed"
+)
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// Group is a set of downloads handled as one job: its members share its
+// rate limit, and it completes, with one completed event, when every member
+// finished and passed its checks.
+type Group struct {
+	Name      string `json:"name"`
+	RateLimit int64  `json:"rate_limit"`
+}
+
+type GroupInfo struct {
+	Group
+	JobProgress
+	State     string `json:"state"`
+	Downloads []int  `json:"downloads"`
+}
+
+type groupState struct {
+	Group
+	completed bool
+}
+
+// SetGroup creates a group, or changes the rate limit of an existing one.
+func (m *Manager) SetGroup(group Group) (GroupInfo, error) {
+	if group.Name = strings.TrimSpace(group.Name); group.Name == "" {
+		return GroupInfo{}, errors.New("group needs a name")
+	}
+	if group.RateLimit < 0 {
+		return GroupInfo{}, errors.New("rate_limit can not be negative")
+	}
+	m.mu.Lock()
+	m.group(group.Name).Group = group
+	m.mu.Unlock()
+	m.rebalance()
+	return m.GetGroup(group.Name)
+}
+
+func (m *Manager) GetGroup(name string) (GroupInfo, error) {
+	m.mu.Lock()
+	g, ok := m.groups[name]
+	m.mu.Unlock()
+	if !ok {
+		return GroupInfo{}, ErrGroupNotFound
+	}
+	return m.groupInfo(g), nil
+}
+
+func (m *Manager) Groups() []GroupInfo {
+	m.mu.Lock()
+	var groups []*groupState
+	for _, g := range m.groups {
+		groups = append(groups, g)
+	}
+	m.mu.Unlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	var list = []GroupInfo{}
+	for _, g := range groups {
+		list = append(list, m.groupInfo(g))
+	}
+	return list
+}
+
+// group returns the group called name, creating it. m.mu is held.
+func (m *Manager) group(name string) *groupState {
+	g, ok := m.groups[name]
+	if !ok {
+		if m.groups == nil {
+			m.groups = map[string]*groupState{}
+		}
+		g = &groupState{Group: Group{Name: name}}
+		m.groups[name] = g
+	}
+	return g
+}
+
+func (m *Manager) groupInfo(g *groupState) GroupInfo {
+	members := m.Find(Filter{Group: g.Name})
+	info := GroupInfo{JobProgress: m.JobProgress(Filter{Group: g.Name}), Downloads: []int{}}
+	m.mu.Lock()
+	info.Group = g.Group
+	completed := g.completed
+	m.mu.Unlock()
+
+	var states = map[string]bool{}
+	for _, d := range members {
+		info.Downloads = append(info.Downloads, d.Id)
+		states[d.State] = true
+	}
+	switch {
+	case completed:
+		info.State = GroupCompleted
+	case states[StateFailed] || states[StateCanceled]:
+		info.State = StateFailed
+	case states[StateDownloading]:
+		info.State = StateDownloading
+	case states[StatePaused]:
+		info.State = StatePaused
+	default:
+		info.State = StateQueued
+	}
+	return info
+}
+
+// capRates caps the rate limits of downloads that belong to a group or
+// tenant with a rate limit at their share of it, by weight.
+func capRates(caps map[string]int64, members []string, limits []int64, weights []int) []int64 {
+	rates := append([]int64(nil), limits...)
+	for name, limit := range caps {
+		if limit <= 0 {
+			continue
+		}
+		var index []int
+		var memberLimits []int64
+		var memberWeights []int
+		for i, member := range members {
+			if member == name {
+				index = append(index, i)
+				memberLimits = append(memberLimits, limits[i])
+				memberWeights = append(memberWeights, weights[i])
+			}
+		}
+		for k, rate := range allocate(limit, memberLimits, memberWeights) {
+			rates[index[k]] = rate
+		}
+	}
+	return rates
+}
+
+// completeGroup marks the group of d completed when d was its last member
+// to finish, and sends the completed event once.
+func (m *Manager) completeGroup(d *Download) {
+	m.mu.Lock()
+	g, ok := m.groups[d.group]
+	if !ok || g.completed {
+		m.mu.Unlock()
+		return
+	}
+	var paths []string
+	var bytes int64
+	for _, member := range m.downloads {
+		if member.group != g.Name {
+			continue
+		}
+		if member.state != StateFinished {
+			m.mu.Unlock()
+			return
+		}
+		paths = append(paths, member.Path)
+		if member.file != nil {
+			bytes += member.file.Progress().Downloaded
+		}
+	}
+	if len(paths) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	g.completed = true
+	m.mu.Unlock()
+
+	if m.Events != nil {
+		m.Events.Dispatch(Event{Type: EventCompleted, Path: commonDir(paths), Size: bytes, Downloaded: bytes, Group: g.Name})
+	}
+}
+
+func commonDir(paths []string) string {
+	dir := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for dir != filepath.Dir(dir) && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
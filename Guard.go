@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrBlockedAddress = errors.New("connection to a private address refused")
+	ErrSchemeRefused  = errors.New("URL scheme not allowed")
+
+	// BlockedNetworks are refused by WithBlockPrivateNetworks on top of the
+	// loopback, private, link-local, multicast and unspecified ranges.
+	BlockedNetworks = []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"}
+)
+
+// WithBlockPrivateNetworks refuses connections to loopback, private,
+// link-local and other non-public addresses. The address is checked when
+// connecting, after DNS resolution, so redirects and host names resolving
+// to such addresses are refused as well. A proxy set with WithProxy is
+// trusted and exempt.
+func WithBlockPrivateNetworks() Option {
+	return func(f *File) error {
+		f.blockPrivate = true
+		return nil
+	}
+}
+
+// WithAllowedSchemes restricts the URL, its redirects and its mirrors to
+// these schemes.
+func WithAllowedSchemes(schemes ...string) Option {
+	return func(f *File) error {
+		f.allowedSchemes = nil
+		for _, s := range schemes {
+			f.allowedSchemes = append(f.allowedSchemes, strings.ToLower(s))
+		}
+		return nil
+	}
+}
+
+func (f *File) checkScheme(u *url.URL) error {
+	if len(f.allowedSchemes) == 0 {
+		return nil
+	}
+	for _, s := range f.allowedSchemes {
+		if strings.EqualFold(u.Scheme, s) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSchemeRefused, u.Redacted())
+}
+
+func (f *File) checkSchemes() error {
+	u, err := url.Parse(f.Url)
+	if err != nil {
+		return err
+	}
+	if err := f.checkScheme(u); err != nil {
+		return err
+	}
+	if f.mirrors != nil {
+		for _, m := range f.mirrors.list {
+			if err := f.checkScheme(m.url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	for _, cidr := range BlockedNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func guardConnection(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+func (f *File) guardDialer(dialer *net.Dialer, addr string) *net.Dialer {
+	if !f.blockPrivate {
+		return dialer
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && f.proxy != nil && strings.EqualFold(host, f.proxy.Hostname()) {
+		return dialer
+	}
+	guarded := *dialer
+	control := dialer.Control
+	guarded.Control = func(network, address string, c syscall.RawConn) error {
+		if err := guardConnection(network, address, c); err != nil || control == nil {
+			return err
+		}
+		return control(network, address, c)
+	}
+	return &guarded
+}
@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+func TestBlockedIP(t *testing.T) {
+	for _, test := range []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.255.0.9", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::2", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"224.0.0.251", true},
+		{"ff02::1", true},
+		{"64:ff9b::7f00:1", true},
+		{"8.8.8.8", false},
+		{"172.15.255.255", false},
+		{"172.32.0.1", false},
+		{"192.169.0.1", false},
+		{"100.128.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	} {
+		if got := blockedIP(net.ParseIP(test.ip)); got != test.blocked {
+			t.Errorf("%s: blocked %v, want %v", test.ip, got, test.blocked)
+		}
+	}
+	if err := guardConnection("tcp", "[::ffff:127.0.0.1]:80", nil); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("connected to an IPv4-mapped loopback address: %v", err)
+	}
+	if err := guardConnection("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("refused a public address: %v", err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// runGuarded downloads u with private networks blocked, failing at once.
+// The error comes from New when the first request is refused.
+func runGuarded(t *testing.T, u string, opts ...Option) error {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	opts = append([]Option{WithBlockPrivateNetworks(), WithRetryPolicy(noRetry{})}, opts...)
+	f, err := New(u, out, opts...)
+	if err != nil {
+		return err
+	}
+	return f.Run(context.Background())
+}
+
+func TestBlockPrivateNetworks(t *testing.T) {
+	data := downloadertest.RandomData(100<<10, 40)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	host, _, _ := strings.Cut(strings.TrimPrefix(origin.URL, "http://"), "/")
+	_, port, _ := net.SplitHostPort(host)
+
+	t.Run("loopback", func(t *testing.T) {
+		if err := runGuarded(t, origin.URL); !errors.Is(err, ErrBlockedAddress) {
+			t.Fatalf("downloaded from loopback: %v", err)
+		}
+		u := strings.Replace(origin.URL, "127.0.0.1", "[::ffff:127.0.0.1]", 1)
+		if err := runGuarded(t, u); !errors.Is(err, ErrBlockedAddress) {
+			t.Fatalf("downloaded from an IPv4-mapped loopback address: %v", err)
+		}
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		// DNS answers with the loopback address for every name.
+		doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			answer := `{"Status": 0, "Answer": []}`
+			if r.URL.Query().Get("type") == "A" {
+				answer = `{"Status": 0, "Answer": [{"type": 1, "data": "127.0.0.1"}]}`
+			}
+			w.Write([]byte(answer))
+		}))
+		defer doh.Close()
+		u := "http://files.example.test:" + port + "/file"
+		if err := runGuarded(t, u, WithDoH(doh.URL)); !errors.Is(err, ErrBlockedAddress) {
+			t.Fatalf("downloaded from a name resolving to loopback: %v", err)
+		}
+		f := newDownload(t, u, WithDoH(doh.URL), WithRetryPolicy(noRetry{}))
+		if err := f.Run(context.Background()); err != nil {
+			t.Fatalf("the name does not resolve without the guard: %v", err)
+		}
+		checkContent(t, f, data)
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		// A public server, played by the transport, redirects to loopback.
+		redirect := WithTransportWrapper(func(next http.RoundTripper) http.RoundTripper {
+			return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Host != "public.example.test" {
+					return next.RoundTrip(r)
+				}
+				return &http.Response{
+					StatusCode: http.StatusFound,
+					Header:     http.Header{"Location": {origin.URL}},
+					Body:       http.NoBody,
+					Request:    r,
+				}, nil
+			})
+		})
+		before := len(origin.Requests())
+		if err := runGuarded(t, "http://public.example.test/file", redirect); !errors.Is(err, ErrBlockedAddress) {
+			t.Fatalf("followed a redirect to loopback: %v", err)
+		}
+		if n := len(origin.Requests()) - before; n != 0 {
+			t.Fatalf("%d requests reached the private address", n)
+		}
+		f := newDownload(t, "http://public.example.test/file", redirect, WithRetryPolicy(noRetry{}))
+		if err := f.Run(context.Background()); err != nil {
+			t.Fatalf("the redirect is not followed without the guard: %v", err)
+		}
+		checkContent(t, f, data)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		// The proxy is trusted even on a private address. The origin
+		// serves the file for any URL, so it can stand in for one.
+		f := newDownload(t, "http://files.example.test/file", WithBlockPrivateNetworks(), WithProxy(origin.URL), WithRetryPolicy(noRetry{}))
+		if err := f.Run(context.Background()); err != nil {
+			t.Fatalf("refused the proxy: %v", err)
+		}
+		checkContent(t, f, data)
+	})
+}
+
+func TestAllowedSchemes(t *testing.T) {
+	data := downloadertest.RandomData(1000, 41)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	out, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := New(origin.URL, out, WithAllowedSchemes("HTTPS")); !errors.Is(err, ErrSchemeRefused) {
+		t.Fatalf("downloaded over http: %v", err)
+	}
+	f := newDownload(t, origin.URL, WithAllowedSchemes("https", "http"))
+	if err := f.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, f, data)
+}
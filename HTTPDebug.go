@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var RedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+var redactedParams = []string{"token", "sig", "key", "secret", "password", "credential"}
+
+type debugTransport struct {
+	next http.RoundTripper
+	out  io.Writer
+	mu   *sync.Mutex
+	seq  *int64
+}
+
+func WithHTTPDebug(out io.Writer) Option {
+	return func(f *File) error {
+		var mu sync.Mutex
+		var seq int64
+		wrap := func(next http.RoundTripper) http.RoundTripper {
+			return &debugTransport{next: next, out: out, mu: &mu, seq: &seq}
+		}
+		f.transportWrappers = append([]func(http.RoundTripper) http.RoundTripper{wrap}, f.transportWrappers...)
+		return nil
+	}
+}
+
+func (t *debugTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	id := atomic.AddInt64(t.seq, 1)
+	start := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s #%d > %s %s %s\n", start.Format("15:04:05.000"), id, request.Method, redactUrl(request.URL), request.Proto)
+	writeDebugHeader(&b, id, ">", request.Header)
+	t.write(b.String())
+
+	resp, err := t.next.RoundTrip(request)
+	b.Reset()
+	now := time.Now()
+	if err != nil {
+		fmt.Fprintf(&b, "%s #%d ! %v (%s)\n", now.Format("15:04:05.000"), id, err, now.Sub(start).Round(time.Millisecond))
+		t.write(b.String())
+		return resp, err
+	}
+	fmt.Fprintf(&b, "%s #%d < %s %s (%s)\n", now.Format("15:04:05.000"), id, resp.Proto, resp.Status, now.Sub(start).Round(time.Millisecond))
+	writeDebugHeader(&b, id, "<", resp.Header)
+	t.write(b.String())
+	return resp, nil
+}
+
+func (t *debugTransport) write(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.out, s)
+}
+
+func writeDebugHeader(b *strings.Builder, id int64, dir string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			for _, secret := range RedactedHeaders {
+				if strings.EqualFold(name, secret) {
+					value = "redacted"
+				}
+			}
+			fmt.Fprintf(b, "             #%d %s %s: %s\n", id, dir, name, value)
+		}
+	}
+}
+
+func redactUrl(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.Redacted()
+	}
+	redacted := *u
+	for name := range query {
+		for _, secret := range redactedParams {
+			if strings.Contains(strings.ToLower(name), secret) {
+				query.Set(name, "redacted")
+			}
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.Redacted()
+}
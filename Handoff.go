@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrHandoffFinished = errors.New("a finished download can not be handed off")
+	ErrHandoffRanges   = errors.New("handoff state: the ranges do not cover the file exactly once")
+)
+
+// handoffTarget turns host, host:port or a URL into the URL of the
+// handoff endpoint of a daemon, on port 8800 unless one is given.
+func handoffTarget(to string) (string, error) {
+	if !strings.Contains(to, "://") {
+		to = "http://" + to
+	}
+	u, err := url.Parse(to)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%s: no host to hand off to", to)
+	}
+	if u.Port() == "" {
+		u.Host += ":8800"
+	}
+	return u.JoinPath("handoff").String(), nil
+}
+
+// Handoff moves download id to the daemon at to: the download is paused,
+// its job, the state of its ranges and the bytes written so far are sent,
+// and the other daemon continues from there. Once it took the download
+// over, the download and its partial file are removed here; otherwise a
+// download that was running continues. key authenticates with the other
+// daemon, as a token or user:password. It returns the download as the
+// other daemon reports it.
+func (m *Manager) Handoff(ctx context.Context, id int, to, key string) (DownloadInfo, error) {
+	target, err := handoffTarget(to)
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	job, err := m.Export(id)
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	d, err := m.find(id)
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	m.mu.Lock()
+	state, file, path, tenant := d.state, d.file, d.Path, d.tenant
+	m.mu.Unlock()
+	if state == StateFinished {
+		return DownloadInfo{}, ErrHandoffFinished
+	}
+	running := state == StateDownloading
+	resume := ResumeState{Size: -1}
+	var src *os.File
+	if file != nil {
+		file.Pause()
+		if file.remaining() != nil {
+			if src, err = os.Open(path); err == nil {
+				defer src.Close()
+				resume = file.ResumeState()
+				resume.Url = ""
+				// The state was hashed from the output as the download saw it,
+				// which a failed download already closed.
+				for i, b := range resume.Blocks {
+					if b.Written > 0 {
+						resume.Blocks[i].Sha256 = hashRange(src, b.Begin, b.Written)
+					}
+				}
+			}
+		}
+	}
+
+	body, w := io.Pipe()
+	form := multipart.NewWriter(w)
+	go func() {
+		w.CloseWithError(writeHandoff(form, job, resume, src))
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	// multipart/mixed rather than form-data, which a web page could post
+	// to the other daemon without asking it first.
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+form.Boundary())
+	if tenant != "" {
+		req.Header.Set(TenantHeader, tenant)
+	}
+	if user, password, ok := strings.Cut(key, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	info, err := sendHandoff(req)
+	body.Close()
+	if err != nil {
+		if running {
+			m.Resume(id)
+		}
+		return DownloadInfo{}, fmt.Errorf("handoff to %s: %w", to, err)
+	}
+	m.Remove(id)
+	if src != nil {
+		os.Remove(path)
+		RemoveResume(path)
+	}
+	slog.Info("download handed off", "url", d.Url, "to", target, "remote_id", info.Id)
+	return info, nil
+}
+
+func sendHandoff(req *http.Request) (DownloadInfo, error) {
+	var info DownloadInfo
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure) == nil && failure.Error != "" {
+			return info, errors.New(failure.Error)
+		}
+		return info, &HTTPError{Url: req.URL.Redacted(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return info, json.NewDecoder(resp.Body).Decode(&info)
+}
+
+// writeHandoff writes the parts of a handoff in order: the job, the state
+// of the ranges, and the bytes written of every range one after the other.
+func writeHandoff(form *multipart.Writer, job Job, resume ResumeState, src *os.File) error {
+	part, err := form.CreateFormField("job")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(job); err != nil {
+		return err
+	}
+	if part, err = form.CreateFormField("state"); err != nil {
+		return err
+	}
+	if _, err := resume.WriteTo(part); err != nil {
+		return err
+	}
+	if part, err = form.CreateFormField("data"); err != nil {
+		return err
+	}
+	if src != nil {
+		for _, b := range resume.Blocks {
+			if _, err := io.Copy(part, io.NewSectionReader(src, b.Begin, b.Written)); err != nil {
+				return err
+			}
+		}
+	}
+	return form.Close()
+}
+
+// receiveHandoff adds a download handed off by another daemon and writes
+// the bytes it sent into place. Ranges whose bytes do not match the
+// SHA-256 they were sent with are downloaded again.
+func (m *Manager) receiveHandoff(form *multipart.Reader, tenant string) (DownloadInfo, error) {
+	part, err := nextHandoffPart(form, "job")
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	var job Job
+	if err := json.NewDecoder(part).Decode(&job); err != nil {
+		return DownloadInfo{}, fmt.Errorf("handoff job: %w", err)
+	}
+	if err := m.checkDir(job.Dir); err != nil {
+		return DownloadInfo{}, err
+	}
+	if part, err = nextHandoffPart(form, "state"); err != nil {
+		return DownloadInfo{}, err
+	}
+	resume, err := ReadResume(io.LimitReader(part, 64<<20))
+	if err != nil {
+		return DownloadInfo{}, fmt.Errorf("handoff state: %w", err)
+	}
+	if err := checkHandoffRanges(resume); err != nil {
+		return DownloadInfo{}, err
+	}
+	// The download is held until its bytes are in place.
+	info, err := m.importJob(job, tenant, func(d *Download) { d.state = StatePaused })
+	if err != nil {
+		return info, err
+	}
+	d, err := m.find(info.Id)
+	if err != nil {
+		return info, err
+	}
+	m.mu.Lock()
+	path := d.Path
+	m.mu.Unlock()
+	if resume.Size > 0 {
+		if part, err = nextHandoffPart(form, "data"); err == nil {
+			var remaining []Block
+			if remaining, err = writeHandoffData(path, resume, part); err == nil {
+				m.mu.Lock()
+				d.remaining, d.size, d.etag = remaining, resume.Size, resume.ETag
+				m.mu.Unlock()
+			}
+		}
+		if err != nil {
+			m.Remove(info.Id)
+			os.Remove(path)
+			return DownloadInfo{}, err
+		}
+	}
+	m.Resume(info.Id)
+	return m.Get(info.Id)
+}
+
+// checkHandoffRanges makes sure the ranges of a handoff cover the file from
+// its first byte to its last without gaps or overlaps, so every byte is
+// either sent or left to download. A file of unknown size has no ranges.
+func checkHandoffRanges(resume ResumeState) error {
+	if resume.Size <= 0 {
+		if len(resume.Blocks) > 0 {
+			return ErrHandoffRanges
+		}
+		return nil
+	}
+	blocks := append([]ResumeBlock(nil), resume.Blocks...)
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	var next int64
+	for _, b := range blocks {
+		if b.Begin != next || b.End < b.Begin || b.Written < 0 || b.Written > b.End-b.Begin+1 {
+			return ErrHandoffRanges
+		}
+		next = b.End + 1
+	}
+	if next != resume.Size {
+		return ErrHandoffRanges
+	}
+	return nil
+}
+
+func nextHandoffPart(form *multipart.Reader, name string) (*multipart.Part, error) {
+	part, err := form.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("handoff: reading %s: %w", name, err)
+	}
+	if part.FormName() != name {
+		return nil, fmt.Errorf("handoff: got part %q, want %q", part.FormName(), name)
+	}
+	return part, nil
+}
+
+// writeHandoffData writes the bytes of every range of resume from data to
+// path and returns the ranges left to download.
+func writeHandoffData(path string, resume ResumeState, data io.Reader) ([]Block, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	if err := out.Truncate(resume.Size); err != nil {
+		return nil, err
+	}
+	var remaining = []Block{}
+	for _, b := range resume.Blocks {
+		written := b.Written
+		if _, err := io.CopyN(io.NewOffsetWriter(out, b.Begin), data, written); err != nil {
+			return nil, fmt.Errorf("handoff data: %w", err)
+		}
+		if written > 0 && hashRange(out, b.Begin, written) != b.Sha256 {
+			slog.Warn("handed off range does not match its checksum, downloading it again", "path", path, "begin", b.Begin, "end", b.End)
+			written = 0
+		}
+		if b.Begin+written <= b.End {
+			remaining = append(remaining, Block{Begin: b.Begin + written, End: b.End, start: b.Begin + written})
+		}
+	}
+	return remaining, out.Sync()
+}
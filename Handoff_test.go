@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+func TestCheckHandoffRanges(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		size   int64
+		blocks []ResumeBlock
+		ok     bool
+	}{
+		{"one range", 100, []ResumeBlock{{Begin: 0, End: 99, Written: 40}}, true},
+		{"out of order", 100, []ResumeBlock{{Begin: 50, End: 99}, {Begin: 0, End: 49, Written: 50}}, true},
+		{"unknown size", -1, nil, true},
+		{"no ranges", 100, nil, false},
+		{"gap", 100, []ResumeBlock{{Begin: 0, End: 39}, {Begin: 50, End: 99}}, false},
+		{"overlap", 100, []ResumeBlock{{Begin: 0, End: 59}, {Begin: 50, End: 99}}, false},
+		{"short", 100, []ResumeBlock{{Begin: 0, End: 89}}, false},
+		{"past the end", 100, []ResumeBlock{{Begin: 0, End: 199}}, false},
+		{"reversed", 100, []ResumeBlock{{Begin: 0, End: 49}, {Begin: 50, End: 20}, {Begin: 21, End: 99}}, false},
+		{"written too much", 100, []ResumeBlock{{Begin: 0, End: 99, Written: 101}}, false},
+		{"written negative", 100, []ResumeBlock{{Begin: 0, End: 99, Written: -1}}, false},
+		{"ranges of unknown size", -1, []ResumeBlock{{Begin: 0, End: 99}}, false},
+	} {
+		err := checkHandoffRanges(ResumeState{Size: test.size, Blocks: test.blocks})
+		if test.ok && err != nil || !test.ok && !errors.Is(err, ErrHandoffRanges) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	data := downloadertest.RandomData(4<<20, 30)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithBandwidth(1<<20))
+	defer origin.Close()
+	from := NewManager(t.TempDir(), Config{})
+	defer from.Stop()
+	to := NewManager(t.TempDir(), Config{})
+	defer to.Stop()
+	server := httptest.NewServer(NewDaemon(to))
+	defer server.Close()
+
+	info, err := from.Add(origin.URL, "", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first bytes", func() bool {
+		info, _ := from.Get(info.Id)
+		return info.Downloaded > 256<<10
+	})
+	handed, err := from.Handoff(context.Background(), info.Id, server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := from.Get(info.Id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("the download is still here after the handoff: %v", err)
+	}
+	if _, err := os.Stat(info.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the partial file is still here after the handoff: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if handed, err = to.Wait(ctx, handed.Id); err != nil || handed.State != StateFinished {
+		t.Fatalf("the handed off download ended %s: %v", handed.State, err)
+	}
+	got, err := os.ReadFile(handed.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the handed off download differs from the file served")
+	}
+	// The bytes handed off were not downloaded again.
+	summary, err := to.Summary(handed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Bytes >= int64(len(data)) {
+		t.Fatalf("the other daemon downloaded %d bytes of a %d byte file", summary.Bytes, len(data))
+	}
+}
+
+func TestHandoffRangesRefused(t *testing.T) {
+	data := downloadertest.RandomData(1000, 31)
+	origin := downloadertest.NewOrigin(data)
+	defer origin.Close()
+	m := NewManager(t.TempDir(), Config{})
+	defer m.Stop()
+	server := httptest.NewServer(NewDaemon(m))
+	defer server.Close()
+
+	for name, blocks := range map[string][]ResumeBlock{
+		"no ranges": nil,
+		"gap":       {{Begin: 0, End: 499}, {Begin: 600, End: 999}},
+		"overlap":   {{Begin: 0, End: 599, Written: 600}, {Begin: 500, End: 999}},
+	} {
+		resume := ResumeState{Version: ResumeVersion, Size: int64(len(data)), Blocks: blocks}
+		body, w := io.Pipe()
+		form := multipart.NewWriter(w)
+		src, err := os.CreateTemp(t.TempDir(), "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Write(data)
+		go func() {
+			w.CloseWithError(writeHandoff(form, Job{Url: origin.URL, Name: "file"}, resume, src))
+		}()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/handoff", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "multipart/mixed; boundary="+form.Boundary())
+		if _, err := sendHandoff(req); err == nil {
+			t.Errorf("%s: the handoff was taken", name)
+		}
+		body.Close()
+		src.Close()
+	}
+	if list := m.List(); len(list) != 0 {
+		t.Fatalf("%d downloads were added", len(list))
+	}
+}
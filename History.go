@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"strings"
+	"sync"
+)
+
+const HistorySize = 300
+
+type SpeedHistory struct {
+	mu      sync.Mutex
+	samples []int64
+	next    int
+	full    bool
+}
+
+func NewSpeedHistory(size int) *SpeedHistory {
+	return &SpeedHistory{samples: make([]int64, size)}
+}
+
+func (h *SpeedHistory) Add(bytesPerSecond int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = bytesPerSecond
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *SpeedHistory) Samples() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]int64{}, h.samples[:h.next]...)
+	}
+	return append(append([]int64{}, h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+func (f *File) SpeedHistory() []int64 {
+	return f.history.Samples()
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+func Sparkline(samples []int64, width int) string {
+	if len(samples) == 0 || width < 1 {
+		return ""
+	}
+	if len(samples) > width {
+		var buckets = make([]int64, width)
+		for i := range buckets {
+			from, to := i*len(samples)/width, (i+1)*len(samples)/width
+			var sum int64
+			for _, v := range samples[from:to] {
+				sum += v
+			}
+			buckets[i] = sum / int64(to-from)
+		}
+		samples = buckets
+	}
+
+	var max int64
+	for _, v := range samples {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range samples {
+		i := 0
+		if max > 0 {
+			i = int(v * int64(len(sparks)-1) / max)
+		}
+		b.WriteRune(sparks[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,508 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IPFSGateways are the gateways ipfs:// URLs are downloaded from when
+// WithIPFSGateways is not given. The first one is probed and the others
+// serve ranges as mirrors.
+var IPFSGateways = []string{"https://ipfs.io", "https://dweb.link"}
+
+// IPFSMaxBlock is the largest block fetched from a gateway to verify a file.
+var IPFSMaxBlock int64 = 2 << 20
+
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+
+	hashIdentity = 0x00
+	hashSHA256   = 0x12
+
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+)
+
+var errNotVerifiable = errors.New("can not be verified")
+
+func WithIPFSGateways(gateways ...string) Option {
+	return func(f *File) error {
+		for _, g := range gateways {
+			u, err := url.Parse(g)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("IPFS gateway %s is not an http or https URL", g)
+			}
+		}
+		f.ipfsGateways = gateways
+		return nil
+	}
+}
+
+type cid struct {
+	codec  uint64
+	hash   uint64
+	digest []byte
+}
+
+// String is the CIDv1 in base32, which every gateway accepts.
+func (c cid) String() string {
+	b := binary.AppendUvarint(nil, 1)
+	b = binary.AppendUvarint(b, c.codec)
+	b = binary.AppendUvarint(b, c.hash)
+	b = binary.AppendUvarint(b, uint64(len(c.digest)))
+	b = append(b, c.digest...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	zeros := len(s) - len(strings.TrimLeft(s, "1"))
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+func parseCID(s string) (cid, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		b, err := decodeBase58(s)
+		if err != nil {
+			return cid{}, fmt.Errorf("invalid CID %s: %v", s, err)
+		}
+		c, err := readMultihash(b, cid{codec: codecDagPB})
+		if err != nil {
+			return cid{}, fmt.Errorf("invalid CID %s: %v", s, err)
+		}
+		return c, nil
+	}
+	if s == "" {
+		return cid{}, errors.New("empty CID")
+	}
+	var b []byte
+	var err error
+	switch s[0] {
+	case 'b', 'B':
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+	case 'z':
+		b, err = decodeBase58(s[1:])
+	case 'f', 'F':
+		b, err = hex.DecodeString(s[1:])
+	default:
+		err = fmt.Errorf("unsupported multibase prefix %q", s[0])
+	}
+	if err != nil {
+		return cid{}, fmt.Errorf("invalid CID %s: %v", s, err)
+	}
+	c, err := readCID(b)
+	if err != nil {
+		return cid{}, fmt.Errorf("invalid CID %s: %v", s, err)
+	}
+	return c, nil
+}
+
+// readCID reads a binary CID, where a bare multihash is a CIDv0.
+func readCID(b []byte) (cid, error) {
+	if len(b) == 34 && b[0] == hashSHA256 && b[1] == 32 {
+		return readMultihash(b, cid{codec: codecDagPB})
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != 1 {
+		return cid{}, errors.New("unsupported CID version")
+	}
+	b = b[n:]
+	codec, n := binary.Uvarint(b)
+	if n <= 0 {
+		return cid{}, errors.New("truncated CID")
+	}
+	return readMultihash(b[n:], cid{codec: codec})
+}
+
+func readMultihash(b []byte, c cid) (cid, error) {
+	hash, n := binary.Uvarint(b)
+	if n <= 0 {
+		return cid{}, errors.New("truncated multihash")
+	}
+	b = b[n:]
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) != size {
+		return cid{}, errors.New("multihash length does not match")
+	}
+	c.hash, c.digest = hash, b[n:]
+	return c, nil
+}
+
+// matches tells whether data is the block c names.
+func (c cid) matches(data []byte) bool {
+	switch c.hash {
+	case hashSHA256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], c.digest)
+	case hashIdentity:
+		return bytes.Equal(data, c.digest)
+	}
+	return false
+}
+
+type pbLink struct {
+	hash []byte
+	name string
+}
+
+// pbNode is a dag-pb node with the UnixFS data it carries.
+type pbNode struct {
+	links      []pbLink
+	kind       uint64
+	data       []byte
+	fileSize   uint64
+	blockSizes []uint64
+}
+
+// protoFields calls fn with the fields of a protobuf message, their varint
+// or their bytes.
+func protoFields(b []byte, fn func(field int, value uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("truncated protobuf")
+		}
+		b = b[n:]
+		var value uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("truncated protobuf")
+			}
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errors.New("truncated protobuf")
+			}
+			data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("unexpected protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseNode(block []byte) (pbNode, error) {
+	var node pbNode
+	var unixfs []byte
+	err := protoFields(block, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			unixfs = data
+		case 2:
+			var link pbLink
+			err := protoFields(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case 1:
+					link.hash = data
+				case 2:
+					link.name = string(data)
+				}
+				return nil
+			})
+			node.links = append(node.links, link)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return node, err
+	}
+	err = protoFields(unixfs, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			node.kind = value
+		case 2:
+			node.data = data
+		case 3:
+			node.fileSize = value
+		case 4:
+			if data == nil {
+				node.blockSizes = append(node.blockSizes, value)
+				break
+			}
+			for len(data) > 0 {
+				size, n := binary.Uvarint(data)
+				if n <= 0 {
+					return errors.New("truncated block sizes")
+				}
+				node.blockSizes = append(node.blockSizes, size)
+				data = data[n:]
+			}
+		}
+		return nil
+	})
+	return node, err
+}
+
+// leafBlocks are the dag-pb encodings a leaf holding data may have, so that
+// leaves are checked against the file without fetching them.
+func leafBlocks(data []byte) [][]byte {
+	var blocks [][]byte
+	for _, kind := range []uint64{unixfsFile, unixfsRaw} {
+		unixfs := binary.AppendUvarint([]byte{0x08}, kind)
+		if len(data) > 0 {
+			unixfs = append(unixfs, 0x12)
+			unixfs = binary.AppendUvarint(unixfs, uint64(len(data)))
+			unixfs = append(unixfs, data...)
+		}
+		unixfs = append(unixfs, 0x18)
+		unixfs = binary.AppendUvarint(unixfs, uint64(len(data)))
+		block := binary.AppendUvarint([]byte{0x0a}, uint64(len(unixfs)))
+		blocks = append(blocks, append(block, unixfs...))
+	}
+	return blocks
+}
+
+type ipfsSource struct {
+	root     cid
+	path     []string
+	gateways []string
+}
+
+// resolveIPFS turns an ipfs://CID/path URL into the gateway URLs it is
+// downloaded from.
+func (f *File) resolveIPFS() error {
+	u, err := url.Parse(f.Url)
+	if err != nil || !strings.EqualFold(u.Scheme, "ipfs") {
+		return nil
+	}
+	root, err := parseCID(u.Host)
+	if err != nil {
+		return err
+	}
+	gateways := f.ipfsGateways
+	if len(gateways) == 0 {
+		gateways = IPFSGateways
+	}
+	source := &ipfsSource{root: root}
+	for _, segment := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		if segment != "" {
+			source.path = append(source.path, segment)
+		}
+	}
+	var urls []string
+	for _, g := range gateways {
+		g = strings.TrimSuffix(g, "/")
+		source.gateways = append(source.gateways, g)
+		gateway := *u
+		gateway.Scheme, gateway.Host, gateway.Path, gateway.RawPath = "", "", "/ipfs/"+u.Host+u.Path, ""
+		urls = append(urls, g+gateway.String())
+	}
+	f.ipfs = source
+	f.Url = urls[0]
+	if len(urls) > 1 {
+		return WithMirrors(urls[1:]...)(f)
+	}
+	return nil
+}
+
+// fetchBlock gets a block from the gateways, which need not be trusted as
+// it is checked against its CID.
+func (s *ipfsSource) fetchBlock(ctx context.Context, client *http.Client, c cid) ([]byte, error) {
+	if c.hash == hashIdentity {
+		return c.digest, nil
+	}
+	var errs []error
+	for _, gateway := range s.gateways {
+		block, err := fetchRaw(ctx, client, gateway+"/ipfs/"+c.String()+"?format=raw")
+		if err == nil && !c.matches(block) {
+			err = errors.New("block does not match its CID")
+		}
+		if err == nil {
+			return block, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", gateway, err))
+	}
+	return nil, fmt.Errorf("can not get block %s: %w", c, errors.Join(errs...))
+}
+
+func fetchRaw(ctx context.Context, client *http.Client, rawUrl string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	block, err := io.ReadAll(io.LimitReader(resp.Body, IPFSMaxBlock+1))
+	if err == nil && int64(len(block)) > IPFSMaxBlock {
+		err = errors.New("block too large")
+	}
+	return block, err
+}
+
+// verifyIPFS checks the downloaded file against its CID: the blocks of the
+// DAG above the leaves are fetched and checked against their CIDs, and the
+// leaves are computed from the file, so that a gateway can not send other
+// bytes than the ones the CID names.
+func (f *File) verifyIPFS(ctx context.Context) error {
+	if f.ipfs == nil {
+		return nil
+	}
+	if f.Stream == nil || f.writer != io.WriterAt(f.Stream) || f.ranged || f.payload != "" {
+		slog.Warn("the file is not written to disk as it is, its CID is not verified", "url", f.Url)
+		return nil
+	}
+	err := f.ipfs.verify(ctx, f.client, io.NewSectionReader(f.Stream, 0, f.Size), f.Size)
+	switch {
+	case errors.Is(err, errNotVerifiable):
+		slog.Warn("the file can not be verified against its CID", "url", f.Url, "err", err)
+		return nil
+	case err != nil:
+		return fmt.Errorf("IPFS verification: %w", err)
+	}
+	slog.Debug("verified against its CID", "url", f.Url, "cid", f.ipfs.root)
+	return nil
+}
+
+func (s *ipfsSource) verify(ctx context.Context, client *http.Client, file *io.SectionReader, size int64) error {
+	c := s.root
+	for _, name := range s.path {
+		block, err := s.fetchBlock(ctx, client, c)
+		if err != nil {
+			return err
+		}
+		node, err := parseNode(block)
+		if err != nil {
+			return err
+		}
+		if c.codec != codecDagPB || node.kind != unixfsDirectory {
+			return fmt.Errorf("%w: %s is not a plain directory", errNotVerifiable, c)
+		}
+		found := false
+		for _, link := range node.links {
+			if link.name == name {
+				if c, err = readCID(link.hash); err != nil {
+					return err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s has no entry %q", c, name)
+		}
+	}
+	return s.verifyNode(ctx, client, c, file, 0, size)
+}
+
+// verifyNode checks the size bytes of the file at offset against the
+// subtree c names.
+func (s *ipfsSource) verifyNode(ctx context.Context, client *http.Client, c cid, file *io.SectionReader, offset, size int64) error {
+	if c.hash != hashSHA256 && c.hash != hashIdentity {
+		return fmt.Errorf("%w: unsupported hash function 0x%x", errNotVerifiable, c.hash)
+	}
+	var data []byte
+	if size >= 0 && size <= IPFSMaxBlock {
+		data = make([]byte, size)
+		if _, err := file.ReadAt(data, offset); err != nil {
+			return err
+		}
+	}
+	switch c.codec {
+	case codecRaw:
+		if data == nil || !c.matches(data) {
+			return fmt.Errorf("%w: bytes %d-%d do not match %s", ErrChecksumMismatch, offset, offset+size-1, c)
+		}
+		return nil
+	case codecDagPB:
+	default:
+		return fmt.Errorf("%w: unsupported codec 0x%x", errNotVerifiable, c.codec)
+	}
+	if data != nil {
+		for _, leaf := range leafBlocks(data) {
+			if c.matches(leaf) {
+				return nil
+			}
+		}
+	}
+
+	block, err := s.fetchBlock(ctx, client, c)
+	if err != nil {
+		return err
+	}
+	node, err := parseNode(block)
+	if err != nil {
+		return err
+	}
+	if node.kind != unixfsFile && node.kind != unixfsRaw {
+		return fmt.Errorf("%s is not a file", c)
+	}
+	nodeSize := int64(node.fileSize)
+	if nodeSize == 0 && len(node.links) == 0 {
+		nodeSize = int64(len(node.data))
+	}
+	if nodeSize != size {
+		return fmt.Errorf("%w: %s has %d bytes, the file %d", ErrChecksumMismatch, c, nodeSize, size)
+	}
+	if len(node.data) > 0 && !sectionEquals(file, offset, node.data) {
+		return fmt.Errorf("%w: bytes %d-%d do not match %s", ErrChecksumMismatch, offset, offset+int64(len(node.data))-1, c)
+	}
+	if len(node.links) != len(node.blockSizes) {
+		return fmt.Errorf("%s has %d links and %d block sizes", c, len(node.links), len(node.blockSizes))
+	}
+	pos := offset + int64(len(node.data))
+	for i, link := range node.links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		child, err := readCID(link.hash)
+		if err != nil {
+			return err
+		}
+		if err := s.verifyNode(ctx, client, child, file, pos, int64(node.blockSizes[i])); err != nil {
+			return err
+		}
+		pos += int64(node.blockSizes[i])
+	}
+	if pos != offset+size {
+		return fmt.Errorf("%w: %s covers %d bytes, the file %d", ErrChecksumMismatch, c, pos-offset, size)
+	}
+	return nil
+}
+
+func sectionEquals(file *io.SectionReader, offset int64, data []byte) bool {
+	got := make([]byte, len(data))
+	_, err := file.ReadAt(got, offset)
+	return err == nil && bytes.Equal(got, data)
+}
@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type InputEntry struct {
+	Url       string
+	Mirrors   []string
+	Dir       string
+	Name      string
+	Sha256    string
+	Checksums []string
+	Size      int64
+	Header    [][2]string
+	Priority  int
+	Group     string
+}
+
+func ParseInput(r io.Reader) ([]InputEntry, error) {
+	var entries []InputEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			urls := strings.Fields(line)
+			entries = append(entries, InputEntry{Url: urls[0], Mirrors: urls[1:]})
+			continue
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("input line %d: option before the first url", n)
+		}
+		if err := entries[len(entries)-1].set(trimmed); err != nil {
+			return nil, fmt.Errorf("input line %d: %w", n, err)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (e *InputEntry) set(option string) error {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return fmt.Errorf("invalid option %q, expected key=value", option)
+	}
+	var err error
+	switch value = strings.TrimSpace(value); strings.TrimSpace(key) {
+	case "out":
+		e.Name = value
+	case "dir":
+		e.Dir = value
+	case "sha256":
+		e.Sha256, err = ParseChecksum(value)
+	case "checksum":
+		algorithm, sum, _ := strings.Cut(value, "=")
+		if checksumName(algorithm) == "sha256" {
+			e.Sha256, err = ParseChecksum(sum)
+			break
+		}
+		expected, err := newExpectedSum(algorithm, sum)
+		if err != nil {
+			return err
+		}
+		e.Checksums = append(e.Checksums, expected.String())
+	case "size":
+		if e.Size, err = ParseBytes(value); err == nil && e.Size == 0 {
+			err = errors.New("invalid size")
+		}
+	case "header":
+		name, v, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q", value)
+		}
+		e.Header = append(e.Header, [2]string{strings.TrimSpace(name), strings.TrimSpace(v)})
+	case "group":
+		e.Group = value
+	case "priority":
+		if e.Priority, err = strconv.Atoi(value); err == nil && e.Priority < 1 {
+			err = ErrInvalidPriority
+		}
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return err
+}
+
+func (e InputEntry) options() []Option {
+	var opts []Option
+	if len(e.Mirrors) > 0 {
+		opts = append(opts, WithMirrors(e.Mirrors...))
+	}
+	for _, h := range e.Header {
+		opts = append(opts, WithHeader(h[0], h[1]))
+	}
+	if e.Size > 0 {
+		opts = append(opts, WithSizeLimits(e.Size, e.Size))
+	}
+	return append(opts, checksumOptions(e.Checksums)...)
+}
+
+func (m *Manager) AddInput(r io.Reader) ([]DownloadInfo, error) {
+	return m.addInput(r, "")
+}
+
+func (m *Manager) addInput(r io.Reader, tenant string) ([]DownloadInfo, error) {
+	entries, err := ParseInput(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.addEntries(entries, tenant)
+}
+
+func (m *Manager) addEntries(entries []InputEntry, tenant string) ([]DownloadInfo, error) {
+	var list = []DownloadInfo{}
+	for _, e := range entries {
+		info, err := m.add(e.Url, e.Dir, e.Name, func(d *Download) {
+			d.checksum = e.Sha256
+			d.group, d.tenant = e.Group, tenant
+			d.job = e.job()
+			if e.Priority > 0 {
+				d.priority = e.Priority
+			}
+		}, e.options()...)
+		if err != nil && !errors.Is(err, ErrDuplicate) {
+			return list, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// job is what of the entry its download can be exported with.
+func (e InputEntry) job() Job {
+	j := Job{Mirrors: e.Mirrors, Dir: e.Dir, Size: e.Size, Checksums: e.Checksums}
+	for _, h := range e.Header {
+		j.Headers = append(j.Headers, JobHeader{h[0], h[1]})
+	}
+	return j
+}
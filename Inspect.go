@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"time"
+)
+
+type Inspection struct {
+	Url             string        `json:"url"`
+	FinalUrl        string        `json:"final_url"`
+	Filename        string        `json:"filename"`
+	Size            int64         `json:"size"`
+	AcceptRanges    bool          `json:"accept_ranges"`
+	Server          string        `json:"server,omitempty"`
+	ContentType     string        `json:"content_type,omitempty"`
+	ContentEncoding string        `json:"content_encoding,omitempty"`
+	ETag            string        `json:"etag,omitempty"`
+	LastModified    time.Time     `json:"last_modified,omitempty"`
+	Strategy        string        `json:"strategy"`
+	Split           SplitDecision `json:"split"`
+	Blocks          []Block       `json:"blocks"`
+}
+
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+func Inspect(url string, opts ...Option) (Inspection, error) {
+	f, err := New(url, nil, append(opts, WithWriterAt(discardWriterAt{}))...)
+	if err != nil {
+		return Inspection{}, err
+	}
+	if f.ownClient {
+		defer f.closeIdleConnections()
+	}
+	return Inspection{
+		Url:             f.Url,
+		FinalUrl:        f.finalUrl,
+		Filename:        suggestedFilename(f.finalUrl, f.header.Get("Content-Disposition"), f.ContentType),
+		Size:            f.Size,
+		AcceptRanges:    f.header.Get("Accept-Ranges") == "bytes" && !f.noRanges,
+		Server:          f.header.Get("Server"),
+		ContentType:     f.ContentType,
+		ContentEncoding: f.ContentEncoding,
+		ETag:            f.ETag,
+		LastModified:    f.LastModified,
+		Strategy:        f.Strategy(),
+		Split:           f.SplitDecision(),
+		Blocks:          f.plan(),
+	}, nil
+}
+
+func (i Inspection) WriteTo(w io.Writer) (int64, error) {
+	var n int
+	print := func(format string, args ...interface{}) {
+		m, _ := fmt.Fprintf(w, format, args...)
+		n += m
+	}
+	print("URL:              %s\n", i.Url)
+	if i.FinalUrl != i.Url {
+		print("Redirected to:    %s\n", i.FinalUrl)
+	}
+	print("Filename:         %s\n", i.Filename)
+	if i.Size >= 0 {
+		print("Size:             %d (%s)\n", i.Size, FormatBytes(i.Size))
+	} else {
+		print("Size:             unknown\n")
+	}
+	print("Range support:    %t\n", i.AcceptRanges)
+	print("Server:           %s\n", i.Server)
+	print("Content-Type:     %s\n", i.ContentType)
+	if i.ContentEncoding != "" {
+		print("Content-Encoding: %s\n", i.ContentEncoding)
+	}
+	if i.ETag != "" {
+		print("ETag:             %s\n", i.ETag)
+	}
+	if !i.LastModified.IsZero() {
+		print("Last-Modified:    %s\n", i.LastModified.Format(time.RFC1123))
+	}
+	print("Strategy:         %s\n", i.Strategy)
+	if i.Split.Baseline > 0 {
+		print("Baseline:         %s/s over one connection\n", FormatBytes(i.Split.Baseline))
+	}
+	print("Connections:      %d, %s\n", i.Split.Connections, i.Split.Reason)
+	print("Blocks:           %d\n", len(i.Blocks))
+	for id, b := range i.Blocks {
+		if b.End < 0 {
+			print("  %2d  %d-\n", id, b.Begin)
+			continue
+		}
+		print("  %2d  %d-%d (%s)\n", id, b.Begin, b.End, FormatBytes(b.End-b.Begin+1))
+	}
+	return int64(n), nil
+}
+
+func suggestedFilename(rawUrl, disposition, contentType string) string {
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		if name := path.Base(params["filename"]); params["filename"] != "" && name != "/" && name != "." {
+			return name
+		}
+	}
+	if u, err := url.Parse(rawUrl); err == nil {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			return withExtension(name, contentType)
+		}
+	}
+	return "index.html"
+}
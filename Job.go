@@ -0,0 +1,213 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JobVersion is the version of the job files written by Export. Import
+// reads files of this version and older.
+const JobVersion = 1
+
+var ErrJobVersion = errors.New("job file is of a newer version")
+
+// Job is a download in a form another daemon, or another machine, can add
+// it from: what was asked for, without anything tied to this queue. Headers
+// that carry credentials are left out, as is the password of the URL.
+type Job struct {
+	Version     int               `json:"version"`
+	Url         string            `json:"url"`
+	Mirrors     []string          `json:"mirrors,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Sha256      string            `json:"sha256,omitempty"`
+	Checksums   []string          `json:"checksums,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	Headers     []JobHeader       `json:"headers,omitempty"`
+	Connections int               `json:"connections,omitempty"`
+	RateLimit   int64             `json:"rate_limit,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Group       string            `json:"group,omitempty"`
+	Strategy    string            `json:"strategy,omitempty"`
+	PieceOrder  string            `json:"piece_order,omitempty"`
+	PieceWindow int64             `json:"piece_window,omitempty"`
+	MaxLifetime int               `json:"max_lifetime,omitempty"`
+	NoProgress  int               `json:"no_progress,omitempty"`
+	// Post is the post-processing pipeline, as ParsePipeline reads it,
+	// without exec steps.
+	Post []string `json:"post,omitempty"`
+}
+
+type JobHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// secretHeader tells whether a header likely carries a credential.
+func secretHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization", "Cookie":
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "token", "secret", "password", "session", "key"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutPassword drops the password of a URL, keeping the user.
+func withoutPassword(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+func (j Job) validate() error {
+	if j.Version > JobVersion {
+		return fmt.Errorf("%w: %d", ErrJobVersion, j.Version)
+	}
+	if j.Url == "" {
+		return errors.New("url is required")
+	}
+	if j.Strategy != "" && !validStrategy(j.Strategy) {
+		return errors.New("unknown download strategy " + j.Strategy)
+	}
+	if j.PieceOrder != "" && !validPieceOrder(j.PieceOrder) {
+		return errors.New("unknown piece order " + j.PieceOrder)
+	}
+	if j.Sha256 != "" {
+		if _, err := ParseChecksum(j.Sha256); err != nil {
+			return err
+		}
+	}
+	for _, sum := range j.Checksums {
+		if _, err := parseDigest(sum); err != nil {
+			return err
+		}
+	}
+	if _, err := parseJobPipeline(j.Post); err != nil {
+		return err
+	}
+	if j.Size < 0 || j.Priority < 0 || j.Connections < 0 || j.RateLimit < 0 {
+		return errors.New("size, priority, connections and rate_limit can not be negative")
+	}
+	return nil
+}
+
+func (j Job) options() []Option {
+	var opts []Option
+	if len(j.Mirrors) > 0 {
+		opts = append(opts, WithMirrors(j.Mirrors...))
+	}
+	for _, h := range j.Headers {
+		opts = append(opts, WithHeader(h.Name, h.Value))
+	}
+	if j.Size > 0 {
+		opts = append(opts, WithSizeLimits(j.Size, j.Size))
+	}
+	if j.Strategy != "" {
+		opts = append(opts, WithStrategy(j.Strategy))
+	}
+	if j.PieceOrder != "" {
+		opts = append(opts, WithPieceOrder(j.PieceOrder, j.PieceWindow))
+	}
+	return append(opts, checksumOptions(j.Checksums)...)
+}
+
+// Export returns download id as a job, with its current settings.
+func (m *Manager) Export(id int) (Job, error) {
+	d, err := m.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := d.job
+	j.Version = JobVersion
+	j.Url = withoutPassword(d.Url)
+	j.Mirrors = nil
+	for _, mirror := range d.job.Mirrors {
+		j.Mirrors = append(j.Mirrors, withoutPassword(mirror))
+	}
+	j.Name = filepath.Base(d.relative)
+	if d.dataDir != "" {
+		// The data directory the download was placed in, so that it is
+		// resumed and verified there.
+		j.Dir = filepath.Dir(d.Path)
+	}
+	j.Sha256 = d.checksum
+	var headers []JobHeader
+	for _, h := range j.Headers {
+		if !secretHeader(h.Name) {
+			headers = append(headers, h)
+		}
+	}
+	j.Headers = headers
+	j.Connections, j.RateLimit, j.Priority = d.connections, d.rateLimit, d.priority
+	j.Tags, j.Metadata, j.Group = d.tags, d.metadata, d.group
+	j.MaxLifetime, j.NoProgress = int(d.maxLifetime/time.Second), int(d.noProgress/time.Second)
+	return j, nil
+}
+
+// Import adds the download described by job.
+func (m *Manager) Import(job Job) (DownloadInfo, error) {
+	return m.importJob(job, "", nil)
+}
+
+func (m *Manager) importJob(job Job, tenant string, setup func(*Download)) (DownloadInfo, error) {
+	if err := job.validate(); err != nil {
+		return DownloadInfo{}, err
+	}
+	if job.Sha256 != "" {
+		job.Sha256, _ = ParseChecksum(job.Sha256)
+	}
+	info, err := m.add(job.Url, job.Dir, job.Name, func(d *Download) {
+		d.job = job
+		d.checksum = job.Sha256
+		d.setLabels(job.Tags, job.Metadata)
+		d.group, d.tenant = strings.TrimSpace(job.Group), tenant
+		if job.Priority > 0 {
+			d.priority = job.Priority
+		}
+		if setup != nil {
+			setup(d)
+		}
+	}, job.options()...)
+	if err != nil {
+		return info, err
+	}
+	if job.Connections > 0 {
+		m.SetConnections(info.Id, job.Connections)
+	}
+	if job.RateLimit > 0 {
+		m.SetRateLimit(info.Id, job.RateLimit)
+	}
+	if job.MaxLifetime > 0 || job.NoProgress > 0 {
+		config := m.Config()
+		maxLifetime, noProgress := config.MaxLifetime, config.NoProgress
+		if job.MaxLifetime > 0 {
+			maxLifetime = job.MaxLifetime
+		}
+		if job.NoProgress > 0 {
+			noProgress = job.NoProgress
+		}
+		m.SetTimeouts(info.Id, time.Duration(maxLifetime)*time.Second, time.Duration(noProgress)*time.Second)
+	}
+	return m.Get(info.Id)
+}
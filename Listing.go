@@ -0,0 +1,395 @@
+package downloader
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrNoListing = errors.New("no WebDAV or S3 directory listing")
+
+	MaxListingDepth = 32
+)
+
+// RemoteEntry is a file found below a remote directory, with its path
+// relative to that directory.
+type RemoteEntry struct {
+	Url  string `json:"url"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Lister is implemented by protocols that can list a remote directory,
+// recursively.
+type Lister interface {
+	List(ctx context.Context, url string) ([]RemoteEntry, error)
+}
+
+type JobProgress struct {
+	Files      int   `json:"files"`
+	Finished   int   `json:"finished"`
+	Failed     int   `json:"failed"`
+	Downloaded int64 `json:"downloaded"`
+	Total      int64 `json:"total"`
+	Speed      int64 `json:"speed"`
+}
+
+// ListRemote lists the files below rawUrl with the protocol's Lister, or for
+// http and https with WebDAV PROPFIND or, failing that, the S3
+// ListObjectsV2 API. s3://bucket/prefix is listed at
+// https://bucket.s3.amazonaws.com.
+func ListRemote(ctx context.Context, rawUrl string, client *http.Client) ([]RemoteEntry, error) {
+	return listRemote(ctx, rawUrl, client, 0)
+}
+
+// listRemote lists no deeper than level, as DirectoryFilter has it, where
+// the listing itself can stop there.
+func listRemote(ctx context.Context, rawUrl string, client *http.Client, level int) ([]RemoteEntry, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		base := &url.URL{Scheme: "https", Host: u.Host + ".s3.amazonaws.com"}
+		return listS3(ctx, client, base, strings.TrimPrefix(u.Path, "/"))
+	case "http", "https":
+	default:
+		p, err := lookupProtocol(rawUrl)
+		if err != nil {
+			return nil, err
+		}
+		lister, ok := p.(Lister)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s can not list directories", ErrNoListing, u.Scheme)
+		}
+		return lister.List(ctx, rawUrl)
+	}
+
+	entries, err := listWebDAV(ctx, client, u, level)
+	if !errors.Is(err, ErrNoListing) {
+		return entries, err
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	entries, err = listS3(ctx, client, &url.URL{Scheme: u.Scheme, Host: u.Host}, prefix)
+	if !errors.Is(err, ErrNoListing) {
+		return entries, err
+	}
+	if bucket, rest, ok := strings.Cut(prefix, "/"); ok {
+		return listS3(ctx, client, &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + bucket}, rest)
+	}
+	return nil, fmt.Errorf("%w at %s", ErrNoListing, u.Redacted())
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Collection *struct{} `xml:"DAV: resourcetype>collection"`
+				Length     int64     `xml:"DAV: getcontentlength"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/></prop></propfind>`
+
+func listWebDAV(ctx context.Context, client *http.Client, root *url.URL, level int) ([]RemoteEntry, error) {
+	if !strings.HasSuffix(root.Path, "/") {
+		dir := *root
+		dir.Path += "/"
+		root = &dir
+	}
+	var entries []RemoteEntry
+	seen := map[string]bool{}
+	var walk func(dir *url.URL, depth int) error
+	walk = func(dir *url.URL, depth int) error {
+		if depth > MaxListingDepth || seen[dir.Path] {
+			return nil
+		}
+		seen[dir.Path] = true
+		request, err := http.NewRequestWithContext(ctx, "PROPFIND", dir.String(), strings.NewReader(davPropfind))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Depth", "1")
+		request.Header.Set("Content-Type", "application/xml")
+		resp, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusMultiStatus {
+			if depth == 0 {
+				return ErrNoListing
+			}
+			return &HTTPError{Url: dir.Redacted(), StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		var ms davMultistatus
+		if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&ms); err != nil {
+			return fmt.Errorf("%s: %w", dir.Redacted(), err)
+		}
+		for _, r := range ms.Responses {
+			href, err := url.Parse(r.Href)
+			if err != nil {
+				continue
+			}
+			target := dir.ResolveReference(href)
+			if target.Host != root.Host || !strings.HasPrefix(target.Path, root.Path) || strings.TrimSuffix(target.Path, "/") == strings.TrimSuffix(dir.Path, "/") {
+				continue
+			}
+			var collection bool
+			var length int64 = -1
+			for _, ps := range r.Propstat {
+				if strings.Contains(ps.Status, " 200") {
+					collection = collection || ps.Prop.Collection != nil
+					length = max(length, ps.Prop.Length)
+				}
+			}
+			if collection {
+				if level > 0 && depth+1 >= level {
+					continue
+				}
+				if !strings.HasSuffix(target.Path, "/") {
+					target.Path += "/"
+				}
+				target.RawPath = ""
+				if err := walk(target, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			entries = append(entries, RemoteEntry{Url: target.String(), Path: strings.TrimPrefix(target.Path, root.Path), Size: length})
+		}
+		return nil
+	}
+	return entries, walk(root, 0)
+}
+
+type s3ListResult struct {
+	XMLName   xml.Name `xml:"ListBucketResult"`
+	Truncated bool     `xml:"IsTruncated"`
+	Next      string   `xml:"NextContinuationToken"`
+	Contents  []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func listS3(ctx context.Context, client *http.Client, bucket *url.URL, prefix string) ([]RemoteEntry, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var entries []RemoteEntry
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		list := *bucket
+		list.Path = strings.TrimSuffix(bucket.Path, "/") + "/"
+		list.RawQuery = query.Encode()
+		request, err := http.NewRequestWithContext(ctx, "GET", list.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			if entries == nil {
+				return nil, ErrNoListing
+			}
+			return nil, fmt.Errorf("%s: %s", list.Redacted(), resp.Status)
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				continue
+			}
+			object := *bucket
+			object.Path = strings.TrimSuffix(bucket.Path, "/") + "/" + c.Key
+			entries = append(entries, RemoteEntry{Url: object.String(), Path: strings.TrimPrefix(c.Key, prefix), Size: c.Size})
+		}
+		if !result.Truncated || result.Next == "" {
+			return entries, nil
+		}
+		token = result.Next
+	}
+}
+
+func matchGlobs(rel string, include, exclude []string) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(p, path.Base(rel)); ok && !strings.Contains(p, "/") {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(include) == 0 || match(include)) && !match(exclude)
+}
+
+// DirectoryFilter chooses the files below a remote directory AddDirectory
+// queues: those passing every condition given. Globs are matched as by
+// matchGlobs and regular expressions against the path below the
+// directory, where including needs one of them to match. Files the listing
+// gives no size for pass the size limits.
+type DirectoryFilter struct {
+	Include      []string `json:"include,omitempty"`
+	Exclude      []string `json:"exclude,omitempty"`
+	IncludeRegex []string `json:"include_regex,omitempty"`
+	ExcludeRegex []string `json:"exclude_regex,omitempty"`
+	MinSize      int64    `json:"min_size,omitempty"`
+	MaxSize      int64    `json:"max_size,omitempty"`
+	// Level is how many levels deep files are taken from, 1 being the files
+	// directly in the directory. 0 goes down to MaxListingDepth.
+	Level int `json:"level,omitempty"`
+}
+
+type directoryMatcher struct {
+	DirectoryFilter
+	include, exclude []*regexp.Regexp
+}
+
+func (f DirectoryFilter) matcher() (*directoryMatcher, error) {
+	if f.MinSize < 0 || f.MaxSize < 0 || f.Level < 0 {
+		return nil, errors.New("min_size, max_size and level can not be negative")
+	}
+	if f.MaxSize > 0 && f.MaxSize < f.MinSize {
+		return nil, errors.New("max_size is below min_size")
+	}
+	m := &directoryMatcher{DirectoryFilter: f}
+	for _, list := range []struct {
+		patterns []string
+		to       *[]*regexp.Regexp
+	}{{f.IncludeRegex, &m.include}, {f.ExcludeRegex, &m.exclude}} {
+		for _, p := range list.patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, err
+			}
+			*list.to = append(*list.to, re)
+		}
+	}
+	return m, nil
+}
+
+func (m *directoryMatcher) matches(rel string, size int64) bool {
+	if !matchGlobs(rel, m.Include, m.Exclude) {
+		return false
+	}
+	if m.Level > 0 && strings.Count(rel, "/") >= m.Level {
+		return false
+	}
+	if size >= 0 && (size < m.MinSize || m.MaxSize > 0 && size > m.MaxSize) {
+		return false
+	}
+	match := func(res []*regexp.Regexp) bool {
+		for _, re := range res {
+			if re.MatchString(rel) {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(m.include) == 0 || match(m.include)) && !match(m.exclude)
+}
+
+// AddDirectory queues every file below rawUrl that passes filter, keeping
+// the remote structure below dir. All of them get tag, "dir:" and the name
+// of the remote directory by default, so they can be controlled together
+// and followed with JobProgress.
+func (m *Manager) AddDirectory(ctx context.Context, rawUrl, dir string, filter DirectoryFilter, tag, group string) ([]DownloadInfo, error) {
+	return m.addDirectory(ctx, rawUrl, dir, filter, tag, group, "")
+}
+
+func (m *Manager) addDirectory(ctx context.Context, rawUrl, dir string, filter DirectoryFilter, tag, group, tenant string) ([]DownloadInfo, error) {
+	matcher, err := filter.matcher()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := listRemote(ctx, rawUrl, nil, filter.Level)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		u, _ := url.Parse(rawUrl)
+		tag = "dir:" + path.Base(strings.TrimSuffix(u.Path, "/"))
+	}
+	var list = []DownloadInfo{}
+	for _, e := range entries {
+		rel := path.Clean(e.Path)
+		if rel == "." || strings.HasPrefix(rel, "../") || !matcher.matches(rel, e.Size) {
+			continue
+		}
+		root := dir
+		if root == "" {
+			m.mu.Lock()
+			if root = m.place(rel, e.Size); root == "" {
+				root = m.Dir
+			}
+			m.mu.Unlock()
+		}
+		sub := root
+		if parent := path.Dir(rel); parent != "." {
+			for _, segment := range strings.Split(parent, "/") {
+				sub = filepath.Join(sub, SanitizeFilename(segment))
+			}
+		}
+		info, err := m.add(e.Url, sub, path.Base(rel), func(d *Download) {
+			d.tags = append(d.tags, tag)
+			d.group, d.tenant = group, tenant
+			if dir == "" && root != m.Dir {
+				d.dataDir, d.reserved = root, e.Size
+			}
+		})
+		if err != nil && !errors.Is(err, ErrDuplicate) {
+			return list, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func (m *Manager) JobProgress(filter Filter) JobProgress {
+	var p JobProgress
+	for _, d := range m.Find(filter) {
+		p.Files++
+		switch d.State {
+		case StateFinished:
+			p.Finished++
+		case StateFailed:
+			p.Failed++
+		}
+		p.Downloaded += d.Downloaded
+		p.Speed += d.Speed
+		if d.Total < 0 || p.Total < 0 {
+			p.Total = -1
+		} else {
+			p.Total += d.Total
+		}
+	}
+	return p
+}
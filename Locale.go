@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Catalog maps messages shown to people, in English and format strings as
+// they are, to their translation. Messages missing from it stay in English.
+type Catalog map[string]string
+
+var catalogs = struct {
+	mu     sync.RWMutex
+	byLang map[string]Catalog
+	active Catalog
+}{byLang: map[string]Catalog{"es": catalogES}}
+
+// RegisterCatalog adds the translations of c to the catalog of lang, such
+// as "es" or "pt_BR", replacing those it already had.
+func RegisterCatalog(lang string, c Catalog) {
+	lang = languageTag(lang)
+	catalogs.mu.Lock()
+	defer catalogs.mu.Unlock()
+	merged := Catalog{}
+	for k, v := range catalogs.byLang[lang] {
+		merged[k] = v
+	}
+	for k, v := range c {
+		merged[k] = v
+	}
+	catalogs.byLang[lang] = merged
+}
+
+// languageTag turns es_MX.UTF-8, es-MX and es_MX@euro into es_MX.
+func languageTag(lang string) string {
+	lang, _, _ = strings.Cut(lang, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	return strings.ReplaceAll(strings.TrimSpace(lang), "-", "_")
+}
+
+// SetLanguage translates messages to lang from then on, with its own
+// catalog or that of its language without the region. English, C and POSIX,
+// and an empty lang, leave them untranslated.
+func SetLanguage(lang string) error {
+	lang = languageTag(lang)
+	catalogs.mu.Lock()
+	defer catalogs.mu.Unlock()
+	base, _, _ := strings.Cut(lang, "_")
+	switch base {
+	case "", "C", "POSIX", "en":
+		catalogs.active = nil
+		return nil
+	}
+	for _, tag := range []string{lang, base} {
+		if c, ok := catalogs.byLang[tag]; ok {
+			catalogs.active = c
+			return nil
+		}
+	}
+	catalogs.active = nil
+	return fmt.Errorf("no translation for language %q, messages stay in English", lang)
+}
+
+// systemLanguage is the language of the messages as the locale sets it.
+func systemLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if lang := os.Getenv(name); lang != "" {
+			return lang
+		}
+	}
+	return ""
+}
+
+// LoadLanguage loads the catalogs in the locale directory of the user's
+// configuration directory, cdm/locale/lang.json, and translates to lang,
+// or to the language of the locale when it is empty. A catalog that can not
+// be read is left out and reported.
+func LoadLanguage(lang string) error {
+	var errs []error
+	if dir, err := os.UserConfigDir(); err == nil {
+		names, _ := filepath.Glob(filepath.Join(dir, "cdm", "locale", "*.json"))
+		for _, name := range names {
+			var c Catalog
+			b, err := os.ReadFile(name)
+			if err == nil {
+				err = json.Unmarshal(b, &c)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			RegisterCatalog(strings.TrimSuffix(filepath.Base(name), ".json"), c)
+		}
+	}
+	if lang != "" {
+		errs = append(errs, SetLanguage(lang))
+	} else {
+		// A locale without a catalog is no mistake of the user's.
+		SetLanguage(systemLanguage())
+	}
+	return errors.Join(errs...)
+}
+
+func tr(message string) string {
+	catalogs.mu.RLock()
+	defer catalogs.mu.RUnlock()
+	if t, ok := catalogs.active[message]; ok {
+		return t
+	}
+	return message
+}
+
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
+
+// localizedErrors are the errors whose text is translated where it appears
+// in an error message; the rest of the message, such as a URL or a status,
+// stays as it is. Texts containing others come first.
+var localizedErrors = []error{
+	ErrBlockChecksum, ErrCanceled, ErrPartial, ErrChecksumMismatch, ErrRangeIgnored,
+	ErrStalled, ErrTooSlow, ErrTooLarge, ErrTooSmall, ErrQuota, ErrMaxLifetime, ErrNoProgress,
+	ErrRedirect, ErrBlockedAddress, ErrUnexpectedContent, ErrNoChecksum, syscall.ENOSPC,
+}
+
+func trError(message string) string {
+	for _, err := range localizedErrors {
+		if text := err.Error(); strings.Contains(message, text) {
+			message = strings.ReplaceAll(message, text, tr(text))
+		}
+	}
+	return message
+}
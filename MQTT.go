@@ -0,0 +1,417 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// MQTTKeepAlive is how often the intake pings the broker when idle.
+	MQTTKeepAlive = 60 * time.Second
+	// MQTTPoll is how often the intake looks for downloads of its jobs
+	// that ended.
+	MQTTPoll = time.Second
+)
+
+// EventRejected is the type of the result of a message that is not a job.
+const EventRejected = "rejected"
+
+var ErrMQTTRefused = errors.New("mqtt broker refused the connection")
+
+// MQTTResult is the message published for a job once its download ended:
+// the download as the events API shows it, with the state it ended in as
+// the type, and the job it was added from.
+type MQTTResult struct {
+	StreamEvent
+	Job json.RawMessage `json:"job"`
+}
+
+// MQTTIntake adds the jobs published to an MQTT 3.1.1 topic to a Manager,
+// each message a JSON job as cdm import reads it. It subscribes with QoS 1
+// and a persistent session, and acknowledges a message only once its
+// download finished, failed or was canceled or removed, so that the broker
+// delivers the jobs of a daemon that stopped before then again. The end of
+// every download is published to ResultTopic, if set, as an MQTTResult.
+type MQTTIntake struct {
+	// Broker is mqtt://[user:password@]host[:port]/topic, or mqtts:// for
+	// TLS. The topic may hold the wildcards + and #.
+	Broker      string
+	ResultTopic string
+	ClientId    string
+	Manager     *Manager
+
+	mu sync.Mutex
+	// conn is the connection of the current session, and pending the
+	// messages received on it, in order, until they are acknowledged.
+	conn    net.Conn
+	pending []*mqttJob
+}
+
+type mqttJob struct {
+	packet uint16
+	id     int
+	job    json.RawMessage
+	done   bool
+}
+
+// mqttMessage is a PUBLISH packet received.
+type mqttMessage struct {
+	packet  uint16
+	qos     byte
+	topic   string
+	payload []byte
+}
+
+func NewMQTTIntake(broker, resultTopic, clientId string, m *Manager) (*MQTTIntake, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid broker %q, want mqtt://[user:password@]host[:port]/topic", broker)
+	}
+	if clientId == "" {
+		host, _ := os.Hostname()
+		clientId = "cdm-" + host
+	}
+	return &MQTTIntake{Broker: broker, ResultTopic: resultTopic, ClientId: clientId, Manager: m}, nil
+}
+
+// Run keeps the intake connected until ctx ends, connecting again after an
+// error with a growing delay of up to a minute.
+func (q *MQTTIntake) Run(ctx context.Context) error {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := q.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		slog.Warn("mqtt intake disconnected", "broker", withoutPassword(q.Broker), "err", err, "retry", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+func (q *MQTTIntake) session(ctx context.Context) error {
+	u, _ := url.Parse(q.Broker)
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	password, hasPassword := u.User.Password()
+	if err := q.write(conn, mqttConnect(q.ClientId, u.User.Username(), password, hasPassword)); err != nil {
+		return err
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ>>4 != 2 || len(body) < 2 {
+		return fmt.Errorf("mqtt: expected CONNACK, got packet type %d", typ>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("%w: return code %d", ErrMQTTRefused, body[1])
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if err := q.write(conn, mqttSubscribe(1, topic)); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	q.mu.Lock()
+	q.conn, q.pending = conn, nil
+	q.mu.Unlock()
+	slog.Info("mqtt intake subscribed", "broker", withoutPassword(q.Broker), "topic", topic)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ping := time.NewTicker(MQTTKeepAlive / 2)
+		defer ping.Stop()
+		poll := time.NewTicker(MQTTPoll)
+		defer poll.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ping.C:
+				q.write(conn, []byte{0xc0, 0})
+			case <-poll.C:
+				q.poll(conn)
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(MQTTKeepAlive * 3 / 2))
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		switch typ >> 4 {
+		case 3:
+			msg, err := parseMQTTPublish(typ, body)
+			if err != nil {
+				return err
+			}
+			q.receive(conn, msg)
+		case 9:
+			if len(body) < 3 || body[2] == 0x80 {
+				return fmt.Errorf("mqtt: subscription to %s refused", topic)
+			}
+		}
+	}
+}
+
+// receive adds the job of msg. A message that is not a job is answered
+// right away, with a rejected result.
+func (q *MQTTIntake) receive(conn net.Conn, msg mqttMessage) {
+	var job Job
+	err := json.Unmarshal(msg.payload, &job)
+	if err == nil {
+		err = q.Manager.checkDir(job.Dir)
+	}
+	var info DownloadInfo
+	if err == nil {
+		info, err = q.Manager.Import(job)
+		if errors.Is(err, ErrDuplicate) {
+			err = nil
+		}
+	}
+	if errors.Is(err, ErrDraining) {
+		// Left unacknowledged for the broker to deliver again once the
+		// daemon takes jobs.
+		slog.Info("mqtt job left to the broker while draining", "topic", msg.topic)
+		return
+	}
+	pending := &mqttJob{packet: msg.packet, id: info.Id, job: json.RawMessage(msg.payload)}
+	if err != nil {
+		slog.Warn("mqtt job rejected", "topic", msg.topic, "err", err)
+		if !json.Valid(msg.payload) {
+			pending.job, _ = json.Marshal(string(msg.payload))
+		}
+		event := StreamEvent{Type: EventRejected}
+		event.Error = err.Error()
+		q.result(conn, MQTTResult{event, pending.job})
+		pending.done = true
+	} else {
+		slog.Info("mqtt job added", "id", info.Id, "url", info.Url)
+	}
+	q.mu.Lock()
+	if q.conn == conn {
+		q.pending = append(q.pending, pending)
+	}
+	q.mu.Unlock()
+	q.acknowledge(conn)
+}
+
+// poll publishes the results of the downloads that ended.
+func (q *MQTTIntake) poll(conn net.Conn) {
+	q.mu.Lock()
+	var waiting []*mqttJob
+	for _, p := range q.pending {
+		if !p.done && q.conn == conn {
+			waiting = append(waiting, p)
+		}
+	}
+	q.mu.Unlock()
+	for _, p := range waiting {
+		info, err := q.Manager.Get(p.id)
+		event := StreamEvent{Type: info.State, DownloadInfo: info}
+		switch {
+		case errors.Is(err, ErrNotFound):
+			event.Type, event.Id = EventRemoved, p.id
+		case err != nil:
+			continue
+		}
+		if ended(event.Type) || event.Type == EventRemoved {
+			q.result(conn, MQTTResult{event, p.job})
+			q.mu.Lock()
+			p.done = true
+			q.mu.Unlock()
+		}
+	}
+	q.acknowledge(conn)
+}
+
+// acknowledge sends the PUBACKs of the messages whose downloads ended, in
+// the order the messages came as MQTT requires, so a long download holds
+// back those of the jobs after it.
+func (q *MQTTIntake) acknowledge(conn net.Conn) {
+	q.mu.Lock()
+	var acks []uint16
+	for q.conn == conn && len(q.pending) > 0 && q.pending[0].done {
+		if q.pending[0].packet != 0 {
+			acks = append(acks, q.pending[0].packet)
+		}
+		q.pending = q.pending[1:]
+	}
+	q.mu.Unlock()
+	for _, packet := range acks {
+		q.write(conn, []byte{0x40, 2, byte(packet >> 8), byte(packet)})
+	}
+}
+
+// result publishes r to ResultTopic with QoS 0.
+func (q *MQTTIntake) result(conn net.Conn, r MQTTResult) {
+	if q.ResultTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	var body []byte
+	body = appendMQTTString(body, q.ResultTopic)
+	body = append(body, payload...)
+	if err := q.write(conn, mqttPacket(0x30, body)); err != nil {
+		slog.Warn("can not publish the mqtt result", "id", r.Id, "err", err)
+	}
+}
+
+func (q *MQTTIntake) write(conn net.Conn, packet []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, err := conn.Write(packet)
+	return err
+}
+
+func mqttConnect(clientId, user, password string, hasPassword bool) []byte {
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	// Level 4 is MQTT 3.1.1, and the session is kept while disconnected.
+	flags := byte(0)
+	if user != "" {
+		flags |= 0x80
+	}
+	if user != "" && hasPassword {
+		flags |= 0x40
+	}
+	keepAlive := uint16(MQTTKeepAlive / time.Second)
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, clientId)
+	if user != "" {
+		body = appendMQTTString(body, user)
+		if hasPassword {
+			body = appendMQTTString(body, password)
+		}
+	}
+	return mqttPacket(0x10, body)
+}
+
+func mqttSubscribe(packet uint16, topic string) []byte {
+	body := []byte{byte(packet >> 8), byte(packet)}
+	body = appendMQTTString(body, topic)
+	return mqttPacket(0x82, append(body, 1))
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads a packet, returning its first byte and the rest of
+// it after the length.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
+
+func parseMQTTPublish(typ byte, body []byte) (mqttMessage, error) {
+	malformed := errors.New("mqtt: malformed PUBLISH")
+	msg := mqttMessage{qos: typ >> 1 & 3}
+	if len(body) < 2 {
+		return msg, malformed
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return msg, malformed
+	}
+	msg.topic, body = string(body[2:2+n]), body[2+n:]
+	if msg.qos > 0 {
+		if len(body) < 2 {
+			return msg, malformed
+		}
+		msg.packet, body = binary.BigEndian.Uint16(body), body[2:]
+	}
+	msg.payload = body
+	return msg, nil
+}
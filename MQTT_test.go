@@ -0,0 +1,285 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+// testBroker is the broker end of a connection of an MQTTIntake.
+type testBroker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func acceptBroker(t *testing.T, l net.Listener) *testBroker {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testBroker{t, conn, bufio.NewReader(conn)}
+}
+
+// read returns the next packet but a PINGREQ.
+func (b *testBroker) read() (byte, []byte) {
+	b.t.Helper()
+	for {
+		typ, body, err := readMQTTPacket(b.r)
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if typ != 0xc0 {
+			return typ, body
+		}
+	}
+}
+
+func (b *testBroker) write(packet []byte) {
+	b.t.Helper()
+	if _, err := b.conn.Write(packet); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func (b *testBroker) publish(packet uint16, topic, payload string) {
+	body := appendMQTTString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, packet)
+	b.write(mqttPacket(0x32, append(body, payload...)))
+}
+
+// handshake takes the CONNECT and SUBSCRIBE of the intake, and returns the
+// body of its CONNECT and the topic it subscribed to.
+func (b *testBroker) handshake() ([]byte, string) {
+	b.t.Helper()
+	typ, connect := b.read()
+	if typ != 0x10 {
+		b.t.Fatalf("expected CONNECT, got %#x", typ)
+	}
+	b.write([]byte{0x20, 2, 0, 0})
+	typ, subscribe := b.read()
+	if typ != 0x82 || len(subscribe) < 5 {
+		b.t.Fatalf("expected SUBSCRIBE, got %#x", typ)
+	}
+	n := int(binary.BigEndian.Uint16(subscribe[2:]))
+	if qos := subscribe[4+n]; qos != 1 {
+		b.t.Fatalf("subscribed with QoS %d", qos)
+	}
+	b.write(mqttPacket(0x90, []byte{subscribe[0], subscribe[1], 1}))
+	return connect, string(subscribe[4 : 4+n])
+}
+
+func fastMQTT(t *testing.T) {
+	poll := MQTTPoll
+	t.Cleanup(func() { MQTTPoll = poll })
+	MQTTPoll = 10 * time.Millisecond
+}
+
+func TestMQTTIntake(t *testing.T) {
+	fastMQTT(t)
+	data := downloadertest.RandomData(256<<10, 50)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithBandwidth(1<<20))
+	defer origin.Close()
+	m := NewManager(t.TempDir(), Config{})
+	defer m.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	q, err := NewMQTTIntake("mqtt://cdm:secret@"+l.Addr().String()+"/jobs/+", "results", "test-client", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	b := acceptBroker(t, l)
+	connect, topic := b.handshake()
+	// MQTT 3.1.1 with user and password, and a session the broker keeps.
+	want := appendMQTTString(nil, "MQTT")
+	want = append(want, 4, 0xc0, 0, byte(MQTTKeepAlive/time.Second))
+	want = appendMQTTString(want, "test-client")
+	want = appendMQTTString(appendMQTTString(want, "cdm"), "secret")
+	if !bytes.Equal(connect, want) {
+		t.Fatalf("CONNECT %x, want %x", connect, want)
+	}
+	if topic != "jobs/+" {
+		t.Fatalf("subscribed to %q", topic)
+	}
+
+	job := `{"version": 1, "url": "` + origin.URL + `", "name": "file"}`
+	b.publish(7, "jobs/a", job)
+	b.publish(8, "jobs/b", "not a job")
+
+	// The message that is not a job is rejected at once, but acknowledged
+	// only after the one before it, whose download takes a while.
+	var results []MQTTResult
+	var acks []uint16
+	for len(acks) < 2 {
+		typ, body := b.read()
+		switch typ >> 4 {
+		case 3:
+			msg, err := parseMQTTPublish(typ, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.topic != "results" || msg.qos != 0 {
+				t.Fatalf("result published to %s with QoS %d", msg.topic, msg.qos)
+			}
+			var r MQTTResult
+			if err := json.Unmarshal(msg.payload, &r); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, r)
+		case 4:
+			if len(results) < 2 {
+				t.Fatalf("PUBACK before the results of both jobs, after %d", len(results))
+			}
+			acks = append(acks, binary.BigEndian.Uint16(body))
+		default:
+			t.Fatalf("unexpected packet %#x", typ)
+		}
+	}
+	if len(acks) != 2 || acks[0] != 7 || acks[1] != 8 {
+		t.Fatalf("acknowledged %v, want [7 8]", acks)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results", len(results))
+	}
+	if r := results[0]; r.Type != EventRejected || r.Error == "" || string(r.Job) != `"not a job"` {
+		t.Fatalf("first result %s %q for %s", r.Type, r.Error, r.Job)
+	}
+	r := results[1]
+	var resultJob Job
+	if err := json.Unmarshal(r.Job, &resultJob); err != nil || r.Type != StateFinished || resultJob.Url != origin.URL {
+		t.Fatalf("second result %s for %s: %v", r.Type, r.Job, err)
+	}
+	got, err := os.ReadFile(r.Path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("the job's download differs from the file served: %v", err)
+	}
+}
+
+func TestMQTTRedelivery(t *testing.T) {
+	fastMQTT(t)
+	data := downloadertest.RandomData(512<<10, 51)
+	origin := downloadertest.NewOrigin(data, downloadertest.WithBandwidth(512<<10))
+	defer origin.Close()
+	m := NewManager(t.TempDir(), Config{})
+	defer m.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	q, err := NewMQTTIntake("mqtt://"+l.Addr().String()+"/jobs", "", "test-client", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	// The broker delivers the job again when the connection is lost before
+	// it was acknowledged, and the job is added once.
+	job := `{"version": 1, "url": "` + origin.URL + `", "name": "file"}`
+	b := acceptBroker(t, l)
+	if connect, _ := b.handshake(); connect[7] != 0 {
+		t.Fatalf("connect flags %#x without credentials", connect[7])
+	}
+	b.publish(1, "jobs", job)
+	waitFor(t, "the job", func() bool { return len(m.List()) == 1 })
+	b.conn.Close()
+
+	b = acceptBroker(t, l)
+	b.handshake()
+	b.publish(2, "jobs", job)
+	if typ, body := b.read(); typ != 0x40 || binary.BigEndian.Uint16(body) != 2 {
+		t.Fatalf("expected the PUBACK of the job, got %#x %x", typ, body)
+	}
+	if list := m.List(); len(list) != 1 || list[0].State != StateFinished {
+		t.Fatalf("the job was added as %+v", list)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readMQTTPacket(bufio.NewReader(conn))
+		// Bad user name or password.
+		conn.Write([]byte{0x20, 2, 0, 4})
+	}()
+	q, err := NewMQTTIntake("mqtt://cdm:wrong@"+l.Addr().String()+"/jobs", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.session(context.Background()); !errors.Is(err, ErrMQTTRefused) {
+		t.Fatalf("connected with a refused CONNACK: %v", err)
+	}
+}
+
+func TestNewMQTTIntake(t *testing.T) {
+	for _, broker := range []string{"http://host/jobs", "mqtt:///jobs", "mqtt://host", "mqtt://host/"} {
+		if _, err := NewMQTTIntake(broker, "", "", nil); err == nil {
+			t.Errorf("%s: accepted", broker)
+		}
+	}
+	q, err := NewMQTTIntake("mqtts://host/jobs/#", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.ClientId == "" {
+		t.Fatal("no client id")
+	}
+}
+
+func TestMQTTPackets(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		packet := mqttPacket(0x30, make([]byte, n))
+		typ, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || typ != 0x30 || len(body) != n {
+			t.Errorf("%d bytes: read %#x with %d bytes: %v", n, typ, len(body), err)
+		}
+	}
+	if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}))); err == nil {
+		t.Error("read a remaining length of five bytes")
+	}
+
+	body := append(appendMQTTString(nil, "a/b"), 0, 9)
+	msg, err := parseMQTTPublish(0x32, append(body, "payload"...))
+	if err != nil || msg.topic != "a/b" || msg.qos != 1 || msg.packet != 9 || string(msg.payload) != "payload" {
+		t.Errorf("QoS 1: %+v, %v", msg, err)
+	}
+	msg, err = parseMQTTPublish(0x30, append(appendMQTTString(nil, "a/b"), "payload"...))
+	if err != nil || msg.qos != 0 || msg.packet != 0 || string(msg.payload) != "payload" {
+		t.Errorf("QoS 0: %+v, %v", msg, err)
+	}
+	for _, body := range [][]byte{nil, {0}, {0, 5, 'a'}, appendMQTTString(nil, "a/b")} {
+		if _, err := parseMQTTPublish(0x32, body); err == nil {
+			t.Errorf("parsed %x", body)
+		}
+	}
+}
@@ -0,0 +1,799 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("download not found")
+	ErrDuplicate = errors.New("url or destination is already in the queue")
+)
+
+const (
+	DuplicateMerge = "merge"
+	DuplicateSkip  = "skip"
+	DuplicateError = "error"
+)
+
+type Config struct {
+	Concurrency      int      `json:"concurrency"`
+	Connections      int      `json:"connections"`
+	RateLimit        int64    `json:"rate_limit"`
+	TotalRateLimit   int64    `json:"total_rate_limit"`
+	TotalConnections int      `json:"total_connections"`
+	Duplicates       string   `json:"duplicates"`
+	Routes           []Route  `json:"routes"`
+	MaxLifetime      int      `json:"max_lifetime"`
+	NoProgress       int      `json:"no_progress"`
+	StuckAction      string   `json:"stuck_action"`
+	NoExtension      bool     `json:"no_extension"`
+	Quotas           []Quota  `json:"quotas"`
+	MemoryBudget     int64    `json:"memory_budget"`
+	PathTemplate     string   `json:"path_template"`
+	Tenants          []Tenant `json:"tenants"`
+	// DataDirs are the directories downloads without a directory or a
+	// route are spread over, by Placement, instead of the download
+	// directory.
+	DataDirs  []string `json:"data_dirs"`
+	Placement string   `json:"placement"`
+	// Post is the post-processing pipeline of downloads added without
+	// one.
+	Post []string `json:"post"`
+	// Coalesce, CoalesceKeepAlive or CoalesceHTTP2, makes the downloads
+	// share a ConnectionPool.
+	Coalesce string `json:"coalesce"`
+	// Domains are the settings of downloads from particular hosts.
+	Domains []DomainRule `json:"domains"`
+}
+
+type Download struct {
+	Id    int
+	Url   string
+	Path  string
+	Added time.Time
+
+	relative    string
+	connections int
+	rateLimit   int64
+	priority    int
+	tags        []string
+	metadata    map[string]string
+	group       string
+	tenant      string
+	maxLifetime time.Duration
+	noProgress  time.Duration
+	checksum    string
+	// job is what the download was added with that Export needs and its
+	// options do not tell.
+	job       Job
+	options   []Option
+	route     bool
+	extension bool
+	remaining []Block
+	size      int64
+	etag      string
+	state     string
+	file      *File
+	err       error
+	// spent is the time earlier attempts of a retried download took.
+	spent Summary
+	// created is set once the download has made its file, which a retry
+	// from the start overwrites without backing it up.
+	created bool
+	// drained is set while the download is paused by Drain.
+	drained bool
+	// dataDir is the data directory place put the download in, and
+	// reserved the size it expected then, -1 when unknown.
+	dataDir  string
+	reserved int64
+	// step is the post-processing step running.
+	step string
+}
+
+type DownloadInfo struct {
+	Progress
+	Path        string            `json:"path"`
+	Added       time.Time         `json:"added"`
+	Connections int               `json:"connections"`
+	RateLimit   int64             `json:"rate_limit"`
+	Priority    int               `json:"priority"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Group       string            `json:"group,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	// Step is the post-processing step running, while the state is
+	// processing.
+	Step string `json:"step,omitempty"`
+	// ServerLimit is the request quota the server advertised, until it
+	// resets.
+	ServerLimit *ServerLimit `json:"server_limit,omitempty"`
+}
+
+type Hooks struct {
+	OnQueued   func(DownloadInfo)
+	OnStarted  func(DownloadInfo)
+	OnFinished func(DownloadInfo)
+	OnFailed   func(DownloadInfo)
+	OnCanceled func(DownloadInfo)
+	OnProgress func(DownloadInfo)
+}
+
+type Manager struct {
+	Dir     string
+	Options []Option
+	Events  *Dispatcher
+	Hooks   Hooks
+
+	// Delivery runs the Hooks, synchronously when nil.
+	Delivery *Delivery
+	// Backups, if set, keeps the files downloads overwrite.
+	Backups *Backups
+	// Namer names downloads added without a name, DefaultFileNamer when
+	// nil.
+	Namer FileNamer
+
+	mu        sync.Mutex
+	config    Config
+	memory    *MemoryBudget
+	downloads []*Download
+	nextId    int
+	stopped   bool
+	draining  bool
+	placed    int
+	pool      *ConnectionPool
+
+	subMu       sync.Mutex
+	subscribers map[chan StreamEvent]bool
+
+	scheduled       []*Scheduled
+	nextScheduledId int
+
+	groups map[string]*groupState
+	// served counts the downloads started per tenant, divided by its weight.
+	served map[string]float64
+}
+
+// setDefaults fills in the settings left at zero, for NewManager and
+// Configure alike.
+func (c *Config) setDefaults() {
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	if c.Connections < 1 {
+		c.Connections = MaxThread
+	}
+	if c.Duplicates == "" {
+		c.Duplicates = DuplicateMerge
+	}
+}
+
+func NewManager(dir string, config Config) *Manager {
+	config.setDefaults()
+	m := &Manager{Dir: dir, config: config, memory: NewMemoryBudget(config.MemoryBudget), nextId: 1, nextScheduledId: 1}
+	m.pool, _ = NewConnectionPool(config.Coalesce)
+	return m
+}
+
+func (m *Manager) Config() Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config
+}
+
+func (m *Manager) Configure(config Config) {
+	m.mu.Lock()
+	config.setDefaults()
+	if config.Coalesce != m.config.Coalesce {
+		if m.pool != nil {
+			m.pool.CloseIdleConnections()
+		}
+		m.pool, _ = NewConnectionPool(config.Coalesce)
+	}
+	m.config = config
+	m.memory.SetLimit(config.MemoryBudget)
+	for _, d := range m.downloads {
+		d.connections, d.rateLimit = config.limits(d.Url)
+		d.maxLifetime = time.Duration(config.MaxLifetime) * time.Second
+		d.noProgress = time.Duration(config.NoProgress) * time.Second
+		if d.state == StateDeferred {
+			d.state, d.err = StateQueued, nil
+		}
+	}
+	m.mu.Unlock()
+
+	m.rebalance()
+	m.schedule()
+}
+
+func ValidDuplicatePolicy(policy string) bool {
+	switch policy {
+	case "", DuplicateMerge, DuplicateSkip, DuplicateError:
+		return true
+	}
+	return false
+}
+
+func (m *Manager) Add(url, dir, name string, opts ...Option) (DownloadInfo, error) {
+	return m.add(url, dir, name, nil, opts...)
+}
+
+func (m *Manager) add(url, dir, name string, setup func(*Download), opts ...Option) (DownloadInfo, error) {
+	d := &Download{Url: url, Added: time.Now(), priority: DefaultPriority, options: opts, state: StateQueued, reserved: -1}
+	if setup != nil {
+		setup(d)
+	}
+	extension := name == ""
+	if name == "" {
+		name = fileName(m.Namer, url)
+	}
+	name = SanitizeFilename(filepath.Base(name))
+	m.mu.Lock()
+	if d.group != "" {
+		m.group(d.group).completed = false
+	}
+	relative := name
+	if m.config.PathTemplate != "" {
+		var err error
+		if relative, err = m.expandPath(d, name); err != nil {
+			m.mu.Unlock()
+			return DownloadInfo{}, err
+		}
+	}
+	extension = extension && !m.config.NoExtension && filepath.Ext(relative) == ""
+	var route bool
+	if rule, ok := m.config.domainRule(url); ok && dir == "" {
+		dir = rule.Dir
+	}
+	if dir == "" {
+		var ok bool
+		if dir, ok = routeDir(m.config.Routes, name, ""); !ok {
+			dir, route = m.Dir, hasContentTypeRoutes(m.config.Routes)
+			if placed := m.place(relative, d.reserved); placed != "" {
+				dir, d.dataDir = placed, placed
+			}
+		}
+	}
+	path := filepath.Join(m.resolveDir(dir), relative)
+	for _, d := range m.downloads {
+		if d.Url != url && d.Path != path {
+			continue
+		}
+		requeue := m.config.Duplicates == DuplicateMerge && d.state == StateFailed
+		if requeue {
+			d.state, d.err = StateQueued, nil
+			d.retireFile()
+		}
+		info := d.info()
+		m.mu.Unlock()
+		if requeue {
+			m.hook(d, EventQueued, m.Hooks.OnQueued)
+			m.schedule()
+		}
+		return info, ErrDuplicate
+	}
+	if m.draining {
+		m.mu.Unlock()
+		return DownloadInfo{}, ErrDraining
+	}
+	if err := m.admitTenant(d); err != nil {
+		m.mu.Unlock()
+		return DownloadInfo{}, err
+	}
+	d.Id, d.Path, d.relative = m.nextId, path, relative
+	d.connections, d.rateLimit = m.config.limits(url)
+	d.maxLifetime = time.Duration(m.config.MaxLifetime) * time.Second
+	d.noProgress = time.Duration(m.config.NoProgress) * time.Second
+	d.route, d.extension = route, extension
+	m.nextId++
+	m.downloads = append(m.downloads, d)
+	info := d.info()
+	m.mu.Unlock()
+
+	m.hook(d, EventAdded, m.Hooks.OnQueued)
+	m.schedule()
+	return info, nil
+}
+
+func (m *Manager) Get(id int) (DownloadInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.downloads {
+		if d.Id == id {
+			return d.info(), nil
+		}
+	}
+	return DownloadInfo{}, ErrNotFound
+}
+
+func (m *Manager) List() []DownloadInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list = make([]DownloadInfo, 0, len(m.downloads))
+	for _, d := range m.downloads {
+		list = append(list, d.info())
+	}
+	return list
+}
+
+func (m *Manager) Summary(id int) (Summary, error) {
+	d, err := m.find(id)
+	if err != nil {
+		return Summary{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return d.summary(), nil
+}
+
+func (m *Manager) Summaries(filter Filter) []Summary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var summaries = make([]Summary, 0, len(m.downloads))
+	for _, d := range m.downloads {
+		if filter.matches(d) {
+			summaries = append(summaries, d.summary())
+		}
+	}
+	return summaries
+}
+
+func (m *Manager) Pause(id int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	file := d.file
+	held := d.state == StateQueued
+	if held {
+		d.state = StatePaused
+	}
+	m.mu.Unlock()
+	if held {
+		m.publish(d, EventPaused)
+	}
+	if file != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), PauseTimeout)
+		defer cancel()
+		if _, err := file.PauseContext(ctx); err != nil && !errors.Is(err, ErrNotRunning) && !errors.Is(err, ErrNotStarted) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) Resume(id int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	file := d.file
+	held := file == nil && d.state == StatePaused
+	paused := file != nil && d.state == StatePaused
+	switch {
+	case held:
+		d.state = StateQueued
+	case paused:
+		d.state = StateDownloading
+		d.err = nil
+	}
+	m.mu.Unlock()
+	if held {
+		m.publish(d, EventResumed)
+		m.schedule()
+	}
+	if paused {
+		m.rebalance()
+		file.Resume()
+		m.publish(d, EventResumed)
+	}
+	return nil
+}
+
+func (m *Manager) Cancel(id int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	switch d.state {
+	case StateQueued, StateDownloading, StatePaused, StateDeferred:
+	default:
+		m.mu.Unlock()
+		return nil
+	}
+	d.state = StateCanceled
+	file := d.file
+	m.mu.Unlock()
+
+	if file != nil {
+		file.Cancel()
+		file.Stream.Close()
+		m.mu.Lock()
+		d.keepPartial()
+		m.mu.Unlock()
+	}
+	m.rebalance()
+	m.hook(d, EventCanceled, m.Hooks.OnCanceled)
+	m.schedule()
+	return nil
+}
+
+func (m *Manager) Remove(id int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.Cancel(id)
+	m.mu.Lock()
+	for i, item := range m.downloads {
+		if item == d {
+			m.downloads = append(m.downloads[:i], m.downloads[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	m.publish(d, EventRemoved)
+	m.completeGroup(d)
+	return nil
+}
+
+func (m *Manager) History(id int) ([]int64, error) {
+	d, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	file := d.file
+	m.mu.Unlock()
+	if file == nil {
+		return []int64{}, nil
+	}
+	return file.SpeedHistory(), nil
+}
+
+func (m *Manager) SetConnections(id, n int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	d.connections = n
+	m.mu.Unlock()
+	m.rebalance()
+	return nil
+}
+
+func (m *Manager) SetRateLimit(id int, bytesPerSecond int64) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	d.rateLimit = bytesPerSecond
+	m.mu.Unlock()
+	m.rebalance()
+	return nil
+}
+
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	var files []*File
+	for _, d := range m.downloads {
+		if d.file != nil && (d.state == StateDownloading || d.state == StatePaused) {
+			files = append(files, d.file)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, file := range files {
+		ctx, cancel := context.WithTimeout(context.Background(), PauseTimeout)
+		if _, err := file.PauseContext(ctx); err != nil && !errors.Is(err, ErrNotRunning) && !errors.Is(err, ErrNotStarted) {
+			slog.Warn("download did not stop cleanly", "url", file.Url, "err", err)
+		}
+		cancel()
+	}
+}
+
+func (m *Manager) find(id int) (*Download, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.downloads {
+		if d.Id == id {
+			return d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Manager) schedule() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped || m.draining {
+		return
+	}
+	var active int
+	running := map[string]int{}
+	for _, d := range m.downloads {
+		if d.state == StateDownloading || (d.state == StatePaused && d.file != nil) {
+			active++
+			running[d.tenant]++
+		}
+	}
+	for active < m.config.Concurrency && (m.config.TotalConnections <= 0 || active < m.config.TotalConnections) {
+		d := m.nextQueued(running)
+		if d == nil {
+			return
+		}
+		d.state = StateDownloading
+		active++
+		running[d.tenant]++
+		go m.start(d)
+	}
+}
+
+func (m *Manager) start(d *Download) {
+	m.mu.Lock()
+	opts := append([]Option{WithConnections(d.connections), WithRateLimit(d.rateLimit), WithCancelCleanup(CleanupNone), WithMemoryBudget(m.memory), WithWritePriority(d.priority)}, m.Options...)
+	if m.pool != nil {
+		opts = append(opts, WithConnectionPool(m.pool))
+	}
+	if rule, ok := m.config.domainRule(d.Url); ok {
+		opts = append(opts, rule.options()...)
+	}
+	opts = append(opts, d.options...)
+	routes := m.config.Routes
+	remaining, size, etag := d.remaining, d.size, d.etag
+	route, extension := d.route, d.extension
+	d.remaining = nil
+	m.mu.Unlock()
+
+	if remaining != nil {
+		if stream, file := continuePartial(d, remaining, size, etag, opts); file != nil {
+			if deferred, err := m.admit(d, file.Size); err != nil {
+				stream.Close()
+				m.mu.Lock()
+				d.remaining, d.size, d.etag = remaining, size, etag
+				m.mu.Unlock()
+				m.refuse(d, deferred, err)
+				return
+			}
+			m.run(d, stream, file)
+			return
+		}
+	}
+	if route || extension {
+		if inspection, err := Inspect(d.Url, opts...); err == nil {
+			m.mu.Lock()
+			if extension {
+				d.Path, d.extension = withExtension(d.Path, inspection.ContentType), false
+				d.relative = withExtension(d.relative, inspection.ContentType)
+			}
+			if dir, ok := routeDir(routes, "", inspection.ContentType); ok && route {
+				d.Path, d.dataDir = filepath.Join(m.resolveDir(dir), d.relative), ""
+			}
+			m.mu.Unlock()
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(d.Path), 0755); err != nil {
+		m.fail(d, err)
+		return
+	}
+	if m.Backups != nil && !d.created {
+		if _, err := m.Backups.Save(d.Path, d.Url); err != nil {
+			m.fail(d, err)
+			return
+		}
+	}
+	stream, err := os.Create(d.Path)
+	if err != nil {
+		m.fail(d, err)
+		return
+	}
+	d.created = true
+	file, err := New(d.Url, stream, opts...)
+	if err != nil {
+		stream.Close()
+		m.fail(d, err)
+		return
+	}
+	if deferred, err := m.admit(d, file.Size); err != nil {
+		stream.Close()
+		os.Remove(d.Path)
+		m.refuse(d, deferred, err)
+		return
+	}
+	m.run(d, stream, file)
+}
+
+func (m *Manager) run(d *Download, stream *os.File, file *File) {
+	file.OnPause = func() {
+		m.mu.Lock()
+		if d.state == StateDownloading {
+			d.state = StatePaused
+		}
+		m.mu.Unlock()
+		m.rebalance()
+		m.publish(d, EventPaused)
+	}
+	file.OnFinish = func() {
+		stream.Close()
+		if d.checksum != "" {
+			if _, err := VerifySHA256(d.Path, d.checksum); err != nil {
+				m.fail(d, err)
+				return
+			}
+		}
+		if err := m.postProcess(d); err != nil {
+			m.fail(d, err)
+			return
+		}
+		m.mu.Lock()
+		d.state = StateFinished
+		m.mu.Unlock()
+		m.rebalance()
+		m.notify(d, EventFinished)
+		m.hook(d, EventFinished, m.Hooks.OnFinished)
+		m.completeGroup(d)
+		m.schedule()
+	}
+	file.OnError = func(errCode int, err error) {
+		m.mu.Lock()
+		d.err = err
+		m.mu.Unlock()
+		switch errCode {
+		case ErrDownload:
+			stream.Close()
+			m.fail(d, err)
+		case ErrDiskFull:
+			m.publish(d, EventDiskFull)
+			m.notify(d, EventDiskFull)
+		}
+	}
+	file.OnThrottle = func(ServerLimit) {
+		m.publish(d, EventThrottled)
+		m.notify(d, EventThrottled)
+	}
+
+	if m.Hooks.OnProgress != nil {
+		file.onProgress = func(Progress) {
+			m.mu.Lock()
+			info := d.info()
+			m.mu.Unlock()
+			m.Delivery.deliver(func() { m.Hooks.OnProgress(info) }, true)
+		}
+	}
+
+	m.mu.Lock()
+	d.file = file
+	canceled := d.state == StateCanceled
+	m.mu.Unlock()
+	if canceled {
+		stream.Close()
+		return
+	}
+	m.hook(d, EventStarted, m.Hooks.OnStarted)
+	m.rebalance()
+	file.Start()
+	go m.watch(d, file)
+}
+
+func (m *Manager) fail(d *Download, err error) {
+	m.mu.Lock()
+	if d.state == StateCanceled {
+		m.mu.Unlock()
+		return
+	}
+	d.state = StateFailed
+	d.err = err
+	d.keepPartial()
+	m.mu.Unlock()
+	m.rebalance()
+	m.notify(d, EventFailed)
+	m.hook(d, EventFailed, m.Hooks.OnFailed)
+	m.schedule()
+}
+
+func (m *Manager) hook(d *Download, typ string, fn func(DownloadInfo)) {
+	m.publish(d, typ)
+	if fn == nil {
+		return
+	}
+	m.mu.Lock()
+	info := d.info()
+	m.mu.Unlock()
+	m.Delivery.deliver(func() { fn(info) }, false)
+}
+
+func (m *Manager) notify(d *Download, typ string) {
+	if m.Events == nil {
+		return
+	}
+	m.mu.Lock()
+	info := d.info()
+	m.mu.Unlock()
+	m.Events.Dispatch(Event{
+		Type:       typ,
+		Url:        d.Url,
+		Path:       d.Path,
+		Size:       info.Total,
+		Downloaded: info.Downloaded,
+		Error:      info.Error,
+		Tags:       info.Tags,
+		Metadata:   info.Metadata,
+		Group:      d.group,
+	})
+}
+
+func (d *Download) info() DownloadInfo {
+	info := DownloadInfo{
+		Progress:    Progress{Url: d.Url, Total: -1, Eta: -1},
+		Path:        d.Path,
+		Added:       d.Added,
+		Connections: d.connections,
+		RateLimit:   d.rateLimit,
+		Priority:    d.priority,
+		Tags:        d.tags,
+		Metadata:    d.metadata,
+		Group:       d.group,
+		Tenant:      d.tenant,
+		Step:        d.step,
+	}
+	if d.file != nil {
+		info.Progress = d.file.Progress()
+		if limit, ok := d.file.ServerLimit(); ok {
+			info.ServerLimit = &limit
+		}
+	}
+	info.Id = d.Id
+	if d.file == nil || (d.state != StateDownloading && d.state != StatePaused) || info.State == StateIdle {
+		info.State = d.state
+	}
+	if d.err != nil {
+		info.Error = d.err.Error()
+	}
+	return info
+}
+
+// retireFile drops the file of a download that is queued again, keeping the
+// time it took.
+func (d *Download) retireFile() {
+	if d.file == nil {
+		return
+	}
+	s := d.file.Summary()
+	d.spent.Elapsed += s.Elapsed
+	d.spent.Active += s.Active
+	d.spent.Stalled += s.Stalled
+	d.spent.Paused += s.Paused
+	d.file = nil
+}
+
+func (d *Download) summary() Summary {
+	s := Summary{Url: d.Url}
+	if d.file != nil {
+		s = d.file.Summary()
+	}
+	s.Elapsed += d.spent.Elapsed
+	s.Active += d.spent.Active
+	s.Stalled += d.spent.Stalled
+	s.Paused += d.spent.Paused
+	s.Id, s.Path = d.Id, d.Path
+	s.Tags, s.Metadata = d.tags, d.metadata
+	if d.file == nil || (d.state != StateDownloading && d.state != StatePaused) {
+		s.State = d.state
+	}
+	if d.err != nil {
+		s.Error = d.err.Error()
+	}
+	return s
+}
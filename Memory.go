@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type memoryBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (m *memoryBuffer) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.buf)) {
+		if end > int64(cap(m.buf)) {
+			grown := make([]byte, end, max(end, int64(cap(m.buf))*2))
+			copy(grown, m.buf)
+			m.buf = grown
+		}
+		m.buf = m.buf[:end]
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memoryBuffer) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.buf
+}
+
+func DownloadBytes(ctx context.Context, url string, opts ...Option) ([]byte, error) {
+	buf := &memoryBuffer{}
+	f, err := New(url, nil, append(opts, WithWriterAt(buf))...)
+	if err != nil {
+		return nil, err
+	}
+	if f.Size > 0 {
+		buf.buf = make([]byte, 0, f.Size)
+	}
+	if err := f.Run(ctx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DownloadToWriter(ctx context.Context, url string, w io.Writer, opts ...Option) (int64, error) {
+	b, err := DownloadBytes(ctx, url, opts...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
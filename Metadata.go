@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+)
+
+func (f *File) applyMetadata() {
+	if f.Stream == nil {
+		return
+	}
+	name := f.Stream.Name()
+	if f.remoteTime && !f.LastModified.IsZero() {
+		if err := os.Chtimes(name, f.LastModified, f.LastModified); err != nil {
+			slog.Warn("can not set modification time", "path", name, "err", err)
+		}
+	}
+	if !f.xattrs {
+		return
+	}
+
+	attrs := map[string]string{"user.xdg.origin.url": f.Url}
+	if f.ContentType != "" {
+		attrs["user.mime_type"] = f.ContentType
+	}
+	if f.xattrChecksum {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f.Stream, 0, 1<<62)); err != nil {
+			slog.Warn("can not hash file", "path", name, "err", err)
+		} else {
+			attrs[checksumXattr] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	for key, value := range attrs {
+		if err := setXattr(name, key, value); err != nil {
+			slog.Warn("can not set extended attribute", "path", name, "attr", key, "err", err)
+		}
+	}
+}
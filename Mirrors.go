@@ -0,0 +1,263 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	MirrorProbeSize int64 = 64 << 10
+	MirrorRecheck         = time.Minute
+	MirrorPenalty         = 30 * time.Second
+	// A request to a mirror is moved to another one when its speed stays
+	// below MirrorSwitchRatio of that mirror's for MirrorSwitchTime.
+	MirrorSwitchTime  = 10 * time.Second
+	MirrorSwitchRatio = 0.25
+)
+
+type Mirror struct {
+	Url     string        `json:"url"`
+	Latency time.Duration `json:"latency"`
+	Speed   int64         `json:"speed"`
+	Bytes   int64         `json:"bytes"`
+	Errors  int           `json:"errors"`
+	Usable  bool          `json:"usable"`
+
+	url      *url.URL
+	active   int
+	failures int
+	disabled bool
+	until    time.Time
+}
+
+type mirrors struct {
+	mu   sync.Mutex
+	list []*Mirror
+}
+
+func WithMirrors(urls ...string) Option {
+	return func(f *File) error {
+		if len(urls) == 0 {
+			return nil
+		}
+		s := &mirrors{}
+		for _, rawUrl := range append([]string{f.Url}, urls...) {
+			u, err := url.Parse(rawUrl)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("mirror %s is not an http or https URL", rawUrl)
+			}
+			s.list = append(s.list, &Mirror{Url: rawUrl, url: u})
+		}
+		f.mirrors = s
+		return nil
+	}
+}
+
+func (f *File) Mirrors() []Mirror {
+	if f.mirrors == nil {
+		return nil
+	}
+	f.mirrors.mu.Lock()
+	defer f.mirrors.mu.Unlock()
+	now := time.Now()
+	var list []Mirror
+	for _, m := range f.mirrors.list {
+		c := *m
+		c.Usable = !m.disabled && !now.Before(m.until)
+		list = append(list, c)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Usable != list[j].Usable {
+			return list[i].Usable
+		}
+		return list[i].Speed > list[j].Speed
+	})
+	return list
+}
+
+func (f *File) probeMirrors(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range f.mirrors.list {
+		f.mirrors.mu.Lock()
+		disabled := m.disabled
+		f.mirrors.mu.Unlock()
+		if disabled {
+			continue
+		}
+		wg.Add(1)
+		go func(m *Mirror) {
+			defer wg.Done()
+			latency, speed, err := f.probeMirror(ctx, m.url)
+			f.mirrors.probed(m, latency, speed, err)
+		}(m)
+	}
+	wg.Wait()
+	for _, m := range f.Mirrors() {
+		slog.Debug("mirror", "url", m.Url, "usable", m.Usable, "latency", m.Latency, "speed", m.Speed)
+	}
+}
+
+func (f *File) probeMirror(ctx context.Context, u *url.URL) (time.Duration, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	request.URL, request.Host = u, u.Host
+	request.Header.Set("Range", "bytes=0-"+strconv.FormatInt(min(MirrorProbeSize, f.Size)-1, 10))
+	start := time.Now()
+	resp, err := f.do(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, &mirrorError{fmt.Sprintf("mirror %s: %s", u.Redacted(), resp.Status), resp.StatusCode < 500}
+	}
+	if size := contentRangeSize(resp.Header.Get("Content-Range")); size != f.Size {
+		return 0, 0, &mirrorError{fmt.Sprintf("mirror %s has %d bytes, want %d", u.Redacted(), size, f.Size), true}
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+	return latency, int64(float64(n) / time.Since(start).Seconds()), nil
+}
+
+func (f *File) recheckMirrors(ctx context.Context) {
+	tick := time.NewTicker(MirrorRecheck)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			f.probeMirrors(ctx)
+		}
+	}
+}
+
+type mirrorError struct {
+	msg       string
+	permanent bool
+}
+
+func (e *mirrorError) Error() string {
+	return e.msg
+}
+
+func (s *mirrors) probed(m *Mirror, latency time.Duration, speed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mirrorErr, ok := err.(*mirrorError); ok && mirrorErr.permanent {
+		m.disabled = true
+	}
+	if err != nil {
+		m.Errors++
+		m.until = time.Now().Add(MirrorPenalty)
+		slog.Warn("mirror unavailable", "url", m.url.Redacted(), "err", err)
+		return
+	}
+	m.Latency, m.failures, m.until = latency, 0, time.Time{}
+	if m.Speed == 0 {
+		m.Speed = speed
+	} else {
+		m.Speed = (m.Speed + speed) / 2
+	}
+}
+
+func (s *mirrors) pick() *Mirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var best *Mirror
+	var bestScore float64
+	for _, m := range s.list {
+		if m.disabled || now.Before(m.until) {
+			continue
+		}
+		score := float64(max(m.Speed, 1)) / float64(m.active+1)
+		if best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	if best == nil {
+		best = s.list[0]
+	}
+	best.active++
+	return best
+}
+
+func (s *mirrors) done(m *Mirror, n int64, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.active--
+	m.Bytes += n
+	if n > 0 && elapsed > 0 {
+		speed := int64(float64(n) / elapsed.Seconds())
+		m.Speed = (m.Speed*3 + speed) / 4
+	}
+	if err == nil {
+		m.failures = 0
+		return
+	}
+	if errors.Is(err, ErrSlowMirror) {
+		m.until = time.Now().Add(MirrorPenalty)
+		return
+	}
+	m.Errors++
+	m.failures++
+	m.Speed /= 2
+	if mirrorErr, ok := err.(*mirrorError); ok && mirrorErr.permanent && m != s.list[0] {
+		m.disabled = true
+	} else if m.failures >= 3 {
+		m.failures = 0
+		m.until = time.Now().Add(MirrorPenalty)
+	}
+}
+
+// faster returns the fastest usable mirror other than m that a connection
+// getting speed from m would be at least 1/MirrorSwitchRatio times faster
+// on, or nil.
+func (s *mirrors) faster(m *Mirror, speed int64) *Mirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var best *Mirror
+	for _, other := range s.list {
+		if other == m || other.disabled || other.failures > 0 || now.Before(other.until) {
+			continue
+		}
+		if float64(speed) < float64(other.Speed)*MirrorSwitchRatio && (best == nil || other.Speed > best.Speed) {
+			best = other
+		}
+	}
+	return best
+}
+
+func contentRangeSize(header string) int64 {
+	_, size, ok := strings.Cut(header, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
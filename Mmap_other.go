@@ -0,0 +1,23 @@
+//go:build !unix
+
+package downloader
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+type mmapWriter struct{}
+
+func mapFile(file *os.File, size int64) (*mmapWriter, error) {
+	return nil, errors.New("memory-mapped output is not supported on " + runtime.GOOS)
+}
+
+func (m *mmapWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (m *mmapWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+type mmapWriter struct {
+	data []byte
+}
+
+func mapFile(file *os.File, size int64) (*mmapWriter, error) {
+	if err := file.Truncate(size); err != nil {
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapWriter{data: data}, nil
+}
+
+func (m *mmapWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m.data)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the %d byte mapping", len(p), off, len(m.data))
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("can not write to the mapped file: %v", r)
+		}
+	}()
+	return copy(m.data[off:], p), nil
+}
+
+func (m *mmapWriter) Close() error {
+	return syscall.Munmap(m.data)
+}
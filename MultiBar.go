@@ -0,0 +1,160 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RunBars downloads the URLs like Run, but without keys: on a terminal it
+// draws a progress bar per file and one for the total, redrawn in place,
+// and elsewhere it prints a line when a download ends. An interrupt pauses
+// the downloads and returns.
+func (t *Tui) RunBars(terminal bool) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	interval := 200 * time.Millisecond
+	if t.Json {
+		interval = 500 * time.Millisecond
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	t.schedule()
+	var drawn int
+	var reported = map[*tuiItem]bool{}
+	draw := func() {
+		switch {
+		case t.Json:
+			t.render()
+		case terminal:
+			drawn = t.drawBars(drawn)
+		default:
+			t.reportEnded(reported)
+		}
+	}
+	for {
+		finished := t.finished()
+		draw()
+		if finished {
+			return
+		}
+		select {
+		case <-interrupt:
+			t.pauseAll()
+			draw()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func barWidth() int {
+	columns, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || columns <= 0 {
+		columns = 80
+	}
+	return min(max(columns-64, 10), 50)
+}
+
+func (t *Tui) drawBars(drawn int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var bars []bar
+	for _, item := range t.items {
+		var p = Progress{Total: -1}
+		if item.file != nil {
+			p = item.file.Progress()
+		}
+		bars = append(bars, bar{filepath.Base(item.path), p, item.state})
+	}
+	return writeBars(t.Out, drawn, bars)
+}
+
+type bar struct {
+	name  string
+	p     Progress
+	state string
+}
+
+// writeBars draws a line per bar and one for their total over the drawn
+// lines the last call returned, and returns how many it drew.
+func writeBars(w io.Writer, drawn int, bars []bar) int {
+	var b strings.Builder
+	if drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA", drawn)
+	}
+	width := barWidth()
+	line := func(name string, p Progress, state string) {
+		fmt.Fprintf(&b, "\033[2K%-20.20s %s %9s/s  %s %-7s %s\n",
+			name, progressBar(p, width), FormatBytes(p.Speed), tr("ETA"), formatETA(p.Total-p.Downloaded, p.Speed), state)
+	}
+
+	var total Progress
+	var finished int
+	for _, item := range bars {
+		p := item.p
+		line(item.name, p, tr(item.state))
+		total.Downloaded += p.Downloaded
+		total.Speed += p.Speed
+		if p.Total < 0 || total.Total < 0 {
+			total.Total = -1
+		} else {
+			total.Total += p.Total
+		}
+		if item.state == StateFinished {
+			finished++
+		}
+	}
+	if total.Total > 0 {
+		total.Blocks = []BlockProgress{{Begin: 0, End: total.Total - 1, Downloaded: total.Downloaded}}
+	}
+	line(tr("total"), total, trf("%d/%d done", finished, len(bars)))
+	io.WriteString(w, b.String())
+	return len(bars) + 1
+}
+
+func (t *Tui) reportEnded(reported map[*tuiItem]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, item := range t.items {
+		if reported[item] {
+			continue
+		}
+		switch item.state {
+		case StateFinished:
+			fmt.Fprintln(t.Out, trf("%s: finished, %s", item.path, FormatBytes(item.file.Progress().Downloaded)))
+		case StateFailed:
+			fmt.Fprintln(t.Out, trf("%s: failed: %s", item.path, trError(fmt.Sprint(item.err))))
+		case StateCanceled, StatePaused:
+			fmt.Fprintf(t.Out, "%s: %s\n", item.path, tr(item.state))
+		default:
+			continue
+		}
+		reported[item] = true
+	}
+}
+
+func (t *Tui) pauseAll() {
+	t.mu.Lock()
+	var files []*File
+	for _, item := range t.items {
+		switch {
+		case item.state == StateDownloading && item.file != nil:
+			files = append(files, item.file)
+		case item.state == StateDownloading || item.state == StateQueued:
+			item.state = StateCanceled
+		}
+	}
+	t.mu.Unlock()
+	for _, file := range files {
+		file.Pause()
+	}
+}
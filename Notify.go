@@ -0,0 +1,216 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	EventFinished = "finished"
+	EventFailed   = "failed"
+)
+
+type Event struct {
+	Type       string            `json:"type"`
+	Url        string            `json:"url"`
+	Path       string            `json:"path"`
+	Size       int64             `json:"size"`
+	Downloaded int64             `json:"downloaded"`
+	Error      string            `json:"error,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Group      string            `json:"group,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+func (e Event) Message() string {
+	switch e.Type {
+	case EventFinished:
+		return trf("%s finished (%d bytes)", e.Path, e.Downloaded)
+	case EventFailed:
+		return trf("%s failed: %s", e.Path, trError(e.Error))
+	case EventPaused:
+		return trf("%s paused (%d bytes)", e.Path, e.Downloaded)
+	case EventDiskFull:
+		return trf("%s paused, the disk is full: %s", e.Path, trError(e.Error))
+	case EventThrottled:
+		return trf("%s is slowed down to the request quota of the server", e.Path)
+	case EventStuck:
+		return trf("%s stuck: %s", e.Path, trError(e.Error))
+	case EventPruned:
+		return trf("%s removed to stay under its quota", e.Path)
+	case EventCompleted:
+		return trf("group %s completed (%d bytes) in %s", e.Group, e.Downloaded, e.Path)
+	}
+	return fmt.Sprintf("%s %s", e.Path, tr(e.Type))
+}
+
+type Notifier interface {
+	Notify(Event) error
+}
+
+type Dispatcher struct {
+	mu        sync.Mutex
+	notifiers []Notifier
+
+	OnError func(Notifier, error)
+}
+
+func (d *Dispatcher) Add(n Notifier) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.notifiers = append(d.notifiers, n)
+}
+
+func (d *Dispatcher) Dispatch(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	d.mu.Lock()
+	notifiers := append([]Notifier(nil), d.notifiers...)
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, n := range notifiers {
+		wg.Add(1)
+		go func(n Notifier) {
+			defer wg.Done()
+			if err := n.Notify(e); err != nil && d.OnError != nil {
+				d.OnError(n, err)
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+type DesktopNotifier struct{}
+
+func (DesktopNotifier) Notify(e Event) error {
+	title := "Download " + e.Type
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %q with title %q", e.Message(), title))
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", title, e.Message())
+	default:
+		return errors.New("desktop notifications are not supported on " + runtime.GOOS)
+	}
+	return cmd.Run()
+}
+
+// CommandNotifier runs a command, not through a shell, on the events of one
+// type. Each argument is a template of the event's TemplateData, like
+// {{.Path}}.
+type CommandNotifier struct {
+	Type string
+	Args []*template.Template
+}
+
+func NewCommandNotifier(typ, command string) (*CommandNotifier, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	c := &CommandNotifier{Type: typ}
+	for _, arg := range args {
+		t, err := ParseTemplate(arg)
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, t)
+	}
+	return c, nil
+}
+
+func (c *CommandNotifier) Notify(e Event) error {
+	if e.Type != c.Type {
+		return nil
+	}
+	data := newTemplateData(e.Url, filepath.Base(e.Path), e.Time)
+	data.Tags, data.Metadata, data.Group = e.Tags, e.Metadata, e.Group
+	data.Type, data.Path, data.Dir = e.Type, e.Path, filepath.Dir(e.Path)
+	data.Size, data.Downloaded, data.Error = e.Size, e.Downloaded, e.Error
+	if e.Type == EventCompleted {
+		data.Dir = e.Path
+	}
+	args := make([]string, len(c.Args))
+	for i, t := range c.Args {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return err
+		}
+		args[i] = b.String()
+	}
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+const (
+	WebhookJSON     = "json"
+	WebhookSlack    = "slack"
+	WebhookDiscord  = "discord"
+	WebhookTelegram = "telegram"
+)
+
+type WebhookNotifier struct {
+	Url      string
+	Template string
+	ChatId   string
+	Client   *http.Client
+}
+
+func (w *WebhookNotifier) payload(e Event) (interface{}, error) {
+	switch w.Template {
+	case "", WebhookJSON:
+		return e, nil
+	case WebhookSlack:
+		return map[string]string{"text": e.Message()}, nil
+	case WebhookDiscord:
+		return map[string]string{"content": e.Message()}, nil
+	case WebhookTelegram:
+		if w.ChatId == "" {
+			return nil, errors.New("telegram webhook needs a chat id")
+		}
+		return map[string]string{"chat_id": w.ChatId, "text": e.Message()}, nil
+	}
+	return nil, errors.New("unknown webhook template " + w.Template)
+}
+
+func (w *WebhookNotifier) Notify(e Event) error {
+	p, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 10}
+	}
+	resp, err := client.Post(w.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", w.Url, resp.Status)
+	}
+	return nil
+}
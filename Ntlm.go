@@ -0,0 +1,224 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateNTLM            = 0x00000200
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+	ntlmNegotiate128             = 0x20000000
+	ntlmNegotiate56              = 0x80000000
+
+	ntlmFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+type ntlmCredentials struct {
+	Domain   string
+	User     string
+	Password string
+}
+
+func parseNtlmCredentials(s string) ntlmCredentials {
+	var c ntlmCredentials
+	user, password, _ := strings.Cut(s, ":")
+	c.Password = password
+	if domain, name, ok := strings.Cut(user, `\`); ok {
+		c.Domain, c.User = domain, name
+	} else {
+		c.User = user
+	}
+	return c
+}
+
+func (c ntlmCredentials) login() string {
+	if c.Domain == "" {
+		return c.User
+	}
+	return c.Domain + `\` + c.User
+}
+
+func ntlmNegotiateMessage() []byte {
+	var msg = make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNtlmChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	if len(msg) >= 48 {
+		n := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+n > len(msg) {
+			return nil, errors.New("invalid NTLM target info")
+		}
+		c.targetInfo = msg[offset : offset+n]
+	}
+	return c, nil
+}
+
+func (c ntlmCredentials) authenticateMessage(challenge *ntlmChallenge) ([]byte, error) {
+	var clientChallenge = make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	timestamp, hasTimestamp := ntlmAvPair(challenge.targetInfo, ntlmAvTimestamp)
+	if !hasTimestamp {
+		timestamp = ntlmFiletime(time.Now())
+	}
+	nt, lm := ntlmv2Response(c.ntlmv2Hash(), challenge.challenge, clientChallenge, timestamp, challenge.targetInfo)
+	if hasTimestamp {
+		lm = make([]byte, 24)
+	}
+
+	domain, user, workstation := utf16le(c.Domain), utf16le(c.User), []byte{}
+	const header = 64
+	var msg = make([]byte, header)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	var offset = header
+	for i, field := range [][]byte{lm, nt, domain, user, workstation, nil} {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(offset))
+		msg = append(msg, field...)
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], challenge.flags&ntlmFlags)
+	return msg, nil
+}
+
+func (c ntlmCredentials) ntlmv2Hash() []byte {
+	h := hmac.New(md5.New, md4(utf16le(c.Password)))
+	h.Write(utf16le(strings.ToUpper(c.User) + c.Domain))
+	return h.Sum(nil)
+}
+
+func ntlmv2Response(hash, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	var temp []byte
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	h := hmac.New(md5.New, hash)
+	h.Write(serverChallenge)
+	h.Write(temp)
+	nt = append(h.Sum(nil), temp...)
+
+	h.Reset()
+	h.Write(serverChallenge)
+	h.Write(clientChallenge)
+	lm = append(h.Sum(nil), clientChallenge...)
+	return nt, lm
+}
+
+func ntlmAvPair(info []byte, id uint16) ([]byte, bool) {
+	for len(info) >= 4 {
+		avId := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if avId == ntlmAvEOL || len(info) < 4+n {
+			break
+		}
+		if avId == id {
+			return info[4 : 4+n], true
+		}
+		info = info[4+n:]
+	}
+	return nil, false
+}
+
+func ntlmFiletime(t time.Time) []byte {
+	var b = make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+116444736000000000))
+	return b
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+func md4(data []byte) []byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	msg := append(append([]byte{}, data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(data))*8)
+
+	f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+	g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	for i := 0; i < len(msg); i += 64 {
+		var x [16]uint32
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(msg[i+4*j:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		for j := 0; j < 16; j += 4 {
+			a = bits.RotateLeft32(a+f(b, c, d)+x[j], 3)
+			d = bits.RotateLeft32(d+f(a, b, c)+x[j+1], 7)
+			c = bits.RotateLeft32(c+f(d, a, b)+x[j+2], 11)
+			b = bits.RotateLeft32(b+f(c, d, a)+x[j+3], 19)
+		}
+		for j := 0; j < 4; j++ {
+			a = bits.RotateLeft32(a+g(b, c, d)+x[j]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+g(a, b, c)+x[j+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+g(d, a, b)+x[j+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+g(c, d, a)+x[j+12]+0x5a827999, 13)
+		}
+		for _, j := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+h(b, c, d)+x[j]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+h(a, b, c)+x[j+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+h(d, a, b)+x[j+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+h(c, d, a)+x[j+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	var sum []byte
+	for _, v := range []uint32{a, b, c, d} {
+		sum = binary.LittleEndian.AppendUint32(sum, v)
+	}
+	return sum
+}
@@ -0,0 +1,180 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The NTLMv2 example of MS-NLMP 4.2.4.
+var (
+	ntlmTestCredentials = ntlmCredentials{Domain: "Domain", User: "User", Password: "Password"}
+	ntlmTestServer      = fromHex("0123456789abcdef")
+	ntlmTestClient      = fromHex("aaaaaaaaaaaaaaaa")
+	ntlmTestTime        = make([]byte, 8)
+	// MsvAvNbDomainName "Domain", MsvAvNbComputerName "Server", MsvAvEOL.
+	ntlmTestTargetInfo = fromHex("02000c0044006f006d00610069006e00" + "01000c00530065007200760065007200" + "00000000")
+)
+
+func fromHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestMd4(t *testing.T) {
+	// RFC 1320, and NTOWFv1 of MS-NLMP 4.2.2.1.2.
+	for in, want := range map[string]string{
+		"":               "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc":            "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest": "d9130a8164549fe818874806e1c7014b",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		if got := hex.EncodeToString(md4([]byte(in))); got != want {
+			t.Errorf("md4(%q) = %s, want %s", in, got, want)
+		}
+	}
+	if got := hex.EncodeToString(md4(utf16le("Password"))); got != "a4f49c406510bdcab6824ee7c30fd852" {
+		t.Errorf("NTOWFv1 = %s", got)
+	}
+}
+
+func TestNtlmv2(t *testing.T) {
+	hash := ntlmTestCredentials.ntlmv2Hash()
+	if got := hex.EncodeToString(hash); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Fatalf("NTOWFv2 = %s", got)
+	}
+	nt, lm := ntlmv2Response(hash, ntlmTestServer, ntlmTestClient, ntlmTestTime, ntlmTestTargetInfo)
+	if got := hex.EncodeToString(nt[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr = %s", got)
+	}
+	temp := append(fromHex("0101000000000000"), ntlmTestTime...)
+	temp = append(temp, ntlmTestClient...)
+	temp = append(append(append(temp, 0, 0, 0, 0), ntlmTestTargetInfo...), 0, 0, 0, 0)
+	if !bytes.Equal(nt[16:], temp) {
+		t.Errorf("the NTLMv2 client challenge is %x, want %x", nt[16:], temp)
+	}
+	if got := hex.EncodeToString(lm); got != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("LMv2 response = %s", got)
+	}
+}
+
+func TestNtlmNegotiateMessage(t *testing.T) {
+	msg := ntlmNegotiateMessage()
+	if len(msg) != 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 1 {
+		t.Fatalf("negotiate message %x", msg)
+	}
+	if flags := binary.LittleEndian.Uint32(msg[12:]); flags != ntlmFlags {
+		t.Fatalf("negotiate flags %#x, want %#x", flags, ntlmFlags)
+	}
+	// No domain or workstation is supplied.
+	if !bytes.Equal(msg[16:], make([]byte, 16)) {
+		t.Fatalf("negotiate message carries fields: %x", msg[16:])
+	}
+}
+
+// ntlmTestChallenge is a challenge message as a server sends it, with the
+// target info at its end.
+func ntlmTestChallenge(targetInfo []byte) []byte {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmFlags)
+	copy(msg[24:], ntlmTestServer)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(len(msg)))
+	return append(msg, targetInfo...)
+}
+
+func TestNtlmAuthenticateMessage(t *testing.T) {
+	timestamp := fromHex("0090d336b734c301")
+	targetInfo := append(bytes.Clone(ntlmTestTargetInfo[:32]), 7, 0, 8, 0)
+	targetInfo = append(append(targetInfo, timestamp...), 0, 0, 0, 0)
+	challenge, err := parseNtlmChallenge(ntlmTestChallenge(targetInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(challenge.challenge, ntlmTestServer) || !bytes.Equal(challenge.targetInfo, targetInfo) {
+		t.Fatalf("parsed challenge %x and target info %x", challenge.challenge, challenge.targetInfo)
+	}
+
+	msg, err := ntlmTestCredentials.authenticateMessage(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("authenticate message header %x", msg[:12])
+	}
+	// LmChallengeResponse, NtChallengeResponse, DomainName, UserName,
+	// Workstation and EncryptedRandomSessionKey follow the 64 byte header
+	// in this order, each described by length, maximum length and offset.
+	var fields [6][]byte
+	offset := 64
+	for i := range fields {
+		pos := 12 + i*8
+		n := int(binary.LittleEndian.Uint16(msg[pos:]))
+		if max := int(binary.LittleEndian.Uint16(msg[pos+2:])); max != n {
+			t.Fatalf("field %d: length %d, maximum length %d", i, n, max)
+		}
+		if got := int(binary.LittleEndian.Uint32(msg[pos+4:])); got != offset {
+			t.Fatalf("field %d at offset %d, want %d", i, got, offset)
+		}
+		fields[i] = msg[offset : offset+n]
+		offset += n
+	}
+	if offset != len(msg) {
+		t.Fatalf("%d bytes after the fields", len(msg)-offset)
+	}
+	if flags := binary.LittleEndian.Uint32(msg[60:]); flags != ntlmFlags {
+		t.Errorf("authenticate flags %#x, want %#x", flags, ntlmFlags)
+	}
+	lm, nt, domain, user := fields[0], fields[1], fields[2], fields[3]
+	if !bytes.Equal(domain, utf16le("Domain")) || !bytes.Equal(user, utf16le("User")) {
+		t.Errorf("domain %x and user %x", domain, user)
+	}
+	// The server sent a timestamp, so the LMv2 response is zeroed and the
+	// NTLMv2 response carries the timestamp of the server.
+	if !bytes.Equal(lm, make([]byte, 24)) {
+		t.Errorf("LMv2 response %x with a timestamp in the challenge", lm)
+	}
+	if len(nt) != 16+28+len(targetInfo)+4 || !bytes.Equal(nt[24:32], timestamp) {
+		t.Fatalf("NTLMv2 response %x", nt)
+	}
+	want, _ := ntlmv2Response(ntlmTestCredentials.ntlmv2Hash(), ntlmTestServer, nt[32:40], timestamp, targetInfo)
+	if !hmac.Equal(nt, want) {
+		t.Errorf("NTLMv2 response %x, want %x", nt, want)
+	}
+}
+
+func TestNtlmChallengeInvalid(t *testing.T) {
+	valid := ntlmTestChallenge(ntlmTestTargetInfo)
+	tooLong := bytes.Clone(valid)
+	binary.LittleEndian.PutUint16(tooLong[40:], uint16(len(ntlmTestTargetInfo)+1))
+	for name, msg := range map[string][]byte{
+		"short":             valid[:31],
+		"signature":         append([]byte("NTLMSSX\x00"), valid[8:]...),
+		"message type":      append(append(bytes.Clone(valid[:8]), 3, 0, 0, 0), valid[12:]...),
+		"target info range": tooLong,
+	} {
+		if _, err := parseNtlmChallenge(msg); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestParseNtlmCredentials(t *testing.T) {
+	for in, want := range map[string]ntlmCredentials{
+		`CORP\alice:p:w`: {Domain: "CORP", User: "alice", Password: "p:w"},
+		"bob:secret":     {User: "bob", Password: "secret"},
+		"carol":          {User: "carol"},
+	} {
+		if got := parseNtlmCredentials(in); got != want {
+			t.Errorf("%q: %+v, want %+v", in, got, want)
+		}
+	}
+}
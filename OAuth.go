@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenExpiryDelta = time.Second * 10
+
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+func (t *Token) Valid() bool {
+	return t != nil && t.AccessToken != "" && (t.Expiry.IsZero() || time.Now().Add(tokenExpiryDelta).Before(t.Expiry))
+}
+
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+type reuseTokenSource struct {
+	mu    sync.Mutex
+	src   TokenSource
+	token *Token
+}
+
+func (r *reuseTokenSource) Token() (*Token, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.token.Valid() {
+		return r.token, nil
+	}
+	token, err := r.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	r.token = token
+	return token, nil
+}
+
+type ClientCredentials struct {
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	Client       *http.Client
+}
+
+func (c *ClientCredentials) Token() (*Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", c.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(c.ClientId), url.QueryEscape(c.ClientSecret))
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint %s: %s", c.TokenUrl, resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("token endpoint returned no access token")
+	}
+	token := &Token{AccessToken: body.AccessToken, TokenType: body.TokenType}
+	if body.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+func WithTokenSource(src TokenSource) Option {
+	ts := &reuseTokenSource{src: src}
+	return WithRequestHook(func(request *http.Request) error {
+		token, err := ts.Token()
+		if err != nil {
+			return err
+		}
+		typ := token.TokenType
+		if typ == "" || strings.EqualFold(typ, "bearer") {
+			typ = "Bearer"
+		}
+		request.Header.Set("Authorization", typ+" "+token.AccessToken)
+		return nil
+	})
+}
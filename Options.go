@@ -0,0 +1,379 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Option func(*File) error
+
+func WithUserAgent(userAgent string) Option {
+	return WithUserAgents(userAgent)
+}
+
+func WithUserAgents(userAgents ...string) Option {
+	return func(f *File) error {
+		f.userAgents = userAgents
+		return nil
+	}
+}
+
+func WithReferer(referer string) Option {
+	return func(f *File) error {
+		f.referer = referer
+		return nil
+	}
+}
+
+func WithCookies(cookies string) Option {
+	return func(f *File) error {
+		f.cookies = cookies
+		return nil
+	}
+}
+
+func WithHeader(name, value string) Option {
+	return func(f *File) error {
+		if f.headers == nil {
+			f.headers = http.Header{}
+		}
+		f.headers.Add(name, value)
+		return nil
+	}
+}
+
+func withRanges(blocks []Block) Option {
+	return func(f *File) error {
+		f.ranges = blocks
+		return nil
+	}
+}
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *File) error {
+		f.client = client
+		return nil
+	}
+}
+
+func WithLocalAddr(ip net.IP) Option {
+	return func(f *File) error {
+		if ip == nil {
+			return errors.New("invalid local address")
+		}
+		f.localAddr = &net.TCPAddr{IP: ip}
+		return nil
+	}
+}
+
+func WithInterface(name string) Option {
+	return func(f *File) error {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		var fallback net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				f.localAddr = &net.TCPAddr{IP: ipnet.IP}
+				return nil
+			}
+			if fallback == nil {
+				fallback = ipnet.IP
+			}
+		}
+		if fallback == nil {
+			return errors.New("interface " + name + " has no usable address")
+		}
+		f.localAddr = &net.TCPAddr{IP: fallback}
+		return nil
+	}
+}
+
+func WithIPVersion(version int) Option {
+	return func(f *File) error {
+		switch version {
+		case 4:
+			f.network = "tcp4"
+		case 6:
+			f.network = "tcp6"
+		default:
+			return fmt.Errorf("invalid IP version %d", version)
+		}
+		return nil
+	}
+}
+
+func WithResolve(hostPort, addr string) Option {
+	return func(f *File) error {
+		if f.resolve == nil {
+			f.resolve = make(map[string]string)
+		}
+		f.resolve[hostPort] = addr
+		return nil
+	}
+}
+
+func WithDNSServer(addr string) Option {
+	return func(f *File) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		f.dnsServer = addr
+		return nil
+	}
+}
+
+func WithDoH(server string) Option {
+	return func(f *File) error {
+		f.doh = server
+		return nil
+	}
+}
+
+func WithRange(begin, end int64) Option {
+	return func(f *File) error {
+		if begin < 0 || (end >= 0 && end < begin) {
+			return fmt.Errorf("invalid range %d-%d", begin, end)
+		}
+		f.ranged = true
+		f.offset = begin
+		f.rangeEnd = end
+		return nil
+	}
+}
+
+func WithContinue(etag string) Option {
+	return func(f *File) error {
+		f.resume = true
+		f.resumeETag = etag
+		return nil
+	}
+}
+
+func WithIfNewer(modTime time.Time, etag string) Option {
+	return func(f *File) error {
+		f.ifModifiedSince = modTime
+		f.ifNoneMatch = etag
+		return nil
+	}
+}
+
+func WithRedirects(maxRedirects int, scheme string, forwardAuth bool) Option {
+	return func(f *File) error {
+		if maxRedirects < 0 {
+			return errors.New("the number of redirects can not be negative")
+		}
+		if !validRedirectScheme(scheme) {
+			return fmt.Errorf("unknown redirect scheme policy %q", scheme)
+		}
+		f.maxRedirects, f.redirectScheme, f.redirectAuth = maxRedirects, scheme, forwardAuth
+		return nil
+	}
+}
+
+func WithRemoteTime() Option {
+	return func(f *File) error {
+		f.remoteTime = true
+		return nil
+	}
+}
+
+func WithXattrs(checksum bool) Option {
+	return func(f *File) error {
+		f.xattrs = true
+		f.xattrChecksum = checksum
+		return nil
+	}
+}
+
+func WithStallTimeout(d time.Duration) Option {
+	return func(f *File) error {
+		f.stallTimeout = d
+		return nil
+	}
+}
+
+func WithWriteBuffer(size int, interval time.Duration) Option {
+	return func(f *File) error {
+		if size < 0 {
+			return errors.New("write buffer size can not be negative")
+		}
+		f.writeBuffer = size
+		f.writeInterval = interval
+		return nil
+	}
+}
+
+func WithMmap() Option {
+	return func(f *File) error {
+		f.mmap = true
+		return nil
+	}
+}
+
+func WithSync(policy string, interval time.Duration) Option {
+	return func(f *File) error {
+		if err := validSyncPolicy(policy); err != nil {
+			return err
+		}
+		if policy == SyncPeriodic && interval <= 0 {
+			return errors.New("sync interval must be positive")
+		}
+		f.syncPolicy = policy
+		f.syncInterval = interval
+		return nil
+	}
+}
+
+func WithLowSpeedLimit(bytesPerSecond int64, window time.Duration) Option {
+	return func(f *File) error {
+		if window < time.Second {
+			return errors.New("low speed window must be at least one second")
+		}
+		f.speedLimit = bytesPerSecond
+		f.speedTime = window
+		return nil
+	}
+}
+
+func WithConnections(n int) Option {
+	return func(f *File) error {
+		if n < 1 {
+			return fmt.Errorf("invalid connection count %d", n)
+		}
+		f.connections = n
+		return nil
+	}
+}
+
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(f *File) error {
+		f.limiter.SetRate(bytesPerSecond)
+		return nil
+	}
+}
+
+func WithRateShaping(burst int64, refill time.Duration, smooth bool) Option {
+	return func(f *File) error {
+		if burst < 0 || refill < 0 {
+			return fmt.Errorf("invalid rate shaping: burst %d, refill interval %s", burst, refill)
+		}
+		f.limiter.SetShaping(burst, refill, smooth)
+		return nil
+	}
+}
+
+func WithAcceptEncoding(encodings string) Option {
+	return func(f *File) error {
+		f.acceptEncoding = encodings
+		return nil
+	}
+}
+
+func WithDecompression() Option {
+	return func(f *File) error {
+		if f.acceptEncoding == "" {
+			f.acceptEncoding = "gzip, deflate"
+		}
+		f.decompress = true
+		return nil
+	}
+}
+
+func WithWriterAt(w io.WriterAt) Option {
+	return func(f *File) error {
+		f.writer = w
+		return nil
+	}
+}
+
+func WithRequestHook(hook func(*http.Request) error) Option {
+	return func(f *File) error {
+		f.requestHooks = append(f.requestHooks, hook)
+		return nil
+	}
+}
+
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(f *File) error {
+		f.transportWrappers = append(f.transportWrappers, wrap)
+		return nil
+	}
+}
+
+func WithProxy(proxyUrl string) Option {
+	return func(f *File) error {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" || u.Host == "" {
+			return errors.New("proxy must be an http:// URL")
+		}
+		f.proxy = u
+		return nil
+	}
+}
+
+func WithProxyAuth(scheme, user, password string) Option {
+	return func(f *File) error {
+		switch scheme = strings.ToLower(scheme); scheme {
+		case AuthBasic, AuthNTLM, AuthNegotiate:
+		default:
+			return errors.New("unknown proxy authentication scheme " + scheme)
+		}
+		f.proxyAuth = scheme
+		f.proxyCredentials = parseNtlmCredentials(user + ":" + password)
+		return nil
+	}
+}
+
+func WithNTLM(user, password string) Option {
+	return func(f *File) error {
+		credentials := parseNtlmCredentials(user + ":" + password)
+		f.transportWrappers = append(f.transportWrappers, func(next http.RoundTripper) http.RoundTripper {
+			return &ntlmTransport{next: next, credentials: credentials}
+		})
+		return nil
+	}
+}
+
+func WithTracerProvider(tp TracerProvider) Option {
+	return func(f *File) error {
+		f.tracer = tp.Tracer("cdm")
+		return nil
+	}
+}
+
+func WithParentSpan(ctx context.Context) Option {
+	return func(f *File) error {
+		f.traceCtx = ctx
+		return nil
+	}
+}
+
+func WithMinSplitSize(bytes int64) Option {
+	return func(f *File) error {
+		if bytes < 64<<10 {
+			return errors.New("minimum split size must be at least 64 KiB")
+		}
+		f.minSplitSize = bytes
+		return nil
+	}
+}
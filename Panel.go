@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"net/http"
+	"os/exec"
+	"runtime"
+)
+
+// OpenBrowser opens url in the default browser.
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+func (d *Daemon) panel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+	w.Write([]byte(panelPage))
+}
+
+// panelPage lists the downloads, takes URLs pasted or dropped on it and
+// shows desktop notifications, all through the daemon's API.
+const panelPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cdm</title>
+<style>
+body { font: 14px sans-serif; margin: 1em; }
+body.drop { outline: 3px dashed #48c; }
+textarea { width: 100%; height: 4em; box-sizing: border-box; }
+table { width: 100%; border-collapse: collapse; margin-top: 1em; }
+td { padding: 4px; border-bottom: 1px solid #ddd; }
+td.name { max-width: 30em; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+progress { width: 10em; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<textarea id="urls" placeholder="Paste or drop URLs here, one per line"></textarea>
+<button id="add">Add</button>
+<button id="notify" hidden>Show notifications</button>
+<span id="error"></span>
+<table id="downloads"></table>
+<script>
+const $ = id => document.getElementById(id);
+
+function call(method, path, body) {
+  return fetch(path, {method: method, body: JSON.stringify(body), headers: {"Content-Type": "application/json"}}).then(resp => {
+    if (!resp.ok) return resp.json().then(e => { throw new Error(e.error || resp.statusText); });
+    $("error").textContent = "";
+  }).catch(e => { $("error").textContent = e.message; });
+}
+
+function add(text) {
+  const urls = text.split(/\s+/).filter(u => /^[a-z][a-z0-9+.-]*:\/\//i.test(u));
+  if (urls.length) call("POST", "/input", {input: urls.join("\n") + "\n"}).then(refresh);
+}
+
+function bytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  for (; n >= 1024 && i < units.length - 1; i++) n /= 1024;
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function refresh() {
+  fetch("/downloads").then(resp => resp.json()).then(list => {
+    const table = $("downloads");
+    table.replaceChildren();
+    for (const d of list.slice().reverse()) {
+      const row = table.insertRow();
+      cell(row, d.path.split(/[\\/]/).pop(), "name").title = d.url;
+      cell(row, d.state);
+      const progress = document.createElement("progress");
+      if (d.total > 0) { progress.max = d.total; progress.value = d.downloaded; }
+      row.insertCell().append(progress);
+      cell(row, bytes(d.downloaded) + (d.total > 0 ? " of " + bytes(d.total) : ""));
+      cell(row, d.state == "downloading" ? bytes(d.speed) + "/s" : "");
+      const actions = row.insertCell();
+      const actionsFor = {downloading: ["pause", "cancel"], queued: ["pause", "cancel"], paused: ["resume", "cancel"], failed: ["retry"]};
+      for (const action of actionsFor[d.state] || []) {
+        const button = document.createElement("button");
+        button.textContent = action;
+        button.onclick = () => call("POST", "/downloads/" + d.id + "/" + action).then(refresh);
+        actions.append(button);
+      }
+    }
+  }).catch(e => { $("error").textContent = e.message; });
+}
+
+$("add").onclick = () => { add($("urls").value); $("urls").value = ""; };
+document.addEventListener("dragover", e => { e.preventDefault(); document.body.className = "drop"; });
+document.addEventListener("dragleave", () => { document.body.className = ""; });
+document.addEventListener("drop", e => {
+  e.preventDefault();
+  document.body.className = "";
+  add(e.dataTransfer.getData("text/uri-list") || e.dataTransfer.getData("text/plain"));
+});
+
+if ("Notification" in window && Notification.permission == "default") {
+  $("notify").hidden = false;
+  $("notify").onclick = () => Notification.requestPermission().then(() => { $("notify").hidden = true; });
+}
+const events = new EventSource("/events?interval=0s");
+for (const type of ["finished", "failed"]) {
+  events.addEventListener(type, e => {
+    const d = JSON.parse(e.data);
+    if ("Notification" in window && Notification.permission == "granted") {
+      new Notification("Download " + type, {body: d.path.split(/[\\/]/).pop()});
+    }
+    refresh();
+  });
+}
+refresh();
+setInterval(refresh, 1000);
+</script>
+</body>
+</html>
+`
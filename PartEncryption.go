@@ -0,0 +1,437 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	partMagic   = "cdm-part-aes-v2\n"
+	indexMagic  = "cdm-part-index\n"
+	sealedMagic = "CDMSEALD"
+	// partHeaderSize holds the magic, the salt and iteration count the key
+	// was derived with, and a tag that tells whether the key is right.
+	partHeaderSize = len(partMagic) + saltSize + 4 + 16
+)
+
+var (
+	// PartChunkSize is how much of the file each record of an encrypted
+	// part file seals.
+	PartChunkSize int64 = 64 << 10
+	// PartCacheChunks is how many chunks written in part are kept in memory
+	// before they are sealed and written out.
+	PartCacheChunks = 64
+
+	ErrPartKey     = errors.New("wrong key for the encrypted part file")
+	ErrPartCorrupt = errors.New("encrypted part file is corrupt")
+)
+
+func PartPath(path string) string {
+	return path + ".cdmpart"
+}
+
+// partIndexPath is the file next to a part file that records its length
+// and which of its chunks were written.
+func partIndexPath(name string) string {
+	return name + ".index"
+}
+
+// outputStore is what a download resumes in: the output file, or a writer
+// that can read back and cut what it holds.
+type outputStore interface {
+	io.ReaderAt
+	Size() (int64, error)
+	Truncate(size int64) error
+}
+
+type fileStore struct {
+	*os.File
+}
+
+func (s fileStore) Size() (int64, error) {
+	info, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (f *File) store() outputStore {
+	if f.Stream != nil {
+		return fileStore{f.Stream}
+	}
+	if s, ok := f.writer.(outputStore); ok {
+		return s
+	}
+	return nil
+}
+
+type partChunk struct {
+	data  []byte
+	dirty bool
+}
+
+// EncryptedPart is an io.WriterAt that keeps a download encrypted on disk
+// until it is complete: the file is cut into chunks of PartChunkSize, each
+// sealed with AES-256-GCM under a fresh random nonce whenever it is written,
+// and authenticated with its index so chunks can not be moved around.
+// Chunks are kept in memory until fully written, so a range is not sealed
+// over and over. The key is stretched from the passphrase with a salt of
+// the file, and a sealed index next to the file lists the chunks written,
+// so a chunk wiped on disk is caught instead of reading as never written.
+type EncryptedPart struct {
+	mu      sync.Mutex
+	file    *os.File
+	index   string
+	aead    cipher.AEAD
+	length  int64
+	written []byte
+	changed bool
+	chunks  map[int64]*partChunk
+}
+
+// OpenEncryptedPart opens the part file name, keeping what it holds when
+// keep is set and it was sealed with key, or starting it empty.
+func OpenEncryptedPart(name, key string, keep bool) (*EncryptedPart, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	p := &EncryptedPart{file: file, index: partIndexPath(name), chunks: map[int64]*partChunk{}}
+	header := make([]byte, partHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if keep && n == partHeaderSize && string(header[:len(partMagic)]) == partMagic {
+		err = p.open(key, header)
+	} else {
+		err = p.create(key)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// open derives the key of an existing part file from its header and reads
+// its index.
+func (p *EncryptedPart) open(key string, header []byte) error {
+	salt := header[len(partMagic) : len(partMagic)+saltSize]
+	iterations := binary.BigEndian.Uint32(header[len(partMagic)+saltSize:])
+	aead, err := passphraseCipher(key, salt, int(iterations))
+	if err != nil {
+		return err
+	}
+	p.aead = aead
+	if !bytes.Equal(header[partHeaderSize-aead.Overhead():], p.check()) {
+		return ErrPartKey
+	}
+	sealed, err := os.ReadFile(p.index)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrPartCorrupt
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(sealed, []byte(indexMagic)) || len(sealed) < len(indexMagic)+aead.NonceSize() {
+		return ErrPartCorrupt
+	}
+	sealed = sealed[len(indexMagic):]
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(indexMagic))
+	if err != nil || len(plain) < 8 {
+		return ErrPartCorrupt
+	}
+	p.length = int64(binary.BigEndian.Uint64(plain))
+	p.written = plain[8:]
+	if p.length < 0 || int64(len(p.written)) != (p.chunkCount()+7)/8 {
+		return ErrPartCorrupt
+	}
+	return nil
+}
+
+// create starts the part file empty, under a new salt.
+func (p *EncryptedPart) create(key string) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	if p.aead, err = passphraseCipher(key, salt, PassphraseIterations); err != nil {
+		return err
+	}
+	header := make([]byte, 0, partHeaderSize)
+	header = append(header, partMagic...)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, uint32(PassphraseIterations))
+	header = append(header, p.check()...)
+	if err := p.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return p.writeIndex()
+}
+
+// check is the tag of nothing sealed under the zero nonce, which only
+// the right key reproduces. The nonce is never used for data.
+func (p *EncryptedPart) check() []byte {
+	return p.aead.Seal(nil, make([]byte, p.aead.NonceSize()), nil, []byte(partMagic))
+}
+
+func (p *EncryptedPart) recordSize() int64 {
+	return int64(p.aead.NonceSize()) + PartChunkSize + int64(p.aead.Overhead())
+}
+
+func (p *EncryptedPart) chunkCount() int64 {
+	return (p.length + PartChunkSize - 1) / PartChunkSize
+}
+
+func (p *EncryptedPart) wasWritten(i int64) bool {
+	return i/8 < int64(len(p.written)) && p.written[i/8]&(1<<(i%8)) != 0
+}
+
+// writeIndex seals the length and the chunks written into the index,
+// replacing it whole so a crash leaves the old one. p.mu is held.
+func (p *EncryptedPart) writeIndex() error {
+	plain := binary.BigEndian.AppendUint64(nil, uint64(p.length))
+	bitmap := make([]byte, (p.chunkCount()+7)/8)
+	copy(bitmap, p.written)
+	plain = append(plain, bitmap...)
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append([]byte(indexMagic), nonce...)
+	sealed = p.aead.Seal(sealed, nonce, plain, []byte(indexMagic))
+	tmp := p.index + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.index); err != nil {
+		return err
+	}
+	p.changed = false
+	return nil
+}
+
+// load returns chunk i, read and opened from the file unless it is in
+// memory. A chunk the index does not list reads as zeros; a chunk it lists
+// must open. p.mu is held.
+func (p *EncryptedPart) load(i int64) (*partChunk, error) {
+	if c, ok := p.chunks[i]; ok {
+		return c, nil
+	}
+	c := &partChunk{data: make([]byte, PartChunkSize)}
+	if p.wasWritten(i) {
+		record := make([]byte, p.recordSize())
+		if _, err := p.file.ReadAt(record, int64(partHeaderSize)+i*p.recordSize()); err == io.EOF {
+			return nil, ErrPartCorrupt
+		} else if err != nil {
+			return nil, err
+		}
+		nonce := record[:p.aead.NonceSize()]
+		if _, err := p.aead.Open(c.data[:0], nonce, record[len(nonce):], binary.BigEndian.AppendUint64(nil, uint64(i))); err != nil {
+			return nil, ErrPartCorrupt
+		}
+	}
+	p.chunks[i] = c
+	return c, nil
+}
+
+// seal writes chunk i under a fresh nonce. p.mu is held.
+func (p *EncryptedPart) seal(i int64, c *partChunk) error {
+	nonce := make([]byte, p.aead.NonceSize(), p.recordSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	record := p.aead.Seal(nonce, nonce, c.data, binary.BigEndian.AppendUint64(nil, uint64(i)))
+	if _, err := p.file.WriteAt(record, int64(partHeaderSize)+i*p.recordSize()); err != nil {
+		return err
+	}
+	c.dirty = false
+	if !p.wasWritten(i) {
+		for int64(len(p.written)) <= i/8 {
+			p.written = append(p.written, 0)
+		}
+		p.written[i/8] |= 1 << (i % 8)
+		p.changed = true
+	}
+	return nil
+}
+
+func (p *EncryptedPart) WriteAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		i, at := off/PartChunkSize, off%PartChunkSize
+		c, err := p.load(i)
+		if err != nil {
+			return written, err
+		}
+		n := copy(c.data[at:], b)
+		c.dirty = true
+		if at+int64(n) == PartChunkSize {
+			if err := p.seal(i, c); err != nil {
+				return written, err
+			}
+			delete(p.chunks, i)
+		}
+		b, off, written = b[n:], off+int64(n), written+n
+		if off > p.length {
+			p.length, p.changed = off, true
+		}
+	}
+	if len(p.chunks) > PartCacheChunks {
+		return written, p.flush()
+	}
+	return written, nil
+}
+
+func (p *EncryptedPart) ReadAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	read := 0
+	for read < len(b) && off < p.length {
+		c, err := p.load(off / PartChunkSize)
+		if err != nil {
+			return read, err
+		}
+		end := min(PartChunkSize, p.length-off/PartChunkSize*PartChunkSize)
+		n := copy(b[read:], c.data[off%PartChunkSize:end])
+		read, off = read+n, off+int64(n)
+	}
+	if read < len(b) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// flush seals the chunks in memory, then records them and the length in
+// the index. p.mu is held.
+func (p *EncryptedPart) flush() error {
+	for i, c := range p.chunks {
+		if c.dirty {
+			if err := p.seal(i, c); err != nil {
+				return err
+			}
+		}
+	}
+	clear(p.chunks)
+	if p.changed {
+		return p.writeIndex()
+	}
+	return nil
+}
+
+// Size returns the length of the plain data.
+func (p *EncryptedPart) Size() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.length, nil
+}
+
+func (p *EncryptedPart) Truncate(size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.flush(); err != nil {
+		return err
+	}
+	p.length = min(p.length, size)
+	chunks := p.chunkCount()
+	p.written = p.written[:min(int64(len(p.written)), (chunks+7)/8)]
+	if chunks%8 != 0 && int64(len(p.written)) == (chunks+7)/8 {
+		p.written[len(p.written)-1] &= 1<<(chunks%8) - 1
+	}
+	if err := p.file.Truncate(int64(partHeaderSize) + chunks*p.recordSize()); err != nil {
+		return err
+	}
+	return p.writeIndex()
+}
+
+func (p *EncryptedPart) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.flush(); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *EncryptedPart) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.flush()
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove closes the part file without writing what is left in memory, and
+// removes it and its index.
+func (p *EncryptedPart) Remove() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.chunks)
+	p.changed = false
+	p.file.Close()
+	err := os.Remove(p.file.Name())
+	if indexErr := os.Remove(p.index); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// DecryptTo replaces what dst holds with the first size bytes of the plain
+// data.
+func (p *EncryptedPart) DecryptTo(dst *os.File, size int64) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(dst, 0), io.NewSectionReader(p, 0, size)); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// SaveResume writes the resume state next to path sealed with the key of
+// the part file, so it does not give away the URL either.
+func (p *EncryptedPart) SaveResume(path string, state ResumeState) error {
+	var plain bytes.Buffer
+	if _, err := state.WriteTo(&plain); err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append([]byte(sealedMagic), nonce...)
+	sealed = p.aead.Seal(sealed, nonce, plain.Bytes(), []byte(sealedMagic))
+	tmp := ResumePath(path) + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ResumePath(path))
+}
+
+func (p *EncryptedPart) LoadResume(path string) (ResumeState, error) {
+	sealed, err := os.ReadFile(ResumePath(path))
+	if err != nil {
+		return ResumeState{Size: -1}, err
+	}
+	if !bytes.HasPrefix(sealed, []byte(sealedMagic)) || len(sealed) < len(sealedMagic)+p.aead.NonceSize() {
+		return ResumeState{}, ErrResumeFormat
+	}
+	sealed = sealed[len(sealedMagic):]
+	plain, err := p.aead.Open(nil, sealed[:p.aead.NonceSize()], sealed[p.aead.NonceSize():], []byte(sealedMagic))
+	if err != nil {
+		return ResumeState{}, ErrPartKey
+	}
+	return ReadResume(bytes.NewReader(plain))
+}
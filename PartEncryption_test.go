@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+// fastPassphrases makes the key derivation cheap for the test.
+func fastPassphrases(t *testing.T) {
+	iterations := PassphraseIterations
+	t.Cleanup(func() { PassphraseIterations = iterations })
+	PassphraseIterations = 1000
+}
+
+func TestEncryptedPart(t *testing.T) {
+	fastPassphrases(t)
+	name := filepath.Join(t.TempDir(), "file.cdmpart")
+	data := downloadertest.RandomData(5*int(PartChunkSize)+100, 20)
+	p, err := OpenEncryptedPart(name, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second half first, as a parallel download writes it, leaving the
+	// middle chunk unwritten.
+	half := 3 * PartChunkSize
+	if _, err := p.WriteAt(data[half:], half); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.WriteAt(data[:2*PartChunkSize+10], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, data[:64]) {
+		t.Fatal("the part file holds plain data")
+	}
+
+	if _, err := OpenEncryptedPart(name, "wrong", true); !errors.Is(err, ErrPartKey) {
+		t.Fatalf("opened with the wrong key: %v", err)
+	}
+	p, err = OpenEncryptedPart(name, "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if size, _ := p.Size(); size != int64(len(data)) {
+		t.Fatalf("size %d, want %d", size, len(data))
+	}
+	got, err := io.ReadAll(io.NewSectionReader(p, 0, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Clone(data)
+	clear(want[2*PartChunkSize+10 : half])
+	if !bytes.Equal(got, want) {
+		t.Fatal("read back other data than was written")
+	}
+
+	// The same passphrase gives another key for another file.
+	other, err := OpenEncryptedPart(name+"2", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if bytes.Equal(other.check(), p.check()) {
+		t.Fatal("two part files share a key")
+	}
+}
+
+func TestEncryptedPartWiped(t *testing.T) {
+	fastPassphrases(t)
+	name := filepath.Join(t.TempDir(), "file.cdmpart")
+	p, err := OpenEncryptedPart(name, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.WriteAt(downloadertest.RandomData(2*int(PartChunkSize), 21), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record zeroed on disk is not taken for a chunk never written.
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(make([]byte, p.recordSize()), int64(partHeaderSize)+p.recordSize()); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	p, err = OpenEncryptedPart(name, "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := p.ReadAt(make([]byte, 10), PartChunkSize); !errors.Is(err, ErrPartCorrupt) {
+		t.Fatalf("read the wiped chunk: %v", err)
+	}
+
+	// Nor is a part file that lost its index.
+	if err := os.Remove(partIndexPath(name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncryptedPart(name, "secret", true); !errors.Is(err, ErrPartCorrupt) {
+		t.Fatalf("opened without the index: %v", err)
+	}
+}
+
+func TestEncryptedPartTruncate(t *testing.T) {
+	fastPassphrases(t)
+	name := filepath.Join(t.TempDir(), "file.cdmpart")
+	p, err := OpenEncryptedPart(name, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := downloadertest.RandomData(10*int(PartChunkSize), 22)
+	if _, err := p.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Truncate(PartChunkSize + 5); err != nil {
+		t.Fatal(err)
+	}
+	if p.wasWritten(2) {
+		t.Fatal("a chunk cut off is still listed as written")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = OpenEncryptedPart(name, "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	got := make([]byte, PartChunkSize+10)
+	n, err := p.ReadAt(got, 0)
+	if err != io.EOF || !bytes.Equal(got[:n], data[:PartChunkSize+5]) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+}
+
+func TestEncryptedPartResume(t *testing.T) {
+	fastPassphrases(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	p, err := OpenEncryptedPart(PartPath(path), "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	state := ResumeState{Version: ResumeVersion, Url: "https://example.com/secret-file", Size: 10}
+	if err := p.SaveResume(path, state); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := os.ReadFile(ResumePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret-file")) {
+		t.Fatal("the resume file gives away the URL")
+	}
+	got, err := p.LoadResume(path)
+	if err != nil || got.Url != state.Url || got.Size != state.Size {
+		t.Fatalf("loaded %+v, %v", got, err)
+	}
+}
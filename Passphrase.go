@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// saltSize is the length of the random salt a file keeps next to what it
+// seals with a passphrase.
+const saltSize = 16
+
+var (
+	// PassphraseIterations is how many rounds of PBKDF2-HMAC-SHA256 turn a
+	// passphrase into a key for new files. Each file records the count it
+	// was sealed with, so raising it does not lock out older files.
+	PassphraseIterations = 600_000
+
+	ErrIterations = errors.New("iteration count of the passphrase is out of range")
+)
+
+// maxIterations bounds the count read from a file, which could otherwise
+// keep the key derivation busy for hours.
+const maxIterations = 100_000_000
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// passphraseKey stretches passphrase with salt into an AES-256 key.
+func passphraseKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	if iterations < 1 || iterations > maxIterations {
+		return nil, ErrIterations
+	}
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+}
+
+// passphraseCipher is AES-256-GCM under the key passphraseKey derives.
+func passphraseCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := passphraseKey(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
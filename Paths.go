@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var ContentTypeExtensions = map[string]string{
+	"application/octet-stream":                "",
+	"application/gzip":                        ".gz",
+	"application/x-gzip":                      ".gz",
+	"application/x-bzip2":                     ".bz2",
+	"application/x-xz":                        ".xz",
+	"application/zstd":                        ".zst",
+	"application/x-tar":                       ".tar",
+	"application/zip":                         ".zip",
+	"application/x-7z-compressed":             ".7z",
+	"application/vnd.rar":                     ".rar",
+	"application/x-iso9660-image":             ".iso",
+	"application/x-apple-diskimage":           ".dmg",
+	"application/x-msdownload":                ".exe",
+	"application/x-msi":                       ".msi",
+	"application/vnd.debian.binary-package":   ".deb",
+	"application/x-rpm":                       ".rpm",
+	"application/vnd.android.package-archive": ".apk",
+	"application/pdf":                         ".pdf",
+	"application/json":                        ".json",
+	"application/xml":                         ".xml",
+	"text/xml":                                ".xml",
+	"text/html":                               ".html",
+	"text/plain":                              ".txt",
+	"text/csv":                                ".csv",
+	"image/jpeg":                              ".jpg",
+	"image/png":                               ".png",
+	"image/gif":                               ".gif",
+	"image/webp":                              ".webp",
+	"image/svg+xml":                           ".svg",
+	"audio/mpeg":                              ".mp3",
+	"audio/ogg":                               ".ogg",
+	"audio/flac":                              ".flac",
+	"audio/wav":                               ".wav",
+	"video/mp4":                               ".mp4",
+	"video/webm":                              ".webm",
+	"video/x-matroska":                        ".mkv",
+	"video/quicktime":                         ".mov",
+}
+
+func DefaultDir() string {
+	if dir := os.Getenv("XDG_DOWNLOAD_DIR"); dir != "" {
+		return dir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dir := filepath.Join(home, "Downloads")
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+func urlFilename(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	return SanitizeFilename(path.Base(u))
+}
+
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := ContentTypeExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+func withExtension(name, contentType string) string {
+	if filepath.Ext(name) != "" {
+		return name
+	}
+	return name + contentTypeExtension(contentType)
+}
+
+func SanitizeFilename(name string) string {
+	return sanitizeFilename(name, runtime.GOOS == "windows")
+}
+
+func sanitizeFilename(name string, windows bool) string {
+	invalid := "/\x00"
+	if windows {
+		invalid = `/\<>:"|?*` + "\x00"
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(invalid, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if windows {
+		name = strings.TrimRight(name, ". ")
+		base := strings.ToUpper(strings.TrimSpace(strings.SplitN(name, ".", 2)[0]))
+		if windowsReserved[base] {
+			name = "_" + name
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PauseTimeout is how long the daemon and the CLI wait for a download to
+// stop and reach the disk when it is paused.
+var PauseTimeout = 30 * time.Second
+
+var ErrNotRunning = errors.New("download is not running")
+
+// PauseReport is what a paused download left on disk.
+type PauseReport struct {
+	// Downloaded is the bytes written to the output and synced, every one
+	// of them counted in State.
+	Downloaded int64
+	Size       int64
+	State      ResumeState
+}
+
+// WithPauseState has PauseContext save the resume state with save once the
+// output is synced, so a process killed while paused continues from there.
+func WithPauseState(save func(ResumeState) error) Option {
+	return func(f *File) error {
+		f.pauseState = save
+		return nil
+	}
+}
+
+// PauseContext pauses the download like Pause and returns once every
+// worker stopped, the bytes they read are written and synced to disk and
+// the resume state is saved with WithPauseState. When ctx ends first it
+// returns its error, and the download still pauses in the background.
+// A paused download is synced and reported again.
+func (f *File) PauseContext(ctx context.Context) (PauseReport, error) {
+	f.mu.Lock()
+	if f.state == StateDownloading {
+		f.state = StatePausing
+		f.cancel()
+	}
+	state, done := f.state, f.done
+	f.mu.Unlock()
+	switch state {
+	case StateIdle:
+		return PauseReport{}, ErrNotStarted
+	case StatePausing, StatePaused:
+	default:
+		return PauseReport{}, fmt.Errorf("%w: %s", ErrNotRunning, state)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return PauseReport{}, fmt.Errorf("pausing %s: %w", f.Url, ctx.Err())
+	}
+	if err := f.syncOutput(); err != nil {
+		return PauseReport{}, fmt.Errorf("pausing %s: %w", f.Url, err)
+	}
+	report := PauseReport{Downloaded: f.Progress().Downloaded, Size: f.Size, State: f.ResumeState()}
+	if f.pauseState != nil {
+		if err := f.pauseState(report.State); err != nil {
+			return report, fmt.Errorf("pausing %s: saving the resume state: %w", f.Url, err)
+		}
+	}
+	return report, nil
+}
+
+func (f *File) syncOutput() error {
+	if f.Stream != nil {
+		return f.Stream.Sync()
+	}
+	if s, ok := f.writer.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
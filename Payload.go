@@ -0,0 +1,195 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+var ErrCorruptPayload = errors.New("corrupt compressed data")
+
+const (
+	PayloadGzip  = "gzip"
+	PayloadBzip2 = "bzip2"
+	PayloadXz    = "xz"
+)
+
+var payloadFormats = []struct {
+	name       string
+	magic      []byte
+	extensions []string
+	types      []string
+}{
+	{PayloadGzip, []byte{0x1f, 0x8b}, []string{".gz"}, []string{"application/gzip", "application/x-gzip"}},
+	{PayloadBzip2, []byte("BZh"), []string{".bz2"}, []string{"application/x-bzip2"}},
+	{PayloadXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0}, []string{".xz"}, []string{"application/x-xz"}},
+}
+
+// WithPayloadDecompression writes a file that is itself compressed, like
+// data.csv.gz, decompressed while it downloads. The format is recognized by
+// the first bytes of the response; files that are not compressed are written
+// as they are. gzip and bzip2 are decompressed in the process, xz by the xz
+// command. The download becomes a stream, restarted from the beginning when
+// interrupted.
+func WithPayloadDecompression() Option {
+	return func(f *File) error {
+		f.unpack = true
+		return nil
+	}
+}
+
+// sniffPayload reads the magic bytes of the response body, putting them
+// back for the readers after it, and returns the compression format they
+// start.
+func sniffPayload(resp *http.Response) string {
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(resp.Body, magic)
+	magic = magic[:n]
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(magic), resp.Body), resp.Body}
+
+	var named string
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, format := range payloadFormats {
+		if bytes.HasPrefix(magic, format.magic) {
+			return format.name
+		}
+		for _, ext := range format.extensions {
+			if strings.EqualFold(path.Ext(resp.Request.URL.Path), ext) {
+				named = format.name
+			}
+		}
+		for _, t := range format.types {
+			if mediaType == t {
+				named = format.name
+			}
+		}
+	}
+	if named != "" {
+		slog.Warn("the file is named or typed as compressed but is not, writing it as it is", "url", resp.Request.URL.Redacted(), "format", named)
+	}
+	return ""
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func openPayload(ctx context.Context, format string, body io.ReadCloser) (io.ReadCloser, error) {
+	source := &sourceReader{r: body}
+	var r io.Reader
+	switch format {
+	case PayloadGzip:
+		z, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, source.check(err)
+		}
+		r = z
+	case PayloadBzip2:
+		r = bzip2.NewReader(source)
+	case PayloadXz:
+		c, err := startCommand(ctx, readCloser{source, body}, "xz", "--decompress", "--stdout")
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{&payloadReader{c, source}, c}, nil
+	default:
+		return nil, fmt.Errorf("can not decompress %s", format)
+	}
+	return readCloser{&payloadReader{r, source}, body}, nil
+}
+
+// sourceReader remembers the error reading the response body, to tell a
+// broken connection, which is retried, from corrupt data, which fails the
+// download as fetching it again gives the same bytes.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *sourceReader) check(err error) error {
+	switch {
+	case err == nil || err == io.EOF:
+		return err
+	case s.err != nil:
+		return s.err
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrCorruptPayload, err)
+}
+
+type payloadReader struct {
+	r      io.Reader
+	source *sourceReader
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	return n, p.source.check(err)
+}
+
+// commandReader reads the output of a command decompressing body, failing
+// with the command's error once the output ends.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	body   io.Closer
+	stderr bytes.Buffer
+	waited bool
+}
+
+func startCommand(ctx context.Context, body io.ReadCloser, name string, args ...string) (*commandReader, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	c := &commandReader{cmd: cmd, body: body}
+	cmd.Stdin = body
+	cmd.Stderr = &c.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.ReadCloser = out
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can not decompress %s: %w", name, err)
+	}
+	return c, nil
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF && !c.waited {
+		c.waited = true
+		if e := c.cmd.Wait(); e != nil {
+			return n, fmt.Errorf("%s: %w: %s", c.cmd.Args[0], e, strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (c *commandReader) Close() error {
+	c.body.Close()
+	if !c.waited {
+		c.waited = true
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}
+	return nil
+}
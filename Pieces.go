@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"errors"
+)
+
+const (
+	PieceOrderParallel = "parallel"
+	PieceOrderWindow   = "sequential-window"
+	PieceOrderPipeline = "pipeline"
+)
+
+var (
+	// DefaultPieceWindow is how far ahead of the first missing byte the
+	// sequential-window order downloads when no window is given.
+	DefaultPieceWindow int64 = 16 << 20
+	// DefaultPipelinePiece is the size of the ranges of the pipeline order
+	// when none is given.
+	DefaultPipelinePiece int64 = 4 << 20
+)
+
+// WithPieceOrder chooses the order the parts of a file are downloaded in.
+// PieceOrderParallel gives every connection an equal share of the file.
+// PieceOrderWindow cuts the file into pieces of window divided by the
+// connections and downloads them in order, all connections working within
+// window bytes of the first missing one, so the file fills from its start
+// while it downloads. PieceOrderPipeline cuts the file into pieces of
+// window bytes that the connections request one after another, each over
+// the same keep-alive connection, for hosts that penalize opening many
+// connections: a few of them then stay busy without a block each.
+// PieceOrderAdaptive sizes every piece as a connection asks for it and
+// ignores window.
+func WithPieceOrder(order string, window int64) Option {
+	return func(f *File) error {
+		if !validPieceOrder(order) {
+			return errors.New("unknown piece order " + order)
+		}
+		if window < 0 {
+			return errors.New("piece window can not be negative")
+		}
+		switch {
+		case window > 0:
+		case order == PieceOrderPipeline:
+			window = DefaultPipelinePiece
+		default:
+			window = DefaultPieceWindow
+		}
+		f.pieceOrder, f.pieceWindow = order, window
+		return nil
+	}
+}
+
+func validPieceOrder(order string) bool {
+	return order == PieceOrderParallel || order == PieceOrderWindow || order == PieceOrderPipeline || order == PieceOrderAdaptive
+}
+
+// pieceSize is the size of the pieces of the sequential-window and pipeline
+// orders.
+func (f *File) pieceSize() int64 {
+	if f.pieceOrder == PieceOrderPipeline {
+		return f.pieceWindow
+	}
+	return max(f.pieceWindow/int64(max(f.connections, 1)), f.minSplitSize)
+}
+
+// planPieces cuts the file into pieces in order.
+func (f *File) planPieces() []Block {
+	size := f.pieceSize()
+	var blocks []Block
+	for begin := f.offset + f.skip; begin < f.offset+f.Size; begin += size {
+		end := min(begin+size, f.offset+f.Size) - 1
+		blocks = append(blocks, Block{Begin: begin, End: end, start: begin})
+	}
+	return blocks
+}
+
+// nextPiece gives a worker the earliest piece nobody works on when it is in
+// the window, or else half of the earliest piece in the window that is large
+// enough to split. Only when there is neither does it reach past the window,
+// rather than leave the connection idle. f.blockMu is held.
+func (f *File) nextPiece() (int, bool) {
+	front := int64(-1)
+	idle, busy := -1, -1
+	for i, b := range f.BlockList {
+		if b.done() {
+			continue
+		}
+		if front < 0 || b.Begin < front {
+			front = b.Begin
+		}
+		if !b.busy && (idle < 0 || b.Begin < f.BlockList[idle].Begin) {
+			idle = i
+		}
+		if b.busy && b.End-b.Begin+1 >= f.minSplitSize*2 && (busy < 0 || b.Begin < f.BlockList[busy].Begin) {
+			busy = i
+		}
+	}
+	switch {
+	case idle >= 0 && f.BlockList[idle].Begin < front+f.pieceWindow:
+	case busy >= 0 && f.BlockList[busy].Begin < front+f.pieceWindow:
+		b := &f.BlockList[busy]
+		mid := b.Begin + (b.End-b.Begin+1)/2
+		f.BlockList = append(f.BlockList, Block{Begin: mid, End: b.End, start: mid, busy: true})
+		f.BlockList[busy].End = mid - 1
+		f.countBusy()
+		return len(f.BlockList) - 1, true
+	case idle < 0:
+		return -1, false
+	}
+	f.BlockList[idle].busy = true
+	f.countBusy()
+	return idle, true
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	PlaceFree       = "free"
+	PlaceRoundRobin = "round-robin"
+)
+
+func validPlacement(policy string) bool {
+	switch policy {
+	case "", PlaceFree, PlaceRoundRobin:
+		return true
+	}
+	return false
+}
+
+// place picks the data directory of a download queued without a directory
+// that no route claims, or returns "" without data directories. m.mu must
+// be held.
+//
+// With PlaceRoundRobin the directories take turns. With PlaceFree, the
+// default, every file goes to the directory its path hashes highest on,
+// weighted by the space free there less what the downloads queued on it
+// but not started are expected to take, so a job of many files spreads over
+// the disks in proportion to their room, like CRUSH does, and the same file
+// lands on the same disk while they stay as full. A directory whose free
+// space is unknown weighs as the fullest one known.
+func (m *Manager) place(relative string, size int64) string {
+	dirs := m.config.DataDirs
+	if len(dirs) == 0 {
+		return ""
+	}
+	if m.config.Placement == PlaceRoundRobin {
+		dir := dirs[m.placed%len(dirs)]
+		m.placed++
+		return m.resolveDir(dir)
+	}
+	reserved := map[string]int64{}
+	for _, d := range m.downloads {
+		if d.dataDir != "" && d.state == StateQueued && !d.created {
+			reserved[d.dataDir] += max(d.reserved, 0)
+		}
+	}
+	weights := make([]float64, len(dirs))
+	least := math.Inf(1)
+	for i, dir := range dirs {
+		free, err := diskFree(m.resolveDir(dir))
+		if err != nil {
+			weights[i] = -1
+			continue
+		}
+		weights[i] = float64(max(free-reserved[m.resolveDir(dir)]-max(size, 0), 1))
+		least = min(least, weights[i])
+	}
+	best, bestScore := 0, math.Inf(-1)
+	for i, dir := range dirs {
+		w := weights[i]
+		if w < 0 {
+			w = least
+			if math.IsInf(w, 1) {
+				w = 1
+			}
+		}
+		sum := sha256.Sum256([]byte(dir + "\x00" + relative))
+		u := (float64(binary.BigEndian.Uint64(sum[:])>>11) + 0.5) / (1 << 53)
+		if score := w / -math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return m.resolveDir(dirs[best])
+}
+
+// DataDirs returns the data directories of the configuration, resolved
+// against the download directory.
+func (m *Manager) DataDirs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dirs []string
+	for _, dir := range m.config.DataDirs {
+		dirs = append(dirs, m.resolveDir(dir))
+	}
+	return dirs
+}
@@ -0,0 +1,549 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventProcessing is published as each step of the pipeline of a
+	// finished download starts, and EventProcessed sent to the notifiers
+	// by its notify step.
+	EventProcessing = "processing"
+	EventProcessed  = "processed"
+	StateProcessing = "processing"
+)
+
+// PostProcessor is a step of a Pipeline, run on what the steps before it
+// made of a finished download. A step that makes a new file or directory
+// sets out.Path to it.
+type PostProcessor interface {
+	Process(ctx context.Context, out *Output) error
+}
+
+// Output is what a Pipeline works on.
+type Output struct {
+	Url      string
+	Path     string
+	Tags     []string
+	Metadata map[string]string
+	Group    string
+	// Events gets the event of the notify step.
+	Events *Dispatcher
+}
+
+func (o *Output) event(typ string) Event {
+	e := Event{Type: typ, Url: o.Url, Path: o.Path, Tags: o.Tags, Metadata: o.Metadata, Group: o.Group, Time: time.Now()}
+	if info, err := os.Stat(o.Path); err == nil && !info.IsDir() {
+		e.Size, e.Downloaded = info.Size(), info.Size()
+	}
+	return e
+}
+
+// PipelineStep is a step as given, name=argument, and its processor.
+type PipelineStep struct {
+	Name string
+	Arg  string
+	PostProcessor
+}
+
+func (s PipelineStep) String() string {
+	if s.Arg == "" {
+		return s.Name
+	}
+	return s.Name + "=" + s.Arg
+}
+
+// Pipeline runs its steps one after the other on a finished download, in
+// place of hook scripts for the usual cases.
+type Pipeline []PipelineStep
+
+var postProcessors = struct {
+	mu    sync.RWMutex
+	steps map[string]func(arg string) (PostProcessor, error)
+}{steps: map[string]func(string) (PostProcessor, error){}}
+
+func init() {
+	for name, parse := range map[string]func(string) (PostProcessor, error){
+		"verify":     parseVerifyStep,
+		"decompress": parseDecompressStep,
+		"extract":    parseExtractStep,
+		"move":       parseMoveStep,
+		"notify":     parseNotifyStep,
+		"exec":       parseExecStep,
+	} {
+		if err := RegisterPostProcessor(name, parse); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterPostProcessor adds a step pipelines accept by name, made by parse
+// from the argument after = in name=argument, empty without one. A name
+// can be registered once.
+func RegisterPostProcessor(name string, parse func(arg string) (PostProcessor, error)) error {
+	if name == "" || strings.Contains(name, "=") || parse == nil {
+		return fmt.Errorf("invalid post-processor %q", name)
+	}
+	postProcessors.mu.Lock()
+	defer postProcessors.mu.Unlock()
+	if _, ok := postProcessors.steps[name]; ok {
+		return fmt.Errorf("post-processor %q is already registered", name)
+	}
+	postProcessors.steps[name] = parse
+	return nil
+}
+
+// ParsePipeline parses steps like verify=sha256:..., decompress, extract,
+// extract=dir, move=dir, notify and exec=command.
+func ParsePipeline(steps []string) (Pipeline, error) {
+	var p Pipeline
+	for _, s := range steps {
+		name, arg, _ := strings.Cut(strings.TrimSpace(s), "=")
+		postProcessors.mu.RLock()
+		parse, ok := postProcessors.steps[name]
+		postProcessors.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown post-processing step %q", name)
+		}
+		processor, err := parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("post-processing step %s: %w", name, err)
+		}
+		p = append(p, PipelineStep{name, arg, processor})
+	}
+	return p, nil
+}
+
+// ErrCommandStep refuses an exec step in the pipeline of a single download:
+// anyone who can add a download, through the API or a job, could otherwise
+// run commands as the daemon. Such steps go in the queue's pipeline, -post.
+var ErrCommandStep = errors.New("exec steps can only be set with -post")
+
+// parseJobPipeline parses the pipeline sent with a download, which may not
+// run commands or put its output outside the directory of the download.
+func parseJobPipeline(steps []string) (Pipeline, error) {
+	p, err := ParsePipeline(steps)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range p {
+		switch {
+		case s.Name == "exec":
+			return nil, ErrCommandStep
+		case (s.Name == "move" || s.Name == "extract") && s.Arg != "" && !filepath.IsLocal(s.Arg):
+			return nil, fmt.Errorf("post-processing step %s: %s is outside the directory of the download", s.Name, s.Arg)
+		}
+	}
+	return p, nil
+}
+
+// addsCommand reports whether steps run a command that old does not, which
+// only -post may add to the queue's pipeline.
+func addsCommand(old, steps []string) bool {
+	for _, s := range steps {
+		s = strings.TrimSpace(s)
+		if name, _, _ := strings.Cut(s, "="); name == "exec" && !slices.ContainsFunc(old, func(o string) bool { return strings.TrimSpace(o) == s }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the steps on out, calling step with each before it runs, and
+// stops at the first that fails.
+func (p Pipeline) Run(ctx context.Context, out *Output, step func(PipelineStep)) error {
+	for _, s := range p {
+		if step != nil {
+			step(s)
+		}
+		if err := s.Process(ctx, out); err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+type verifyStep struct{ sum expectedSum }
+
+func parseVerifyStep(arg string) (PostProcessor, error) {
+	sum, err := parseDigest(arg)
+	if err != nil {
+		return nil, err
+	}
+	return verifyStep{sum}, nil
+}
+
+func (s verifyStep) Process(ctx context.Context, out *Output) error {
+	file, err := os.Open(out.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s.sum.Verify(ctx, file, info.Size())
+}
+
+// decompressStep replaces a gzip, bzip2 or xz file with its content, named
+// without the extension of the format. Other files are left as they are.
+type decompressStep struct{}
+
+func parseDecompressStep(arg string) (PostProcessor, error) {
+	if arg != "" {
+		return nil, errors.New("takes no argument")
+	}
+	return decompressStep{}, nil
+}
+
+func (decompressStep) Process(ctx context.Context, out *Output) error {
+	file, err := os.Open(out.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	format := sniffFile(file)
+	if format == "" {
+		return nil
+	}
+	ext := filepath.Ext(out.Path)
+	dest := strings.TrimSuffix(out.Path, ext)
+	switch {
+	case strings.EqualFold(ext, ".tgz") && format == PayloadGzip:
+		dest += ".tar"
+	case !slices.ContainsFunc(payloadExtensions(format), func(e string) bool { return strings.EqualFold(e, ext) }):
+		dest = out.Path + ".out"
+	}
+	r, err := openPayload(ctx, format, file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := writeAtomically(dest, r); err != nil {
+		return err
+	}
+	file.Close()
+	if err := os.Remove(out.Path); err != nil {
+		return err
+	}
+	out.Path = dest
+	return nil
+}
+
+// sniffFile returns the compression format file starts with, leaving the
+// file at its start.
+func sniffFile(file *os.File) string {
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(file, magic)
+	file.Seek(0, io.SeekStart)
+	for _, format := range payloadFormats {
+		if bytes.HasPrefix(magic[:n], format.magic) {
+			return format.name
+		}
+	}
+	return ""
+}
+
+func payloadExtensions(name string) []string {
+	for _, format := range payloadFormats {
+		if format.name == name {
+			return format.extensions
+		}
+	}
+	return nil
+}
+
+// writeAtomically writes r to a temporary file next to dest and renames it
+// to dest once it is complete.
+func writeAtomically(dest string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), dest)
+}
+
+// extractStep unpacks a zip or tar file, compressed or not, into Dir, or
+// next to it into a directory named like it without the extensions. The
+// archive is kept.
+type extractStep struct{ Dir string }
+
+func parseExtractStep(arg string) (PostProcessor, error) {
+	return extractStep{arg}, nil
+}
+
+func (s extractStep) Process(ctx context.Context, out *Output) error {
+	dir := s.Dir
+	if dir == "" {
+		dir = out.Path
+		for _, ext := range []string{".zip", ".tgz", ".gz", ".bz2", ".xz", ".tar"} {
+			if strings.EqualFold(filepath.Ext(dir), ext) {
+				dir = strings.TrimSuffix(dir, filepath.Ext(dir))
+			}
+		}
+		if dir == out.Path {
+			dir += ".d"
+		}
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(out.Path), dir)
+	}
+	file, err := os.Open(out.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	file.Seek(0, io.SeekStart)
+	if bytes.Equal(magic[:n], []byte("PK\x03\x04")) {
+		err = extractZip(ctx, file, dir)
+	} else {
+		r := io.ReadCloser(file)
+		if format := sniffFile(file); format != "" {
+			if r, err = openPayload(ctx, format, file); err != nil {
+				return err
+			}
+			defer r.Close()
+		}
+		err = extractTar(ctx, r, dir)
+	}
+	if err != nil {
+		return err
+	}
+	out.Path = dir
+	return nil
+}
+
+// archivePath returns where name goes in dir, refusing names that would
+// leave it.
+func archivePath(dir, name string) (string, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if name != "." && !filepath.IsLocal(name) {
+		return "", fmt.Errorf("archive entry %q is outside the archive", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func extractZip(ctx context.Context, file *os.File, dir string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	z, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, entry := range z.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path, err := archivePath(dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		r, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeFile(path, r, entry.Mode().Perm())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(ctx context.Context, r io.Reader, dir string) error {
+	t := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("not a zip or tar file: %w", err)
+		}
+		path, err := archivePath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(path, t, os.FileMode(header.Mode).Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeFile writes r to path, leaving out the write permissions of the
+// archive and keeping the rest.
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// moveStep moves the output into Dir, which is made if needed. It does not
+// replace what is already there.
+type moveStep struct{ Dir string }
+
+func parseMoveStep(arg string) (PostProcessor, error) {
+	if arg == "" {
+		return nil, errors.New("needs a directory, move=dir")
+	}
+	return moveStep{arg}, nil
+}
+
+func (s moveStep) Process(ctx context.Context, out *Output) error {
+	dir := s.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(out.Path), dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, filepath.Base(out.Path))
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	info, err := os.Stat(out.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.Rename(out.Path, dest)
+	} else {
+		err = moveFile(out.Path, dest)
+	}
+	if err != nil {
+		return err
+	}
+	out.Path = dest
+	return nil
+}
+
+// notifyStep sends a processed event, with the output as its path, to the
+// notifiers.
+type notifyStep struct{}
+
+func parseNotifyStep(arg string) (PostProcessor, error) {
+	if arg != "" {
+		return nil, errors.New("takes no argument")
+	}
+	return notifyStep{}, nil
+}
+
+func (notifyStep) Process(ctx context.Context, out *Output) error {
+	if out.Events != nil {
+		out.Events.Dispatch(out.event(EventProcessed))
+	}
+	return nil
+}
+
+// execStep runs a command as -on-finish does, its arguments templates of
+// the output, and fails when it does.
+type execStep struct{ command *CommandNotifier }
+
+func parseExecStep(arg string) (PostProcessor, error) {
+	c, err := NewCommandNotifier(EventProcessed, arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Args) == 0 {
+		return nil, errors.New("needs a command, exec=command")
+	}
+	return execStep{c}, nil
+}
+
+func (s execStep) Process(ctx context.Context, out *Output) error {
+	return s.command.Notify(out.event(EventProcessed))
+}
+
+// postProcess runs the pipeline of a finished download, its own or else the
+// queue's, in the processing state, which frees its place in the queue, and
+// points the download at the output of the last step that succeeded.
+func (m *Manager) postProcess(d *Download) error {
+	m.mu.Lock()
+	steps, parse := d.job.Post, parseJobPipeline
+	if steps == nil {
+		steps, parse = m.config.Post, ParsePipeline
+	}
+	out := &Output{Url: d.Url, Path: d.Path, Tags: d.tags, Metadata: d.metadata, Group: d.group, Events: m.Events}
+	m.mu.Unlock()
+	if len(steps) == 0 {
+		return nil
+	}
+	pipeline, err := parse(steps)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	d.state = StateProcessing
+	m.mu.Unlock()
+	m.rebalance()
+	m.schedule()
+	err = pipeline.Run(context.Background(), out, func(s PipelineStep) {
+		m.mu.Lock()
+		d.step = s.Name
+		m.mu.Unlock()
+		m.publish(d, EventProcessing)
+	})
+	m.mu.Lock()
+	d.step = ""
+	d.Path = out.Path
+	m.mu.Unlock()
+	return err
+}
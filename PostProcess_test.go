@@ -0,0 +1,167 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type archiveEntry struct {
+	name string
+	body string
+	link string
+}
+
+func zipArchive(t *testing.T, entries []archiveEntry) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		if e.link != "" {
+			header.SetMode(os.ModeSymlink | 0o777)
+			body = e.link
+		}
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, entries []archiveEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0o755
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// extract runs the extract step on archive saved as name in a directory of
+// its own, which it returns.
+func extract(t *testing.T, name string, archive []byte, dir string) (string, *Output, error) {
+	root := t.TempDir()
+	out := &Output{Path: filepath.Join(root, name)}
+	if err := os.WriteFile(out.Path, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, out, extractStep{dir}.Process(context.Background(), out)
+}
+
+func TestExtract(t *testing.T) {
+	entries := []archiveEntry{{name: "docs/"}, {name: "docs/readme.txt", body: "read me"}, {name: "bin/tool", body: "tool"}}
+	for _, test := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"file.zip", zipArchive(t, entries)},
+		{"file.tar.gz", tarGzArchive(t, entries)},
+		{"file.tgz", tarGzArchive(t, entries)},
+	} {
+		root, out, err := extract(t, test.name, test.archive, "")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if want := filepath.Join(root, "file"); out.Path != want {
+			t.Errorf("%s: extracted into %s, want %s", test.name, out.Path, want)
+		}
+		for _, e := range entries[1:] {
+			got, err := os.ReadFile(filepath.Join(out.Path, filepath.FromSlash(e.name)))
+			if err != nil || string(got) != e.body {
+				t.Errorf("%s: %s holds %q: %v", test.name, e.name, got, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(root, test.name)); err != nil {
+			t.Errorf("%s: the archive was not kept: %v", test.name, err)
+		}
+	}
+
+	root, out, err := extract(t, "file.zip", zipArchive(t, entries), "unpacked")
+	if err != nil || out.Path != filepath.Join(root, "unpacked") {
+		t.Fatalf("extracted into %s: %v", out.Path, err)
+	}
+	if _, _, err := extract(t, "file.zip", []byte("neither zip nor tar"), ""); err == nil {
+		t.Fatal("extracted a file that is not an archive")
+	}
+}
+
+func TestExtractOutside(t *testing.T) {
+	for _, name := range []string{"../evil", "docs/../../evil", "/evil", "docs/../../../evil"} {
+		for archive, data := range map[string][]byte{
+			"file.zip":    zipArchive(t, []archiveEntry{{name: "ok", body: "fine"}, {name: name, body: "evil"}}),
+			"file.tar.gz": tarGzArchive(t, []archiveEntry{{name: "ok", body: "fine"}, {name: name, body: "evil"}}),
+		} {
+			root, _, err := extract(t, archive, data, "")
+			if err == nil {
+				t.Errorf("%s: extracted %s", archive, name)
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s: %s was written outside the archive's directory", archive, name)
+			}
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	// A link would let later entries be written through it, so none are
+	// made, whether it points inside the archive or out of it.
+	entries := []archiveEntry{{name: "up", link: ".."}, {name: "root", link: "/"}, {name: "here", link: "file"}, {name: "file", body: "data"}}
+	for archive, data := range map[string][]byte{
+		"file.zip":    zipArchive(t, entries),
+		"file.tar.gz": tarGzArchive(t, entries),
+	} {
+		_, out, err := extract(t, archive, data, "")
+		if err != nil {
+			t.Fatalf("%s: %v", archive, err)
+		}
+		for _, link := range []string{"up", "root", "here"} {
+			if _, err := os.Lstat(filepath.Join(out.Path, link)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s: the link %s was made: %v", archive, link, err)
+			}
+		}
+	}
+}
+
+func TestParseJobPipeline(t *testing.T) {
+	for _, steps := range [][]string{{"decompress", "extract"}, {"extract=unpacked", "move=done/today", "notify"}} {
+		if _, err := parseJobPipeline(steps); err != nil {
+			t.Errorf("%q: %v", steps, err)
+		}
+	}
+	for _, steps := range [][]string{{"exec=rm -rf /"}, {"extract=../up"}, {"extract=/etc"}, {"move=../../elsewhere"}, {"unknown"}} {
+		if _, err := parseJobPipeline(steps); err == nil {
+			t.Errorf("%q: accepted", steps)
+		}
+	}
+	if _, err := parseJobPipeline([]string{"exec=true"}); !errors.Is(err, ErrCommandStep) {
+		t.Errorf("exec step: %v", err)
+	}
+}
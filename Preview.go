@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// PreviewInterval is how often a followed preview checks for new data.
+var PreviewInterval = 200 * time.Millisecond
+
+var ErrNoPreview = errors.New("nothing of the download is written yet")
+
+// frontier follows the end of the data written contiguously from the start
+// of the output, holding ranges written beyond it until the gap closes.
+type frontier struct {
+	front   int64
+	pending [][2]int64
+}
+
+// add records n bytes written at pos and reports whether the front moved.
+func (fr *frontier) add(pos, n int64) bool {
+	end := pos + n
+	if pos > fr.front {
+		for i := range fr.pending {
+			if fr.pending[i][1] == pos {
+				fr.pending[i][1] = end
+				return false
+			}
+		}
+		fr.pending = append(fr.pending, [2]int64{pos, end})
+		return false
+	}
+	fr.front = max(fr.front, end)
+	for merged := true; merged; {
+		merged = false
+		for i, p := range fr.pending {
+			if p[0] <= fr.front {
+				fr.front = max(fr.front, p[1])
+				fr.pending = append(fr.pending[:i], fr.pending[i+1:]...)
+				merged = true
+				break
+			}
+		}
+	}
+	return true
+}
+
+// startPrefix seeds the frontier with what the output holds before the
+// download starts: everything outside the blocks left to download, which is
+// the part kept from an earlier run.
+func (f *File) startPrefix() {
+	var missing [][2]int64
+	for _, b := range f.BlockList {
+		if !b.done() {
+			missing = append(missing, [2]int64{b.Begin - f.offset, b.End - f.offset})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i][0] < missing[j][0] })
+	f.prefixMu.Lock()
+	defer f.prefixMu.Unlock()
+	f.prefix = frontier{}
+	var pos int64
+	for _, m := range missing {
+		if m[0] > pos {
+			f.prefix.add(pos, m[0]-pos)
+		}
+		if m[1] < 0 {
+			return
+		}
+		pos = max(pos, m[1]+1)
+	}
+	if f.Size > 0 && f.Size > pos {
+		f.prefix.add(pos, f.Size-pos)
+	}
+}
+
+func (f *File) written(pos, n int64) {
+	f.prefixMu.Lock()
+	f.prefix.add(pos, n)
+	f.prefixMu.Unlock()
+	if f.tee != nil {
+		f.tee.written(pos, n)
+	}
+}
+
+// Available returns how many bytes from the start of the output are written
+// and can be read while the download goes on.
+func (f *File) Available() int64 {
+	f.prefixMu.Lock()
+	defer f.prefixMu.Unlock()
+	return f.prefix.front
+}
+
+// Preview reads the output of a download while it downloads, up to the
+// first byte still missing. The parallel strategy fills a file from several
+// places at once, so with the sequential one the readable part grows fastest.
+type Preview struct {
+	*os.File
+	file *File
+}
+
+func (m *Manager) Preview(id int) (*Preview, error) {
+	d, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	file, path := d.file, d.Path
+	m.mu.Unlock()
+	if file == nil {
+		return nil, ErrNoPreview
+	}
+	out, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Preview{File: out, file: file}, nil
+}
+
+// Available returns how many bytes from the start can be read, and whether
+// the download ended, so no more will come.
+func (p *Preview) Available() (int64, bool) {
+	select {
+	case <-p.file.finished:
+		if p.file.State() == StateFinished {
+			if info, err := p.Stat(); err == nil {
+				return info.Size(), true
+			}
+		}
+		return p.file.Available(), true
+	default:
+		return p.file.Available(), false
+	}
+}
+
+// Total returns the size of the file, -1 when it is not known.
+func (p *Preview) Total() int64 {
+	if p.file.Size > 0 {
+		return p.file.Size
+	}
+	return -1
+}
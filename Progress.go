@@ -0,0 +1,209 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StateIdle        = "idle"
+	StateQueued      = "queued"
+	StateDownloading = "downloading"
+	StatePausing     = "pausing"
+	StatePaused      = "paused"
+	StateFinished    = "finished"
+	StateFailed      = "failed"
+	StateCanceled    = "canceled"
+	StateUpToDate    = "up-to-date"
+	StateDeferred    = "deferred"
+	StatePruned      = "pruned"
+)
+
+type Progress struct {
+	Id         int             `json:"id"`
+	Url        string          `json:"url"`
+	FinalUrl   string          `json:"final_url,omitempty"`
+	Downloaded int64           `json:"downloaded"`
+	Session    int64           `json:"session"`
+	Total      int64           `json:"total"`
+	Speed      int64           `json:"speed"`
+	Eta        float64         `json:"eta"`
+	State      string          `json:"state"`
+	Blocks     []BlockProgress `json:"blocks,omitempty"`
+}
+
+type BlockProgress struct {
+	Begin      int64   `json:"begin"`
+	End        int64   `json:"end"`
+	Downloaded int64   `json:"downloaded"`
+	Percent    float64 `json:"percent"`
+	Active     bool    `json:"active"`
+}
+
+func (f *File) Progress() Progress {
+	p := Progress{
+		Url:        f.Url,
+		FinalUrl:   f.finalUrl,
+		Downloaded: atomic.LoadInt64(&f.status.Downloaded),
+		Session:    atomic.LoadInt64(&f.status.Session),
+		Total:      f.Size,
+		Speed:      atomic.LoadInt64(&f.status.Speeds),
+		Eta:        -1,
+		State:      f.State(),
+		Blocks:     f.blockProgress(),
+	}
+	if p.Total < 0 && p.State == StateFinished {
+		// A stream of unknown length ends at EOF, so its size is what arrived.
+		p.Total = p.Downloaded
+	}
+	if p.Total > 0 && p.Speed > 0 {
+		p.Eta = float64(p.Total-p.Downloaded) / float64(p.Speed)
+	}
+	return p
+}
+
+func (f *File) blockProgress() []BlockProgress {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if len(f.BlockList) == 0 {
+		return nil
+	}
+
+	var blocks []BlockProgress
+	if f.skip > 0 {
+		blocks = append(blocks, BlockProgress{Begin: 0, End: f.skip - 1, Downloaded: f.skip, Percent: 100})
+	}
+	for _, b := range f.BlockList {
+		bp := BlockProgress{
+			Begin:      b.start - f.offset,
+			End:        -1,
+			Downloaded: b.Begin - b.start,
+			Active:     b.busy,
+		}
+		if b.End >= 0 {
+			bp.End = b.End - f.offset
+			if size := b.End - b.start + 1; size > 0 {
+				bp.Percent = float64(bp.Downloaded) * 100 / float64(size)
+			}
+		}
+		blocks = append(blocks, bp)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	return blocks
+}
+
+// Line is the progress bar of a single download: the bytes so far out of the
+// total, a map of its blocks width characters wide, the speed and the state.
+func (p Progress) Line(width int) string {
+	if p.Total < 0 {
+		return trf("%v so far, size unknown %v byte/s [%v]", FormatBytes(p.Downloaded), p.Speed, strings.ToUpper(tr(p.State)))
+	}
+	return fmt.Sprintf("%v/%v [%s] %v byte/s [%v]", p.Downloaded, p.Total, blockMap(p.Blocks, p.Total, width), p.Speed, strings.ToUpper(tr(p.State)))
+}
+
+func blockMap(blocks []BlockProgress, total int64, width int) string {
+	if total <= 0 || width < 1 {
+		return strings.Repeat(" ", width)
+	}
+	var done = make([]int64, width)
+	var cells = []byte(strings.Repeat(" ", width))
+	cell := func(pos int64) int {
+		return int(min(pos*int64(width)/total, int64(width-1)))
+	}
+	for _, b := range blocks {
+		if b.End < 0 || b.Downloaded <= 0 {
+			continue
+		}
+		from, to := b.Begin, b.Begin+b.Downloaded
+		for i := cell(from); i <= cell(to-1); i++ {
+			lo, hi := int64(i)*total/int64(width), int64(i+1)*total/int64(width)
+			done[i] += min(hi, to) - max(lo, from)
+		}
+	}
+	for i := range cells {
+		size := int64(i+1)*total/int64(width) - int64(i)*total/int64(width)
+		switch {
+		case done[i] >= size:
+			cells[i] = '='
+		case done[i] > 0:
+			cells[i] = '-'
+		}
+	}
+	for _, b := range blocks {
+		if b.Active && b.End >= 0 && b.Begin+b.Downloaded <= b.End {
+			cells[cell(b.Begin+b.Downloaded)] = '>'
+		}
+	}
+	return string(cells)
+}
+
+// ProgressInterval is how often OnProgress callbacks are called by default.
+var ProgressInterval = 500 * time.Millisecond
+
+// OnProgress calls fn with the download's progress every ProgressInterval,
+// or as set by WithProgressInterval, while it runs, and once more when it
+// stops. Calls never overlap, and run as set by WithDelivery.
+func OnProgress(fn func(Progress)) Option {
+	return func(f *File) error {
+		f.onProgress = fn
+		return nil
+	}
+}
+
+// WithProgressInterval sets how often OnProgress is called: every interval,
+// and as soon as bytes more were downloaded since the previous call. Either
+// may be zero to turn it off.
+func WithProgressInterval(interval time.Duration, bytes int64) Option {
+	return func(f *File) error {
+		if interval < 0 || bytes < 0 {
+			return errors.New("progress interval must not be negative")
+		}
+		f.progressInterval = interval
+		f.progressDelta = bytes
+		return nil
+	}
+}
+
+func (f *File) reportProgress(ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+	if f.onProgress == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+		var tick <-chan time.Time
+		if f.progressInterval > 0 {
+			ticker := time.NewTicker(f.progressInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-f.progressKick:
+			}
+			p := f.Progress()
+			atomic.StoreInt64(&f.progressMark, p.Downloaded)
+			f.delivery.deliver(func() { f.onProgress(p) }, true)
+		}
+	}()
+	return stopped
+}
+
+func (f *File) progressed(downloaded int64) {
+	if f.onProgress == nil || f.progressDelta <= 0 || downloaded-atomic.LoadInt64(&f.progressMark) < f.progressDelta {
+		return
+	}
+	select {
+	case f.progressKick <- struct{}{}:
+	default:
+	}
+}
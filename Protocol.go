@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Capabilities struct {
+	Ranges      bool `json:"ranges"`
+	KnownLength bool `json:"known_length"`
+	ETag        bool `json:"etag"`
+}
+
+type Resource struct {
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+type Protocol interface {
+	Probe(ctx context.Context, url string) (Resource, error)
+	OpenRange(ctx context.Context, url string, begin, end int64) (io.ReadCloser, error)
+	Capabilities() Capabilities
+}
+
+var (
+	protocolsMu sync.RWMutex
+	protocols   = map[string]Protocol{}
+)
+
+func init() {
+	RegisterProtocol("http", &httpProtocol{})
+	RegisterProtocol("https", &httpProtocol{})
+}
+
+func RegisterProtocol(scheme string, p Protocol) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	protocols[strings.ToLower(scheme)] = p
+}
+
+func lookupProtocol(rawUrl string) (Protocol, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	p, ok := protocols[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol scheme %q", u.Scheme)
+	}
+	return p, nil
+}
+
+func (f *File) probeProtocol(ctx context.Context) (bool, error) {
+	r, err := f.protocol.Probe(ctx, f.Url)
+	if err != nil {
+		return false, err
+	}
+	f.finalUrl = f.Url
+	f.Size = r.Size
+	f.ETag = r.ETag
+	f.ContentType = r.ContentType
+	f.LastModified = r.LastModified
+
+	ranges := f.protocol.Capabilities().Ranges
+	if !ranges {
+		if f.ranged {
+			return false, errors.New("protocol does not support byte ranges")
+		}
+		f.noRanges = true
+	}
+	return ranges, nil
+}
+
+type httpProtocol struct {
+	Client *http.Client
+}
+
+func (p *httpProtocol) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func (p *httpProtocol) Capabilities() Capabilities {
+	return Capabilities{Ranges: true}
+}
+
+func (p *httpProtocol) Probe(ctx context.Context, url string) (Resource, error) {
+	request, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return Resource{}, err
+	}
+	resp, err := p.client().Do(request)
+	if err != nil {
+		return Resource{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return Resource{}, &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	r := Resource{Size: resp.ContentLength, ETag: resp.Header.Get("ETag"), ContentType: resp.Header.Get("Content-Type")}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		r.LastModified = t
+	}
+	return r, nil
+}
+
+func (p *httpProtocol) OpenRange(ctx context.Context, url string, begin, end int64) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if end >= 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-"+strconv.FormatInt(end, 10))
+	} else if begin > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-")
+	}
+	resp, err := p.client().Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if request.Header.Get("Range") != "" && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, ErrRangeIgnored
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	AuthBasic     = "basic"
+	AuthNTLM      = "ntlm"
+	AuthNegotiate = "negotiate"
+)
+
+type ntlmTransport struct {
+	next        http.RoundTripper
+	credentials ntlmCredentials
+}
+
+func (t *ntlmTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(request)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	scheme := ntlmScheme(resp.Header.Values("WWW-Authenticate"))
+	if scheme == "" {
+		return resp, nil
+	}
+	discard(resp)
+
+	retry := request.Clone(request.Context())
+	retry.Header.Set("Authorization", scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+	resp, err = t.next.RoundTrip(retry)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge, err := ntlmChallengeHeader(resp.Header.Values("WWW-Authenticate"), scheme)
+	if err != nil {
+		return resp, nil
+	}
+	discard(resp)
+
+	msg, err := t.credentials.authenticateMessage(challenge)
+	if err != nil {
+		return nil, err
+	}
+	retry = request.Clone(request.Context())
+	retry.Header.Set("Authorization", scheme+" "+base64.StdEncoding.EncodeToString(msg))
+	return t.next.RoundTrip(retry)
+}
+
+func (f *File) dialProxy(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxyAddr := f.proxy.Host
+		if f.proxy.Port() == "" {
+			proxyAddr = net.JoinHostPort(f.proxy.Hostname(), "8080")
+		}
+		conn, err := dial(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err := f.connect(conn, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+func (f *File) connect(conn net.Conn, addr string) error {
+	reader := bufio.NewReader(conn)
+	send := func(auth string) (*http.Response, error) {
+		request := &http.Request{Method: "CONNECT", URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+		request.Header.Set("Proxy-Authorization", auth)
+		if err := request.Write(conn); err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(reader, request)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			discard(resp)
+		}
+		return resp, nil
+	}
+
+	scheme := "NTLM"
+	if f.proxyAuth == AuthNegotiate {
+		scheme = "Negotiate"
+	}
+	resp, err := send(scheme + " " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		challenge, err := ntlmChallengeHeader(resp.Header.Values("Proxy-Authenticate"), scheme)
+		if err != nil {
+			return err
+		}
+		msg, err := f.proxyCredentials.authenticateMessage(challenge)
+		if err != nil {
+			return err
+		}
+		if resp, err = send(scheme + " " + base64.StdEncoding.EncodeToString(msg)); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return errors.New("proxy sent data before the tunnel was established")
+	}
+	return nil
+}
+
+func ntlmScheme(values []string) string {
+	var scheme string
+	for _, v := range values {
+		name, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+		switch {
+		case strings.EqualFold(name, "NTLM"):
+			return "NTLM"
+		case strings.EqualFold(name, "Negotiate"):
+			scheme = "Negotiate"
+		}
+	}
+	return scheme
+}
+
+func ntlmChallengeHeader(values []string, scheme string) (*ntlmChallenge, error) {
+	for _, v := range values {
+		name, token, ok := strings.Cut(strings.TrimSpace(v), " ")
+		if !ok || !strings.EqualFold(name, scheme) {
+			continue
+		}
+		msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+		if err != nil {
+			return nil, err
+		}
+		return parseNtlmChallenge(msg)
+	}
+	return nil, errors.New("no " + scheme + " challenge in response")
+}
+
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+}
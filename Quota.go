@@ -0,0 +1,258 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QuotaReject = "reject"
+	QuotaDefer  = "defer"
+
+	EventPruned = "pruned"
+)
+
+var (
+	QuotaRecheck = time.Minute
+
+	ErrQuota = errors.New("quota exceeded")
+)
+
+type Quota struct {
+	Dir    string `json:"dir,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Limit  int64  `json:"limit"`
+	Action string `json:"action,omitempty"`
+	Prune  bool   `json:"prune,omitempty"`
+}
+
+type QuotaUsage struct {
+	Quota
+	Used int64 `json:"used"`
+}
+
+func ParseQuota(s string) (Quota, error) {
+	target, spec, ok := strings.Cut(s, "=")
+	if !ok {
+		return Quota{}, fmt.Errorf("invalid quota %q, expected dir=size or tag:name=size", s)
+	}
+	var q Quota
+	if tag, ok := strings.CutPrefix(strings.TrimSpace(target), "tag:"); ok {
+		q.Tag = tag
+	} else {
+		q.Dir = strings.TrimSpace(target)
+	}
+	fields := strings.Split(spec, ",")
+	limit, err := ParseBytes(fields[0])
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid quota size %q", fields[0])
+	}
+	q.Limit = limit
+	for _, field := range fields[1:] {
+		switch field = strings.TrimSpace(field); field {
+		case QuotaReject, QuotaDefer:
+			q.Action = field
+		case "prune":
+			q.Prune = true
+		default:
+			return Quota{}, fmt.Errorf("unknown quota option %q", field)
+		}
+	}
+	return q, q.validate()
+}
+
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	var shift uint
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			shift, s = uint(i+1)*10, s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n << shift, nil
+}
+
+func (q Quota) validate() error {
+	if (q.Dir == "") == (q.Tag == "") {
+		return errors.New("quota needs either a directory or a tag")
+	}
+	if q.Limit <= 0 {
+		return fmt.Errorf("quota for %s needs a positive limit", q)
+	}
+	if q.Action != "" && q.Action != QuotaReject && q.Action != QuotaDefer {
+		return fmt.Errorf("unknown quota action %q", q.Action)
+	}
+	return nil
+}
+
+func (q Quota) String() string {
+	if q.Tag != "" {
+		return "tag " + q.Tag
+	}
+	return "directory " + q.Dir
+}
+
+func (m *Manager) covers(q Quota, d *Download) bool {
+	if q.Tag != "" {
+		return slices.Contains(d.tags, q.Tag)
+	}
+	rel, err := filepath.Rel(m.resolveDir(q.Dir), d.Path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (m *Manager) Quotas() []QuotaUsage {
+	m.mu.Lock()
+	quotas := m.config.Quotas
+	m.mu.Unlock()
+	var list = []QuotaUsage{}
+	for _, q := range quotas {
+		list = append(list, QuotaUsage{Quota: q, Used: m.usage(q, nil)})
+	}
+	return list
+}
+
+func (m *Manager) usage(q Quota, self *Download) int64 {
+	m.mu.Lock()
+	reserved := map[string]int64{}
+	var finished []string
+	for _, d := range m.downloads {
+		switch {
+		case d == self:
+			reserved[d.Path] = 0
+		case !m.covers(q, d):
+		case d.file != nil && (d.state == StateDownloading || d.state == StatePaused):
+			reserved[d.Path] = max(d.file.Size, 0)
+		case d.state == StateFinished:
+			finished = append(finished, d.Path)
+		}
+	}
+	m.mu.Unlock()
+
+	var used int64
+	for _, n := range reserved {
+		used += n
+	}
+	if q.Tag != "" {
+		for _, path := range finished {
+			if info, err := os.Stat(path); err == nil {
+				used += info.Size()
+			}
+		}
+		return used
+	}
+	filepath.WalkDir(m.resolveDir(q.Dir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if _, ok := reserved[path]; ok {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			used += info.Size()
+		}
+		return nil
+	})
+	return used
+}
+
+func (m *Manager) admit(d *Download, size int64) (bool, error) {
+	m.mu.Lock()
+	var quotas []Quota
+	for _, q := range m.config.Quotas {
+		if m.covers(q, d) {
+			quotas = append(quotas, q)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, q := range quotas {
+		for {
+			used := m.usage(q, d) + max(size, 0)
+			if used <= q.Limit {
+				break
+			}
+			if !q.Prune || !m.prune(q, d) {
+				return q.Action == QuotaDefer, fmt.Errorf("%w: %s would use %d of %d bytes", ErrQuota, q, used, q.Limit)
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *Manager) prune(q Quota, self *Download) bool {
+	m.mu.Lock()
+	var candidates []*Download
+	for _, d := range m.downloads {
+		if d != self && d.state == StateFinished && m.covers(q, d) {
+			candidates = append(candidates, d)
+		}
+	}
+	m.mu.Unlock()
+
+	var oldest *Download
+	var oldestTime time.Time
+	for _, d := range candidates {
+		info, err := os.Stat(d.Path)
+		if err != nil {
+			continue
+		}
+		if oldest == nil || info.ModTime().Before(oldestTime) {
+			oldest, oldestTime = d, info.ModTime()
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	if err := os.Remove(oldest.Path); err != nil {
+		slog.Warn("can not prune download", "path", oldest.Path, "err", err)
+		return false
+	}
+	m.mu.Lock()
+	oldest.state = StatePruned
+	m.mu.Unlock()
+	slog.Info("pruned download", "path", oldest.Path, "quota", q.String())
+	m.publish(oldest, EventPruned)
+	m.notify(oldest, EventPruned)
+	return true
+}
+
+func (m *Manager) refuse(d *Download, deferred bool, err error) {
+	if !deferred {
+		m.fail(d, err)
+		return
+	}
+	m.mu.Lock()
+	if d.state == StateCanceled {
+		m.mu.Unlock()
+		return
+	}
+	d.state, d.err = StateDeferred, err
+	m.mu.Unlock()
+	slog.Info("download deferred", "path", d.Path, "err", err)
+	m.publish(d, EventDeferred)
+	time.AfterFunc(QuotaRecheck, func() {
+		m.mu.Lock()
+		requeue := d.state == StateDeferred
+		if requeue {
+			d.state, d.err = StateQueued, nil
+		}
+		m.mu.Unlock()
+		if requeue {
+			m.publish(d, EventQueued)
+			m.schedule()
+		}
+	})
+	m.schedule()
+}
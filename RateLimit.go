@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+var SmoothSlack = 10 * time.Millisecond
+
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	burst  float64
+	refill time.Duration
+	smooth bool
+}
+
+func NewTokenBucket(bytesPerSecond int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) capacity() float64 {
+	switch {
+	case b.smooth:
+		return b.rate * SmoothSlack.Seconds()
+	case b.burst > 0:
+		return b.burst
+	}
+	return b.rate
+}
+
+func (b *TokenBucket) SetRate(bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bytesPerSecond)
+	b.tokens = min(b.tokens, b.capacity())
+}
+
+func (b *TokenBucket) SetShaping(burst int64, refill time.Duration, smooth bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.burst, b.refill, b.smooth = float64(burst), refill, smooth
+	b.tokens = min(b.tokens, b.capacity())
+}
+
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	var wait time.Duration
+	if b.refill > 0 && !b.smooth {
+		steps := now.Sub(b.last) / b.refill
+		b.tokens = min(b.tokens+float64(steps)*b.refill.Seconds()*b.rate, b.capacity())
+		b.last = b.last.Add(steps * b.refill)
+		b.tokens -= float64(n)
+		if b.tokens < 0 {
+			steps = time.Duration(math.Ceil(-b.tokens / (b.refill.Seconds() * b.rate)))
+			wait = b.last.Add(steps * b.refill).Sub(now)
+		}
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.capacity())
+		b.last = now
+		b.tokens -= float64(n)
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		}
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
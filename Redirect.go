@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	RedirectSame    = "same"
+	RedirectUpgrade = "upgrade"
+	RedirectAny     = "any"
+)
+
+var (
+	MaxRedirects = 10
+
+	ErrRedirect = errors.New("redirect refused")
+)
+
+func validRedirectScheme(policy string) bool {
+	switch policy {
+	case RedirectSame, RedirectUpgrade, RedirectAny:
+		return true
+	}
+	return false
+}
+
+func (f *File) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.maxRedirects {
+		return fmt.Errorf("%w: more than %d redirects", ErrRedirect, f.maxRedirects)
+	}
+	prev := via[len(via)-1]
+	if err := f.checkScheme(req.URL); err != nil {
+		return fmt.Errorf("%w: %w", ErrRedirect, err)
+	}
+	from, to := prev.URL.Scheme, req.URL.Scheme
+	if (f.redirectScheme == RedirectSame && from != to) || (f.redirectScheme == RedirectUpgrade && from == "https" && to != "https") {
+		return fmt.Errorf("%w: %s to %s", ErrRedirect, prev.URL.Redacted(), req.URL.Redacted())
+	}
+	if auth := via[0].Header.Get("Authorization"); auth != "" {
+		if f.redirectAuth {
+			req.Header.Set("Authorization", auth)
+		} else if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			req.Header.Del("Authorization")
+		}
+	}
+	return nil
+}
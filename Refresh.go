@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var (
+	// MaxUrlRefreshes is how many fresh URLs in a row may be refused before
+	// the download fails.
+	MaxUrlRefreshes = 3
+
+	errRefreshed = errors.New("url refreshed")
+)
+
+// WithUrlRefresh asks refresh for a new URL when the server refuses the
+// current one with 403 Forbidden, as pre-signed links do once they expire.
+// refresh gets the refused URL. Ranges in flight are requested again from
+// the new URL, and the download keeps the URL it was started with as its
+// name.
+func WithUrlRefresh(refresh func(ctx context.Context, expired string) (string, error)) Option {
+	return func(f *File) error {
+		f.refresh = refresh
+		return nil
+	}
+}
+
+// RefreshCommand runs command in a shell with the refused URL in $CDM_URL
+// and takes the first line it prints as the new URL.
+func RefreshCommand(command string) func(context.Context, string) (string, error) {
+	return func(ctx context.Context, expired string) (string, error) {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+		cmd.Env = append(os.Environ(), "CDM_URL="+expired)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("refresh command: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				return line, nil
+			}
+		}
+		return "", errors.New("refresh command printed no URL")
+	}
+}
+
+// requestUrl is the URL requests go to: the one the download was started
+// with until it is refreshed.
+func (f *File) requestUrl() string {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if f.freshUrl != "" {
+		return f.freshUrl
+	}
+	return f.Url
+}
+
+// refreshUrl replaces used, which the server refused with refused, and
+// returns errRefreshed to have the request made again. When another
+// connection already replaced it, only the request is made again.
+func (f *File) refreshUrl(ctx context.Context, used string, refused error) error {
+	f.refreshMu.Lock()
+	defer f.refreshMu.Unlock()
+	if f.requestUrl() != used {
+		return errRefreshed
+	}
+	f.blockMu.Lock()
+	f.refreshes++
+	tries := f.refreshes
+	f.blockMu.Unlock()
+	if tries > MaxUrlRefreshes {
+		return refused
+	}
+	fresh, err := f.refresh(ctx, used)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(fresh)
+	if err != nil {
+		return fmt.Errorf("refreshed url: %w", err)
+	}
+	if err := f.checkScheme(u); err != nil {
+		return fmt.Errorf("refreshed url: %w", err)
+	}
+	f.blockMu.Lock()
+	f.freshUrl = fresh
+	f.blockMu.Unlock()
+	slog.Info("server refused the url, continuing with a fresh one", "url", f.Url, "fresh", u.Redacted())
+	return errRefreshed
+}
+
+// refreshed notes that the server accepted the current URL.
+func (f *File) refreshed() {
+	f.blockMu.Lock()
+	f.refreshes = 0
+	f.blockMu.Unlock()
+}
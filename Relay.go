@@ -0,0 +1,373 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// RelayBuffer is how far ahead of the bytes sent on the downloads of a
+	// relay may get, and so the memory it holds.
+	RelayBuffer int64 = 64 << 20
+
+	errRelayAhead = errors.New("relay: write past the buffer")
+)
+
+// relaySink is where a relay sends the file in order. Nothing is to appear
+// at the destination before Commit, and Abort drops what was sent.
+type relaySink interface {
+	io.Writer
+	Commit() error
+	Abort(err error)
+}
+
+// Relay is an io.WriterAt that sends a download on to a remote destination
+// as it arrives, without a local copy: bytes written out of order wait in a
+// buffer of RelayBuffer until the bytes before them arrived, and downloads
+// past the buffer wait for it to drain. The SHA-256 of what was sent is
+// checked before the destination is committed.
+type Relay struct {
+	target string
+	open   func(size int64) (relaySink, error)
+
+	mu sync.Mutex
+	frontier
+	buf   []byte
+	sent  int64
+	ended bool
+	err   error
+	moved chan struct{}
+	sink  relaySink
+	hash  hash.Hash
+	done  chan struct{}
+}
+
+// NewRelay prepares a relay to target: an http or https URL the file is
+// PUT to, s3://bucket/key for a multipart upload, or
+// sftp://[user@]host[:port]/path, sent over ssh.
+func NewRelay(target string, buffer int64) (*Relay, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if buffer < 1<<20 {
+		return nil, errors.New("relay buffer must be at least 1 MiB")
+	}
+	r := &Relay{target: u.Redacted(), buf: make([]byte, buffer), moved: make(chan struct{}), hash: sha256.New(), done: make(chan struct{})}
+	switch u.Scheme {
+	case "http", "https":
+		r.open = func(size int64) (relaySink, error) { return newPutSink(u, size) }
+	case "s3":
+		r.open = func(int64) (relaySink, error) { return newS3Upload(u) }
+	case "sftp":
+		r.open = func(size int64) (relaySink, error) { return newSSHSink(u, size) }
+	default:
+		return nil, fmt.Errorf("can not relay to %q: want http, https, s3 or sftp", u.Scheme)
+	}
+	return r, nil
+}
+
+// Target is where the relay sends the download, its password redacted.
+func (r *Relay) Target() string {
+	return r.target
+}
+
+// WithRelay writes the download to relay instead of a file.
+func WithRelay(relay *Relay) Option {
+	return func(f *File) error {
+		f.writer, f.relay = relay, relay
+		return nil
+	}
+}
+
+// Open starts the upload of a file of size bytes, -1 if unknown.
+func (r *Relay) Open(size int64) error {
+	sink, err := r.open(size)
+	if err != nil {
+		return err
+	}
+	r.sink = sink
+	go r.pump()
+	return nil
+}
+
+// signal wakes everyone waiting on the relay. r.mu is held.
+func (r *Relay) signal() {
+	close(r.moved)
+	r.moved = make(chan struct{})
+}
+
+func (r *Relay) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.signal()
+}
+
+func (r *Relay) WriteAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	n := len(p)
+	if skip := r.front - off; skip > 0 {
+		if skip >= int64(n) {
+			return n, nil
+		}
+		p, off = p[skip:], r.front
+	}
+	window := int64(len(r.buf))
+	if off+int64(len(p)) > r.sent+window {
+		return 0, errRelayAhead
+	}
+	for at, rest := off, p; len(rest) > 0; {
+		c := copy(r.buf[at%window:], rest)
+		at, rest = at+int64(c), rest[c:]
+	}
+	if r.add(off, int64(len(p))) {
+		r.signal()
+	}
+	return n, nil
+}
+
+// wait blocks until the buffer has room for the bytes before end, so that
+// a download ahead of the others does not read more than can be kept.
+func (r *Relay) wait(ctx context.Context, end int64) error {
+	for {
+		r.mu.Lock()
+		room, err, moved := end <= r.sent+int64(len(r.buf)), r.err, r.moved
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if room {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-moved:
+		}
+	}
+}
+
+// pump sends the bytes in order as they arrive. Only it reads the buffer
+// between sent and the front, where nothing writes.
+func (r *Relay) pump() {
+	defer close(r.done)
+	window := int64(len(r.buf))
+	for {
+		r.mu.Lock()
+		front, sent, ended, err, moved := r.front, r.sent, r.ended, r.err, r.moved
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+		if front == sent {
+			if ended {
+				return
+			}
+			<-moved
+			continue
+		}
+		end := min(front, sent+window-sent%window, sent+1<<20)
+		chunk := r.buf[sent%window : sent%window+end-sent]
+		r.hash.Write(chunk)
+		if _, err := r.sink.Write(chunk); err != nil {
+			r.fail(fmt.Errorf("relay to %s: %w", r.target, err))
+			return
+		}
+		r.mu.Lock()
+		r.sent = end
+		r.signal()
+		r.mu.Unlock()
+	}
+}
+
+// Finish sends what is left and commits the destination once size bytes
+// were sent, and their SHA-256 is want when given. It returns the SHA-256.
+func (r *Relay) Finish(size int64, want string) (string, error) {
+	r.mu.Lock()
+	r.ended = true
+	r.signal()
+	r.mu.Unlock()
+	<-r.done
+	err := r.err
+	sum := hex.EncodeToString(r.hash.Sum(nil))
+	switch {
+	case err != nil:
+	case size >= 0 && r.sent != size:
+		err = fmt.Errorf("relay to %s: sent %d of %d bytes", r.target, r.sent, size)
+	case want != "" && sum != want:
+		err = fmt.Errorf("%w: got sha256 %s, want %s", ErrChecksumMismatch, sum, want)
+	}
+	if err != nil {
+		r.sink.Abort(err)
+		return sum, err
+	}
+	return sum, r.sink.Commit()
+}
+
+// Abort stops the relay after a failed download, dropping what was sent.
+func (r *Relay) Abort(err error) {
+	r.fail(err)
+	if r.sink != nil {
+		r.sink.Abort(err)
+		<-r.done
+	}
+}
+
+// streamSink writes to a stream that completes when it is closed, holding
+// back the last write so an aborted relay never closes it whole.
+type streamSink struct {
+	w     io.WriteCloser
+	held  []byte
+	wait  func() error
+	abort func(error)
+}
+
+func (s *streamSink) Write(p []byte) (int, error) {
+	if len(s.held) > 0 {
+		if _, err := s.w.Write(s.held); err != nil {
+			return 0, err
+		}
+	}
+	s.held = append(s.held[:0], p...)
+	return len(p), nil
+}
+
+func (s *streamSink) Commit() error {
+	if len(s.held) > 0 {
+		if _, err := s.w.Write(s.held); err != nil {
+			s.abort(err)
+			return err
+		}
+	}
+	s.w.Close()
+	return s.wait()
+}
+
+func (s *streamSink) Abort(err error) {
+	s.abort(err)
+	s.wait()
+}
+
+// newPutSink sends the file as the body of a PUT to u, with its length when
+// known. An aborted upload ends the body short, which servers do not store.
+func newPutSink(u *url.URL, size int64) (relaySink, error) {
+	body, w := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("PUT %s: %s", u.Redacted(), resp.Status)
+			}
+		}
+		body.CloseWithError(err)
+		result <- err
+	}()
+	var once sync.Once
+	var resultErr error
+	return &streamSink{
+		w:     w,
+		wait:  func() error { once.Do(func() { resultErr = <-result }); return resultErr },
+		abort: func(err error) { w.CloseWithError(err) },
+	}, nil
+}
+
+// newSSHSink writes the file to path on the host of u with ssh, to a
+// temporary name renamed when complete. With a known size a short file is
+// removed instead.
+func newSSHSink(u *url.URL, size int64) (relaySink, error) {
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("%s: want sftp://[user@]host[:port]/path", u.Redacted())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args := []string{"-o", "BatchMode=yes"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	path := strings.TrimPrefix(u.Path, "/~/")
+	tmp := shellQuote(path + ".cdm-relay")
+	command := "cat > " + tmp + " && mv " + tmp + " " + shellQuote(path)
+	if size >= 0 {
+		command = "cat > " + tmp + " && [ \"$(wc -c < " + tmp + ")\" -eq " + strconv.FormatInt(size, 10) + " ] && mv " + tmp + " " + shellQuote(path) + " || { rm -f " + tmp + "; exit 1; }"
+	}
+	cmd := exec.Command("ssh", append(args, host, command)...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	var waitErr error
+	return &streamSink{
+		w: stdin,
+		wait: func() error {
+			once.Do(func() {
+				if waitErr = cmd.Wait(); waitErr != nil {
+					waitErr = fmt.Errorf("ssh %s: %w", host, waitErr)
+				}
+			})
+			return waitErr
+		},
+		abort: func(error) { cmd.Process.Kill() },
+	}, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RelayDownload downloads url and sends it on to the relay, returning the
+// SHA-256 of what was sent.
+func RelayDownload(ctx context.Context, url string, relay *Relay, want string, opts ...Option) (*File, string, error) {
+	opts = append([]Option{WithPieceOrder(PieceOrderWindow, int64(len(relay.buf))/2)}, opts...)
+	file, err := New(url, nil, append(opts, WithRelay(relay))...)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := relay.Open(file.Size); err != nil {
+		return file, "", err
+	}
+	if err := file.Run(ctx); err != nil {
+		relay.Abort(err)
+		return file, "", err
+	}
+	size := file.Size
+	if size < 0 {
+		size = file.Progress().Downloaded
+	}
+	sum, err := relay.Finish(size, want)
+	return file, sum, err
+}
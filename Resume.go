@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	ResumeMagic = "CDMRESUM"
+	// ResumeVersion is the major version of the format, which changes only
+	// when existing fields change. ResumeMinorVersion counts the fields
+	// added at the end of the header or of a record since, which readers
+	// that do not know them skip.
+	ResumeVersion      = 1
+	ResumeMinorVersion = 1
+
+	resumeHeaderSize = 8 + 4 + 4 + 4 + 2
+	resumeRecordSize = 8 + 8 + 8 + sha256.Size
+)
+
+var (
+	ErrResumeFormat  = errors.New("not a resume file")
+	ErrResumeVersion = errors.New("unsupported resume file version")
+)
+
+type ResumeState struct {
+	Version int
+	// MinorVersion is that of the writer, 0 for files written before it
+	// was recorded.
+	MinorVersion int
+	Url          string
+	ETag         string
+	Size         int64
+	Blocks       []ResumeBlock
+}
+
+type ResumeBlock struct {
+	Begin   int64
+	End     int64
+	Written int64
+	Sha256  [sha256.Size]byte
+}
+
+func ResumePath(path string) string {
+	return path + ".cdm"
+}
+
+func WithResumeState(state ResumeState) Option {
+	return func(f *File) error {
+		f.resume = true
+		f.resumeETag = state.ETag
+		f.resumeState = &state
+		return nil
+	}
+}
+
+func (s ResumeState) WriteTo(w io.Writer) (int64, error) {
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, s.Size)
+	binary.Write(&header, binary.BigEndian, uint32(len(s.Url)))
+	header.WriteString(s.Url)
+	binary.Write(&header, binary.BigEndian, uint32(len(s.ETag)))
+	header.WriteString(s.ETag)
+	binary.Write(&header, binary.BigEndian, uint32(len(s.Blocks)))
+	binary.Write(&header, binary.BigEndian, uint16(resumeRecordSize))
+	binary.Write(&header, binary.BigEndian, uint16(ResumeMinorVersion))
+
+	var buf bytes.Buffer
+	buf.WriteString(ResumeMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(ResumeVersion))
+	binary.Write(&buf, binary.BigEndian, uint32(header.Len()))
+	buf.Write(header.Bytes())
+	for _, b := range s.Blocks {
+		binary.Write(&buf, binary.BigEndian, b.Begin)
+		binary.Write(&buf, binary.BigEndian, b.End)
+		binary.Write(&buf, binary.BigEndian, b.Written)
+		buf.Write(b.Sha256[:])
+	}
+	return buf.WriteTo(w)
+}
+
+func ReadResume(r io.Reader) (ResumeState, error) {
+	var s ResumeState
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(ResumeMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != ResumeMagic {
+		return s, ErrResumeFormat
+	}
+	var version uint16
+	var headerLen uint32
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return s, ErrResumeFormat
+	}
+	if version != ResumeVersion {
+		return s, fmt.Errorf("%w %d", ErrResumeVersion, version)
+	}
+	if err := binary.Read(br, binary.BigEndian, &headerLen); err != nil || headerLen < resumeHeaderSize || headerLen > 1<<20 {
+		return s, ErrResumeFormat
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return s, ErrResumeFormat
+	}
+	h := bytes.NewReader(header)
+	var count uint32
+	var recordLen uint16
+	var err error
+	binary.Read(h, binary.BigEndian, &s.Size)
+	if s.Url, err = readResumeString(h); err != nil {
+		return s, err
+	}
+	if s.ETag, err = readResumeString(h); err != nil {
+		return s, err
+	}
+	if err := binary.Read(h, binary.BigEndian, &count); err != nil {
+		return s, ErrResumeFormat
+	}
+	if err := binary.Read(h, binary.BigEndian, &recordLen); err != nil || recordLen < resumeRecordSize {
+		return s, ErrResumeFormat
+	}
+	// Fields added by later minor versions follow, and what is not known
+	// here is left unread.
+	var minor uint16
+	if binary.Read(h, binary.BigEndian, &minor) == nil {
+		s.MinorVersion = int(minor)
+	}
+	record := make([]byte, recordLen)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(br, record); err != nil {
+			return s, ErrResumeFormat
+		}
+		var b ResumeBlock
+		b.Begin = int64(binary.BigEndian.Uint64(record[0:]))
+		b.End = int64(binary.BigEndian.Uint64(record[8:]))
+		b.Written = int64(binary.BigEndian.Uint64(record[16:]))
+		copy(b.Sha256[:], record[24:])
+		if !s.validBlock(b) {
+			return s, fmt.Errorf("%w: block %d-%d with %d bytes written", ErrResumeFormat, b.Begin, b.End, b.Written)
+		}
+		s.Blocks = append(s.Blocks, b)
+	}
+	s.Version = int(version)
+	return s, nil
+}
+
+// validBlock reports whether b lies within the file and was written no
+// further than its end. A stream of unknown size is one block without an
+// end, recorded as -1.
+func (s ResumeState) validBlock(b ResumeBlock) bool {
+	if b.End == -1 && s.Size < 0 {
+		return b.Begin >= 0 && b.Written >= 0
+	}
+	return 0 <= b.Begin && b.Begin <= b.End && (s.Size < 0 || b.End < s.Size) &&
+		0 <= b.Written && b.Written <= b.End-b.Begin+1
+}
+
+func readResumeString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil || int64(n) > int64(r.Len()) {
+		return "", ErrResumeFormat
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+func LoadResume(path string) (ResumeState, error) {
+	file, err := os.Open(ResumePath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return migrateResume(path)
+	}
+	if err != nil {
+		return ResumeState{}, err
+	}
+	defer file.Close()
+	return ReadResume(file)
+}
+
+func migrateResume(path string) (ResumeState, error) {
+	b, err := os.ReadFile(etagPath(path))
+	if err != nil {
+		return ResumeState{Size: -1}, err
+	}
+	return ResumeState{Version: 0, ETag: string(bytes.TrimSpace(b)), Size: -1}, nil
+}
+
+func SaveResume(path string, state ResumeState) error {
+	tmp := ResumePath(path) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := state.WriteTo(file); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, ResumePath(path)); err != nil {
+		return err
+	}
+	os.Remove(etagPath(path))
+	return nil
+}
+
+func RemoveResume(path string) {
+	os.Remove(ResumePath(path))
+	os.Remove(etagPath(path))
+}
+
+func (f *File) ResumeState() ResumeState {
+	f.blockMu.Lock()
+	blocks := append([]Block(nil), f.BlockList...)
+	skip := f.skip
+	f.blockMu.Unlock()
+	s := ResumeState{Version: ResumeVersion, Url: f.Url, ETag: f.ETag, Size: f.Size}
+	if skip > 0 {
+		// The part of the output kept from before is a range of its own.
+		blocks = append([]Block{{Begin: f.offset + skip, End: f.offset + skip - 1, start: f.offset}}, blocks...)
+	}
+	s.Blocks = append(s.Blocks, f.restored...)
+	for _, b := range blocks {
+		r := ResumeBlock{Begin: b.start, End: b.End, Written: b.Begin - b.start}
+		if store := f.store(); r.Written > 0 && store != nil {
+			r.Sha256 = hashRange(store, r.Begin, r.Written)
+		}
+		s.Blocks = append(s.Blocks, r)
+	}
+	return s
+}
+
+func (f *File) restoreBlocks() {
+	var ranges = []Block{}
+	var downloaded int64
+	for _, b := range f.resumeState.Blocks {
+		written := b.Written
+		if written > 0 && hashRange(f.store(), b.Begin, written) != b.Sha256 {
+			slog.Warn("block does not match its checksum, downloading it again", "url", f.Url, "begin", b.Begin, "end", b.End)
+			written = 0
+		}
+		if written > 0 {
+			f.restored = append(f.restored, ResumeBlock{Begin: b.Begin, End: b.Begin + written - 1, Written: written, Sha256: b.Sha256})
+			downloaded += written
+		}
+		if b.Begin+written <= b.End {
+			ranges = append(ranges, Block{Begin: b.Begin + written, End: b.End, start: b.Begin + written})
+		}
+	}
+	f.ranges = ranges
+	f.status.Downloaded = downloaded
+}
+
+// recountDownloaded sets the bytes downloaded from the block map, as the
+// size less what the blocks have left, so a download that continues counts
+// what is in place rather than what an earlier run counted.
+func (f *File) recountDownloaded() {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if f.Size < 0 || len(f.BlockList) == 0 {
+		return
+	}
+	var left int64
+	for _, b := range f.BlockList {
+		if b.End == -1 {
+			return
+		}
+		if b.Begin <= b.End {
+			left += b.End - b.Begin + 1
+		}
+	}
+	if downloaded := f.Size - left; downloaded != atomic.LoadInt64(&f.status.Downloaded) {
+		slog.Debug("recounted the bytes downloaded from the blocks", "url", f.Url, "counted", atomic.LoadInt64(&f.status.Downloaded), "blocks", downloaded)
+		atomic.StoreInt64(&f.status.Downloaded, downloaded)
+	}
+}
+
+func hashRange(r io.ReaderAt, offset, n int64) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if copied, err := io.Copy(h, io.NewSectionReader(r, offset, n)); err != nil || copied != n {
+		return sum
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
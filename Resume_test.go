@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// rawResume encodes a resume file the way a writer of another version
+// might: with version, extra bytes after the header fields known here,
+// and records of recordLen bytes.
+func rawResume(version uint16, size int64, extra []byte, recordLen int, blocks []ResumeBlock) []byte {
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, size)
+	binary.Write(&header, binary.BigEndian, uint32(len("https://example.com/f")))
+	header.WriteString("https://example.com/f")
+	binary.Write(&header, binary.BigEndian, uint32(0))
+	binary.Write(&header, binary.BigEndian, uint32(len(blocks)))
+	binary.Write(&header, binary.BigEndian, uint16(recordLen))
+	header.Write(extra)
+
+	var buf bytes.Buffer
+	buf.WriteString(ResumeMagic)
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(header.Len()))
+	buf.Write(header.Bytes())
+	for _, b := range blocks {
+		record := make([]byte, recordLen)
+		binary.BigEndian.PutUint64(record[0:], uint64(b.Begin))
+		binary.BigEndian.PutUint64(record[8:], uint64(b.End))
+		binary.BigEndian.PutUint64(record[16:], uint64(b.Written))
+		copy(record[24:], b.Sha256[:])
+		buf.Write(record)
+	}
+	return buf.Bytes()
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	state := ResumeState{
+		Version:      ResumeVersion,
+		MinorVersion: ResumeMinorVersion,
+		Url:          "https://example.com/file.iso",
+		ETag:         `"abc"`,
+		Size:         1000,
+		Blocks: []ResumeBlock{
+			{Begin: 500, End: 999, Written: 0},
+			{Begin: 0, End: 499, Written: 120, Sha256: sha256.Sum256([]byte("x"))},
+		},
+	}
+	var buf bytes.Buffer
+	if _, err := state.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadResume(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Fatalf("read %+v, want %+v", got, state)
+	}
+}
+
+func TestResumeVersions(t *testing.T) {
+	blocks := []ResumeBlock{{Begin: 0, End: 99, Written: 10}}
+	for _, test := range []struct {
+		name  string
+		data  []byte
+		minor int
+		err   error
+	}{
+		{"without the minor version", rawResume(1, 100, nil, resumeRecordSize, blocks), 0, nil},
+		{"later minor version", rawResume(1, 100, []byte{0, 7, 1, 2, 3, 4}, resumeRecordSize+8, blocks), 7, nil},
+		{"other major version", rawResume(2, 100, []byte{0, 1}, resumeRecordSize, blocks), 0, ErrResumeVersion},
+		{"major version 0", rawResume(0, 100, nil, resumeRecordSize, blocks), 0, ErrResumeVersion},
+		{"short records", rawResume(1, 100, nil, resumeRecordSize-8, blocks), 0, ErrResumeFormat},
+		{"not a resume file", []byte("CDMRESU"), 0, ErrResumeFormat},
+	} {
+		got, err := ReadResume(bytes.NewReader(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (got.MinorVersion != test.minor || !reflect.DeepEqual(got.Blocks, blocks)) {
+			t.Errorf("%s: read minor version %d and %+v", test.name, got.MinorVersion, got.Blocks)
+		}
+	}
+}
+
+func TestResumeBlocks(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		size  int64
+		block ResumeBlock
+		ok    bool
+	}{
+		{"whole file", 100, ResumeBlock{Begin: 0, End: 99, Written: 100}, true},
+		{"one byte", 100, ResumeBlock{Begin: 5, End: 5, Written: 1}, true},
+		{"unknown size", -1, ResumeBlock{Begin: 0, End: -1, Written: 5000}, true},
+		{"unknown size with an end", -1, ResumeBlock{Begin: 10, End: 99, Written: 3}, true},
+		{"begins after it ends", 100, ResumeBlock{Begin: 50, End: 40}, false},
+		{"negative begin", 100, ResumeBlock{Begin: -1, End: 40}, false},
+		{"past the end of the file", 100, ResumeBlock{Begin: 50, End: 100}, false},
+		{"written past its end", 100, ResumeBlock{Begin: 0, End: 9, Written: 11}, false},
+		{"written negative", 100, ResumeBlock{Begin: 0, End: 9, Written: -5}, false},
+		{"no end in a file of known size", 100, ResumeBlock{Begin: 0, End: -1}, false},
+	} {
+		_, err := ReadResume(bytes.NewReader(rawResume(1, test.size, nil, resumeRecordSize, []ResumeBlock{test.block})))
+		if test.ok && err != nil || !test.ok && !errors.Is(err, ErrResumeFormat) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
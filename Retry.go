@@ -0,0 +1,93 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrNotRetryable = errors.New("only failed or canceled downloads can be retried")
+
+func (f *File) remaining() []Block {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if f.noRanges || f.ranged || f.Size <= 0 {
+		return nil
+	}
+	var blocks = []Block{}
+	for _, b := range f.BlockList {
+		if b.End == -1 {
+			return nil
+		}
+		if !b.done() {
+			blocks = append(blocks, Block{Begin: b.Begin, End: b.End, start: b.Begin})
+		}
+	}
+	return blocks
+}
+
+func (d *Download) keepPartial() {
+	if d.file == nil {
+		return
+	}
+	if blocks := d.file.remaining(); blocks != nil {
+		d.remaining, d.size, d.etag = blocks, d.file.Size, d.file.ETag
+	}
+}
+
+func (m *Manager) Retry(id int) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if d.state != StateFailed && d.state != StateCanceled {
+		m.mu.Unlock()
+		return ErrNotRetryable
+	}
+	d.state, d.err = StateQueued, nil
+	d.retireFile()
+	m.mu.Unlock()
+
+	m.hook(d, EventQueued, m.Hooks.OnQueued)
+	m.schedule()
+	return nil
+}
+
+func (m *Manager) RetryFailed() []DownloadInfo {
+	m.mu.Lock()
+	var retried []*Download
+	var list = []DownloadInfo{}
+	for _, d := range m.downloads {
+		if d.state == StateFailed {
+			d.state, d.err = StateQueued, nil
+			d.retireFile()
+			retried = append(retried, d)
+			list = append(list, d.info())
+		}
+	}
+	m.mu.Unlock()
+
+	for _, d := range retried {
+		m.hook(d, EventQueued, m.Hooks.OnQueued)
+	}
+	m.schedule()
+	return list
+}
+
+func continuePartial(d *Download, remaining []Block, size int64, etag string, opts []Option) (*os.File, *File) {
+	stream, err := os.OpenFile(d.Path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil
+	}
+	file, err := New(d.Url, stream, append(opts, withRanges(remaining))...)
+	if err != nil || file.noRanges || file.Size != size || (etag != "" && file.ETag != etag) {
+		stream.Close()
+		return nil, nil
+	}
+	var left int64
+	for _, b := range remaining {
+		left += b.End - b.Begin + 1
+	}
+	file.status.Downloaded = size - left
+	return stream, file
+}
@@ -0,0 +1,186 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type Route struct {
+	Match string `json:"match"`
+	Dir   string `json:"dir"`
+}
+
+func ParseRoute(s string) (Route, error) {
+	match, dir, ok := strings.Cut(s, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid route %q, expected pattern=dir", s)
+	}
+	r := Route{Match: strings.TrimSpace(match), Dir: strings.TrimSpace(dir)}
+	return r, r.validate()
+}
+
+func (r Route) validate() error {
+	if r.Match == "" || r.Dir == "" {
+		return errors.New("route needs a pattern and a directory")
+	}
+	if _, err := path.Match(r.Match, ""); err != nil {
+		return fmt.Errorf("invalid route pattern %q: %w", r.Match, err)
+	}
+	return nil
+}
+
+func (r Route) byContentType() bool {
+	return strings.Contains(r.Match, "/")
+}
+
+func (r Route) matches(name, contentType string) bool {
+	if r.byContentType() {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return false
+		}
+		ok, _ := path.Match(strings.ToLower(r.Match), mediaType)
+		return ok
+	}
+	ok, _ := path.Match(strings.ToLower(r.Match), strings.ToLower(name))
+	return ok
+}
+
+func routeDir(routes []Route, name, contentType string) (string, bool) {
+	for _, r := range routes {
+		if r.byContentType() == (contentType != "") && r.matches(name, contentType) {
+			return r.Dir, true
+		}
+	}
+	return "", false
+}
+
+func hasContentTypeRoutes(routes []Route) bool {
+	for _, r := range routes {
+		if r.byContentType() {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadConfig(name string, config *Config) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return config.Validate()
+}
+
+func (c Config) Validate() error {
+	if !ValidDuplicatePolicy(c.Duplicates) {
+		return fmt.Errorf("unknown duplicate policy %q", c.Duplicates)
+	}
+	if c.TotalRateLimit < 0 {
+		return errors.New("total_rate_limit can not be negative")
+	}
+	if c.TotalConnections < 0 {
+		return errors.New("total_connections can not be negative")
+	}
+	if c.MemoryBudget < 0 {
+		return errors.New("memory_budget can not be negative")
+	}
+	if !validStuckAction(c.StuckAction) {
+		return fmt.Errorf("unknown stuck download action %q", c.StuckAction)
+	}
+	if !validPlacement(c.Placement) {
+		return fmt.Errorf("unknown placement %q", c.Placement)
+	}
+	for _, dir := range c.DataDirs {
+		if dir == "" {
+			return errors.New("data directory can not be empty")
+		}
+	}
+	if !validCoalesce(c.Coalesce) {
+		return fmt.Errorf("unknown coalesce mode %q", c.Coalesce)
+	}
+	if _, err := ParsePipeline(c.Post); err != nil {
+		return err
+	}
+	for _, r := range c.Routes {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Domains {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, q := range c.Quotas {
+		if err := q.validate(); err != nil {
+			return err
+		}
+	}
+	var tenants = map[string]bool{}
+	for _, t := range c.Tenants {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if tenants[t.Name] {
+			return fmt.Errorf("tenant %s is configured twice", t.Name)
+		}
+		tenants[t.Name] = true
+	}
+	if c.PathTemplate != "" {
+		if _, err := ParseTemplate(c.PathTemplate); err != nil {
+			return fmt.Errorf("invalid path_template: %w", err)
+		}
+	}
+	return nil
+}
+
+// ErrDirOutsideRoot refuses the directory of a download that lies outside
+// the download directory and the data directories.
+var ErrDirOutsideRoot = errors.New("directory is outside the download directory")
+
+// checkDir refuses a directory given with a download unless it is a
+// relative path that stays within the download directory, or an absolute
+// one within it or one of the data directories. It is checked where
+// downloads come from others, the daemon's API, handoffs and MQTT; code
+// embedding the Manager, input files given with -input, routes and domain
+// rules are trusted.
+func (m *Manager) checkDir(dir string) error {
+	if dir == "" || filepath.IsLocal(dir) {
+		return nil
+	}
+	if filepath.IsAbs(dir) {
+		roots := []string{m.Dir}
+		m.mu.Lock()
+		for _, dataDir := range m.config.DataDirs {
+			roots = append(roots, m.resolveDir(dataDir))
+		}
+		m.mu.Unlock()
+		for _, root := range roots {
+			root, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(root, dir); err == nil && filepath.IsLocal(rel) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDirOutsideRoot, dir)
+}
+
+func (m *Manager) resolveDir(dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(m.Dir, dir)
+}
@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+func TestCheckDir(t *testing.T) {
+	root := t.TempDir()
+	data := t.TempDir()
+	m := NewManager(root, Config{DataDirs: []string{data}})
+	defer m.Stop()
+	for dir, ok := range map[string]bool{
+		"":                             true,
+		"isos":                         true,
+		"isos/2026":                    true,
+		root:                           true,
+		filepath.Join(root, "isos"):    true,
+		filepath.Join(data, "a", "b"):  true,
+		"../isos":                      false,
+		"isos/../../etc":               false,
+		"/etc":                         false,
+		filepath.Join(root, "..", "x"): false,
+		filepath.Dir(root):             false,
+		root + "-other":                false,
+		filepath.Join(data, "..", "x"): false,
+	} {
+		err := m.checkDir(dir)
+		if ok && err != nil || !ok && !errors.Is(err, ErrDirOutsideRoot) {
+			t.Errorf("checkDir(%q) = %v", dir, err)
+		}
+	}
+}
+
+func TestDirOutsideRoot(t *testing.T) {
+	origin := downloadertest.NewOrigin(downloadertest.RandomData(1000, 1))
+	defer origin.Close()
+	m := NewManager(t.TempDir(), Config{})
+	defer m.Stop()
+	outside := t.TempDir()
+
+	server := httptest.NewServer(NewDaemon(m))
+	defer server.Close()
+	for path, body := range map[string]string{
+		"/downloads": `{"url": "` + origin.URL + `", "dir": "` + outside + `"}`,
+		"/jobs":      `{"url": "` + origin.URL + `", "dir": "../x"}`,
+		"/input":     `{"input": "` + origin.URL + `\n  dir=` + outside + `\n"}`,
+		"/capture":   `{"url": "` + origin.URL + `", "dir": "/etc"}`,
+	} {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s with a directory outside the root: %s, want 400", path, resp.Status)
+		}
+	}
+	if list := m.List(); len(list) != 0 {
+		t.Fatalf("%d downloads were added", len(list))
+	}
+
+	// Code embedding the Manager is trusted with any directory.
+	info, err := m.Add(origin.URL, outside, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if info, err = m.Wait(ctx, info.Id); err != nil || info.State != StateFinished {
+		t.Fatalf("download ended %s: %v", info.State, err)
+	}
+	if info.Path != filepath.Join(outside, "file") {
+		t.Fatalf("downloaded to %s", info.Path)
+	}
+}
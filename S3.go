@@ -0,0 +1,256 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RelayPartSize is the size of the parts of an S3 multipart upload. S3
+// wants at least 5 MiB in every part but the last.
+var RelayPartSize = 16 << 20
+
+// s3Upload streams to an object with a multipart upload signed with AWS
+// Signature Version 4. Credentials come from $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, the region from
+// $AWS_REGION, and $AWS_ENDPOINT_URL points it at another S3 compatible
+// service, addressing buckets by path.
+type s3Upload struct {
+	client   *http.Client
+	object   *url.URL
+	region   string
+	access   string
+	secret   string
+	token    string
+	uploadId string
+	part     []byte
+	etags    []string
+}
+
+func newS3Upload(target *url.URL) (*s3Upload, error) {
+	s := &s3Upload{
+		client: &http.Client{},
+		region: os.Getenv("AWS_REGION"),
+		access: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.access == "" || s.secret == "" {
+		return nil, fmt.Errorf("%s: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", target.Redacted())
+	}
+	bucket, key := target.Host, strings.TrimPrefix(target.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("%s: want s3://bucket/key", target.Redacted())
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("AWS_ENDPOINT_URL: %w", err)
+		}
+		s.object = u.JoinPath(bucket, key)
+	} else {
+		s.object = &url.URL{Scheme: "https", Host: bucket + ".s3." + s.region + ".amazonaws.com", Path: "/" + key}
+	}
+	var created struct {
+		UploadId string
+	}
+	if err := s.do(http.MethodPost, url.Values{"uploads": {""}}, nil, &created); err != nil {
+		return nil, err
+	}
+	s.uploadId = created.UploadId
+	return s, nil
+}
+
+func (s *s3Upload) Write(p []byte) (int, error) {
+	s.part = append(s.part, p...)
+	for len(s.part) >= RelayPartSize {
+		if err := s.upload(s.part[:RelayPartSize]); err != nil {
+			return 0, err
+		}
+		s.part = append(s.part[:0], s.part[RelayPartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (s *s3Upload) upload(part []byte) error {
+	query := url.Values{"partNumber": {strconv.Itoa(len(s.etags) + 1)}, "uploadId": {s.uploadId}}
+	resp, err := s.send(http.MethodPut, query, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.etags = append(s.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// Commit uploads the last part and completes the upload, which makes the
+// object appear.
+func (s *s3Upload) Commit() error {
+	if len(s.part) > 0 || len(s.etags) == 0 {
+		if err := s.upload(s.part); err != nil {
+			return err
+		}
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range s.etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Code    string
+		Message string
+	}
+	// S3 may answer 200 and still report a failure in the body.
+	if err := s.do(http.MethodPost, url.Values{"uploadId": {s.uploadId}}, body, &result); err != nil {
+		return err
+	}
+	if result.Code != "" {
+		return fmt.Errorf("completing the upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+// Abort drops the parts uploaded, so no object appears and no storage is
+// left behind.
+func (s *s3Upload) Abort(error) {
+	if resp, err := s.send(http.MethodDelete, url.Values{"uploadId": {s.uploadId}}, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do sends a request and decodes the XML answer into v.
+func (s *s3Upload) do(method string, query url.Values, body []byte, v any) error {
+	resp, err := s.send(method, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *s3Upload) send(method string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.object
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var failure struct {
+			Code    string
+			Message string
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+		return nil, fmt.Errorf("%s %s: %s %s %s", method, s.object.Redacted(), resp.Status, failure.Code, failure.Message)
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 headers.
+func (s *s3Upload) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, s3Escape(req.URL.Path, false), req.URL.RawQuery, canonical.String(), signed, payload}, "\n")
+	scope := date[:8] + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{date[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query encodes query sorted by name, as the canonical request wants it.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(query.Get(name), true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, and slashes unless slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// SampleRate is the share of a file a sampled verification compares
+	// when none is given.
+	SampleRate = 0.01
+	// SampleBlockSize is the size of the blocks a sampled verification
+	// picks, and SampleConnections how many it fetches at once.
+	SampleBlockSize   int64 = 1 << 20
+	SampleConnections       = 4
+)
+
+// SampleResult tells what VerifySample compared.
+type SampleResult struct {
+	Size   int64 `json:"size"`
+	Blocks int   `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+	// Hashed is how many of the blocks the server sent a hash of, which
+	// they were checked against as well.
+	Hashed int `json:"hashed"`
+}
+
+// VerifySample checks path against url without reading either in full, for
+// files too large to hash in reasonable time. It compares the sizes, then
+// the first and last block and a random rate of the other blocks of
+// SampleBlockSize with the same ranges downloaded again. When the server
+// sends a Content-MD5 or an RFC 9530 Content-Digest with a range, the local
+// block must also match that hash. It is a confidence check: a change in a
+// block it did not pick goes unnoticed.
+func VerifySample(path, url string, rate float64, progress func(done, total int64), opts ...Option) (SampleResult, error) {
+	if rate <= 0 || rate > 1 {
+		return SampleResult{}, fmt.Errorf("invalid sample rate %v, want more than 0 and at most 1", rate)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return SampleResult{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return SampleResult{}, err
+	}
+	f, err := New(url, nil, append(opts, WithWriterAt(discardWriterAt{}))...)
+	if err != nil {
+		return SampleResult{}, err
+	}
+	if f.ownClient {
+		defer f.closeIdleConnections()
+	}
+	f.Stream = file
+	result := SampleResult{Size: info.Size()}
+	if f.Size < 0 || f.noRanges {
+		return result, fmt.Errorf("%s does not support range requests of a known size, which sampling needs", url)
+	}
+	if f.Size != info.Size() {
+		return result, fmt.Errorf("%w: %s has %d bytes, the server %d", ErrChecksumMismatch, path, info.Size(), f.Size)
+	}
+
+	blocks := sampleBlocks(f.Size, SampleBlockSize, rate)
+	var total int64
+	for _, begin := range blocks {
+		total += min(SampleBlockSize, f.Size-begin)
+	}
+	result.Blocks, result.Bytes = len(blocks), total
+	if len(blocks) == 0 {
+		return result, nil
+	}
+
+	var (
+		done   int64
+		hashed int64
+		mu     sync.Mutex
+		first  error
+		wg     sync.WaitGroup
+		next   = make(chan int64)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop, stopped := make(chan bool), make(chan bool)
+	if progress != nil {
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(200 * time.Millisecond)
+			defer tick.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-tick.C:
+					progress(atomic.LoadInt64(&done), total)
+				}
+			}
+		}()
+	}
+	for range min(SampleConnections, len(blocks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for begin := range next {
+				size := min(SampleBlockSize, f.Size-begin)
+				checked, err := f.compareBlock(ctx, begin, size)
+				if err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+						cancel()
+					}
+					mu.Unlock()
+					continue
+				}
+				if checked {
+					atomic.AddInt64(&hashed, 1)
+				}
+				atomic.AddInt64(&done, size)
+			}
+		}()
+	}
+	for _, begin := range blocks {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- begin
+	}
+	close(next)
+	wg.Wait()
+	close(stop)
+	if progress != nil {
+		<-stopped
+		progress(atomic.LoadInt64(&done), total)
+	}
+	result.Hashed = int(hashed)
+	return result, first
+}
+
+// sampleBlocks returns the offsets of the blocks to compare, in order: the
+// first and the last, and rate of the blocks in between picked at random.
+func sampleBlocks(size, blockSize int64, rate float64) []int64 {
+	if size <= 0 {
+		return nil
+	}
+	n := (size + blockSize - 1) / blockSize
+	picked := map[int64]bool{0: true, n - 1: true}
+	want := int64(float64(n)*rate + 0.5)
+	for int64(len(picked)) < min(max(want, 2), n) {
+		picked[rand.Int64N(n)] = true
+	}
+	var blocks []int64
+	for i := range picked {
+		blocks = append(blocks, i*blockSize)
+	}
+	slices.Sort(blocks)
+	return blocks
+}
+
+// compareBlock downloads size bytes at begin and compares them with the
+// local file, and with the hashes the server sent of them, if any.
+func (f *File) compareBlock(ctx context.Context, begin, size int64) (bool, error) {
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return false, err
+	}
+	from := f.offset + begin
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(from, 10)+"-"+strconv.FormatInt(from+size-1, 10))
+	request.Header.Set("Want-Content-Digest", "sha-256=10, sha-512=5")
+	resp, err := f.do(request)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return false, fmt.Errorf("range request answered with %s", resp.Status)
+	}
+	remote := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, remote); err != nil {
+		return false, err
+	}
+	local := make([]byte, size)
+	if _, err := f.Stream.ReadAt(local, begin); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(local, remote) {
+		return false, fmt.Errorf("%w: bytes %d-%d differ", ErrChecksumMismatch, begin, begin+size-1)
+	}
+	sums := rangeSums(resp.Header)
+	for _, sum := range sums {
+		sum.hash.Write(local)
+		if err := sum.check(); err != nil {
+			return false, fmt.Errorf("%w: bytes %d-%d: %v", ErrChecksumMismatch, begin, begin+size-1, err)
+		}
+	}
+	return len(sums) > 0, nil
+}
+
+// rangeSums are the hashes a server sent of the body of a range response,
+// its Content-MD5 and its Content-Digest (RFC 9530).
+func rangeSums(header http.Header) []serverSum {
+	sums := bodySums(header, -1, false)
+	for _, value := range header.Values("Content-Digest") {
+		for _, field := range strings.Split(value, ",") {
+			algorithm, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			value = strings.Trim(value, ":")
+			switch algorithm = strings.ToLower(algorithm); algorithm {
+			case "sha-256":
+				if want := base64Sum(value, sha256.Size); want != nil {
+					sums = append(sums, serverSum{"content-digest " + algorithm, sha256.New(), want})
+				}
+			case "sha-512":
+				if want := base64Sum(value, sha512.Size); want != nil {
+					sums = append(sums, serverSum{"content-digest " + algorithm, sha512.New(), want})
+				}
+			}
+		}
+	}
+	return sums
+}
@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"time"
+)
+
+type Scheduled struct {
+	Id   int       `json:"id"`
+	Url  string    `json:"url"`
+	Name string    `json:"name,omitempty"`
+	Cron string    `json:"cron,omitempty"`
+	Next time.Time `json:"next"`
+
+	cron  *Cron
+	timer *time.Timer
+}
+
+func (m *Manager) ScheduleAt(url, name string, at time.Time) Scheduled {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Scheduled{Id: m.nextScheduledId, Url: url, Name: name, Next: at}
+	m.nextScheduledId++
+	m.scheduled = append(m.scheduled, s)
+	m.arm(s)
+	return *s
+}
+
+func (m *Manager) ScheduleCron(url, name, spec string) (Scheduled, error) {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return Scheduled{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Scheduled{Id: m.nextScheduledId, Url: url, Name: name, Cron: spec, Next: cron.Next(time.Now()), cron: cron}
+	m.nextScheduledId++
+	m.scheduled = append(m.scheduled, s)
+	m.arm(s)
+	return *s, nil
+}
+
+func (m *Manager) ListScheduled() []Scheduled {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list = make([]Scheduled, 0, len(m.scheduled))
+	for _, s := range m.scheduled {
+		list = append(list, *s)
+	}
+	return list
+}
+
+func (m *Manager) CancelScheduled(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range m.scheduled {
+		if s.Id == id {
+			s.timer.Stop()
+			m.scheduled = append(m.scheduled[:i], m.scheduled[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Manager) arm(s *Scheduled) {
+	s.timer = time.AfterFunc(time.Until(s.Next), func() {
+		m.fire(s)
+	})
+}
+
+func (m *Manager) fire(s *Scheduled) {
+	m.mu.Lock()
+	var found bool
+	for i, item := range m.scheduled {
+		if item != s {
+			continue
+		}
+		found = true
+		if s.cron == nil {
+			m.scheduled = append(m.scheduled[:i], m.scheduled[i+1:]...)
+		} else if s.Next = s.cron.Next(time.Now()); !s.Next.IsZero() {
+			m.arm(s)
+		}
+		break
+	}
+	m.mu.Unlock()
+
+	if found {
+		m.Add(s.Url, "", s.Name)
+	}
+}
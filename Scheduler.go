@@ -0,0 +1,200 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var MinSplitSize int64 = 1 << 20
+
+var errRetired = errors.New("block worker retired")
+
+func (f *File) SetConnections(n int) {
+	if n < 1 {
+		n = 1
+	}
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	f.connections = n
+	if f.runCtx != nil && f.workers > 0 {
+		f.spawnWorkers()
+	}
+}
+
+func (f *File) Connections() int {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	return f.connections
+}
+
+func (f *File) SetRateLimit(bytesPerSecond int64) {
+	f.limiter.SetRate(bytesPerSecond)
+}
+
+func (f *File) RateLimit() int64 {
+	return f.limiter.Rate()
+}
+
+func (f *File) spawnWorkers() {
+	for f.workers < f.allowed() {
+		f.workers++
+		ctx := f.runCtx
+		delay := f.spawnDelay()
+		f.group.Go(func() error {
+			if delay > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+			}
+			return f.worker(ctx)
+		})
+	}
+}
+
+func (f *File) worker(ctx context.Context) error {
+	var failures int
+	for {
+		id, ok := f.nextBlock(ctx)
+		if !ok {
+			return nil
+		}
+		err := f.downloadBlock(ctx, id)
+		if err == nil && f.syncPolicy == SyncBlock {
+			f.sync()
+		}
+
+		f.blockMu.Lock()
+		f.BlockList[id].busy = false
+		f.blockMu.Unlock()
+
+		if err == nil {
+			f.recoverConnections()
+			failures = 0
+		}
+		if err == nil || ctx.Err() != nil || errors.Is(err, errRetired) || errors.Is(err, errRefreshed) || errors.Is(err, ErrSlowMirror) {
+			continue
+		}
+		if diskFull(err) {
+			f.pauseDiskFull(err)
+			continue
+		}
+		failures++
+		delay, retry := f.retryPolicy.Retry(err, failures)
+		if !retry {
+			f.blockMu.Lock()
+			f.workers--
+			f.blockMu.Unlock()
+			return err
+		}
+		atomic.AddInt64(&f.status.Retries, 1)
+		f.OnError(ErrBlock, err)
+		f.backOff(ctx, err, delay)
+	}
+}
+
+func fatal(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		code := httpErr.StatusCode
+		return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+	}
+	var outputErr *outputError
+	return errors.As(err, &outputErr) || errors.Is(err, ErrRangeIgnored) || errors.Is(err, ErrRedirect) || errors.Is(err, ErrTooLarge) || errors.Is(err, ErrBlockedAddress) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrCorruptPayload) || errors.Is(err, errPanic)
+}
+
+var errPanic = errors.New("panic in download worker")
+
+type group struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	err    error
+}
+
+func (g *group) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := protect(fn); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	}()
+}
+
+func (g *group) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v\n%s", errPanic, r, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+func (f *File) nextBlock(ctx context.Context) (int, bool) {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if ctx.Err() != nil || f.workers > f.allowed() {
+		f.workers--
+		return -1, false
+	}
+	if f.pieceOrder == PieceOrderWindow && f.Strategy() == StrategyParallel {
+		id, ok := f.nextPiece()
+		if !ok {
+			f.workers--
+		}
+		return id, ok
+	}
+	if f.pieceOrder == PieceOrderAdaptive && f.Strategy() == StrategyParallel {
+		return f.nextAdaptive()
+	}
+
+	for i, b := range f.BlockList {
+		if !b.busy && !b.done() {
+			f.BlockList[i].busy = true
+			f.countBusy()
+			return i, true
+		}
+	}
+
+	var best = -1
+	var remaining int64
+	for i, b := range f.BlockList {
+		if b.busy && b.End != -1 && b.End-b.Begin+1 > remaining {
+			best, remaining = i, b.End-b.Begin+1
+		}
+	}
+	if best < 0 || remaining < f.minSplitSize*2 || f.Strategy() != StrategyParallel {
+		f.workers--
+		return -1, false
+	}
+	mid := f.BlockList[best].Begin + remaining/2
+	f.BlockList = append(f.BlockList, Block{Begin: mid, End: f.BlockList[best].End, start: mid, busy: true})
+	f.BlockList[best].End = mid - 1
+	f.countBusy()
+	return len(f.BlockList) - 1, true
+}
+
+func (f *File) countBusy() {
+	var busy int
+	for _, b := range f.BlockList {
+		if b.busy {
+			busy++
+		}
+	}
+	f.peakWorkers = max(f.peakWorkers, busy)
+}
@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	SeedSamples          = 8
+	SeedSampleSize int64 = 16 << 10
+)
+
+func WithSeed() Option {
+	return func(f *File) error {
+		f.resume = true
+		f.verifySeed = true
+		return nil
+	}
+}
+
+func CopySeed(seed string, destination *os.File) error {
+	src, err := os.Open(seed)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if info, err := destination.Stat(); err == nil {
+		if seedInfo, err := src.Stat(); err == nil && os.SameFile(info, seedInfo) {
+			return nil
+		}
+	}
+	if err := destination.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := destination.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(destination, src)
+	return err
+}
+
+func (f *File) verifyPrefix(existing int64) error {
+	if !f.verifySeed {
+		return nil
+	}
+	size := min(SeedSampleSize, existing)
+	checked := map[int64]bool{}
+	for i := 0; i < SeedSamples; i++ {
+		pos := existing - size
+		if SeedSamples > 1 {
+			pos = pos * int64(i) / int64(SeedSamples-1)
+		}
+		if checked[pos] {
+			continue
+		}
+		checked[pos] = true
+		if err := f.verifySample(pos, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) verifySample(pos, size int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return err
+	}
+	begin := f.offset + pos
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-"+strconv.FormatInt(begin+size-1, 10))
+	resp, err := f.do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range request answered with %s", resp.Status)
+	}
+	remote := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, remote); err != nil {
+		return err
+	}
+	local := make([]byte, size)
+	if _, err := f.Stream.ReadAt(local, pos); err != nil {
+		return err
+	}
+	if !bytes.Equal(local, remote) {
+		return fmt.Errorf("bytes %d-%d differ", pos, pos+size-1)
+	}
+	return nil
+}
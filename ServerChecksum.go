@@ -0,0 +1,301 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ErrBlockChecksum = errors.New("block checksum mismatch")
+
+	// MaxBlockMismatches is how often a block is downloaded again because
+	// of a wrong Content-MD5 before the download fails.
+	MaxBlockMismatches = 3
+)
+
+// WithServerChecksums turns off (or back on) the verification of hashes the
+// server sends: Content-MD5 of every range response, checked as soon as the
+// block arrives so that only that block is fetched again, and the whole
+// object hashes of x-goog-hash, x-amz-checksum-* and S3 ETags, checked once
+// the download finished.
+func WithServerChecksums(verify bool) Option {
+	return func(f *File) error {
+		f.serverChecksums = verify
+		return nil
+	}
+}
+
+type serverSum struct {
+	name string
+	hash hash.Hash
+	want []byte
+}
+
+func (s serverSum) check() error {
+	if got := s.hash.Sum(nil); !bytes.Equal(got, s.want) {
+		return fmt.Errorf("%s is %x, the server sent %x", s.name, got, s.want)
+	}
+	return nil
+}
+
+func base64Sum(value string, size int) []byte {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(b) != size {
+		return nil
+	}
+	return b
+}
+
+func crc32c() hash.Hash {
+	return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+}
+
+var amzChecksums = []struct {
+	header  string
+	size    int
+	newHash func() hash.Hash
+}{
+	{"X-Amz-Checksum-Sha256", sha256.Size, sha256.New},
+	{"X-Amz-Checksum-Sha1", sha1.Size, sha1.New},
+	{"X-Amz-Checksum-Crc32c", 4, crc32c},
+	{"X-Amz-Checksum-Crc32", 4, func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// bodySums are the hashes of a response body: its Content-MD5, which covers
+// a range response too, and the hashes of the whole object when the body is
+// the complete object.
+func bodySums(header http.Header, size int64, complete bool) []serverSum {
+	var sums []serverSum
+	if want := base64Sum(header.Get("Content-MD5"), md5.Size); want != nil {
+		sums = append(sums, serverSum{"content-md5", md5.New(), want})
+	}
+	if complete {
+		sums = append(sums, objectSums(header, size)...)
+	}
+	return sums
+}
+
+func objectSums(header http.Header, size int64) []serverSum {
+	var sums []serverSum
+	for _, value := range header.Values("X-Goog-Hash") {
+		for _, field := range strings.Split(value, ",") {
+			algorithm, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch strings.ToLower(algorithm) {
+			case "md5":
+				if want := base64Sum(value, md5.Size); want != nil {
+					sums = append(sums, serverSum{"md5", md5.New(), want})
+				}
+			case "crc32c":
+				if want := base64Sum(value, 4); want != nil {
+					sums = append(sums, serverSum{"crc32c", crc32c(), want})
+				}
+			}
+		}
+	}
+	for _, c := range amzChecksums {
+		if want := base64Sum(header.Get(c.header), c.size); want != nil {
+			sums = append(sums, serverSum{strings.ToLower(c.header), c.newHash(), want})
+		}
+	}
+	if sum, ok := etagSum(header, size); ok {
+		sums = append(sums, sum)
+	}
+	return sums
+}
+
+// etagSum checks the ETag of S3 compatible servers, the MD5 of the object
+// or, for multipart uploads, the MD5 of the MD5s of its parts followed by
+// their count. The part size is not sent, so the usual ones that give that
+// count are tried. ETags of encrypted objects are not hashes.
+func etagSum(header http.Header, size int64) (serverSum, bool) {
+	if header.Get("X-Amz-Request-Id") == "" || header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" || header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return serverSum{}, false
+	}
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	sum, parts, multipart := strings.Cut(etag, "-")
+	want, err := hex.DecodeString(sum)
+	if err != nil || len(want) != md5.Size {
+		return serverSum{}, false
+	}
+	if !multipart {
+		return serverSum{"etag", md5.New(), want}, true
+	}
+	n, err := strconv.ParseInt(parts, 10, 64)
+	if err != nil || n < 1 || size <= 0 {
+		return serverSum{}, false
+	}
+	h := &multipartMD5{want: want}
+	for _, partSize := range partSizes(size, n) {
+		h.parts = append(h.parts, &partMD5{size: partSize, part: md5.New()})
+	}
+	if len(h.parts) == 0 {
+		return serverSum{}, false
+	}
+	return serverSum{"etag", h, want}, true
+}
+
+// PartSizes are the multipart upload part sizes tried against S3 ETags, on
+// top of the smallest whole MiB giving the ETag's part count.
+var PartSizes = []int64{8 << 20, 5 << 20, 16 << 20, 15 << 20, 32 << 20, 64 << 20, 100 << 20, 128 << 20, 256 << 20, 512 << 20}
+
+func partSizes(size, parts int64) []int64 {
+	if parts == 1 {
+		return []int64{size}
+	}
+	fits := func(s int64) bool {
+		return (size+s-1)/s == parts
+	}
+	var sizes []int64
+	if smallest := ((size+parts-1)/parts + 1<<20 - 1) &^ (1<<20 - 1); fits(smallest) {
+		sizes = append(sizes, smallest)
+	}
+	for _, s := range PartSizes {
+		if fits(s) && !slices.Contains(sizes, s) {
+			sizes = append(sizes, s)
+		}
+	}
+	return sizes
+}
+
+type partMD5 struct {
+	size  int64
+	n     int64
+	part  hash.Hash
+	parts []byte
+}
+
+func (p *partMD5) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		chunk := b[:min(int64(len(b)), p.size-p.n)]
+		p.part.Write(chunk)
+		p.n += int64(len(chunk))
+		b = b[len(chunk):]
+		if p.n == p.size {
+			p.parts = p.part.Sum(p.parts)
+			p.part.Reset()
+			p.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (p *partMD5) sum() []byte {
+	parts := p.parts
+	if p.n > 0 {
+		parts = p.part.Sum(parts)
+	}
+	sum := md5.Sum(parts)
+	return sum[:]
+}
+
+// multipartMD5 hashes the object for several part sizes at once and sums
+// to the ETag when one of them matches.
+type multipartMD5 struct {
+	want  []byte
+	parts []*partMD5
+}
+
+func (m *multipartMD5) Write(b []byte) (int, error) {
+	for _, p := range m.parts {
+		p.Write(b)
+	}
+	return len(b), nil
+}
+
+func (m *multipartMD5) Sum(b []byte) []byte {
+	for _, p := range m.parts {
+		if sum := p.sum(); bytes.Equal(sum, m.want) {
+			return append(b, sum...)
+		}
+	}
+	return append(b, m.parts[0].sum()...)
+}
+
+func (m *multipartMD5) Reset() {
+	for _, p := range m.parts {
+		p.part.Reset()
+		p.n, p.parts = 0, nil
+	}
+}
+
+func (m *multipartMD5) Size() int      { return md5.Size }
+func (m *multipartMD5) BlockSize() int { return md5.BlockSize }
+
+func (f *File) responseSums(resp *http.Response) []serverSum {
+	if !f.serverChecksums || f.decompress || f.payload != "" || resp.ContentLength < 0 {
+		return nil
+	}
+	return bodySums(resp.Header, resp.ContentLength, false)
+}
+
+func sumWriters(sums []serverSum) io.Writer {
+	var writers []io.Writer
+	for _, s := range sums {
+		writers = append(writers, s.hash)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// checkBlock verifies the hashes of a response once all of its body was
+// read. On a mismatch the bytes it wrote are downloaded again.
+func (f *File) checkBlock(id int, begin, written, received, length int64, sums []serverSum) error {
+	if received != length {
+		return nil
+	}
+	for _, s := range sums {
+		err := s.check()
+		if err == nil {
+			continue
+		}
+		f.blockMu.Lock()
+		f.BlockList[id].Begin = begin
+		f.BlockList[id].mismatches++
+		mismatches := f.BlockList[id].mismatches
+		f.blockMu.Unlock()
+		atomic.AddInt64(&f.status.Downloaded, -written)
+		err = fmt.Errorf("%w: bytes %d-%d: %v", ErrBlockChecksum, begin-f.offset, begin-f.offset+written-1, err)
+		if mismatches > MaxBlockMismatches {
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+		slog.Warn("block checksum mismatch, downloading it again", "url", f.Url, "err", err)
+		return err
+	}
+	return nil
+}
+
+// verifyObject checks the finished file against the whole object hashes the
+// server sent with the probe response.
+func (f *File) verifyObject() error {
+	if !f.serverChecksums || f.Stream == nil || f.writer != io.WriterAt(f.Stream) || f.ranged || f.offset != 0 || f.ContentEncoding != "" || f.Size <= 0 {
+		return nil
+	}
+	sums := bodySums(f.header, f.Size, true)
+	if len(sums) == 0 {
+		return nil
+	}
+	if _, err := io.Copy(sumWriters(sums), io.NewSectionReader(f.Stream, 0, f.Size)); err != nil {
+		return err
+	}
+	for _, s := range sums {
+		if err := s.check(); err != nil {
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+	}
+	return nil
+}
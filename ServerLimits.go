@@ -0,0 +1,152 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EventThrottled = "throttled"
+
+// ServerLimit is the request quota a server advertised in its rate limit
+// headers.
+type ServerLimit struct {
+	Limit     int       `json:"limit,omitempty"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// WithServerLimits turns pacing requests to the X-RateLimit-* and RateLimit
+// headers of the server on or off.
+func WithServerLimits(enabled bool) Option {
+	return func(f *File) error {
+		f.serverLimits = enabled
+		return nil
+	}
+}
+
+// parseServerLimit reads X-RateLimit-Limit/Remaining/Reset, RateLimit-*
+// or the RateLimit header of the IETF drafts (limit=, remaining=, reset= or
+// r=, t=). A reset above a billion seconds is taken as a Unix time.
+func parseServerLimit(h http.Header, now time.Time) (ServerLimit, bool) {
+	values := map[string]string{}
+	for _, prefix := range []string{"X-Ratelimit-", "Ratelimit-"} {
+		for _, name := range []string{"Limit", "Remaining", "Reset"} {
+			if v := h.Get(prefix + name); v != "" {
+				values[strings.ToLower(name)] = v
+			}
+		}
+	}
+	for _, item := range strings.FieldsFunc(h.Get("Ratelimit"), func(r rune) bool { return r == ',' || r == ';' }) {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "limit", "remaining", "reset":
+			values[strings.ToLower(key)] = value
+		case "r":
+			values["remaining"] = value
+		case "t":
+			values["reset"] = value
+		}
+	}
+	remaining, err := strconv.Atoi(values["remaining"])
+	if err != nil || remaining < 0 {
+		return ServerLimit{}, false
+	}
+	limit := ServerLimit{Remaining: remaining}
+	limit.Limit, _ = strconv.Atoi(values["limit"])
+	reset, err := strconv.ParseInt(values["reset"], 10, 64)
+	switch {
+	case err != nil || reset < 0:
+		limit.Reset = now.Add(time.Minute)
+	case reset > 1e9:
+		limit.Reset = time.Unix(reset, 0)
+	default:
+		limit.Reset = now.Add(time.Duration(reset) * time.Second)
+	}
+	return limit, true
+}
+
+// noteServerLimit takes the quota the response to request seq advertises,
+// less the requests sent after it, which the server had not counted yet.
+// Connections are not cut when the quota runs low, which would waste a
+// request on the rest of each range: requests past it wait for it to reset
+// instead.
+func (f *File) noteServerLimit(h http.Header, seq int64) {
+	if !f.serverLimits {
+		return
+	}
+	limit, ok := parseServerLimit(h, time.Now())
+	if !ok {
+		return
+	}
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	limit.Remaining = max(limit.Remaining-int(f.limitSent-seq), 0)
+	if old := f.serverLimit; old != nil && time.Now().Before(old.Reset) && limit.Reset.Sub(old.Reset).Abs() < 2*time.Second {
+		old.Remaining = min(old.Remaining, limit.Remaining)
+		return
+	}
+	f.serverLimit = &limit
+}
+
+// paceRequest counts a request against the server's quota, and when none is
+// left waits until it resets, telling the caller the first time. A quota
+// whose size is known starts over whole when it resets, until a response
+// tells the new one. It returns the number of the request for
+// noteServerLimit.
+func (f *File) paceRequest(ctx context.Context) (int64, error) {
+	for {
+		f.blockMu.Lock()
+		limit := f.serverLimit
+		if now := time.Now(); limit != nil && !now.Before(limit.Reset) {
+			if limit.Limit > 0 {
+				limit.Remaining, limit.Reset = limit.Limit, now.Add(time.Minute)
+			} else {
+				f.serverLimit, limit = nil, nil
+			}
+		}
+		if limit == nil || limit.Remaining > 0 {
+			if limit != nil {
+				limit.Remaining--
+			}
+			f.limitSent++
+			seq := f.limitSent
+			f.blockMu.Unlock()
+			return seq, nil
+		}
+		snapshot := *limit
+		f.limitedAt = time.Now()
+		first := !f.limitWait.Equal(snapshot.Reset)
+		f.limitWait = snapshot.Reset
+		f.blockMu.Unlock()
+
+		if first {
+			slog.Warn("server's request quota is used up, waiting for it to reset", "url", f.Url, "reset", snapshot.Reset.Format(time.RFC3339))
+			if f.OnThrottle != nil {
+				f.OnThrottle(snapshot)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Until(snapshot.Reset)):
+		}
+	}
+}
+
+// ServerLimit returns the request quota the server last advertised, if it
+// has not reset yet.
+func (f *File) ServerLimit() (ServerLimit, bool) {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	if f.serverLimit == nil || !time.Now().Before(f.serverLimit.Reset) {
+		return ServerLimit{}, false
+	}
+	return *f.serverLimit, true
+}
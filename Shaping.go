@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shape is a slow network WithShaping simulates on the connections of a
+// download, to reproduce what users on a poor link see and to exercise the
+// adaptive logic against it without external tools.
+type Shape struct {
+	// Latency delays every connection once when it is opened and once for
+	// each response, on its first read after a request was written; Jitter
+	// adds up to as much again, at random.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Rate caps the bytes per second the connections read together, like a
+	// link they share. Zero does not cap them.
+	Rate int64
+	// Stall stops every connection from reading for that long, at random
+	// times Every apart on average, as a link that drops out does.
+	Stall time.Duration
+	Every time.Duration
+}
+
+// ParseShape parses comma separated latency=DURATION, jitter=DURATION,
+// rate=BYTES, stall=DURATION and every=DURATION, like
+// latency=300ms,rate=256K,stall=3s,every=20s. A stall comes every 30
+// seconds on average unless every is given.
+func ParseShape(s string) (Shape, error) {
+	var shape Shape
+	for _, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch key {
+		case "latency":
+			shape.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			shape.Jitter, err = time.ParseDuration(value)
+		case "rate":
+			shape.Rate, err = ParseBytes(value)
+		case "stall":
+			shape.Stall, err = time.ParseDuration(value)
+		case "every":
+			shape.Every, err = time.ParseDuration(value)
+		default:
+			return Shape{}, fmt.Errorf("invalid shape %q, expected latency=, jitter=, rate=, stall= or every=", s)
+		}
+		if err != nil {
+			return Shape{}, fmt.Errorf("invalid shape %q: %w", s, err)
+		}
+	}
+	if shape.Stall > 0 && shape.Every == 0 {
+		shape.Every = 30 * time.Second
+	}
+	return shape, nil
+}
+
+// WithShaping slows the connections of the download down as shape says. It
+// is meant for diagnostics only: the server is not told, so what it sees
+// of the download is not what a real slow link would make it see.
+func WithShaping(shape Shape) Option {
+	return func(f *File) error {
+		if shape.Latency < 0 || shape.Jitter < 0 || shape.Rate < 0 || shape.Stall < 0 || shape.Every < 0 {
+			return errors.New("negative network shape")
+		}
+		if shape.Stall > 0 && shape.Every == 0 {
+			return errors.New("network shape stalls need an interval")
+		}
+		s := &shaper{Shape: shape}
+		if shape.Rate > 0 {
+			s.bucket = NewTokenBucket(shape.Rate)
+			s.bucket.SetShaping(0, 0, true)
+		}
+		f.shaper = s
+		return nil
+	}
+}
+
+type shaper struct {
+	Shape
+	bucket *TokenBucket
+
+	mu    sync.Mutex
+	next  time.Time
+	until time.Time
+}
+
+// conn wraps a connection just opened, after waiting for its latency.
+func (s *shaper) conn(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if s == nil {
+		return conn, nil
+	}
+	if err := sleepContext(ctx, s.delay()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shapedConn{Conn: conn, shaper: s, ctx: ctx, cancel: cancel}, nil
+}
+
+func (s *shaper) delay() time.Duration {
+	if s.Jitter <= 0 {
+		return s.Latency
+	}
+	return s.Latency + rand.N(s.Jitter)
+}
+
+// stalled returns how long the link is still down, if it is.
+func (s *shaper) stalled() time.Duration {
+	if s.Stall <= 0 {
+		return 0
+	}
+	interval := func() time.Duration {
+		return time.Duration(rand.ExpFloat64() * float64(s.Every))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.next.IsZero() {
+		s.next = now.Add(interval())
+	}
+	for !now.Before(s.next) {
+		s.until = s.next.Add(s.Stall)
+		s.next = s.until.Add(interval())
+	}
+	return s.until.Sub(now)
+}
+
+type shapedConn struct {
+	net.Conn
+	shaper *shaper
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	written bool
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written = true
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	respond := c.written
+	c.written = false
+	c.mu.Unlock()
+	wait := c.shaper.stalled()
+	if respond {
+		wait = max(wait, c.shaper.delay())
+	}
+	if err := sleepContext(c.ctx, wait); err != nil {
+		return 0, net.ErrClosed
+	}
+	if c.shaper.bucket != nil {
+		// Small reads keep the pace even rather than in bursts of the
+		// buffer size.
+		p = p[:min(len(p), max(int(c.shaper.Rate/50), 512))]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.shaper.bucket != nil {
+		if err := c.shaper.bucket.Wait(c.ctx, n); err != nil {
+			return n, net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+func (c *shapedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
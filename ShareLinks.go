@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	GoogleDriveDownload = "https://drive.usercontent.google.com/download"
+	GoogleDriveAPI      = "https://www.googleapis.com/drive/v3/files/"
+	ShareLinkTimeout    = 30 * time.Second
+)
+
+// WithGoogleAPIKey downloads Google Drive files through the Drive API with
+// key, which skips the virus scan page.
+func WithGoogleAPIKey(key string) Option {
+	return func(f *File) error {
+		f.googleAPIKey = key
+		return nil
+	}
+}
+
+var (
+	driveFilePath = regexp.MustCompile(`^/(?:a/[^/]+/)?file/d/([\w-]+)`)
+	driveDocPath  = regexp.MustCompile(`^/(document|spreadsheets|presentation)/d/`)
+	htmlForm      = regexp.MustCompile(`(?is)<form[^>]*\baction="([^"]*)"[^>]*>(.*?)</form>`)
+	htmlInput     = regexp.MustCompile(`(?is)<input[^>]*>`)
+	htmlAttribute = regexp.MustCompile(`(?is)\b([\w-]+)="([^"]*)"`)
+	htmlTitle     = regexp.MustCompile(`(?is)<title>(.*?)</title>`)
+	driveConfirm  = regexp.MustCompile(`confirm=([\w-]+)`)
+)
+
+// resolveShareLink turns Google Drive and Dropbox share links, which open a
+// preview page, into the URL of the file itself.
+func (f *File) resolveShareLink() error {
+	u, err := url.Parse(f.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	switch host := strings.ToLower(u.Hostname()); {
+	case host == "dropbox.com" || host == "www.dropbox.com":
+		resolveDropbox(u)
+		f.Url = u.String()
+	case host == "drive.google.com" || host == "docs.google.com":
+		ctx, cancel := context.WithTimeout(f.parentContext(), ShareLinkTimeout)
+		defer cancel()
+		if err := f.resolveDrive(ctx, u); err != nil {
+			return fmt.Errorf("%s: %w", u, err)
+		}
+	}
+	return nil
+}
+
+// resolveDropbox asks for the file instead of its preview with dl=1. Dropbox
+// redirects to its content host, which serves ranges; shared folders come as
+// a zip file built on the fly.
+func resolveDropbox(u *url.URL) {
+	if !strings.HasPrefix(u.Path, "/s/") && !strings.HasPrefix(u.Path, "/sh/") && !strings.HasPrefix(u.Path, "/scl/") {
+		return
+	}
+	query := u.Query()
+	query.Del("raw")
+	query.Set("dl", "1")
+	u.RawQuery = query.Encode()
+}
+
+// resolveDrive handles drive.google.com/file/d/ID/view and the open?id=ID
+// and uc?id=ID forms. With an API key the Drive API serves the file. Without
+// one, files too large for Google's virus scan get a warning page whose form
+// carries the confirmation the download URL needs.
+func (f *File) resolveDrive(ctx context.Context, u *url.URL) error {
+	if driveDocPath.MatchString(u.Path) {
+		return errors.New("documents, spreadsheets and presentations on Google Drive are not files, export them from their File menu")
+	}
+	id := u.Query().Get("id")
+	if m := driveFilePath.FindStringSubmatch(u.Path); m != nil {
+		id = m[1]
+	}
+	if id == "" {
+		if strings.HasPrefix(u.Path, "/drive/folders/") {
+			return errors.New("folders on Google Drive can not be downloaded, share the files in them")
+		}
+		return errors.New("no Google Drive file id in the link")
+	}
+	if f.googleAPIKey != "" {
+		f.Url = GoogleDriveAPI + url.PathEscape(id) + "?" + url.Values{"alt": {"media"}, "key": {f.googleAPIKey}, "supportsAllDrives": {"true"}}.Encode()
+		return nil
+	}
+
+	download := GoogleDriveDownload + "?" + url.Values{"id": {id}, "export": {"download"}}.Encode()
+	request, err := http.NewRequestWithContext(ctx, "GET", download, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		if resp.StatusCode >= 400 {
+			return &HTTPError{Url: download, StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		f.Url = download
+		return nil
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if confirmed, ok := driveConfirmation(resp.Request.URL, string(page)); ok {
+		f.Url = confirmed
+		return nil
+	}
+	reason := "the file is not shared with anyone with the link, or its download quota is exceeded"
+	if m := htmlTitle.FindStringSubmatch(string(page)); m != nil {
+		reason += " (" + strings.TrimSpace(html.UnescapeString(m[1])) + ")"
+	}
+	return errors.New("no file offered: " + reason)
+}
+
+// driveConfirmation finds the URL a Drive warning page would download from:
+// the action and hidden fields of its form, or a link with a confirm token on
+// older pages.
+func driveConfirmation(base *url.URL, page string) (string, bool) {
+	var target string
+	if m := htmlForm.FindStringSubmatch(page); m != nil {
+		query := url.Values{}
+		for _, input := range htmlInput.FindAllString(m[2], -1) {
+			attributes := map[string]string{}
+			for _, a := range htmlAttribute.FindAllStringSubmatch(input, -1) {
+				attributes[strings.ToLower(a[1])] = html.UnescapeString(a[2])
+			}
+			if attributes["type"] == "hidden" && attributes["name"] != "" {
+				query.Set(attributes["name"], attributes["value"])
+			}
+		}
+		if query.Get("confirm") != "" {
+			target = html.UnescapeString(m[1]) + "?" + query.Encode()
+		}
+	} else if m := driveConfirm.FindStringSubmatch(page); m != nil {
+		query := base.Query()
+		query.Set("confirm", m[1])
+		target = base.Path + "?" + query.Encode()
+	}
+	if target == "" {
+		return "", false
+	}
+	u, err := base.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	return u.String(), true
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions tune the TCP connections of a download. The operating
+// system defaults suit short transfers; on links with a large
+// bandwidth-delay product a bigger receive buffer and a congestion control
+// like bbr let each connection fill more of the link.
+type SocketOptions struct {
+	// KeepAlive is the idle time before the first keepalive probe and the
+	// interval between probes, 30 seconds when zero. Negative turns
+	// keepalive probes off.
+	KeepAlive time.Duration
+	// ReadBuffer is the size of the receive buffer (SO_RCVBUF) in bytes,
+	// left to the system when zero.
+	ReadBuffer int
+	// Delay turns Nagle's algorithm back on; Go sets TCP_NODELAY.
+	Delay bool
+	// Congestion names the congestion control (TCP_CONGESTION), like bbr or
+	// cubic. It is a hint: where the system can not use it the connection
+	// keeps the default and a warning is logged once.
+	Congestion string
+}
+
+func WithSocketOptions(o SocketOptions) Option {
+	return func(f *File) error {
+		if o.ReadBuffer < 0 {
+			return errors.New("read buffer size can not be negative")
+		}
+		f.sockets = o
+		return nil
+	}
+}
+
+func (f *File) tuneDialer(d *net.Dialer) {
+	if keepAlive := f.sockets.KeepAlive; keepAlive != 0 {
+		d.KeepAlive = keepAlive
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: keepAlive > 0, Idle: keepAlive, Interval: keepAlive}
+	}
+	if f.sockets.Congestion != "" {
+		d.Control = f.socketControl
+	}
+}
+
+func (f *File) socketControl(network, address string, c syscall.RawConn) error {
+	if err := setCongestion(c, f.sockets.Congestion); err != nil {
+		f.socketWarn.Do(func() {
+			slog.Warn("can not set the TCP congestion control", "congestion", f.sockets.Congestion, "err", err)
+		})
+	}
+	return nil
+}
+
+// tuneConn applies the options that are set on a connected socket.
+func (f *File) tuneConn(conn net.Conn) {
+	if m, ok := conn.(*measuredConn); ok {
+		conn = m.Conn
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if f.sockets.Delay {
+		tcp.SetNoDelay(false)
+	}
+	if f.sockets.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(f.sockets.ReadBuffer); err != nil {
+			f.socketWarn.Do(func() {
+				slog.Warn("can not set the read buffer size", "size", f.sockets.ReadBuffer, "err", err)
+			})
+		}
+	}
+}
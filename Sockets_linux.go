@@ -0,0 +1,13 @@
+package downloader
+
+import "syscall"
+
+func setCongestion(c syscall.RawConn, name string) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+	}); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package downloader
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func setCongestion(c syscall.RawConn, name string) error {
+	return errors.New("the congestion control can not be chosen on " + runtime.GOOS)
+}
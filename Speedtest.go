@@ -0,0 +1,183 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SpeedtestUrls are the test files cdm speedtest downloads unless given
+// others: large files on well connected hosts that answer range requests.
+var SpeedtestUrls = []string{
+	"https://proof.ovh.net/files/100Mb.dat",
+	"http://speedtest.tele2.net/100MB.zip",
+	"https://ash-speed.hetzner.com/100MB.bin",
+}
+
+// speedtestMargin is how much slower than the fastest run a run with fewer
+// connections may be and still be recommended: connections cost the server
+// too.
+const speedtestMargin = 0.05
+
+type speedtestRun struct {
+	url         string
+	connections int
+	throughput  int64
+}
+
+func RunSpeedtest(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("speedtest", flag.ContinueOnError)
+	var urls stringList
+	fs.Var(&urls, "url", "test file to download, instead of the built-in ones (repeatable)")
+	counts := fs.String("connections", "1,2,4,8,16", "comma-separated connection counts to measure")
+	duration := fs.Duration("duration", 8*time.Second, "longest time to download the file with each connection count")
+	writeConfig := fs.String("write-config", "", "set the recommended connections in this daemon configuration file (-config), creating it if needed")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return ExitUsage
+	}
+	if *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "duration must be positive")
+		return ExitUsage
+	}
+	var connections []int
+	for _, s := range strings.Split(*counts, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "invalid connection count %q\n", s)
+			return ExitUsage
+		}
+		connections = append(connections, n)
+	}
+	if len(urls) == 0 {
+		urls = SpeedtestUrls
+	}
+
+	var runs []speedtestRun
+	for _, u := range urls {
+		fmt.Fprintf(out, "%s\n", u)
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "connections\ttime\tdownloaded\tthroughput\tresult\t")
+		for _, n := range connections {
+			run, elapsed, downloaded, err := speedtest(u, n, *duration)
+			result := "ok"
+			if err != nil {
+				result = err.Error()
+			}
+			fmt.Fprintf(tw, "%d\t%.2fs\t%s\t%s/s\t%s\t\n", n, elapsed.Seconds(), FormatBytes(downloaded), FormatBytes(run.throughput), result)
+			if err != nil {
+				break
+			}
+			runs = append(runs, run)
+		}
+		tw.Flush()
+		fmt.Fprintln(out)
+	}
+	best, ok := recommendConnections(runs)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "no test file could be downloaded")
+		return ExitNetwork
+	}
+	host := best.url
+	if u, err := url.Parse(best.url); err == nil {
+		host = u.Host
+	}
+	fmt.Fprintf(out, "recommended: -connections %d (%s/s from %s)\n", best.connections, FormatBytes(best.throughput), host)
+	if *writeConfig != "" {
+		if err := setConfigConnections(*writeConfig, best.connections); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailure
+		}
+		fmt.Fprintf(out, "set connections to %d in %s\n", best.connections, *writeConfig)
+	}
+	return ExitOK
+}
+
+// speedtest downloads u over n connections for at most d, throwing the data
+// away.
+func speedtest(u string, n int, d time.Duration) (speedtestRun, time.Duration, int64, error) {
+	run := speedtestRun{url: u, connections: n}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	start := time.Now()
+	f, err := New(u, nil, WithWriterAt(discardWriterAt{}), WithConnections(n), WithMinSplitSize(64<<10))
+	if err != nil {
+		return run, time.Since(start), 0, err
+	}
+	if n > 1 && !f.Capabilities().Ranges {
+		return run, time.Since(start), 0, errors.New("no range requests, skipped")
+	}
+	start = time.Now()
+	err = f.Run(ctx)
+	elapsed := time.Since(start)
+	f.closeIdleConnections()
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = nil
+	}
+	downloaded := f.Progress().Downloaded
+	if elapsed > 0 {
+		run.throughput = int64(float64(downloaded) / elapsed.Seconds())
+	}
+	return run, elapsed, downloaded, err
+}
+
+// recommendConnections picks the fewest connections that came within
+// speedtestMargin of the fastest run.
+func recommendConnections(runs []speedtestRun) (speedtestRun, bool) {
+	if len(runs) == 0 {
+		return speedtestRun{}, false
+	}
+	fastest := runs[0]
+	for _, r := range runs {
+		if r.throughput > fastest.throughput {
+			fastest = r
+		}
+	}
+	best := fastest
+	for _, r := range runs {
+		if float64(r.throughput) >= float64(fastest.throughput)*(1-speedtestMargin) && r.connections < best.connections {
+			best = r
+		}
+	}
+	return best, best.throughput > 0
+}
+
+// setConfigConnections sets connections in the configuration file name,
+// keeping everything else it holds.
+func setConfigConnections(name string, connections int) error {
+	config := map[string]json.RawMessage{}
+	b, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	config["connections"] = json.RawMessage(strconv.Itoa(connections))
+	if b, err = json.MarshalIndent(config, "", "  "); err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(b, '\n'), 0o644)
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
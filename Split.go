@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+var (
+	// BaselineTime and BaselineBytes bound the sample of one connection's
+	// speed the probe takes before splitting a file.
+	BaselineTime        = 500 * time.Millisecond
+	BaselineBytes int64 = 4 << 20
+	// SplitWorthTime is how long one connection must need for a file before
+	// it is split: below it, opening more connections costs more than they
+	// save.
+	SplitWorthTime = 2 * time.Second
+)
+
+// SplitDecision tells how many connections a download is split over, of
+// what block size, and why.
+type SplitDecision struct {
+	Connections int   `json:"connections"`
+	BlockSize   int64 `json:"block_size"`
+	// Baseline is the speed of one connection in the probe's sample, in
+	// bytes/s, 0 when none was taken.
+	Baseline int64  `json:"baseline,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// WithBaseline turns the sample of one connection's speed, and keeping
+// files one connection fetches quickly to it, on or off.
+func WithBaseline(enabled bool) Option {
+	return func(f *File) error {
+		f.noBaseline = !enabled
+		return nil
+	}
+}
+
+func (f *File) SplitDecision() SplitDecision {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	return f.split
+}
+
+// decideSplit settles how the file is split and logs why.
+func (f *File) decideSplit(ctx context.Context) {
+	d := SplitDecision{Connections: 1, BlockSize: f.Size - f.skip}
+	switch {
+	case f.prefetched != nil:
+		d.Reason = "the probe request brought the whole file along"
+	case f.Strategy() != StrategyParallel:
+		d.Reason = "the " + f.Strategy() + " strategy uses one connection"
+	case f.pieceOrder == PieceOrderWindow:
+		d.Connections = f.connections
+		d.BlockSize = f.pieceSize()
+		d.Reason = fmt.Sprintf("%d connections as configured, in pieces of the %s window", f.connections, FormatBytes(f.pieceWindow))
+	case f.pieceOrder == PieceOrderPipeline:
+		d.Connections = f.connections
+		d.BlockSize = f.pieceSize()
+		d.Reason = fmt.Sprintf("%d keep-alive connections as configured, each requesting %s ranges one after another", f.connections, FormatBytes(d.BlockSize))
+	case f.pieceOrder == PieceOrderAdaptive:
+		d.Connections = f.connections
+		d.BlockSize = max((f.Size-f.skip)/int64(AdaptiveShare*f.connections), f.minSplitSize)
+		d.Reason = fmt.Sprintf("%d connections as configured, in pieces that start at %s and shrink as the file completes", f.connections, FormatBytes(d.BlockSize))
+	case f.splitCount() < f.connections:
+		d.Connections = f.splitCount()
+		d.Reason = fmt.Sprintf("%d connections asked for, but the file makes only %d blocks of the %s minimum split size", f.connections, d.Connections, FormatBytes(f.minSplitSize))
+	default:
+		d.Connections = f.connections
+		d.Reason = fmt.Sprintf("%d connections as configured", f.connections)
+	}
+	pieces := f.pieceOrder == PieceOrderWindow || f.pieceOrder == PieceOrderPipeline || f.pieceOrder == PieceOrderAdaptive
+	if d.Connections > 1 && !pieces && !f.noBaseline && f.protocol == nil && f.mirrors == nil && BaselineTime > 0 {
+		if d.Baseline = f.sampleBaseline(ctx); d.Baseline > 0 {
+			speed := d.Baseline
+			if rate := f.limiter.Rate(); rate > 0 {
+				speed = min(speed, rate)
+			}
+			single := time.Duration(float64(f.Size-f.skip) / float64(speed) * float64(time.Second))
+			if single < SplitWorthTime {
+				d.Reason = fmt.Sprintf("one connection at %s/s fetches the file in %s, less than %s, so it is not split (turn the baseline off to split it anyway)", FormatBytes(speed), single.Round(time.Millisecond), SplitWorthTime)
+				d.Connections = 1
+				f.splitLimit = 1
+			}
+		}
+	}
+	if d.Connections > 1 && !pieces {
+		d.BlockSize = (f.Size - f.skip) / int64(d.Connections)
+	}
+	f.split = d
+	slog.Debug("split decision", "url", f.Url, "connections", d.Connections, "block_size", d.BlockSize, "baseline", d.Baseline, "reason", d.Reason)
+}
+
+// sampleBaseline reads the start of the file over one connection for up to
+// BaselineTime or BaselineBytes and returns its speed after the first byte,
+// or 0 when the sample was too small to tell.
+func (f *File) sampleBaseline(ctx context.Context) int64 {
+	ctx, cancel := context.WithTimeout(ctx, BaselineTime+10*time.Second)
+	defer cancel()
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return 0
+	}
+	begin := f.offset + f.skip
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-"+strconv.FormatInt(begin+min(BaselineBytes, f.Size-f.skip)-1, 10))
+	resp, err := f.do(request)
+	if err != nil {
+		slog.Debug("can not sample the connection speed", "url", f.Url, "err", err)
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0
+	}
+	buf := make([]byte, 32<<10)
+	_, err = resp.Body.Read(buf)
+	start := time.Now()
+	var read int64
+	for err == nil && read < BaselineBytes && time.Since(start) < BaselineTime {
+		n, e := resp.Body.Read(buf)
+		read, err = read+int64(n), e
+	}
+	elapsed := time.Since(start)
+	if read < 64<<10 || elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(read) / elapsed.Seconds())
+}
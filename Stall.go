@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	StallTimeout = time.Second * 60
+
+	ErrStalled = errors.New("connection stalled")
+	ErrTooSlow = errors.New("connection below the low speed limit")
+	// ErrSlowMirror ends the request of a block to a mirror that falls
+	// behind the others, so the rest of the block comes from a faster one.
+	ErrSlowMirror = errors.New("mirror slower than the others")
+)
+
+func (f *File) watchBlock(ctx context.Context, cancel context.CancelCauseFunc, read *int64) {
+	tick := time.NewTicker(time.Second * 1)
+	defer tick.Stop()
+
+	var last int64
+	var lastProgress = time.Now()
+	var window []int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			n := atomic.LoadInt64(read)
+			if n != last {
+				lastProgress = now
+			}
+			if f.stallTimeout > 0 && now.Sub(lastProgress) >= f.stallTimeout {
+				cancel(ErrStalled)
+				return
+			}
+
+			window = append(window, n-last)
+			last = n
+			seconds := int(f.speedTime / time.Second)
+			if f.speedLimit <= 0 || seconds <= 0 {
+				continue
+			}
+			if len(window) > seconds {
+				window = window[1:]
+			}
+			if len(window) < seconds {
+				continue
+			}
+			var sum int64
+			for _, b := range window {
+				sum += b
+			}
+			if sum < f.speedLimit*int64(seconds) {
+				cancel(ErrTooSlow)
+				return
+			}
+		}
+	}
+}
+
+// watchMirror ends the request to m when it stays below MirrorSwitchRatio
+// of the speed of another usable mirror for MirrorSwitchTime. A rate limit
+// slows every mirror alike, so it does not watch then.
+func (f *File) watchMirror(ctx context.Context, cancel context.CancelCauseFunc, m *Mirror, read *int64) {
+	seconds := int(MirrorSwitchTime / time.Second)
+	if seconds <= 0 || MirrorSwitchRatio <= 0 || f.limiter.Rate() > 0 {
+		return
+	}
+	tick := time.NewTicker(time.Second * 1)
+	defer tick.Stop()
+
+	last := atomic.LoadInt64(read)
+	var window []int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			n := atomic.LoadInt64(read)
+			window = append(window, n-last)
+			last = n
+			if len(window) > seconds {
+				window = window[1:]
+			}
+			if len(window) < seconds {
+				continue
+			}
+			var sum int64
+			for _, b := range window {
+				sum += b
+			}
+			speed := sum / int64(seconds)
+			if faster := f.mirrors.faster(m, speed); faster != nil {
+				slog.Info("mirror too slow, moving the rest of the block to a faster one", "url", m.url.Redacted(), "speed", speed, "faster", faster.url.Redacted(), "faster_speed", faster.Speed)
+				cancel(ErrSlowMirror)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	StrategyAuto       = "auto"
+	StrategyParallel   = "parallel"
+	StrategySequential = "sequential"
+	StrategyStreaming  = "streaming"
+)
+
+func WithStrategy(strategy string) Option {
+	return func(f *File) error {
+		if !validStrategy(strategy) {
+			return errors.New("unknown download strategy " + strategy)
+		}
+		f.strategy = strategy
+		return nil
+	}
+}
+
+func validStrategy(strategy string) bool {
+	switch strategy {
+	case StrategyAuto, StrategyParallel, StrategySequential, StrategyStreaming:
+		return true
+	}
+	return false
+}
+
+func (f *File) probeCapabilities(acceptRanges bool) {
+	f.capabilities = Capabilities{
+		Ranges:      acceptRanges && !f.noRanges,
+		KnownLength: f.Size >= 0,
+		ETag:        f.ETag != "",
+	}
+	if f.strategy == StrategyStreaming {
+		f.noRanges = true
+	}
+}
+
+// probeSize asks for the first byte of a response sent without a length,
+// for servers that only tell the size in the Content-Range of a range
+// response. It returns -1 when the server does not answer with one.
+func (f *File) probeSize(ctx context.Context) int64 {
+	request, err := f.newRequest(ctx)
+	if err != nil {
+		return -1
+	}
+	request.Header.Set("Range", "bytes=0-0")
+	resp, err := f.do(request)
+	if err != nil {
+		slog.Debug("can not probe the size", "url", f.Url, "err", err)
+		return -1
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	if resp.StatusCode != http.StatusPartialContent || contentEncoding(resp) != "" {
+		return -1
+	}
+	if etag := resp.Header.Get("ETag"); f.ETag != "" && etag != "" && etag != f.ETag {
+		return -1
+	}
+	return contentRangeSize(resp.Header.Get("Content-Range"))
+}
+
+func (f *File) Capabilities() Capabilities {
+	return f.capabilities
+}
+
+// Strategy is how the download is fetched: parallel ranges, one ranged
+// connection that resumes where it stopped (or from the beginning when the
+// server ignores the range), or one stream that restarts from the beginning
+// when interrupted.
+func (f *File) Strategy() string {
+	switch {
+	case f.noRanges:
+		return StrategyStreaming
+	case f.Size > 0 && (f.strategy == StrategyParallel || (f.strategy == StrategyAuto && (f.ranged || f.capabilities.Ranges))):
+		return StrategyParallel
+	}
+	return StrategySequential
+}
+
+func (f *File) setRange(request *http.Request, begin, end int64) {
+	switch {
+	case end != -1 && (begin > 0 || f.Strategy() == StrategyParallel):
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-"+strconv.FormatInt(end, 10))
+	case begin > 0:
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-")
+	}
+}
@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	SummaryText = "text"
+	SummaryJSON = "json"
+	SummaryNone = "none"
+)
+
+type Summary struct {
+	Id           int               `json:"id"`
+	Url          string            `json:"url"`
+	FinalUrl     string            `json:"final_url,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	State        string            `json:"state"`
+	Bytes        int64             `json:"bytes"`
+	Downloaded   int64             `json:"downloaded"`
+	Elapsed      float64           `json:"elapsed"`
+	Active       float64           `json:"active"`
+	Stalled      float64           `json:"stalled"`
+	Paused       float64           `json:"paused"`
+	AverageSpeed int64             `json:"average_speed"`
+	PeakSpeed    int64             `json:"peak_speed"`
+	Retries      int64             `json:"retries"`
+	Connections  int               `json:"connections"`
+	Split        *SplitDecision    `json:"split,omitempty"`
+	Sources      map[string]int64  `json:"sources"`
+	Tags         []string          `json:"tags,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+func (f *File) Summary() Summary {
+	f.mu.Lock()
+	elapsed := f.elapsed
+	if f.state == StateDownloading || f.state == StatePausing {
+		elapsed += time.Since(f.runStart)
+	}
+	var paused time.Duration
+	if !f.startedAt.IsZero() {
+		end := f.endedAt
+		if end.IsZero() {
+			end = time.Now()
+		}
+		paused = max(end.Sub(f.startedAt)-elapsed, 0)
+	}
+	s := Summary{Url: f.Url, FinalUrl: f.finalUrl, State: f.state}
+	if f.err != nil {
+		s.Error = f.err.Error()
+	}
+	f.mu.Unlock()
+
+	f.blockMu.Lock()
+	s.Connections = f.peakWorkers
+	if f.split.Reason != "" {
+		split := f.split
+		s.Split = &split
+	}
+	f.blockMu.Unlock()
+
+	// Bytes are those received by this run, Downloaded those of the file in
+	// place, including what earlier runs left.
+	s.Bytes = atomic.LoadInt64(&f.status.Session)
+	s.Downloaded = atomic.LoadInt64(&f.status.Downloaded)
+	s.Elapsed = elapsed.Seconds()
+	active := min(time.Duration(atomic.LoadInt64(&f.active)), elapsed)
+	s.Active, s.Stalled, s.Paused = active.Seconds(), (elapsed - active).Seconds(), paused.Seconds()
+	if s.Elapsed > 0 {
+		s.AverageSpeed = int64(float64(s.Bytes) / s.Elapsed)
+	}
+	s.PeakSpeed = max(atomic.LoadInt64(&f.status.PeakSpeed), s.AverageSpeed)
+	s.Retries = atomic.LoadInt64(&f.status.Retries)
+	s.Sources = map[string]int64{f.Url: s.Bytes}
+	return s
+}
+
+type Report struct {
+	Downloads []Summary `json:"downloads"`
+	Bytes     int64     `json:"bytes"`
+	Retries   int64     `json:"retries"`
+	Active    float64   `json:"active"`
+	Stalled   float64   `json:"stalled"`
+	Paused    float64   `json:"paused"`
+	Finished  int       `json:"finished"`
+	Failed    int       `json:"failed"`
+}
+
+func NewReport(downloads []Summary) Report {
+	r := Report{Downloads: downloads}
+	for _, s := range downloads {
+		r.Bytes += s.Bytes
+		r.Retries += s.Retries
+		r.Active += s.Active
+		r.Stalled += s.Stalled
+		r.Paused += s.Paused
+		switch s.State {
+		case StateFinished:
+			r.Finished++
+		case StateFailed:
+			r.Failed++
+		}
+	}
+	return r
+}
+
+func (r Report) Write(w io.Writer, format string) error {
+	switch format {
+	case SummaryNone:
+		return nil
+	case SummaryJSON:
+		return json.NewEncoder(w).Encode(r)
+	}
+	_, err := r.WriteTo(w)
+	return err
+}
+
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	print := func(format string, args ...interface{}) {
+		m, _ := fmt.Fprintf(tw, format, args...)
+		n += int64(m)
+	}
+	seconds := func(s float64) string {
+		return (time.Duration(s*1000) * time.Millisecond).String()
+	}
+	print("\n%s\n", tr("Download Results:"))
+	print("%s\n", tr("id\t state\t bytes\t of file\t avg speed\t peak speed\t retries\t conns\t elapsed\t active\t stalled\t paused\t path"))
+	for _, s := range r.Downloads {
+		print("%d\t %s\t %s\t %s\t %s/s\t %s/s\t %d\t %d\t %s\t %s\t %s\t %s\t %s\n",
+			s.Id, tr(s.State), FormatBytes(s.Bytes), FormatBytes(s.Downloaded), FormatBytes(s.AverageSpeed), FormatBytes(s.PeakSpeed),
+			s.Retries, s.Connections, seconds(s.Elapsed), seconds(s.Active), seconds(s.Stalled), seconds(s.Paused), s.Path)
+	}
+	tw.Flush()
+	for _, s := range r.Downloads {
+		if s.Error != "" {
+			m, _ := fmt.Fprintf(w, "%d: %s\n", s.Id, trError(s.Error))
+			n += int64(m)
+		}
+		for source, bytes := range s.Sources {
+			m, _ := fmt.Fprintln(w, trf("%d: %s from %s", s.Id, FormatBytes(bytes), source))
+			n += int64(m)
+		}
+	}
+	m, err := fmt.Fprintln(w, trf("%d finished, %d failed, %s, %d retries, %s active, %s stalled, %s paused",
+		r.Finished, r.Failed, FormatBytes(r.Bytes), r.Retries, seconds(r.Active), seconds(r.Stalled), seconds(r.Paused)))
+	return n + int64(m), err
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	SyncNever    = "never"
+	SyncFinish   = "finish"
+	SyncBlock    = "block"
+	SyncPeriodic = "periodic"
+)
+
+var SyncInterval = time.Second * 10
+
+func validSyncPolicy(policy string) error {
+	switch policy {
+	case SyncNever, SyncFinish, SyncBlock, SyncPeriodic:
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy %q", policy)
+}
+
+func (f *File) sync() {
+	if f.Stream == nil {
+		return
+	}
+	if err := f.Stream.Sync(); err != nil {
+		slog.Warn("can not sync the output file", "path", f.Stream.Name(), "err", err)
+	}
+}
+
+func (f *File) syncPeriodically(ctx context.Context) {
+	tick := time.NewTicker(f.syncInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			f.sync()
+		}
+	}
+}
+
+func (f *File) syncFinished() {
+	if f.syncPolicy == SyncNever || f.Stream == nil {
+		return
+	}
+	f.sync()
+	if err := syncDir(filepath.Dir(f.Stream.Name())); err != nil {
+		slog.Warn("can not sync the output directory", "path", f.Stream.Name(), "err", err)
+	}
+}
+
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func (m *Manager) SetLabels(id int, tags []string, metadata map[string]string) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.setLabels(tags, metadata)
+	return nil
+}
+
+func (d *Download) setLabels(tags []string, metadata map[string]string) {
+	if tags != nil {
+		d.tags = normalizeTags(tags)
+	}
+	if metadata != nil {
+		d.metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			d.metadata[k] = v
+		}
+	}
+}
+
+func normalizeTags(tags []string) []string {
+	var list = []string{}
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(list, tag) {
+			list = append(list, tag)
+		}
+	}
+	return list
+}
+
+func ParseMetadata(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid metadata %q, want key=value", s)
+	}
+	return key, value, nil
+}
@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+type tee struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	frontier
+	finished bool
+	done     chan struct{}
+	err      error
+}
+
+func WithTee(w io.Writer) Option {
+	return func(f *File) error {
+		if f.Stream == nil {
+			return errors.New("tee needs a destination file to read back from")
+		}
+		t := &tee{w: w, done: make(chan struct{})}
+		t.cond = sync.NewCond(&t.mu)
+		f.tee = t
+		return nil
+	}
+}
+
+func (f *File) WaitTee() error {
+	if f.tee == nil {
+		return nil
+	}
+	select {
+	case <-f.finished:
+	default:
+		f.tee.mu.Lock()
+		f.tee.finished = true
+		f.tee.cond.Broadcast()
+		f.tee.mu.Unlock()
+	}
+	<-f.tee.done
+	return f.tee.err
+}
+
+func (f *File) startTee() {
+	f.tee.front = f.skip
+	go func() {
+		<-f.finished
+		f.tee.mu.Lock()
+		f.tee.finished = true
+		f.tee.cond.Broadcast()
+		f.tee.mu.Unlock()
+	}()
+	go f.tee.pump(f.Stream)
+}
+
+func (t *tee) written(pos, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.add(pos, n) {
+		t.cond.Broadcast()
+	}
+}
+
+func (t *tee) pump(r io.ReaderAt) {
+	defer close(t.done)
+	if c, ok := t.w.(io.Closer); ok {
+		defer c.Close()
+	}
+	buf := make([]byte, 256<<10)
+	var sent int64
+	for {
+		t.mu.Lock()
+		for t.front == sent && !t.finished {
+			t.cond.Wait()
+		}
+		front, finished := t.front, t.finished
+		t.mu.Unlock()
+		for sent < front {
+			n, err := r.ReadAt(buf[:min(int64(len(buf)), front-sent)], sent)
+			if n > 0 {
+				if _, err := t.w.Write(buf[:n]); err != nil {
+					t.err = err
+					return
+				}
+				sent += int64(n)
+			}
+			if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+				t.err = err
+				return
+			}
+		}
+		if finished {
+			return
+		}
+	}
+}
+
+type TeeCommand struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func StartTeeCommand(command string) (*TeeCommand, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &TeeCommand{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+func (t *TeeCommand) Wait() error {
+	return t.cmd.Wait()
+}
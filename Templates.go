@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is what path templates like {{.Host}}/{{.Date}}/{{.Filename}}
+// and the arguments of event commands are expanded with. Type, Path, Dir,
+// Size, Downloaded and Error are only set for commands.
+type TemplateData struct {
+	Url      string
+	Host     string
+	Filename string
+	Name     string
+	Ext      string
+	Date     string
+	Time     string
+	Tags     []string
+	Metadata map[string]string
+	Group    string
+
+	Type       string
+	Path       string
+	Dir        string
+	Size       int64
+	Downloaded int64
+	Error      string
+}
+
+func newTemplateData(rawUrl, filename string, t time.Time) TemplateData {
+	var host string
+	if u, err := url.Parse(rawUrl); err == nil {
+		host = u.Hostname()
+	}
+	ext := filepath.Ext(filename)
+	return TemplateData{
+		Url:      rawUrl,
+		Host:     host,
+		Filename: filename,
+		Name:     strings.TrimSuffix(filename, ext),
+		Ext:      ext,
+		Date:     t.Format("2006-01-02"),
+		Time:     t.Format("15-04-05"),
+	}
+}
+
+// ParseTemplate parses a path or command template and tries it out, so a
+// misspelled field fails now rather than on the first download.
+func ParseTemplate(text string) (*template.Template, error) {
+	t, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&strings.Builder{}, newTemplateData("https://example.com/file.bin", "file.bin", time.Now())); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// expandPath expands a path template into a relative path. Slashes separate
+// directories; each element is sanitized and . and .. are dropped, so the
+// path stays below the download directory.
+func expandPath(t *template.Template, data TemplateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	var elements []string
+	for _, element := range strings.FieldsFunc(b.String(), func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element = strings.TrimSpace(element); element != "" && element != "." && element != ".." {
+			elements = append(elements, SanitizeFilename(element))
+		}
+	}
+	if len(elements) == 0 {
+		return "", errors.New("path template expanded to an empty path")
+	}
+	return filepath.Join(elements...), nil
+}
+
+// splitCommand splits a command line into its arguments at spaces outside
+// quotes and template actions, so {{index .Metadata "feed"}} stays one.
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	var quote byte
+	var inArg, inAction bool
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case inAction:
+			if strings.HasPrefix(command[i:], "}}") {
+				b.WriteString("}}")
+				inAction = false
+				i++
+				continue
+			}
+			b.WriteByte(c)
+		case strings.HasPrefix(command[i:], "{{"):
+			b.WriteString("{{")
+			inAction, inArg = true, true
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || inAction {
+		return nil, errors.New("unterminated quote or {{ in command")
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+func (m *Manager) expandPath(d *Download, name string) (string, error) {
+	t, err := ParseTemplate(m.config.PathTemplate)
+	if err != nil {
+		return "", err
+	}
+	data := newTemplateData(d.Url, name, d.Added)
+	data.Tags, data.Metadata, data.Group = d.tags, d.metadata, d.group
+	return expandPath(t, data)
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TenantHeader names the tenant a request to the daemon adds downloads for.
+const TenantHeader = "X-Cdm-Tenant"
+
+var ErrTenantQueueFull = errors.New("the tenant has too many downloads queued")
+
+// Tenant is a user of a shared daemon. Tenants get queue slots and, under a
+// total rate limit, bandwidth in proportion to their weight, so one with many
+// queued downloads can not starve the others.
+type Tenant struct {
+	Name string `json:"name"`
+	// Weight is the tenant's share relative to the others, 1 when 0.
+	Weight    int   `json:"weight"`
+	RateLimit int64 `json:"rate_limit"`
+	// MaxActive and MaxQueued cap the tenant's downloads running at once and
+	// waiting, without a cap when 0.
+	MaxActive int `json:"max_active"`
+	MaxQueued int `json:"max_queued"`
+}
+
+// ParseTenant parses NAME[:WEIGHT].
+func ParseTenant(s string) (Tenant, error) {
+	name, weight, ok := strings.Cut(s, ":")
+	t := Tenant{Name: strings.TrimSpace(name)}
+	if ok {
+		if _, err := fmt.Sscan(weight, &t.Weight); err != nil {
+			return Tenant{}, fmt.Errorf("invalid tenant weight %q", weight)
+		}
+	}
+	return t, t.validate()
+}
+
+func (t Tenant) validate() error {
+	if t.Name == "" {
+		return errors.New("tenant needs a name")
+	}
+	if t.Weight < 0 || t.RateLimit < 0 || t.MaxActive < 0 || t.MaxQueued < 0 {
+		return fmt.Errorf("tenant %s: weight, rate_limit, max_active and max_queued can not be negative", t.Name)
+	}
+	return nil
+}
+
+// tenant returns the settings of the tenant called name. Tenants that are
+// not configured, and downloads added without one, get weight 1 and no caps.
+func (c Config) tenant(name string) Tenant {
+	t := Tenant{Name: name}
+	for _, configured := range c.Tenants {
+		if configured.Name == name {
+			t = configured
+			break
+		}
+	}
+	if t.Weight < 1 {
+		t.Weight = 1
+	}
+	return t
+}
+
+func tenantOf(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(TenantHeader))
+}
+
+// admitTenant checks the tenant of d may queue another download. A tenant
+// that had nothing waiting or running starts even with the busy ones instead
+// of catching up on the turns it did not need. m.mu is held.
+func (m *Manager) admitTenant(d *Download) error {
+	t := m.config.tenant(d.tenant)
+	var queued int
+	var busy bool
+	floor := -1.0
+	for _, other := range m.downloads {
+		if other.state != StateQueued && other.state != StateDownloading {
+			continue
+		}
+		if other.tenant == d.tenant {
+			busy = true
+			if other.state == StateQueued {
+				queued++
+			}
+		} else if floor < 0 || m.served[other.tenant] < floor {
+			floor = m.served[other.tenant]
+		}
+	}
+	if t.MaxQueued > 0 && queued >= t.MaxQueued {
+		return fmt.Errorf("%w: %s has %d", ErrTenantQueueFull, t.Name, queued)
+	}
+	if !busy && floor > m.served[d.tenant] {
+		if m.served == nil {
+			m.served = map[string]float64{}
+		}
+		m.served[d.tenant] = floor
+	}
+	return nil
+}
+
+// nextQueued picks the download to start next: the first queued one of the
+// tenant with the fewest running downloads for its weight, among those below
+// their max_active, and of those the one that was served least. m.mu is held.
+func (m *Manager) nextQueued(running map[string]int) *Download {
+	var next *Download
+	var share, served float64
+	for _, d := range m.downloads {
+		if d.state != StateQueued {
+			continue
+		}
+		t := m.config.tenant(d.tenant)
+		if t.MaxActive > 0 && running[d.tenant] >= t.MaxActive {
+			continue
+		}
+		s := float64(running[d.tenant]) / float64(t.Weight)
+		if next == nil || s < share || (s == share && m.served[d.tenant] < served) {
+			next, share, served = d, s, m.served[d.tenant]
+		}
+	}
+	if next != nil {
+		if m.served == nil {
+			m.served = map[string]float64{}
+		}
+		m.served[next.tenant] += 1 / float64(m.config.tenant(next.tenant).Weight)
+	}
+	return next
+}
+
+// tenantWeights scales the priorities of the running downloads so that those
+// of each tenant together weigh as much as its weight says.
+func tenantWeights(config Config, tenants []string, priorities []int) []int {
+	sums := map[string]int{}
+	for i, name := range tenants {
+		sums[name] += priorities[i]
+	}
+	weights := make([]int, len(priorities))
+	for i, name := range tenants {
+		weights[i] = max(1, priorities[i]*config.tenant(name).Weight*1000/max(sums[name], 1))
+	}
+	return weights
+}
@@ -0,0 +1,56 @@
+package downloader
+
+import "context"
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+type spanKey struct{}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+func (f *File) startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	if f.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := f.tracer.Start(ctx, name, attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func (f *File) newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Second * 30,
+		KeepAlive: time.Second * 30,
+		LocalAddr: f.localAddr,
+	}
+	f.tuneDialer(dialer)
+	if f.dnsServer != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, f.dnsServer)
+			},
+		}
+	}
+	if pooled := f.pool.transport(f, func() *http.Transport { return f.newTransport(dialer) }); pooled != nil {
+		return &http.Client{Transport: f.wrapTransport(pooled), CheckRedirect: f.checkRedirect}
+	}
+	transport := f.newTransport(dialer)
+	transport.MaxIdleConns = f.connections * 2
+	transport.MaxIdleConnsPerHost = f.connections
+	transport.IdleConnTimeout = time.Second * 30
+	if f.pieceOrder == PieceOrderPipeline {
+		transport.MaxConnsPerHost = f.connections
+	}
+	f.transport = transport
+	return &http.Client{Transport: f.wrapTransport(transport), CheckRedirect: f.checkRedirect}
+}
+
+func (f *File) newTransport(dialer *net.Dialer) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = f.dialContext(dialer)
+	if f.proxy != nil {
+		switch f.proxyAuth {
+		case AuthNTLM, AuthNegotiate:
+			transport.Proxy = nil
+			transport.DialContext = f.dialProxy(transport.DialContext)
+		case AuthBasic:
+			proxy := *f.proxy
+			proxy.User = url.UserPassword(f.proxyCredentials.login(), f.proxyCredentials.Password)
+			transport.Proxy = http.ProxyURL(&proxy)
+		default:
+			transport.Proxy = http.ProxyURL(f.proxy)
+		}
+	}
+	return transport
+}
+
+func (f *File) wrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	for _, wrap := range f.transportWrappers {
+		rt = wrap(rt)
+	}
+	return rt
+}
+
+func (f *File) do(request *http.Request) (*http.Response, error) {
+	for _, hook := range f.requestHooks {
+		if err := hook(request); err != nil {
+			return nil, err
+		}
+	}
+	return f.client.Do(request)
+}
+
+func (f *File) closeIdleConnections() {
+	if f.ownClient {
+		f.transport.CloseIdleConnections()
+	}
+}
+
+func (f *File) dialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := f.dial(ctx, f.guardDialer(dialer, addr), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		f.tuneConn(conn)
+		return f.shaper.conn(ctx, conn)
+	}
+}
+
+func (f *File) dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if f.network != "" {
+		network = f.network
+	}
+	if override, ok := f.resolve[addr]; ok {
+		return d.DialContext(ctx, network, override)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	return f.dialHost(ctx, d, network, host, port)
+}
+
+func lookupDoH(ctx context.Context, server, host, network string) ([]string, error) {
+	var types []string
+	switch network {
+	case "tcp4":
+		types = []string{"A"}
+	case "tcp6":
+		types = []string{"AAAA"}
+	default:
+		types = []string{"A", "AAAA"}
+	}
+
+	var ips []string
+	for _, typ := range types {
+		query := url.Values{"name": {host}, "type": {typ}}
+		request, err := http.NewRequestWithContext(ctx, "GET", server+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", "application/dns-json")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		var answer struct {
+			Status int
+			Answer []struct {
+				Type int    `json:"type"`
+				Data string `json:"data"`
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&answer)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("doh %s: %w", server, err)
+		}
+		for _, a := range answer.Answer {
+			if (a.Type == 1 || a.Type == 28) && net.ParseIP(a.Data) != nil {
+				ips = append(ips, a.Data)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func ParseResolve(s string) (string, string, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return "", "", errors.New("resolve entry must be host:port:addr")
+	}
+	host, port := parts[0], parts[1]
+	addr := strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+	if host == "" || port == "" || net.ParseIP(addr) == nil {
+		return "", "", errors.New("resolve entry must be host:port:addr")
+	}
+	return net.JoinHostPort(host, port), net.JoinHostPort(addr, port), nil
+}
@@ -0,0 +1,433 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type tuiItem struct {
+	url   string
+	path  string
+	file  *File
+	state string
+	err   error
+}
+
+type Tui struct {
+	Jobs    int
+	Out     io.Writer
+	Events  *Dispatcher
+	Json    bool
+	Options []Option
+	Keep    bool
+	// Backups, if set, keeps the files downloads overwrite.
+	Backups *Backups
+	// Namer names the files, DefaultFileNamer when nil.
+	Namer FileNamer
+
+	mu       sync.Mutex
+	dir      string
+	paths    *template.Template
+	items    []*tuiItem
+	pending  []string
+	selected int
+	quit     chan bool
+}
+
+// NewTui queues urls for downloading into dir, under the path the template
+// paths expands to when it is not nil.
+func NewTui(urls []string, dir string, paths *template.Template) *Tui {
+	t := &Tui{Jobs: 2, Out: os.Stdout, dir: dir, paths: paths, quit: make(chan bool, 1)}
+	for _, u := range urls {
+		t.items = append(t.items, t.newItem(u))
+	}
+	return t
+}
+
+func (t *Tui) newItem(u string) *tuiItem {
+	name := SanitizeFilename(filepath.Base(fileName(t.Namer, u)))
+	if t.paths != nil {
+		relative, err := expandPath(t.paths, newTemplateData(u, name, time.Now()))
+		if err != nil {
+			slog.Warn("can not expand the path template", "url", u, "err", err)
+		} else {
+			name = relative
+		}
+	}
+	path := filepath.Join(t.dir, name)
+	ext := filepath.Ext(name)
+	for i := 1; t.taken(path); i++ {
+		path = filepath.Join(t.dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	return &tuiItem{url: u, path: path, state: StateQueued}
+}
+
+func (t *Tui) taken(path string) bool {
+	for _, item := range t.items {
+		if item.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tui) Add(url string) {
+	t.mu.Lock()
+	t.items = append(t.items, t.newItem(url))
+	t.mu.Unlock()
+	t.schedule()
+}
+
+func (t *Tui) Prompt(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, url)
+}
+
+func (t *Tui) Run() {
+	if !t.Json {
+		restore := rawTerminal()
+		defer restore()
+	}
+
+	keys := make(chan byte)
+	go func() {
+		var b = make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				return
+			}
+			keys <- b[0]
+		}
+	}()
+
+	t.schedule()
+	tick := time.NewTicker(time.Millisecond * 500)
+	defer tick.Stop()
+	for {
+		t.render()
+		if t.finished() {
+			return
+		}
+		select {
+		case <-t.quit:
+			return
+		case <-tick.C:
+		case k := <-keys:
+			t.key(k)
+		}
+	}
+}
+
+func (t *Tui) key(k byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) > 0 && (k == 'a' || k == 'x') {
+		if k == 'a' {
+			t.items = append(t.items, t.newItem(t.pending[0]))
+			go t.schedule()
+		}
+		t.pending = t.pending[1:]
+		return
+	}
+	if len(t.items) == 0 {
+		if k == 'q' {
+			t.quit <- true
+		}
+		return
+	}
+	item := t.items[t.selected]
+	switch k {
+	case 'k', 'A':
+		if t.selected > 0 {
+			t.selected--
+		}
+	case 'j', 'B':
+		if t.selected < len(t.items)-1 {
+			t.selected++
+		}
+	case 'p', ' ':
+		switch item.state {
+		case StateDownloading:
+			go item.file.Pause()
+		case StatePaused:
+			item.state = StateDownloading
+			go item.file.Resume()
+		}
+	case 'c':
+		switch item.state {
+		case StateQueued, StateDownloading, StatePaused:
+			if item.file != nil {
+				go item.file.Cancel()
+			}
+			item.state = StateCanceled
+			go t.schedule()
+		}
+	case '+':
+		if item.state == StateQueued && t.selected > 0 {
+			t.items[t.selected-1], t.items[t.selected] = item, t.items[t.selected-1]
+			t.selected--
+		}
+	case '-':
+		if item.state == StateQueued && t.selected < len(t.items)-1 {
+			t.items[t.selected+1], t.items[t.selected] = item, t.items[t.selected+1]
+			t.selected++
+		}
+	case 'q':
+		t.quit <- true
+	}
+}
+
+func (t *Tui) schedule() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var active int
+	for _, item := range t.items {
+		if item.state == StateDownloading || item.state == StatePaused {
+			active++
+		}
+	}
+	for _, item := range t.items {
+		if active >= t.Jobs {
+			return
+		}
+		if item.state == StateQueued {
+			item.state = StateDownloading
+			active++
+			go t.start(item)
+		}
+	}
+}
+
+func (t *Tui) start(item *tuiItem) {
+	fail := func(err error) {
+		t.mu.Lock()
+		item.state = StateFailed
+		item.err = err
+		t.mu.Unlock()
+		t.notify(item, EventFailed)
+		t.schedule()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(item.path), 0755); err != nil {
+		fail(err)
+		return
+	}
+	if t.Backups != nil {
+		if _, err := t.Backups.Save(item.path, item.url); err != nil {
+			fail(err)
+			return
+		}
+	}
+	stream, err := os.Create(item.path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	file, err := New(item.url, stream, t.Options...)
+	if err != nil {
+		stream.Close()
+		fail(err)
+		return
+	}
+
+	file.OnStart = func() {}
+	file.OnResume = func() {}
+	file.OnPause = func() {
+		t.mu.Lock()
+		if item.state == StateDownloading {
+			item.state = StatePaused
+		}
+		t.mu.Unlock()
+	}
+	file.OnFinish = func() {
+		stream.Close()
+		t.mu.Lock()
+		item.state = StateFinished
+		t.mu.Unlock()
+		t.notify(item, EventFinished)
+		t.schedule()
+	}
+	file.OnError = func(errCode int, err error) {
+		t.mu.Lock()
+		item.err = err
+		t.mu.Unlock()
+		if errCode == ErrDownload {
+			stream.Close()
+			fail(err)
+		}
+	}
+
+	t.mu.Lock()
+	item.file = file
+	canceled := item.state == StateCanceled
+	t.mu.Unlock()
+	if canceled {
+		file.Cancel()
+		return
+	}
+	file.Start()
+}
+
+func (t *Tui) notify(item *tuiItem, typ string) {
+	if t.Events == nil {
+		return
+	}
+	e := Event{Type: typ, Url: item.url, Path: item.path}
+	if item.file != nil {
+		e.Size = item.file.Size
+		e.Downloaded = item.file.Progress().Downloaded
+	}
+	if item.err != nil {
+		e.Error = item.err.Error()
+	}
+	t.Events.Dispatch(e)
+}
+
+func (t *Tui) finished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Keep {
+		return false
+	}
+	for _, item := range t.items {
+		switch item.state {
+		case StateQueued, StateDownloading, StatePaused:
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Tui) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	for _, item := range t.items {
+		switch item.state {
+		case StateFailed:
+			return item.err
+		case StateFinished:
+		default:
+			err = ErrCanceled
+		}
+	}
+	return err
+}
+
+func (t *Tui) Summaries() []Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var summaries []Summary
+	for i, item := range t.items {
+		s := Summary{Url: item.url, State: item.state}
+		if item.file != nil {
+			s = item.file.Summary()
+		}
+		s.Id, s.Path, s.State = i+1, item.path, item.state
+		if item.err != nil && item.state != StateFinished {
+			s.Error = item.err.Error()
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+func (t *Tui) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Json {
+		enc := json.NewEncoder(t.Out)
+		for i, item := range t.items {
+			var p = Progress{Url: item.url}
+			if item.file != nil {
+				p = item.file.Progress()
+			}
+			p.Id = i
+			p.State = item.state
+			enc.Encode(p)
+		}
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	for i, item := range t.items {
+		cursor := " "
+		if i == t.selected {
+			cursor = ">"
+		}
+		var p = Progress{Total: -1}
+		if item.file != nil {
+			p = item.file.Progress()
+		}
+		fmt.Fprintf(&b, "%s %-24.24s %s %9s/s  %s %-8s %s\r\n",
+			cursor, filepath.Base(item.path), progressBar(p, 30),
+			FormatBytes(p.Speed), tr("ETA"), formatETA(p.Total-p.Downloaded, p.Speed), tr(item.state))
+		if item.err != nil && item.state != StateFinished {
+			fmt.Fprintf(&b, "    %s\r\n", trError(item.err.Error()))
+		}
+	}
+	if len(t.pending) > 0 {
+		fmt.Fprintf(&b, "\r\n%s\r\n", trf("Add %s from the clipboard? [a] add  [x] ignore", t.pending[0]))
+	}
+	fmt.Fprintf(&b, "\r\n%s\r\n", tr("[j/k] select  [p] pause/resume  [c] cancel  [+/-] priority  [q] quit"))
+	io.WriteString(t.Out, b.String())
+}
+
+func progressBar(p Progress, width int) string {
+	if p.Total <= 0 {
+		return "[" + strings.Repeat("?", width) + "] " + FormatBytes(p.Downloaded)
+	}
+	return fmt.Sprintf("[%s] %3d%%", blockMap(p.Blocks, p.Total, width), min(p.Downloaded*100/p.Total, 100))
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatETA(remaining, speed int64) string {
+	if speed <= 0 || remaining <= 0 {
+		return "-"
+	}
+	return (time.Duration(remaining/speed) * time.Second).String()
+}
+
+func rawTerminal() func() {
+	state, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return func() {}
+	}
+	return func() {
+		stty(strings.TrimSpace(state))
+	}
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var ErrUnexpectedContent = errors.New("unexpected response content")
+
+func WithContentTypes(patterns ...string) Option {
+	return func(f *File) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid content type pattern %q", pattern)
+			}
+		}
+		f.contentTypes = append(f.contentTypes, patterns...)
+		return nil
+	}
+}
+
+func WithRejectHTML() Option {
+	return func(f *File) error {
+		f.rejectHTML = true
+		return nil
+	}
+}
+
+func matchesContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *File) validateResponse(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if len(f.contentTypes) > 0 && !matchesContentType(f.contentTypes, mediaType) {
+		return fmt.Errorf("%w: content type %q does not match %s", ErrUnexpectedContent, mediaType, strings.Join(f.contentTypes, ", "))
+	}
+	if !f.rejectHTML || matchesContentType(f.contentTypes, "text/html") {
+		return nil
+	}
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		return fmt.Errorf("%w: the server sent an HTML page", ErrUnexpectedContent)
+	}
+	if contentEncoding(resp) != "" {
+		return nil
+	}
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(resp.Body, buf)
+	if strings.HasPrefix(http.DetectContentType(buf[:n]), "text/html") {
+		return fmt.Errorf("%w: the response looks like an HTML page", ErrUnexpectedContent)
+	}
+	return nil
+}
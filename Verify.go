@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const checksumXattr = "user.checksum.sha256"
+
+var ErrNoChecksum = errors.New("no checksum to verify against, pass --checksum or download with -xattr-checksum")
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// VerifyFile hashes path and compares it with want, algorithm:hex with a
+// registered algorithm or the hex of a SHA-256, or without want the SHA-256
+// stored by -xattr-checksum. It returns the hex digest of the file.
+func VerifyFile(path, want string, progress func(done, total int64)) (string, error) {
+	if want == "" {
+		stored, err := getXattr(path, checksumXattr)
+		if err != nil || stored == "" {
+			return "", ErrNoChecksum
+		}
+		want = stored
+	}
+	expected, err := parseDigest(want)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	r := &countingReader{r: file}
+	stop, stopped := make(chan bool), make(chan bool)
+	if progress != nil {
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(200 * time.Millisecond)
+			defer tick.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-tick.C:
+					progress(atomic.LoadInt64(&r.n), info.Size())
+				}
+			}
+		}()
+	}
+	h := expected.newHash()
+	_, err = io.Copy(h, r)
+	close(stop)
+	if progress != nil {
+		<-stopped
+		progress(atomic.LoadInt64(&r.n), info.Size())
+	}
+	if err != nil {
+		return "", err
+	}
+	got := h.Sum(nil)
+	sum := hex.EncodeToString(got)
+	if !bytes.Equal(got, expected.want) {
+		return sum, fmt.Errorf("%w: got %s %s, want %x", ErrChecksumMismatch, expected.name, sum, expected.want)
+	}
+	return sum, nil
+}
+
+func RunVerify(args []string, checksum string, quiet bool, out io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: cdm verify file [--checksum algorithm:hex | --sample [--url url] [--sample-rate 1%]]")
+		return ExitUsage
+	}
+	var path, url string
+	var sample bool
+	rate := SampleRate
+	for ; len(args) > 0; args = args[1:] {
+		switch opt := args[0]; {
+		case (opt == "--checksum" || opt == "-checksum") && len(args) > 1:
+			checksum, args = args[1], args[1:]
+		case opt == "--sample" || opt == "-sample":
+			sample = true
+		case (opt == "--url" || opt == "-url") && len(args) > 1:
+			sample, url, args = true, args[1], args[1:]
+		case (opt == "--sample-rate" || opt == "-sample-rate") && len(args) > 1:
+			var err error
+			if rate, err = parseRate(args[1]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return ExitUsage
+			}
+			sample, args = true, args[1:]
+		case path == "" && !strings.HasPrefix(opt, "-"):
+			path = opt
+		default:
+			return usage()
+		}
+	}
+	if path == "" || sample && checksum != "" {
+		return usage()
+	}
+	if sample && url == "" {
+		if url, _ = getXattr(path, "user.xdg.origin.url"); url == "" {
+			fmt.Fprintln(os.Stderr, "no URL to sample against, pass --url or download with -xattr")
+			return ExitUsage
+		}
+	}
+	if checksum != "" {
+		if _, err := parseDigest(checksum); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+	}
+
+	var progress func(done, total int64)
+	var drawn bool
+	if !quiet {
+		progress = func(done, total int64) {
+			drawn = true
+			p := Progress{Total: total, Downloaded: done, Blocks: []BlockProgress{{Begin: 0, End: total - 1, Downloaded: done}}}
+			fmt.Fprintf(os.Stderr, "\033[2K\r%s %s", progressBar(p, 50), FormatBytes(done))
+		}
+	}
+	var sum string
+	var sampled SampleResult
+	var err error
+	if sample {
+		sampled, err = VerifySample(path, url, rate, progress)
+	} else {
+		sum, err = VerifyFile(path, checksum, progress)
+	}
+	if drawn {
+		fmt.Fprintln(os.Stderr)
+	}
+	switch {
+	case errors.Is(err, ErrNoChecksum):
+		fmt.Fprintln(os.Stderr, trError(err.Error()))
+		return ExitUsage
+	case errors.Is(err, ErrChecksumMismatch):
+		fmt.Fprintln(out, trf("%s: FAILED", path))
+		fmt.Fprintln(os.Stderr, trError(err.Error()))
+		return ExitChecksum
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailure
+	}
+	if sample {
+		fmt.Fprintln(out, trf("%s: OK, %d of %d bytes sampled in %d blocks, %d hashed by the server", path, sampled.Bytes, sampled.Size, sampled.Blocks, sampled.Hashed))
+		return ExitOK
+	}
+	fmt.Fprintf(out, "%s: OK %s\n", path, sum)
+	return ExitOK
+}
+
+// parseRate reads a share as 0.01 or 1%.
+func parseRate(s string) (float64, error) {
+	percent := strings.HasSuffix(s, "%")
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if percent {
+		rate /= 100
+	}
+	if err != nil || rate <= 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid sample rate %q, want a share such as 0.01 or 1%%", s)
+	}
+	return rate, nil
+}
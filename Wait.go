@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ended tells whether a download in state is done with, so that only a
+// retry or a resume starts it again.
+func ended(state string) bool {
+	switch state {
+	case StateFinished, StateFailed, StateCanceled, StateUpToDate, StatePruned:
+		return true
+	}
+	return false
+}
+
+// Wait blocks until download id ends or ctx does, and returns it as it is
+// then. It returns ErrNotFound when the download is removed meanwhile.
+func (m *Manager) Wait(ctx context.Context, id int) (DownloadInfo, error) {
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	// Events are dropped when a subscriber falls behind, so the state is
+	// looked at now and then as well.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		info, err := m.Get(id)
+		if err != nil || ended(info.State) {
+			return info, err
+		}
+		select {
+		case <-ctx.Done():
+			return info, nil
+		case <-events:
+		case <-tick.C:
+		}
+	}
+}
+
+// wait answers GET /downloads/{id}/wait, holding the request until the
+// download ends or the timeout of the query, 60s by default, passes. Either
+// way it answers with the download, whose state tells which.
+func (d *Daemon) wait(w http.ResponseWriter, r *http.Request, id int) {
+	timeout := time.Minute
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid timeout "+s))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	info, err := d.Manager.Wait(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	EventStuck = "stuck"
+
+	StuckCancel = "cancel"
+	StuckPause  = "pause"
+)
+
+var (
+	ErrMaxLifetime = errors.New("download exceeded its maximum lifetime")
+	ErrNoProgress  = errors.New("download made no progress")
+)
+
+func validStuckAction(action string) bool {
+	switch action {
+	case "", StuckCancel, StuckPause:
+		return true
+	}
+	return false
+}
+
+func (m *Manager) SetTimeouts(id int, maxLifetime, noProgress time.Duration) error {
+	d, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	d.maxLifetime, d.noProgress = maxLifetime, noProgress
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Manager) watch(d *Download, file *File) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	var active, idle time.Duration
+	var last int64 = -1
+	for {
+		select {
+		case <-file.finished:
+			return
+		case <-tick.C:
+		}
+		m.mu.Lock()
+		state, current := d.state, d.file
+		maxLifetime, noProgress, action := d.maxLifetime, d.noProgress, m.config.StuckAction
+		m.mu.Unlock()
+		if current != file || (state != StateDownloading && state != StatePaused) {
+			return
+		}
+		if file.State() != StateDownloading {
+			continue
+		}
+
+		active += time.Second
+		if n := file.Progress().Downloaded; n != last {
+			last, idle = n, 0
+		} else {
+			idle += time.Second
+		}
+		var err error
+		switch {
+		case maxLifetime > 0 && active >= maxLifetime:
+			err = fmt.Errorf("%w of %s", ErrMaxLifetime, maxLifetime)
+		case noProgress > 0 && idle >= noProgress:
+			err = fmt.Errorf("%w for %s", ErrNoProgress, noProgress)
+		default:
+			continue
+		}
+
+		m.mu.Lock()
+		d.err = err
+		m.mu.Unlock()
+		if action == StuckPause {
+			file.Pause()
+			m.publish(d, EventStuck)
+			m.notify(d, EventStuck)
+			active, idle = 0, 0
+			continue
+		}
+		m.Cancel(d.Id)
+		m.publish(d, EventStuck)
+		m.notify(d, EventStuck)
+		return
+	}
+}
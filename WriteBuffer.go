@@ -0,0 +1,89 @@
+package downloader
+
+import (
+	"io"
+	"time"
+)
+
+var (
+	WriteBufferSize     = 256 << 10
+	WriteBufferInterval = time.Second
+)
+
+type blockWriter struct {
+	w        io.WriterAt
+	buf      []byte
+	pos      int64
+	interval time.Duration
+	flushed  time.Time
+	written  func(pos, n int64)
+}
+
+func (f *File) newBlockWriter() *blockWriter {
+	size := f.writeBuffer
+	if _, mapped := f.writer.(*mmapWriter); mapped {
+		size = 0
+	}
+	b := &blockWriter{
+		w:        f.scheduledWriter(f.writer),
+		buf:      make([]byte, 0, size),
+		interval: f.writeInterval,
+		flushed:  time.Now(),
+		written:  f.written,
+	}
+	return b
+}
+
+func (b *blockWriter) WriteAt(p []byte, pos int64) error {
+	if cap(b.buf) == 0 {
+		n, err := b.w.WriteAt(p, pos)
+		b.report(pos, n)
+		if err != nil {
+			return &outputError{pos + int64(n), err}
+		}
+		return nil
+	}
+	if len(b.buf) > 0 && pos != b.pos+int64(len(b.buf)) {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(b.buf) == 0 {
+		b.pos = pos
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], p)
+		b.buf = b.buf[:len(b.buf)+n]
+		p = p[n:]
+		if len(b.buf) == cap(b.buf) {
+			if err := b.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if b.interval > 0 && time.Since(b.flushed) >= b.interval {
+		return b.Flush()
+	}
+	return nil
+}
+
+func (b *blockWriter) Flush() error {
+	b.flushed = time.Now()
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.w.WriteAt(b.buf, b.pos)
+	b.report(b.pos, n)
+	if err != nil {
+		err = &outputError{b.pos + int64(n), err}
+	}
+	b.pos += int64(len(b.buf))
+	b.buf = b.buf[:0]
+	return err
+}
+
+func (b *blockWriter) report(pos int64, n int) {
+	if b.written != nil && n > 0 {
+		b.written(pos, int64(n))
+	}
+}
@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+// The README compares the output modes by filling a 1 GiB file in 1 KiB
+// reads, as a connection does with a slow response:
+//
+//	go test -run '^$' -bench Fill -benchtime 3x
+const (
+	fillSize = 1 << 30
+	fillRead = 1 << 10
+)
+
+// benchmarkFill writes fillSize bytes through a blockWriter with a buffer
+// of buffer bytes, into the file or, with mmap, its mapping.
+func benchmarkFill(b *testing.B, buffer int, mmap bool) {
+	read := downloadertest.RandomData(fillRead, 1)
+	b.SetBytes(fillSize)
+	for range b.N {
+		out, err := os.Create(filepath.Join(b.TempDir(), "file"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var w io.WriterAt = out
+		var mapping *mmapWriter
+		if mmap {
+			if mapping, err = mapFile(out, fillSize); err != nil {
+				b.Skip(err)
+			}
+			w = mapping
+		}
+		writer := &blockWriter{w: w, buf: make([]byte, 0, buffer), interval: WriteBufferInterval}
+		for pos := int64(0); pos < fillSize; pos += fillRead {
+			if err := writer.WriteAt(read, pos); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		if mapping != nil {
+			mapping.Close()
+		}
+		out.Close()
+	}
+}
+
+func BenchmarkFillUnbuffered(b *testing.B) { benchmarkFill(b, 0, false) }
+
+func BenchmarkFillWriteBuffer(b *testing.B) { benchmarkFill(b, WriteBufferSize, false) }
+
+func BenchmarkFillMmap(b *testing.B) { benchmarkFill(b, 0, true) }
+
+func TestBlockWriter(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	var reported int64
+	writer := &blockWriter{w: out, buf: make([]byte, 0, 8), written: func(pos, n int64) { reported += n }}
+	for _, write := range []struct {
+		pos  int64
+		data string
+	}{{0, "abc"}, {3, "defgh"}, {8, "ij"}, {20, "xy"}} {
+		if err := writer.WriteAt([]byte(write.data), write.pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcdefghij" + string(make([]byte, 10)) + "xy"; string(got) != want {
+		t.Fatalf("wrote %q, want %q", got, want)
+	}
+	if reported != 12 {
+		t.Fatalf("reported %d bytes written, want 12", reported)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package downloader
+
+import (
+	"errors"
+	"runtime"
+)
+
+func setXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on " + runtime.GOOS)
+}
+
+func getXattr(path, name string) (string, error) {
+	return "", errors.New("extended attributes are not supported on " + runtime.GOOS)
+}
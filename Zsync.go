@@ -0,0 +1,249 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrNoDelta = errors.New("delta download not possible")
+
+type zsyncControl struct {
+	Blocksize     int
+	Length        int64
+	RsumBytes     int
+	ChecksumBytes int
+	SHA1          string
+
+	rsums     []uint32
+	checksums [][]byte
+}
+
+type Delta struct {
+	Blocks          int   `json:"blocks"`
+	ReusedBlocks    int   `json:"reused_blocks"`
+	ReusedBytes     int64 `json:"reused_bytes"`
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+}
+
+func parseZsync(b []byte) (*zsyncControl, error) {
+	header, body, ok := bytes.Cut(b, []byte("\n\n"))
+	if !ok {
+		return nil, errors.New("zsync control file has no block checksums")
+	}
+	c := &zsyncControl{Blocksize: 2048, RsumBytes: 4, ChecksumBytes: 16, Length: -1}
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "Blocksize":
+			c.Blocksize, err = strconv.Atoi(value)
+		case "Length":
+			c.Length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			parts := strings.Split(value, ",")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("invalid zsync Hash-Lengths %q", value)
+			}
+			if c.RsumBytes, err = strconv.Atoi(parts[1]); err == nil {
+				c.ChecksumBytes, err = strconv.Atoi(parts[2])
+			}
+		case "SHA-1":
+			c.SHA1 = strings.ToLower(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid zsync %s: %w", key, err)
+		}
+	}
+	if c.Blocksize <= 0 || c.Length < 0 || c.RsumBytes < 1 || c.RsumBytes > 4 || c.ChecksumBytes < 1 || c.ChecksumBytes > 16 {
+		return nil, errors.New("invalid zsync control file header")
+	}
+	blocks := int((c.Length + int64(c.Blocksize) - 1) / int64(c.Blocksize))
+	entry := c.RsumBytes + c.ChecksumBytes
+	if len(body) < blocks*entry {
+		return nil, errors.New("zsync control file is truncated")
+	}
+	for i := 0; i < blocks; i++ {
+		e := body[i*entry : (i+1)*entry]
+		var rsum [4]byte
+		copy(rsum[4-c.RsumBytes:], e[:c.RsumBytes])
+		c.rsums = append(c.rsums, binary.BigEndian.Uint32(rsum[:]))
+		c.checksums = append(c.checksums, e[c.RsumBytes:])
+	}
+	return c, nil
+}
+
+func (c *zsyncControl) mask() uint32 {
+	return uint32(uint64(1)<<(8*c.RsumBytes) - 1)
+}
+
+func rsum(block []byte) (a, b uint16) {
+	n := len(block)
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(n-i) * uint16(c)
+	}
+	return a, b
+}
+
+func (c *zsyncControl) match(local io.Reader, out io.WriterAt) ([]bool, int64, error) {
+	bs := c.Blocksize
+	have := make([]bool, len(c.rsums))
+	index := map[uint32][]int{}
+	for i, r := range c.rsums {
+		index[r] = append(index[r], i)
+	}
+
+	var reused int64
+	r := bufio.NewReaderSize(local, 1<<20)
+	window := make([]byte, bs)
+	fill := func() bool {
+		_, err := io.ReadFull(r, window)
+		return err == nil
+	}
+	if !fill() {
+		return have, 0, nil
+	}
+	a, b := rsum(window)
+	start := 0
+	block := make([]byte, bs)
+	for {
+		if ids, ok := index[(uint32(a)<<16|uint32(b))&c.mask()]; ok {
+			n := copy(block, window[start:])
+			copy(block[n:], window[:start])
+			sum := md4(block)
+			var matched bool
+			for _, id := range ids {
+				if have[id] || !bytes.Equal(sum[:c.ChecksumBytes], c.checksums[id]) {
+					continue
+				}
+				size := min(int64(bs), c.Length-int64(id)*int64(bs))
+				if _, err := out.WriteAt(block[:size], int64(id)*int64(bs)); err != nil {
+					return nil, 0, err
+				}
+				have[id], matched = true, true
+				reused += size
+			}
+			if matched {
+				if !fill() {
+					break
+				}
+				a, b = rsum(window)
+				start = 0
+				continue
+			}
+		}
+		next, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		old := window[start]
+		window[start] = next
+		start = (start + 1) % bs
+		a += uint16(next) - uint16(old)
+		b += a - uint16(bs)*uint16(old)
+	}
+	return have, reused, nil
+}
+
+func (c *zsyncControl) missing(have []bool) []Block {
+	var blocks []Block
+	bs := int64(c.Blocksize)
+	for i := 0; i < len(have); i++ {
+		if have[i] {
+			continue
+		}
+		j := i
+		for j+1 < len(have) && !have[j+1] {
+			j++
+		}
+		begin, end := int64(i)*bs, min(int64(j+1)*bs, c.Length)-1
+		blocks = append(blocks, Block{Begin: begin, End: end, start: begin})
+		i = j
+	}
+	return blocks
+}
+
+func ZsyncUpdate(ctx context.Context, url, controlUrl, seed, path string, opts ...Option) (Delta, error) {
+	b, err := DownloadBytes(ctx, controlUrl, opts...)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == 404 {
+		return Delta{}, fmt.Errorf("%w: %s not found", ErrNoDelta, controlUrl)
+	}
+	if err != nil {
+		return Delta{}, err
+	}
+	c, err := parseZsync(b)
+	if err != nil {
+		return Delta{}, fmt.Errorf("%w: %v", ErrNoDelta, err)
+	}
+
+	local, err := os.Open(seed)
+	if err != nil {
+		return Delta{}, fmt.Errorf("%w: %v", ErrNoDelta, err)
+	}
+	defer local.Close()
+	part, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".zsync-*")
+	if err != nil {
+		return Delta{}, err
+	}
+	defer os.Remove(part.Name())
+	defer part.Close()
+	if info, err := local.Stat(); err == nil {
+		part.Chmod(info.Mode())
+	}
+
+	have, reused, err := c.match(local, part)
+	if err != nil {
+		return Delta{}, err
+	}
+	missing := c.missing(have)
+	delta := Delta{Blocks: len(have), ReusedBytes: reused, DownloadedBytes: c.Length - reused}
+	for _, h := range have {
+		if h {
+			delta.ReusedBlocks++
+		}
+	}
+
+	if len(missing) > 0 {
+		f, err := New(url, part, append([]Option{withRanges(missing)}, opts...)...)
+		if err != nil {
+			return delta, err
+		}
+		if f.Size != c.Length || f.noRanges {
+			return delta, fmt.Errorf("%w: the control file does not describe the remote file", ErrNoDelta)
+		}
+		f.status.Downloaded = reused
+		if err := f.Run(ctx); err != nil {
+			return delta, err
+		}
+	}
+	if err := part.Truncate(c.Length); err != nil {
+		return delta, err
+	}
+	if c.SHA1 != "" {
+		h := sha1.New()
+		if _, err := io.Copy(h, io.NewSectionReader(part, 0, c.Length)); err != nil {
+			return delta, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != c.SHA1 {
+			return delta, ErrChecksumMismatch
+		}
+	}
+	if err := part.Close(); err != nil {
+		return delta, err
+	}
+	local.Close()
+	return delta, os.Rename(part.Name(), path)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+	"github.com/rasoulkhaksari/Concurrent_Download_Manager/downloadertest"
+)
+
+// dataChecker is where bench downloads go: it counts the writes that
+// differ from the data served instead of keeping them.
+type dataChecker struct {
+	data    []byte
+	corrupt int64
+}
+
+func (c *dataChecker) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(c.data)) || !bytes.Equal(p, c.data[off:off+int64(len(p))]) {
+		atomic.AddInt64(&c.corrupt, 1)
+	}
+	return len(p), nil
+}
+
+func runBench(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	size := fs.String("size", "64M", "size of the file served")
+	latency := fs.Duration("latency", 20*time.Millisecond, "delay before the server answers each request")
+	bandwidth := fs.String("bandwidth", "8M", "bytes/s the server sends per connection (0 means unlimited)")
+	errorRate := fs.Float64("error-rate", 0, "fraction of requests answered with 500 Internal Server Error")
+	counts := fs.String("connections", "1,2,4,8,16", "comma-separated connection counts to measure")
+	if err := fs.Parse(args); err != nil {
+		return downloader.ExitUsage
+	}
+	fileSize, err := downloader.ParseBytes(*size)
+	if err != nil || fileSize == 0 {
+		fmt.Fprintf(os.Stderr, "invalid size %q\n", *size)
+		return downloader.ExitUsage
+	}
+	rate, err := downloader.ParseBytes(*bandwidth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid bandwidth %q\n", *bandwidth)
+		return downloader.ExitUsage
+	}
+	var connections []int
+	for _, s := range strings.Split(*counts, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "invalid connection count %q\n", s)
+			return downloader.ExitUsage
+		}
+		connections = append(connections, n)
+	}
+
+	opts := []downloadertest.Option{downloadertest.WithLatency(*latency)}
+	if rate > 0 {
+		opts = append(opts, downloadertest.WithBandwidth(rate))
+	}
+	if *errorRate > 0 {
+		opts = append(opts, downloadertest.WithErrorRate(*errorRate, http.StatusInternalServerError))
+	}
+	data := downloadertest.RandomData(int(fileSize), 1)
+	origin := downloadertest.NewOrigin(data, opts...)
+	defer origin.Close()
+
+	limit := "unlimited"
+	if rate > 0 {
+		limit = downloader.FormatBytes(rate) + "/s"
+	}
+	fmt.Fprintf(out, "%s random file, %s latency, %s per connection, %.1f%% errors\n\n", downloader.FormatBytes(fileSize), *latency, limit, *errorRate*100)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "connections\ttime\tthroughput\trequests\tretries\tresult\t")
+	exit := downloader.ExitOK
+	for _, n := range connections {
+		before := len(origin.Requests())
+		checker := &dataChecker{data: data}
+		start := time.Now()
+		result := "ok"
+		var retries int64
+		f, err := downloader.New(origin.URL, nil, downloader.WithWriterAt(checker), downloader.WithConnections(n), downloader.WithMinSplitSize(64<<10))
+		if err == nil {
+			err = f.Run(context.Background())
+			retries = f.Summary().Retries
+		}
+		elapsed := time.Since(start)
+		switch {
+		case err != nil:
+			result, exit = err.Error(), downloader.ExitFailure
+		case checker.corrupt > 0:
+			result, exit = "corrupt", downloader.ExitChecksum
+		}
+		fmt.Fprintf(tw, "%d\t%.2fs\t%s/s\t%d\t%d\t%s\t\n", n, elapsed.Seconds(), downloader.FormatBytes(int64(float64(fileSize)/elapsed.Seconds())), len(origin.Requests())-before, retries, result)
+	}
+	tw.Flush()
+	return exit
+}
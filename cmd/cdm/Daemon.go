@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+// runDaemon serves the REST API of a download manager until it is stopped.
+func runDaemon(opts []downloader.Option, events *downloader.Dispatcher, backups *downloader.Backups) int {
+	var serviceStop <-chan struct{}
+	if *asService {
+		stop, finish, err := startService("cdm")
+		if err != nil {
+			slog.Error("can not start the service", "err", err)
+			return downloader.ExitFailure
+		}
+		defer finish()
+		serviceStop = stop
+	}
+	m, err := newManager(opts, events, backups)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	audit, err := downloader.OpenAuditLog(*auditLog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	defer audit.Close()
+	daemon := downloader.NewDaemon(m)
+	daemon.Audit = audit
+	exit := make(chan struct{}, 1)
+	daemon.Exit = func() {
+		select {
+		case exit <- struct{}{}:
+		default:
+		}
+	}
+	var handler http.Handler = daemon
+	if *apiKeys != "" {
+		keys, err := downloader.LoadAPIKeys(*apiKeys)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+		handler = downloader.RequireAPIKeys(handler, keys)
+	}
+	handler = downloader.GuardRequests(handler, allowHosts, allowOrigins)
+	handler = audit.Audit(handler)
+	server := &http.Server{Handler: handler, ConnContext: downloader.MarkLocal}
+	server.RegisterOnShutdown(daemon.Close)
+	listeners, err := systemdListeners()
+	if err != nil {
+		slog.Error("daemon failed", "err", err)
+		return downloader.ExitCode(err)
+	}
+	if len(listeners) > 0 {
+		*listen, *socket = "", ""
+	}
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			slog.Error("daemon failed", "err", err)
+			return downloader.ExitCode(err)
+		}
+		listeners = append(listeners, l)
+	}
+	if *socket != "" {
+		l, err := downloader.ListenUnix(*socket)
+		if err != nil {
+			slog.Error("daemon failed", "err", err)
+			return downloader.ExitCode(err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		fmt.Fprintln(os.Stderr, "the daemon needs -listen or -socket")
+		return downloader.ExitUsage
+	}
+	for _, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && *apiKeys == "" && !addr.IP.IsLoopback() {
+			slog.Warn("the daemon API is open to other hosts without a key, see -api-keys", "addr", addr.String())
+		}
+	}
+	if *tlsOn || *tlsCert != "" || *tlsKey != "" {
+		host, _, _ := net.SplitHostPort(*listen)
+		tlsConfig, fingerprint, err := downloader.DaemonTLS(*tlsCert, *tlsKey, host)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+		for i, l := range listeners {
+			if _, ok := l.Addr().(*net.TCPAddr); ok {
+				listeners[i] = tls.NewListener(l, tlsConfig)
+			}
+		}
+		slog.Info("daemon serving TLS", "sha256", fingerprint)
+	}
+	if err := startIntakes(m); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	stopped := make(chan struct{})
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-interrupt:
+		case <-serviceStop:
+		case <-exit:
+		}
+		sdNotify("STOPPING=1")
+		if *drainTimeout > 0 {
+			// The API stays up while draining, /readyz failing, so that
+			// the pod is taken out of its service first.
+			ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+			report := m.Drain(ctx)
+			cancel()
+			slog.Info("daemon drained", "waited", report.Waited, "ended", len(report.Ended), "paused", len(report.Paused))
+		}
+		server.Shutdown(context.Background())
+		m.Stop()
+		close(stopped)
+	}()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		slog.Info("daemon listening", "addr", l.Addr().String())
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	if *openUI {
+		scheme := "http"
+		if *tlsOn || *tlsCert != "" {
+			scheme = "https"
+		}
+		if *listen == "" {
+			slog.Warn("the web panel needs -listen")
+		} else if err := downloader.OpenBrowser(scheme + "://" + *listen + "/ui"); err != nil {
+			slog.Warn("can not open the web panel", "err", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sdWatchdog(ctx)
+	sdNotify("READY=1")
+	if err := <-errs; err != http.ErrServerClosed {
+		server.Close()
+		slog.Error("daemon failed", "err", err)
+		return downloader.ExitCode(err)
+	}
+	<-stopped
+	return downloader.ExitOK
+}
+
+// daemonConfig is the configuration of the manager from the flags and the
+// -config file.
+func daemonConfig() (downloader.Config, error) {
+	config := downloader.Config{
+		Concurrency:      *jobs,
+		Connections:      *connections,
+		RateLimit:        *limitRate,
+		TotalRateLimit:   *totalRate,
+		TotalConnections: *totalConns,
+		MemoryBudget:     *memoryBudget,
+		Duplicates:       *duplicates,
+		MaxLifetime:      int(*maxLifetime / time.Second),
+		NoProgress:       int(*noProgress / time.Second),
+		StuckAction:      *stuckAction,
+		NoExtension:      *noExtension,
+		PathTemplate:     *pathTemplate,
+		DataDirs:         dataDirs,
+		Placement:        *placement,
+		Post:             posts,
+		Coalesce:         *coalesce,
+	}
+	for _, s := range routes {
+		route, err := downloader.ParseRoute(s)
+		if err != nil {
+			return config, err
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	for _, s := range domains {
+		rule, err := downloader.ParseDomainRule(s)
+		if err != nil {
+			return config, err
+		}
+		config.Domains = append(config.Domains, rule)
+	}
+	for _, s := range quotas {
+		quota, err := downloader.ParseQuota(s)
+		if err != nil {
+			return config, err
+		}
+		config.Quotas = append(config.Quotas, quota)
+	}
+	for _, s := range tenants {
+		tenant, err := downloader.ParseTenant(s)
+		if err != nil {
+			return config, err
+		}
+		config.Tenants = append(config.Tenants, tenant)
+	}
+	if *configFile != "" {
+		if err := downloader.LoadConfig(*configFile, &config); err != nil {
+			return config, err
+		}
+	}
+	return config, config.Validate()
+}
+
+// newManager is the manager of the daemon, with the downloads of -input
+// queued.
+func newManager(opts []downloader.Option, events *downloader.Dispatcher, backups *downloader.Backups) (*downloader.Manager, error) {
+	config, err := daemonConfig()
+	if err != nil {
+		return nil, err
+	}
+	m := downloader.NewManager(*dir, config)
+	m.Options = opts
+	m.Events = events
+	m.Backups = backups
+	if *inputFile != "" {
+		input, err := os.Open(*inputFile)
+		if err != nil {
+			return nil, err
+		}
+		_, err = m.AddInput(input)
+		input.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// startIntakes watches the clipboard and the MQTT topic for downloads to add
+// to m, as the flags ask.
+func startIntakes(m *downloader.Manager) error {
+	if *clipboard {
+		watcher, err := downloader.NewClipboardWatcher(clipPatterns, func(url string) {
+			if d, err := m.Add(url, "", ""); err == nil {
+				slog.Info("added download from clipboard", "id", d.Id, "url", url)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := watcher.Run(context.Background()); err != nil {
+				slog.Warn("can not watch the clipboard", "err", err)
+			}
+		}()
+	}
+	if *mqttBroker != "" {
+		intake, err := downloader.NewMQTTIntake(*mqttBroker, *mqttResults, *mqttClientId, m)
+		if err != nil {
+			return err
+		}
+		go intake.Run(context.Background())
+	}
+	return nil
+}
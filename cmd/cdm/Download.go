@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+// runDownload downloads one URL to a file, or relays it with -relay, once
+// -start-at comes.
+func runDownload(opts []downloader.Option, events *downloader.Dispatcher, backups *downloader.Backups) int {
+	if *relayTo != "" && flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cdm -relay target [flags] url")
+		return downloader.ExitUsage
+	}
+	if flag.NArg() != 2 && *relayTo == "" {
+		fmt.Fprintln(os.Stderr, "usage: cdm [flags] url filename")
+		flag.PrintDefaults()
+		return downloader.ExitUsage
+	}
+
+	if *startAt != "" {
+		at, err := downloader.ParseStartAt(*startAt, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+		slog.Info("waiting to start", "at", at)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-ctx.Done():
+			stop()
+			return downloader.ExitCode(downloader.ErrCanceled)
+		case <-time.After(time.Until(at)):
+			stop()
+		}
+	}
+
+	var want string
+	var otherSum bool
+	if *checksum != "" {
+		algorithm, sum, err := downloader.ParseDigest(*checksum)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+		// The cache, the relay and split files go by SHA-256; other
+		// algorithms are checked by the download itself.
+		if algorithm == "sha256" {
+			want = sum
+		} else if *relayTo != "" {
+			fmt.Fprintln(os.Stderr, "-relay checks a SHA-256 -checksum only")
+			return downloader.ExitUsage
+		} else {
+			otherSum = true
+			opts = append(opts, downloader.WithChecksum(algorithm, sum))
+		}
+	}
+	if *relayTo != "" {
+		return runRelay(opts, want)
+	}
+	return runFile(opts, want, otherSum, events, backups)
+}
+
+// runRelay sends the download on to -relay instead of writing it, checking
+// its SHA-256 against want.
+func runRelay(opts []downloader.Option, want string) int {
+	buffer := downloader.RelayBuffer
+	if *relayBuffer != "" {
+		var err error
+		if buffer, err = downloader.ParseBytes(*relayBuffer); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -relay-buffer %q\n", *relayBuffer)
+			return downloader.ExitUsage
+		}
+	}
+	relay, err := downloader.NewRelay(*relayTo, buffer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	file, sum, err := downloader.RelayDownload(ctx, flag.Arg(0), relay, want, opts...)
+	if err != nil {
+		slog.Error("relay failed", "url", flag.Arg(0), "to", relay.Target(), "err", err)
+	} else {
+		slog.Info("relayed", "url", flag.Arg(0), "to", relay.Target(), "sha256", sum)
+	}
+	if file != nil && (!*quiet || *summary == downloader.SummaryJSON) {
+		s := file.Summary()
+		s.Id, s.Path = 1, relay.Target()
+		downloader.NewReport([]downloader.Summary{s}).Write(os.Stdout, *summary)
+	}
+	return downloader.ExitCode(err)
+}
+
+// runFile downloads the URL to the file, or to stdout as "-", reusing the
+// cache, the seed or the zsync blocks it can, and runs the -post steps.
+func runFile(opts []downloader.Option, want string, otherSum bool, events *downloader.Dispatcher, backups *downloader.Backups) int {
+	pipeline, err := downloader.ParsePipeline(posts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	var cache *downloader.Cache
+	if *cacheDir != "" {
+		if cache, err = downloader.NewCache(*cacheDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+	}
+
+	var progressOut io.Writer = os.Stdout
+	path := flag.Arg(1)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(*dir, path)
+	}
+
+	base := path
+	if *seed != "" {
+		base = *seed
+	}
+	if _, err := os.Stat(base); (*zsync || *zsyncUrl != "") && err == nil {
+		if code, done := runZsync(base, path, opts); done {
+			return code
+		}
+	}
+	toStdout := flag.Arg(1) == "-"
+	if info, err := os.Stat(path); *newer && !toStdout && err == nil {
+		_, err := downloader.Inspect(flag.Arg(0), append(opts, downloader.WithIfNewer(info.ModTime(), downloader.LoadETag(path)))...)
+		if errors.Is(err, downloader.ErrUpToDate) {
+			slog.Info("destination is up to date, skipping", "path", path)
+			if *progress == "json" {
+				json.NewEncoder(progressOut).Encode(downloader.Progress{Url: flag.Arg(0), Downloaded: info.Size(), Total: info.Size(), State: downloader.StateUpToDate})
+			}
+			return downloader.ExitOK
+		}
+	}
+	var chunkSize int64
+	if *splitSize != "" {
+		if chunkSize, err = downloader.ParseBytes(*splitSize); err != nil || chunkSize <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -split-size %q\n", *splitSize)
+			return downloader.ExitUsage
+		}
+		if toStdout || *resume || *seed != "" || *teeTo != "" || *mmap || *existing != downloader.ExistsOverwrite {
+			fmt.Fprintln(os.Stderr, "-split-size can not be combined with writing to stdout, -c, -existing, -seed, -tee or -mmap")
+			return downloader.ExitUsage
+		}
+		cache = nil
+	}
+	if otherSum && (toStdout || chunkSize > 0) {
+		fmt.Fprintln(os.Stderr, "only a SHA-256 -checksum can be checked when writing to stdout or -split-size")
+		return downloader.ExitUsage
+	}
+	if *encryptParts && (toStdout || chunkSize > 0 || *seed != "" || *teeTo != "" || *mmap) {
+		fmt.Fprintln(os.Stderr, "-encrypt-parts can not be combined with writing to stdout, -split-size, -seed, -tee or -mmap")
+		return downloader.ExitUsage
+	}
+	saveResume, loadResume := downloader.SaveResume, downloader.LoadResume
+	var part *downloader.EncryptedPart
+	var destination *os.File
+	if chunkSize > 0 {
+		var chunks *downloader.ChunkWriter
+		if chunks, err = downloader.NewChunkWriter(path, chunkSize); err == nil {
+			defer chunks.Close()
+			opts = append(opts, downloader.WithWriterAt(chunks))
+		}
+	} else if toStdout {
+		progressOut = os.Stderr
+		destination, err = os.CreateTemp("", "cdm-*")
+		if err == nil {
+			path = destination.Name()
+			defer os.Remove(path)
+		}
+	} else {
+		if *resume || *seed != "" {
+			*existing = downloader.ExistsContinue
+		}
+		if backups != nil && (*existing == "" || *existing == downloader.ExistsOverwrite) {
+			if backup, err := backups.Save(path, flag.Arg(0)); err != nil {
+				slog.Error("can not back up the destination", "path", path, "err", err)
+				return downloader.ExitFailure
+			} else if backup != "" {
+				slog.Info("moved the existing destination to the backup directory", "path", path, "backup", backup)
+			}
+		}
+		destination, path, err = downloader.OpenDestination(path, *existing)
+		if errors.Is(err, downloader.ErrSkipped) {
+			slog.Info("destination exists, skipping", "path", path)
+			return downloader.ExitOK
+		}
+		if err == nil && *encryptParts {
+			if part, err = downloader.OpenEncryptedPart(downloader.PartPath(path), *partKey, *existing == downloader.ExistsContinue); err == nil {
+				defer part.Close()
+				saveResume, loadResume = part.SaveResume, part.LoadResume
+				opts = append(opts, downloader.WithWriterAt(part))
+			}
+		}
+		if err == nil && *existing == downloader.ExistsContinue {
+			state, err := loadResume(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("ignoring resume file", "path", downloader.ResumePath(path), "err", err)
+			}
+			opts = append(opts, downloader.WithResumeState(state))
+		}
+	}
+	if err != nil {
+		slog.Error("can not create destination", "path", path, "err", err)
+		return downloader.ExitCode(err)
+	}
+	defer destination.Close()
+	if *seed != "" {
+		if err := downloader.CopySeed(*seed, destination); err != nil {
+			slog.Error("can not use seed", "path", *seed, "err", err)
+			return downloader.ExitCode(err)
+		}
+		opts = append(opts, downloader.WithSeed())
+	}
+	var teeCmd *downloader.TeeCommand
+	switch *teeTo {
+	case "":
+	case "-":
+		if toStdout {
+			fmt.Fprintln(os.Stderr, "-tee - can not be combined with writing the file to stdout")
+			return downloader.ExitUsage
+		}
+		progressOut = os.Stderr
+		opts = append(opts, downloader.WithTee(struct{ io.Writer }{os.Stdout}))
+	default:
+		if teeCmd, err = downloader.StartTeeCommand(*teeTo); err != nil {
+			slog.Error("can not start tee command", "command", *teeTo, "err", err)
+			return downloader.ExitFailure
+		}
+		defer func() {
+			teeCmd.Close()
+			teeCmd.Wait()
+		}()
+		opts = append(opts, downloader.WithTee(teeCmd))
+	}
+
+	stream := destination
+	if part != nil {
+		stream = nil
+	}
+	if !toStdout && chunkSize == 0 {
+		opts = append(opts, downloader.WithPauseState(func(state downloader.ResumeState) error { return saveResume(path, state) }))
+	}
+	file, err := downloader.New(flag.Arg(0), stream, append(opts, downloader.WithMirrors(mirrorUrls...))...)
+	if err != nil {
+		slog.Error("can not probe url", "url", flag.Arg(0), "err", err)
+		return downloader.ExitCode(err)
+	}
+	if want == "" {
+		want = file.ServerSHA256()
+	}
+	if cache != nil && want != "" && cache.Has(want) {
+		slog.Info("found in cache", "url", file.Url, "sha256", want)
+		if toStdout {
+			cached, err := cache.Open(want)
+			if err == nil {
+				_, err = io.Copy(os.Stdout, cached)
+				cached.Close()
+			}
+			return downloader.ExitCode(err)
+		}
+		destination.Close()
+		if err := cache.Link(want, path); err != nil {
+			slog.Error("can not copy from cache", "path", path, "err", err)
+			return downloader.ExitCode(err)
+		}
+		return downloader.ExitOK
+	}
+	if !toStdout && chunkSize == 0 {
+		if err := saveResume(path, downloader.ResumeState{Version: downloader.ResumeVersion, Url: file.Url, ETag: file.ETag, Size: file.Size}); err != nil {
+			slog.Warn("can not save resume file", "path", downloader.ResumePath(path), "err", err)
+		}
+	}
+
+	result := watch(file, path, progressOut, events)
+	slog.Debug("probed", "url", file.Url, "size", file.Size)
+
+	if err := file.Start(); err != nil {
+		slog.Error("can not start the download", "url", file.Url, "err", err)
+		return downloader.ExitCode(err)
+	}
+	err = <-result
+	if err == nil && file.Size > 0 && file.Progress().Downloaded < file.Size {
+		err = downloader.ErrPartial
+	}
+	if err == nil && part != nil {
+		if err = part.DecryptTo(destination, file.Progress().Downloaded); err == nil {
+			part.Remove()
+		} else {
+			slog.Error("can not decrypt the part file", "path", downloader.PartPath(path), "err", err)
+		}
+	}
+	for _, m := range file.Mirrors() {
+		slog.Info("mirror", "url", m.Url, "bytes", m.Bytes, "speed", m.Speed, "errors", m.Errors, "usable", m.Usable)
+	}
+	if err == nil && want != "" {
+		err = checkSHA256(path, want, chunkSize > 0)
+	}
+	if err == nil && cache != nil && !toStdout {
+		if sum, err := cache.Insert(path); err != nil {
+			slog.Warn("can not add the file to the cache", "path", path, "err", err)
+		} else {
+			slog.Debug("added to cache", "path", path, "sha256", sum)
+		}
+	}
+	if err == nil && len(pipeline) > 0 && !toStdout {
+		out := &downloader.Output{Url: file.Url, Path: path, Events: events}
+		err = pipeline.Run(context.Background(), out, func(s downloader.PipelineStep) {
+			slog.Info("post-processing", "path", out.Path, "step", s.String())
+		})
+		if err != nil {
+			slog.Error("post-processing failed", "path", out.Path, "err", err)
+		}
+	}
+	if teeErr := file.WaitTee(); teeCmd != nil {
+		if cmdErr := teeCmd.Wait(); cmdErr != nil {
+			slog.Error("tee command failed", "command", *teeTo, "err", cmdErr)
+			if err == nil {
+				err = cmdErr
+			}
+		}
+	} else if teeErr != nil {
+		slog.Error("can not write to tee", "err", teeErr)
+		if err == nil {
+			err = teeErr
+		}
+	}
+	writeReport(file, path, progressOut)
+	if err != nil {
+		slog.Error("download incomplete", "path", path, "err", err)
+		if !toStdout && chunkSize == 0 {
+			if err := saveResume(path, file.ResumeState()); err != nil {
+				slog.Warn("can not save resume file", "path", downloader.ResumePath(path), "err", err)
+			}
+		}
+	} else if !toStdout && !*newer && chunkSize == 0 {
+		downloader.RemoveResume(path)
+	} else if toStdout {
+		if _, err = io.Copy(os.Stdout, io.NewSectionReader(destination, 0, file.Progress().Downloaded)); err != nil {
+			slog.Error("can not write to stdout", "err", err)
+		}
+	}
+	return downloader.ExitCode(err)
+}
+
+// runZsync updates path from base downloading only the blocks that changed.
+// It is not done when no delta is possible, and the whole file is to be
+// downloaded.
+func runZsync(base, path string, opts []downloader.Option) (int, bool) {
+	control := *zsyncUrl
+	if control == "" {
+		control = flag.Arg(0) + ".zsync"
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	delta, err := downloader.ZsyncUpdate(ctx, flag.Arg(0), control, base, path, opts...)
+	stop()
+	if errors.Is(err, downloader.ErrNoDelta) {
+		slog.Info("no delta possible, downloading the whole file", "reason", err)
+		return downloader.ExitOK, false
+	}
+	if err != nil {
+		slog.Error("delta update failed", "path", path, "err", err)
+		return downloader.ExitCode(err), true
+	}
+	slog.Info("delta update finished", "path", path, "blocks", delta.Blocks, "reused", delta.ReusedBlocks, "downloaded", delta.DownloadedBytes)
+	return downloader.ExitOK, true
+}
+
+// checkSHA256 fails unless the file at path, or its chunks with -split-size,
+// has the SHA-256 want.
+func checkSHA256(path, want string, chunked bool) error {
+	if !chunked {
+		_, err := downloader.VerifySHA256(path, want)
+		return err
+	}
+	sum, err := downloader.ChunksSHA256(path)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%w: got sha256 %s, want %s", downloader.ErrChecksumMismatch, sum, want)
+	}
+	return nil
+}
+
+// writeReport writes the summary of file and, with -diagnostics, those of
+// its connections and blocks.
+func writeReport(file *downloader.File, path string, progressOut io.Writer) {
+	if !*quiet || *summary == downloader.SummaryJSON {
+		s := file.Summary()
+		s.Id, s.Path = 1, path
+		downloader.NewReport([]downloader.Summary{s}).Write(progressOut, *summary)
+	}
+	if *diagnostics {
+		if *summary == downloader.SummaryJSON {
+			json.NewEncoder(progressOut).Encode(file.Diagnostics())
+		} else {
+			file.Diagnostics().WriteTo(os.Stderr)
+		}
+	}
+}
+
+// watch reports the progress and the events of file downloading to path, and
+// pauses it on an interrupt. The result of the download is sent on the
+// channel it returns.
+func watch(file *downloader.File, path string, progressOut io.Writer, events *downloader.Dispatcher) <-chan error {
+	var exit = make(chan bool)
+	var result = make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	report := func(p downloader.Progress) {
+		if *progress == "json" {
+			json.NewEncoder(progressOut).Encode(p)
+			return
+		}
+		if *quiet {
+			return
+		}
+		fmt.Fprint(os.Stderr, "\033[2K\r"+p.Line(50))
+	}
+
+	file.OnStart = func() {
+		slog.Info("download started", "url", file.Url, "path", path)
+		tick := time.NewTicker(time.Second * 1)
+		defer tick.Stop()
+		for {
+			select {
+			case <-exit:
+				report(file.Progress())
+				if !*quiet && *progress != "json" {
+					fmt.Fprintln(os.Stderr)
+					if samples := file.SpeedHistory(); len(samples) > 1 {
+						fmt.Fprintln(os.Stderr, downloader.Sparkline(samples, 60))
+					}
+				}
+				slog.Info("download finished", "path", path, "bytes", file.Progress().Downloaded)
+				done(nil)
+				return
+			case <-tick.C:
+				report(file.Progress())
+			}
+		}
+	}
+
+	file.OnPause = func() {
+		slog.Info("download paused", "path", path)
+	}
+
+	file.OnResume = func() {
+		slog.Info("download resumed", "path", path)
+	}
+
+	file.OnFinish = func() {
+		events.Dispatch(downloader.Event{Type: downloader.EventFinished, Url: file.Url, Path: path, Size: file.Size, Downloaded: file.Progress().Downloaded})
+		exit <- true
+	}
+
+	file.OnError = func(errCode int, err error) {
+		if errCode == downloader.ErrBlock {
+			slog.Warn("block failed, retrying", "url", file.Url, "err", err)
+			return
+		}
+		if errCode == downloader.ErrDiskFull {
+			slog.Error("disk full, stopped the download keeping what it wrote", "url", file.Url, "err", err)
+			events.Dispatch(downloader.Event{Type: downloader.EventDiskFull, Url: file.Url, Path: path, Size: file.Size, Downloaded: file.Progress().Downloaded, Error: err.Error()})
+			done(err)
+			return
+		}
+		slog.Error("download failed", "url", file.Url, "err", err)
+		events.Dispatch(downloader.Event{Type: downloader.EventFailed, Url: file.Url, Path: path, Size: file.Size, Downloaded: file.Progress().Downloaded, Error: err.Error()})
+		done(err)
+	}
+
+	file.OnThrottle = func(downloader.ServerLimit) {
+		events.Dispatch(downloader.Event{Type: downloader.EventThrottled, Url: file.Url, Path: path, Size: file.Size, Downloaded: file.Progress().Downloaded})
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		ctx, cancel := context.WithTimeout(context.Background(), downloader.PauseTimeout)
+		report, err := file.PauseContext(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("download did not stop cleanly", "path", path, "err", err)
+		} else {
+			slog.Info("download stopped", "path", path, "bytes", report.Downloaded)
+			events.Dispatch(downloader.Event{Type: downloader.EventPaused, Url: file.Url, Path: path, Size: file.Size, Downloaded: report.Downloaded})
+		}
+		done(downloader.ErrCanceled)
+	}()
+	return result
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+// The flags of the command, shared by its modes.
+var (
+	notify          = flag.Bool("notify", false, "show a desktop notification on completion or failure")
+	webhook         = flag.String("webhook", "", "POST completion and failure events to this URL")
+	webhookTemplate = flag.String("webhook-template", downloader.WebhookJSON, "webhook payload: json, slack, discord or telegram")
+	telegramChat    = flag.String("telegram-chat", "", "chat id for the telegram webhook template")
+	tui             = flag.Bool("tui", false, "download every URL argument in an interactive terminal UI")
+	jobs            = flag.Int("jobs", 2, "number of simultaneous downloads with several URLs, in the terminal UI or daemon")
+	connections     = flag.Int("connections", downloader.MaxThread, "number of connections per download")
+	limitRate       = flag.Int64("limit-rate", 0, "limit each download to this many bytes/s (0 means unlimited)")
+	totalConns      = flag.Int("total-connections", 0, "daemon: never open more than this many connections over all downloads, shared by priority (0 means no limit)")
+	rateBurst       = flag.Int64("rate-burst", 0, "bytes a rate-limited download may read at once after being idle (0 means one second's worth)")
+	rateRefill      = flag.Duration("rate-refill", 0, "add the rate limit's tokens in steps of this interval instead of continuously")
+	rateSmooth      = flag.Bool("rate-smooth", false, "pace rate-limited reads evenly, without bursts")
+	memoryBudget    = flag.Int64("memory-budget", 0, "daemon: limit the read and write buffers of all downloads together to this many bytes, making connections wait for room (0 means unlimited)")
+	totalRate       = flag.Int64("total-rate", 0, "daemon: limit all downloads together to this many bytes/s, shared by priority (0 means unlimited)")
+	minSplitSize    = flag.Int64("min-split-size", downloader.MinSplitSize, "do not split a file into ranges smaller than this many bytes")
+	cacheDir        = flag.String("cache", "", "reuse files with the same SHA-256 from this cache directory and add finished downloads to it")
+	checksum        = flag.String("checksum", "", "expected checksum of the file, algorithm:hex with sha256, sha512, sha1, md5, crc32, crc32c or a registered algorithm, or the hex of a SHA-256")
+	zsync           = flag.Bool("zsync", false, "update an existing destination by downloading only the blocks that changed, using url.zsync")
+	zsyncUrl        = flag.String("zsync-url", "", "URL of the zsync control file (implies -zsync)")
+	mmap            = flag.Bool("mmap", false, "copy downloaded data into a memory mapping of the output file instead of writing it")
+	syncPolicy      = flag.String("sync", downloader.SyncNever, "fsync the output: never, finish, block (after every finished range) or periodic (every -sync-interval)")
+	syncInterval    = flag.Duration("sync-interval", downloader.SyncInterval, "interval of -sync periodic")
+	diskScheduler   = flag.String("disk-scheduler", downloader.DiskSchedulerOff, "order the writes of all downloads to the same disk one at a time along the disk, by priority: off, hdd (rotational disks, Linux) or all")
+	writeBuffer     = flag.Int("write-buffer", downloader.WriteBufferSize, "collect up to this many bytes per connection before writing them (0 writes every read)")
+	daemon          = flag.Bool("daemon", false, "run the download daemon with a REST API")
+	duplicates      = flag.String("duplicates", downloader.DuplicateMerge, "when a queued URL or destination is added again: merge, skip or error")
+	maxLifetime     = flag.Duration("max-lifetime", 0, "daemon: stop a download that has been running this long (0 disables)")
+	noProgress      = flag.Duration("no-progress", 0, "daemon: stop a download that received no data for this long (0 disables)")
+	inputFile       = flag.String("input", "", "daemon: queue the downloads listed in this input file (one URL per line, indented key=value options below it)")
+	noExtension     = flag.Bool("no-extension", false, "daemon: do not add an extension from the Content-Type to file names taken from URLs without one")
+	pathTemplate    = flag.String("path-template", "", "save downloads given without a path under this template, like {{.Host}}/{{.Date}}/{{.Filename}}, in the download directory")
+	placement       = flag.String("placement", downloader.PlaceFree, "daemon: how -data-dir places downloads, free (weighted by free space) or round-robin")
+	onFinish        = flag.String("on-finish", "", "run this command when a download finishes, its arguments templates like {{.Path}}")
+	onComplete      = flag.String("on-complete", "", "daemon: run this command when every download of a group finished, its arguments templates like {{.Group}} and {{.Dir}}")
+	onFail          = flag.String("on-fail", "", "run this command when a download fails, its arguments templates like {{.Url}} and {{.Error}}")
+	stuckAction     = flag.String("stuck-action", downloader.StuckCancel, "daemon: what to do with a download stopped by -max-lifetime or -no-progress: cancel or pause")
+	listen          = flag.String("listen", "127.0.0.1:8800", "address of the daemon REST API (empty to disable TCP)")
+	apiKeys         = flag.String("api-keys", "", "daemon: require a key from this file (lines of token or user:password, read or control, and optionally a tenant) on the TCP API")
+	drainTimeout    = flag.Duration("drain-timeout", 0, "daemon: on SIGTERM stop taking downloads and wait this long for the running ones before pausing them, a little under the grace period of the pod")
+	mqttBroker      = flag.String("mqtt", "", "daemon: add the JSON jobs published to this MQTT topic, mqtt://[user:password@]host[:port]/topic or mqtts://")
+	mqttResults     = flag.String("mqtt-results", "", "daemon: publish the result of every MQTT job to this topic")
+	mqttClientId    = flag.String("mqtt-client-id", "", "daemon: MQTT client id, which keeps the session of unacknowledged jobs (cdm-hostname by default)")
+	auditLog        = flag.String("audit-log", "", "daemon: append every control action to this JSON lines file (kept in memory when empty)")
+	tlsOn           = flag.Bool("tls", false, "daemon: serve the TCP API over HTTPS, with a self-signed certificate unless -tls-cert and -tls-key are given")
+	openUI          = flag.Bool("open-ui", false, "daemon: open its web panel in the browser once it listens")
+	tlsCert         = flag.String("tls-cert", "", "daemon: certificate file for -tls")
+	tlsKey          = flag.String("tls-key", "", "daemon: private key file for -tls")
+	socket          = flag.String("socket", downloader.DefaultSocket(), "unix socket of the daemon REST API, used by cdm add/status/pause/resume (empty to disable)")
+	startAt         = flag.String("start-at", "", "wait until this time (HH:MM or YYYY-MM-DD HH:MM) before downloading")
+	progress        = flag.String("progress", "bar", "progress output: bar or json (one JSON object per line)")
+	quiet           = flag.Bool("quiet", false, "print nothing but errors")
+	logLevel        = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	lang            = flag.String("lang", "", "language of the progress, the report at exit and the notifications, such as es or es_MX, instead of that of $LC_ALL, $LC_MESSAGES or $LANG")
+	logFormat       = flag.String("log-format", "text", "log format: text or json")
+	logFile         = flag.String("log-file", "", "append logs to this file instead of stderr")
+	debugHTTP       = flag.Bool("debug-http", false, "log the request line and headers of every HTTP request and response, with credentials redacted")
+	debugHTTPFile   = flag.String("debug-http-file", "", "append the -debug-http trace to this file instead of stderr (implies -debug-http)")
+	referer         = flag.String("referer", "", "Referer header sent with every request")
+	iface           = flag.String("interface", "", "send traffic from the address of this network interface")
+	localAddr       = flag.String("local-addr", "", "send traffic from this source IP address")
+	ipv4            = flag.Bool("4", false, "connect over IPv4 only")
+	ipv6            = flag.Bool("6", false, "connect over IPv6 only")
+	dnsServer       = flag.String("dns-server", "", "resolve host names with this DNS server (host[:port])")
+	doh             = flag.String("doh", "", "resolve host names with this DNS-over-HTTPS endpoint (JSON API)")
+	keepAlive       = flag.Duration("tcp-keepalive", 0, "idle time before TCP keepalive probes and interval between them (0 for 30s, negative turns them off)")
+	readBuffer      = flag.Int("tcp-read-buffer", 0, "TCP receive buffer size in bytes, larger helps on fast links with high latency (0 for the system default)")
+	tcpDelay        = flag.Bool("tcp-delay", false, "turn Nagle's algorithm on (TCP_NODELAY off)")
+	congestion      = flag.String("tcp-congestion", "", "TCP congestion control to ask for, like bbr or cubic (Linux)")
+	byteRange       = flag.String("range", "", "download only bytes begin-end (or begin-) of the remote file")
+	existing        = flag.String("existing", downloader.ExistsOverwrite, "when the destination exists: overwrite, skip, rename or continue")
+	backupDir       = flag.String("backup-dir", "", "move files that would be overwritten into this directory, recording each move for cdm restore")
+	backupKeep      = flag.Int("backup-keep", downloader.BackupKeep, "backups of each file -backup-dir keeps, the oldest are deleted first (0 keeps all)")
+	splitSize       = flag.String("split-size", "", "write the file as numbered chunks of this size (like 4G) named filename.000, filename.001, ... to be joined with cdm join")
+	teeTo           = flag.String("tee", "", "also stream the file in order to the standard input of this shell command while it downloads (\"-\" for stdout)")
+	seed            = flag.String("seed", "", "start from an existing local copy or partial download of the file, reused when sampled ranges match the remote file")
+	resume          = flag.Bool("c", false, "continue a partially downloaded file (same as -existing continue)")
+	remoteTime      = flag.Bool("remote-time", false, "set the file modification time from the server's Last-Modified")
+	maxRedirects    = flag.Int("max-redirects", downloader.MaxRedirects, "follow at most this many redirects")
+	redirectScheme  = flag.String("redirect-scheme", downloader.RedirectUpgrade, "redirects allowed between http and https: same, upgrade (also http to https) or any")
+	blockPrivate    = flag.Bool("block-private", false, "refuse connections to loopback, private, link-local and other non-public addresses, also after redirects")
+	redirectAuth    = flag.Bool("redirect-auth", false, "send the Authorization header to other hosts when redirected")
+	minFilesize     = flag.Int64("min-filesize", 0, "fail if the file is smaller than this many bytes (0 means no limit)")
+	maxFilesize     = flag.Int64("max-filesize", 0, "fail before or during the download if the file is larger than this many bytes (0 means no limit)")
+	rejectHTML      = flag.Bool("reject-html", false, "fail if the server sends an HTML page instead of the file, unless -content-type allows text/html")
+	newer           = flag.Bool("newer", false, "download only if the remote file changed since the destination was written (implies -remote-time)")
+	xattr           = flag.Bool("xattr", false, "store the source URL and content type in extended attributes")
+	xattrChecksum   = flag.Bool("xattr-checksum", false, "also store the SHA-256 of the file in an extended attribute")
+	noServerSums    = flag.Bool("no-server-checksum", false, "do not verify the Content-MD5, x-goog-hash, x-amz-checksum and S3 ETag hashes sent by the server")
+	noServerLimits  = flag.Bool("no-server-limits", false, "do not pace requests to the X-RateLimit-* and RateLimit headers of the server")
+	rampUp          = flag.Duration("ramp-up", 0, "open the connections of a download one at a time, this far apart (e.g. 200ms)")
+	stallTimeout    = flag.Duration("stall-timeout", downloader.StallTimeout, "retry a block that received no data for this long (0 disables)")
+	speedLimit      = flag.Int64("speed-limit", 0, "retry a block slower than this many bytes/s over -speed-time")
+	speedTime       = flag.Duration("speed-time", time.Second*30, "window for -speed-limit")
+	proxy           = flag.String("proxy", "", "send requests through this http:// proxy")
+	proxyUser       = flag.String("proxy-user", "", "proxy credentials as user:password (DOMAIN\\user for NTLM)")
+	proxyAuth       = flag.String("proxy-auth", downloader.AuthBasic, "proxy authentication: basic, ntlm or negotiate")
+	ntlmUser        = flag.String("ntlm-user", "", "answer NTLM/Negotiate challenges of the server as DOMAIN\\user:password")
+	oauthTokenUrl   = flag.String("oauth-token-url", "", "fetch bearer tokens from this OAuth2 token endpoint (client credentials grant)")
+	oauthClientId   = flag.String("oauth-client-id", "", "OAuth2 client id")
+	oauthSecret     = flag.String("oauth-client-secret", os.Getenv("CDM_OAUTH_CLIENT_SECRET"), "OAuth2 client secret (default $CDM_OAUTH_CLIENT_SECRET)")
+	cookieJar       = flag.String("cookie-jar", "", "keep the cookies servers set in this file and send them with every download, across runs")
+	cookieJarKey    = flag.String("cookie-jar-key", os.Getenv("CDM_COOKIE_JAR_KEY"), "encrypt -cookie-jar with this passphrase (default $CDM_COOKIE_JAR_KEY)")
+	importCookies   = flag.String("import-cookies", "", "add the cookies of this Netscape cookies.txt file to -cookie-jar")
+	encryptParts    = flag.Bool("encrypt-parts", false, "keep the download and its resume file encrypted with -part-key until it is complete")
+	partKey         = flag.String("part-key", os.Getenv("CDM_PART_KEY"), "passphrase of -encrypt-parts (default $CDM_PART_KEY)")
+	relayTo         = flag.String("relay", "", "send the download on to this URL as it arrives instead of writing a file: http(s):// (PUT), s3://bucket/key or sftp://[user@]host/path")
+	relayBuffer     = flag.String("relay-buffer", "", "memory -relay keeps for data arriving out of order (default 64M)")
+	refreshCommand  = flag.String("refresh-command", "", "when the server answers 403 Forbidden, run this shell command with the refused URL in $CDM_URL and continue from the URL it prints")
+	oauthScope      = flag.String("oauth-scope", "", "space separated OAuth2 scopes")
+	acceptEncoding  = flag.String("accept-encoding", "", "request these content encodings (e.g. \"gzip, br\") and store the response as sent")
+	summary         = flag.String("summary", downloader.SummaryText, "report at exit: text, json or none")
+	diagnostics     = flag.Bool("diagnostics", false, "report the bytes, speed, time to first byte and errors of every connection and block at exit")
+	noBaseline      = flag.Bool("no-baseline", false, "split a file over -connections without first sampling one connection's speed, even if one alone would fetch it in under 2s")
+	pieceOrder      = flag.String("piece-order", downloader.PieceOrderParallel, "order of the ranges of a parallel download: parallel (an equal share per connection), sequential-window (in order, within -piece-window of the first missing byte, to open the file while it downloads) or pipeline (ranges of -piece-window bytes requested one after another over each keep-alive connection) or adaptive (pieces that start large and shrink as the file completes, sized to the measured latency and speed)")
+	pieceWindow     = flag.Int64("piece-window", 0, "bytes ahead of the first missing one -piece-order sequential-window downloads (0 for 16 MiB), or the size of the ranges of -piece-order pipeline (0 for 4 MiB)")
+	strategy        = flag.String("strategy", downloader.StrategyAuto, "auto, parallel (ranges over several connections), sequential (one connection, resumed with a range) or streaming (one connection, restarted when interrupted)")
+	dryRun          = flag.Bool("dry-run", false, "probe the URL and print what would be downloaded without downloading")
+	compressed      = flag.Bool("compressed", false, "request a compressed response and decompress it while downloading")
+	unpack          = flag.Bool("decompress", false, "write a gzip, bzip2 or xz compressed file decompressed, recognized by its first bytes")
+	mavenRepo       = flag.String("maven-repo", downloader.MavenRepository, "Maven repository maven:// URLs are downloaded from")
+	pypiIndex       = flag.String("pypi-index", downloader.PyPIIndex, "package index pypi:// URLs are downloaded from")
+	googleAPIKey    = flag.String("google-api-key", os.Getenv("CDM_GOOGLE_API_KEY"), "download Google Drive links through the Drive API with this key (default $CDM_GOOGLE_API_KEY)")
+	asService       = flag.Bool("service", false, "run the daemon as a Windows service (used by -install-service)")
+	installSvc      = flag.Bool("install-service", false, "install the daemon, with the other flags given, as the Windows service cdm")
+	uninstallSvc    = flag.Bool("uninstall-service", false, "stop and remove the Windows service cdm")
+	dir             = flag.String("dir", downloader.DefaultDir(), "directory for downloads whose filename is relative")
+	configFile      = flag.String("config", "", "load the daemon configuration from this JSON file")
+	clipboard       = flag.Bool("clipboard", false, "watch the clipboard for URLs in -daemon or -tui mode")
+	clipboardAuto   = flag.Bool("clipboard-auto", false, "add clipboard URLs to the terminal UI without asking")
+	resolves        stringList
+	userAgents      stringList
+	routes          stringList
+	quotas          stringList
+	tenants         stringList
+	clipPatterns    stringList
+	mirrorUrls      stringList
+	ipfsGateways    stringList
+	contentTypes    stringList
+	allowSchemes    stringList
+	faults          stringList
+	shape           = flag.String("shape", "", "for diagnostics: slow the connections down like a poor link, with latency=300ms,jitter=100ms,rate=256K,stall=3s,every=20s")
+	dataDirs        stringList
+	posts           stringList
+	domains         stringList
+	allowHosts      stringList
+	allowOrigins    stringList
+	coalesce        = flag.String("coalesce", "", "daemon: share connections between downloads of the same host and fetch small files with one request, over keep-alive or http2 connections")
+)
+
+func init() {
+	flag.Var(&userAgents, "user-agent", "User-Agent header; repeat to rotate between several per request")
+	flag.Var(&resolves, "resolve", "connect to addr instead of resolving host:port (host:port:addr, repeatable)")
+	flag.Var(&clipPatterns, "clipboard-pattern", "only pick up clipboard URLs matching this regular expression (repeatable)")
+	flag.Var(&contentTypes, "content-type", "fail unless the response Content-Type matches this pattern, like application/* (repeatable)")
+	flag.Var(&allowSchemes, "allow-scheme", "only download URLs, redirects and mirrors with this scheme, like https (repeatable)")
+	flag.Var(&mirrorUrls, "mirror", "also download ranges of the file from this mirror, preferring the fastest (repeatable)")
+	flag.Var(&faults, "fault", "for testing: fail the download at offset=N (with ,corrupt flip that byte instead), block=N or after=DURATION, once or ,times=N (repeatable)")
+	flag.Var(&ipfsGateways, "ipfs-gateway", "download ipfs:// URLs from this gateway, like https://ipfs.io (repeatable, all are used at once)")
+	flag.Var(&quotas, "quota", "daemon: limit the bytes kept in a directory or under a tag (\"/data/podcasts=50G\", \"tag:isos=20G,defer,prune\", repeatable)")
+	flag.Var(&tenants, "tenant", "daemon: give the tenant named by the X-Cdm-Tenant header this weight in sharing queue slots and bandwidth (\"alice:2\", repeatable)")
+	flag.Var(&dataDirs, "data-dir", "daemon: spread downloads without a directory or route over these directories, by -placement (repeatable)")
+	flag.Var(&posts, "post", "run this step on the finished download: verify=sha256:HEX, decompress, extract[=dir], move=dir, notify or exec=command (repeatable, in order)")
+	flag.Var(&domains, "domain", "daemon: apply these settings to downloads from a host (\"files.example.com:connections=2,rate=1M,token=...\", also dir=, user_agent=, user=USER:PASSWORD, header=NAME:VALUE, repeatable)")
+	flag.Var(&allowHosts, "allow-host", "daemon: also serve the TCP API under this host name, besides IP addresses and localhost (repeatable)")
+	flag.Var(&allowOrigins, "allow-origin", "daemon: also take API requests from web pages of this origin, like https://example.com (repeatable)")
+	flag.Var(&routes, "route", "daemon: save downloads matching a file pattern or content type in a directory (\"*.iso=/data/isos\", \"video/*=/media/incoming\", repeatable)")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func setupLogging(level, format, file string, quiet bool) (io.Closer, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	if quiet {
+		lvl = slog.LevelError
+	}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		closer.Close()
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return closer, nil
+}
@@ -0,0 +1,254 @@
+// Command cdm downloads files over several connections at once, and runs
+// the download daemon and its control commands. The engine is the
+// downloader package at the root of the repository.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run parses the flags and runs the mode they and the arguments ask for.
+func run() int {
+	if downloader.IsNativeMessagingLaunch(os.Args[1:]) {
+		return downloader.ExitCode(downloader.RunNativeHost(os.Stdin, os.Stdout, downloader.NativeHostDaemon()))
+	}
+	flag.Parse()
+	if err := downloader.LoadLanguage(*lang); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	var backups *downloader.Backups
+	if *backupDir != "" {
+		var err error
+		if backups, err = downloader.OpenBackups(*backupDir, *backupKeep); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+	}
+
+	switch command := flag.Arg(0); {
+	case downloader.ControlCommands[command]:
+		return downloader.RunControl(downloader.NewControlClient(*socket), flag.Args(), os.Stdout)
+	case command == "bench":
+		return runBench(flag.Args()[1:], os.Stdout)
+	case command == "speedtest":
+		return downloader.RunSpeedtest(flag.Args()[1:], os.Stdout)
+	case command == "join":
+		return downloader.RunJoin(flag.Args()[1:], os.Stdout)
+	case command == "self-update":
+		return runSelfUpdate(flag.Args()[1:], os.Stdout)
+	case command == "restore":
+		return downloader.RunRestore(backups, flag.Args()[1:], os.Stdout)
+	case command == "verify":
+		return downloader.RunVerify(flag.Args()[1:], *checksum, *quiet, os.Stdout)
+	case downloader.DocCommands[command]:
+		return downloader.RunDocs(flag.Args(), *socket, os.Stdout)
+	}
+	if *installSvc || *uninstallSvc {
+		return runServiceInstall()
+	}
+
+	opts, err := options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	logs, err := setupLogging(*logLevel, *logFormat, *logFile, *quiet)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	defer logs.Close()
+	if *debugHTTP || *debugHTTPFile != "" {
+		var trace io.Writer = os.Stderr
+		if *debugHTTPFile != "" {
+			file, err := os.OpenFile(*debugHTTPFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return downloader.ExitUsage
+			}
+			defer file.Close()
+			trace = file
+		}
+		opts = append(opts, downloader.WithHTTPDebug(trace))
+	}
+
+	events, err := notifiers()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitUsage
+	}
+	var paths *template.Template
+	if *pathTemplate != "" {
+		var err error
+		if paths, err = downloader.ParseTemplate(*pathTemplate); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid path template:", err)
+			return downloader.ExitUsage
+		}
+	}
+
+	if *encryptParts && (*daemon || *dryRun || flag.NArg() != 2 || strings.Contains(flag.Arg(1), "://")) {
+		fmt.Fprintln(os.Stderr, "-encrypt-parts only works downloading one url to a file")
+		return downloader.ExitUsage
+	}
+	if *encryptParts && *partKey == "" {
+		fmt.Fprintln(os.Stderr, "-encrypt-parts needs -part-key or $CDM_PART_KEY")
+		return downloader.ExitUsage
+	}
+
+	if *daemon {
+		return runDaemon(opts, events, backups)
+	}
+	opts = append(opts, downloader.WithConnections(*connections))
+	switch urls := flag.Args(); {
+	case *tui:
+		return runTui(opts, events, backups, paths)
+	case *dryRun:
+		return runDryRun(opts)
+	case len(urls) > 2 || len(urls) == 2 && strings.Contains(urls[1], "://"):
+		return runBatch(urls, opts, events, backups, paths)
+	}
+	return runDownload(opts, events, backups)
+}
+
+// runServiceInstall installs the daemon, with the flags given, as the Windows
+// service, or removes it.
+func runServiceInstall() int {
+	var err error
+	if *installSvc {
+		var args []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "install-service" && f.Name != "daemon" && f.Name != "service" {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		err = installService("cdm", args)
+	} else {
+		err = uninstallService("cdm")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitFailure
+	}
+	return downloader.ExitOK
+}
+
+// runDryRun prints what downloading the URL would fetch.
+func runDryRun(opts []downloader.Option) int {
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cdm -dry-run [flags] url")
+		return downloader.ExitUsage
+	}
+	info, err := downloader.Inspect(flag.Arg(0), opts...)
+	if err != nil {
+		slog.Error("can not probe url", "url", flag.Arg(0), "err", err)
+		return downloader.ExitCode(err)
+	}
+	if *progress == "json" {
+		json.NewEncoder(os.Stdout).Encode(info)
+	} else {
+		info.WriteTo(os.Stdout)
+	}
+	return downloader.ExitOK
+}
+
+// runTui downloads the URL arguments, and those taken from the clipboard, in
+// the terminal UI.
+func runTui(opts []downloader.Option, events *downloader.Dispatcher, backups *downloader.Backups, paths *template.Template) int {
+	t := downloader.NewTui(flag.Args(), *dir, paths)
+	t.Jobs = *jobs
+	t.Events = events
+	t.Backups = backups
+	t.Options = opts
+	t.Json = *progress == "json"
+	if *clipboard {
+		onUrl := t.Prompt
+		if *clipboardAuto {
+			onUrl = t.Add
+		}
+		watcher, err := downloader.NewClipboardWatcher(clipPatterns, onUrl)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return downloader.ExitUsage
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			if err := watcher.Run(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("can not watch the clipboard", "err", err)
+			}
+		}()
+		t.Keep = true
+	}
+	t.Run()
+	if !*quiet || *summary == downloader.SummaryJSON {
+		downloader.NewReport(t.Summaries()).Write(os.Stdout, *summary)
+	}
+	return downloader.ExitCode(t.Err())
+}
+
+// runBatch downloads several URLs at once, with a progress bar each.
+func runBatch(urls []string, opts []downloader.Option, events *downloader.Dispatcher, backups *downloader.Backups, paths *template.Template) int {
+	t := downloader.NewTui(urls, *dir, paths)
+	t.Jobs = *jobs
+	t.Events = events
+	t.Backups = backups
+	t.Options = opts
+	t.Json = *progress == "json"
+	t.Out = os.Stderr
+	if t.Json {
+		t.Out = os.Stdout
+	} else if *quiet {
+		t.Out = io.Discard
+	}
+	t.RunBars(!*quiet && !t.Json && downloader.AnsiTerminal(os.Stderr))
+	if !*quiet || *summary == downloader.SummaryJSON {
+		downloader.NewReport(t.Summaries()).Write(os.Stdout, *summary)
+	}
+	return downloader.ExitCode(t.Err())
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func parseRange(s string) (int64, int64, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q, want begin-end or begin-", s)
+	}
+	begin, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q, want begin-end or begin-", s)
+	}
+	if last == "" {
+		return begin, -1, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q, want begin-end or begin-", s)
+	}
+	return begin, end, nil
+}
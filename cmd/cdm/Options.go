@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+// options are the download options the flags ask for, shared by every mode.
+func options() ([]downloader.Option, error) {
+	var opts []downloader.Option
+	if len(userAgents) > 0 {
+		opts = append(opts, downloader.WithUserAgents(userAgents...))
+	}
+	if *referer != "" {
+		opts = append(opts, downloader.WithReferer(*referer))
+	}
+	if *iface != "" {
+		opts = append(opts, downloader.WithInterface(*iface))
+	}
+	if *localAddr != "" {
+		ip := net.ParseIP(*localAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid -local-addr %s", *localAddr)
+		}
+		opts = append(opts, downloader.WithLocalAddr(ip))
+	}
+	switch {
+	case *ipv4 && *ipv6:
+		return nil, errors.New("-4 and -6 are mutually exclusive")
+	case *ipv4:
+		opts = append(opts, downloader.WithIPVersion(4))
+	case *ipv6:
+		opts = append(opts, downloader.WithIPVersion(6))
+	}
+	for _, r := range resolves {
+		hostPort, addr, err := downloader.ParseResolve(r)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithResolve(hostPort, addr))
+	}
+	if *dnsServer != "" {
+		opts = append(opts, downloader.WithDNSServer(*dnsServer))
+	}
+	if *doh != "" {
+		opts = append(opts, downloader.WithDoH(*doh))
+	}
+	if *keepAlive != 0 || *readBuffer != 0 || *tcpDelay || *congestion != "" {
+		opts = append(opts, downloader.WithSocketOptions(downloader.SocketOptions{KeepAlive: *keepAlive, ReadBuffer: *readBuffer, Delay: *tcpDelay, Congestion: *congestion}))
+	}
+	opts = append(opts, downloader.WithStallTimeout(*stallTimeout), downloader.WithMinSplitSize(*minSplitSize), downloader.WithWriteBuffer(*writeBuffer, downloader.WriteBufferInterval))
+	if *rampUp > 0 {
+		opts = append(opts, downloader.WithRampUp(*rampUp))
+	}
+	if *limitRate > 0 {
+		opts = append(opts, downloader.WithRateLimit(*limitRate))
+	}
+	if *rateBurst != 0 || *rateRefill != 0 || *rateSmooth {
+		opts = append(opts, downloader.WithRateShaping(*rateBurst, *rateRefill, *rateSmooth))
+	}
+	if *speedLimit > 0 {
+		opts = append(opts, downloader.WithLowSpeedLimit(*speedLimit, *speedTime))
+	}
+	if *proxy != "" {
+		opts = append(opts, downloader.WithProxy(*proxy))
+		if *proxyUser != "" {
+			user, password, _ := strings.Cut(*proxyUser, ":")
+			opts = append(opts, downloader.WithProxyAuth(*proxyAuth, user, password))
+		}
+	}
+	if *ntlmUser != "" {
+		user, password, _ := strings.Cut(*ntlmUser, ":")
+		opts = append(opts, downloader.WithNTLM(user, password))
+	}
+	if *oauthTokenUrl != "" {
+		opts = append(opts, downloader.WithTokenSource(&downloader.ClientCredentials{
+			TokenUrl:     *oauthTokenUrl,
+			ClientId:     *oauthClientId,
+			ClientSecret: *oauthSecret,
+			Scopes:       strings.Fields(*oauthScope),
+		}))
+	}
+	if *importCookies != "" && *cookieJar == "" {
+		return nil, errors.New("-import-cookies needs -cookie-jar")
+	}
+	if *cookieJar != "" {
+		jar, err := downloader.OpenCookieJar(*cookieJar, *cookieJarKey)
+		if err != nil {
+			return nil, err
+		}
+		if *importCookies != "" {
+			n, err := downloader.ImportCookies(jar, *importCookies)
+			if err != nil {
+				return nil, err
+			}
+			slog.Info("imported cookies", "count", n, "jar", *cookieJar)
+		}
+		opts = append(opts, downloader.WithCookieJar(jar))
+	}
+	if *refreshCommand != "" {
+		opts = append(opts, downloader.WithUrlRefresh(downloader.RefreshCommand(*refreshCommand)))
+	}
+	if *acceptEncoding != "" {
+		opts = append(opts, downloader.WithAcceptEncoding(*acceptEncoding))
+	}
+	if *compressed {
+		opts = append(opts, downloader.WithDecompression())
+	}
+	if *unpack {
+		opts = append(opts, downloader.WithPayloadDecompression())
+	}
+	if len(faults) > 0 {
+		var list []downloader.Fault
+		for _, s := range faults {
+			fault, err := downloader.ParseFault(s)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, fault)
+		}
+		opts = append(opts, downloader.WithFaults(list...))
+	}
+	if *shape != "" {
+		s, err := downloader.ParseShape(*shape)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithShaping(s))
+	}
+	if len(ipfsGateways) > 0 {
+		opts = append(opts, downloader.WithIPFSGateways(ipfsGateways...))
+	}
+	opts = append(opts, downloader.WithMavenRepository(*mavenRepo), downloader.WithPyPIIndex(*pypiIndex))
+	if *googleAPIKey != "" {
+		opts = append(opts, downloader.WithGoogleAPIKey(*googleAPIKey))
+	}
+	if *noBaseline {
+		opts = append(opts, downloader.WithBaseline(false))
+	}
+	if *pieceOrder != downloader.PieceOrderParallel || *pieceWindow != 0 {
+		opts = append(opts, downloader.WithPieceOrder(*pieceOrder, *pieceWindow))
+	}
+	if *strategy != downloader.StrategyAuto {
+		opts = append(opts, downloader.WithStrategy(*strategy))
+	}
+	if *mmap {
+		opts = append(opts, downloader.WithMmap())
+	}
+	if *syncPolicy != downloader.SyncNever {
+		opts = append(opts, downloader.WithSync(*syncPolicy, *syncInterval))
+	}
+	if *diskScheduler != downloader.DiskSchedulerOff {
+		disks, diskErr := downloader.NewDiskScheduler(*diskScheduler)
+		if diskErr != nil {
+			return nil, diskErr
+		}
+		opts = append(opts, downloader.WithDiskScheduler(disks))
+	}
+	opts = append(opts, downloader.WithRedirects(*maxRedirects, *redirectScheme, *redirectAuth))
+	if *blockPrivate {
+		opts = append(opts, downloader.WithBlockPrivateNetworks())
+	}
+	if *noServerSums {
+		opts = append(opts, downloader.WithServerChecksums(false))
+	}
+	if *noServerLimits {
+		opts = append(opts, downloader.WithServerLimits(false))
+	}
+	if *diagnostics {
+		opts = append(opts, downloader.WithDiagnostics())
+	}
+	if len(allowSchemes) > 0 {
+		opts = append(opts, downloader.WithAllowedSchemes(allowSchemes...))
+	}
+	if len(contentTypes) > 0 {
+		opts = append(opts, downloader.WithContentTypes(contentTypes...))
+	}
+	if *rejectHTML {
+		opts = append(opts, downloader.WithRejectHTML())
+	}
+	if *minFilesize > 0 || *maxFilesize > 0 {
+		opts = append(opts, downloader.WithSizeLimits(*minFilesize, *maxFilesize))
+	}
+	if *remoteTime || *newer {
+		opts = append(opts, downloader.WithRemoteTime())
+	}
+	if *xattr || *xattrChecksum {
+		opts = append(opts, downloader.WithXattrs(*xattrChecksum))
+	}
+	if *byteRange != "" {
+		begin, end, err := parseRange(*byteRange)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithRange(begin, end))
+	}
+	return opts, nil
+}
+
+// notifiers are where the flags send the events of downloads.
+func notifiers() (*downloader.Dispatcher, error) {
+	events := &downloader.Dispatcher{}
+	events.OnError = func(n downloader.Notifier, err error) {
+		slog.Warn("notification failed", "err", err)
+	}
+	if *notify {
+		events.Add(downloader.DesktopNotifier{})
+	}
+	if *webhook != "" {
+		events.Add(&downloader.WebhookNotifier{Url: *webhook, Template: *webhookTemplate, ChatId: *telegramChat})
+	}
+	for _, hook := range [][2]string{{downloader.EventFinished, *onFinish}, {downloader.EventFailed, *onFail}, {downloader.EventCompleted, *onComplete}} {
+		if hook[1] == "" {
+			continue
+		}
+		n, err := downloader.NewCommandNotifier(hook[0], hook[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid command for %s downloads: %w", hook[0], err)
+		}
+		events.Add(n)
+	}
+	return events, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+var (
+	// Version is the release the binary was built as, set with
+	// -ldflags "-X main.Version=v1.4.0".
+	Version = "dev"
+	// UpdateSource lists the releases self-update picks from, as the
+	// GitHub releases API does.
+	UpdateSource = "https://api.github.com/repos/rasoulkhaksari/Concurrent_Download_Manager/releases"
+	// UpdateKey is the Ed25519 public key, in base64, the checksum files of
+	// releases are signed with, set with -ldflags "-X main.UpdateKey=...".
+	// Without one, self-update refuses to install unless -insecure is given.
+	UpdateKey = ""
+)
+
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+var (
+	ErrNoReleaseBinary = errors.New("no release binary for this platform")
+	ErrVersionFormat   = errors.New("not a version like v1.4.0")
+)
+
+type Release struct {
+	Tag        string         `json:"tag_name"`
+	Draft      bool           `json:"draft"`
+	Prerelease bool           `json:"prerelease"`
+	Assets     []ReleaseAsset `json:"assets"`
+}
+
+type ReleaseAsset struct {
+	Name string `json:"name"`
+	Url  string `json:"browser_download_url"`
+}
+
+// LatestRelease returns the newest release of source on channel: stable
+// takes releases only, beta prereleases too.
+func LatestRelease(ctx context.Context, source, channel string) (Release, error) {
+	if channel != ChannelStable && channel != ChannelBeta {
+		return Release{}, fmt.Errorf("unknown channel %q, want %s or %s", channel, ChannelStable, ChannelBeta)
+	}
+	b, err := downloader.DownloadBytes(ctx, source, downloader.WithHeader("Accept", "application/vnd.github+json"))
+	if err != nil {
+		return Release{}, err
+	}
+	var releases []Release
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return Release{}, fmt.Errorf("%s: %w", source, err)
+	}
+	var latest Release
+	for _, r := range releases {
+		if r.Draft || r.Prerelease && channel != ChannelBeta {
+			continue
+		}
+		if _, err := parseVersion(r.Tag); err != nil {
+			slog.Debug("skipping release", "tag", r.Tag, "err", err)
+			continue
+		}
+		if latest.Tag == "" {
+			latest = r
+		} else if c, _ := compareVersions(r.Tag, latest.Tag); c > 0 {
+			latest = r
+		}
+	}
+	if latest.Tag == "" {
+		return Release{}, fmt.Errorf("no %s release at %s", channel, source)
+	}
+	return latest, nil
+}
+
+// binary returns the asset of the release built for goos and goarch, named
+// like cdm-linux-amd64 or cdm_windows_amd64.exe. Archives are not unpacked,
+// so they do not count.
+func (r Release) binary(goos, goarch string) (ReleaseAsset, error) {
+	arches := strings.NewReplacer("x86_64", "amd64", "x86-64", "amd64", "aarch64", "arm64", "i386", "386")
+	for _, a := range r.Assets {
+		name := arches.Replace(strings.ToLower(a.Name))
+		if updateSidecar(name) || strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+			continue
+		}
+		fields := strings.FieldsFunc(strings.TrimSuffix(name, ".exe"), func(r rune) bool { return r == '-' || r == '_' || r == '.' })
+		if containsField(fields, goos) && containsField(fields, goarch) {
+			return a, nil
+		}
+	}
+	return ReleaseAsset{}, fmt.Errorf("%w: %s/%s in %s", ErrNoReleaseBinary, goos, goarch, r.Tag)
+}
+
+func containsField(fields []string, s string) bool {
+	for _, f := range fields {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+func updateSidecar(name string) bool {
+	return strings.HasSuffix(name, ".sha256") || strings.HasSuffix(name, ".sig") || strings.HasSuffix(name, ".txt") || strings.Contains(name, "sha256sums")
+}
+
+// checksum returns the SHA-256 the release publishes for asset, from a
+// SHA256SUMS or checksums.txt file or asset.sha256, checking the signature
+// in the file of the same name with .sig appended against key if there is
+// a key.
+func (r Release) checksum(ctx context.Context, asset ReleaseAsset, key ed25519.PublicKey) (string, error) {
+	for _, a := range r.Assets {
+		name := strings.ToLower(a.Name)
+		if name != "sha256sums" && name != "sha256sums.txt" && !strings.HasSuffix(name, "checksums.txt") && name != strings.ToLower(asset.Name)+".sha256" {
+			continue
+		}
+		sums, err := downloader.DownloadBytes(ctx, a.Url)
+		if err != nil {
+			return "", err
+		}
+		if key != nil {
+			if err := r.verifySignature(ctx, a, sums, key); err != nil {
+				return "", err
+			}
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(sums))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			switch {
+			case len(fields) == 1 && strings.HasSuffix(name, ".sha256"):
+				return fields[0], nil
+			case len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset.Name:
+				return fields[0], nil
+			}
+		}
+		return "", fmt.Errorf("%s has no checksum of %s", a.Name, asset.Name)
+	}
+	return "", fmt.Errorf("release %s publishes no checksums", r.Tag)
+}
+
+func (r Release) verifySignature(ctx context.Context, sums ReleaseAsset, data []byte, key ed25519.PublicKey) error {
+	for _, a := range r.Assets {
+		if a.Name != sums.Name+".sig" {
+			continue
+		}
+		sig, err := downloader.DownloadBytes(ctx, a.Url)
+		if err != nil {
+			return err
+		}
+		if len(sig) != ed25519.SignatureSize {
+			if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+				return fmt.Errorf("%s: %w", a.Name, err)
+			}
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return fmt.Errorf("%w: the signature of %s does not match", downloader.ErrChecksumMismatch, sums.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("release %s does not sign %s", r.Tag, sums.Name)
+}
+
+// SelfUpdate replaces the running executable with the binary of release
+// for this platform, downloaded next to it and checked against the
+// published checksum first, so that the executable is either the old or
+// the new one if anything fails. With a key the checksum file must be
+// signed with it; a nil key checks the checksum only.
+func SelfUpdate(ctx context.Context, release Release, key ed25519.PublicKey, opts ...downloader.Option) error {
+	asset, err := release.binary(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	sum, err := release.checksum(ctx, asset, key)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".cdm-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	f, err := downloader.New(asset.Url, tmp, append(opts, downloader.WithChecksum("sha256", sum))...)
+	if err == nil {
+		err = f.Run(ctx)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+	return replaceExecutable(tmp.Name(), exe)
+}
+
+// replaceExecutable renames src over exe. Windows does not let a running
+// executable be replaced but lets it be renamed, so it is moved aside to
+// exe.old first, and removed on the next update.
+func replaceExecutable(src, exe string) error {
+	if runtime.GOOS != "windows" {
+		return os.Rename(src, exe)
+	}
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	return nil
+}
+
+// releaseVersion is a release tag split into the numbers of its core and
+// the identifiers of its prerelease.
+type releaseVersion struct {
+	core []string
+	pre  []string
+}
+
+// parseVersion reads a tag like v1.4.0 or v1.5.0-beta.2+build.7, the build
+// metadata being ignored as semantic versioning has it.
+func parseVersion(tag string) (releaseVersion, error) {
+	s, _, _ := strings.Cut(strings.TrimPrefix(tag, "v"), "+")
+	core, pre, hasPre := strings.Cut(s, "-")
+	var v releaseVersion
+	for _, part := range strings.Split(core, ".") {
+		if !numericIdentifier(part) {
+			return v, fmt.Errorf("%w: %q", ErrVersionFormat, tag)
+		}
+		v.core = append(v.core, part)
+	}
+	if hasPre {
+		for _, id := range strings.Split(pre, ".") {
+			if id == "" {
+				return v, fmt.Errorf("%w: %q", ErrVersionFormat, tag)
+			}
+			v.pre = append(v.pre, id)
+		}
+	}
+	return v, nil
+}
+
+func numericIdentifier(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// compareNumbers compares two strings of digits by value, however long.
+func compareNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// compareVersions compares release tags like v1.4.0 and v1.5.0-beta.2 in
+// the order of semantic versioning: by the numbers of the core, missing
+// ones counting as 0, then a prerelease before its release, and between
+// prereleases identifier by identifier, numbers by value and before words.
+func compareVersions(a, b string) (int, error) {
+	x, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range max(len(x.core), len(y.core)) {
+		p, q := "0", "0"
+		if i < len(x.core) {
+			p = x.core[i]
+		}
+		if i < len(y.core) {
+			q = y.core[i]
+		}
+		if c := compareNumbers(p, q); c != 0 {
+			return c, nil
+		}
+	}
+	switch {
+	case len(x.pre) == 0 && len(y.pre) == 0:
+		return 0, nil
+	case len(x.pre) == 0:
+		return 1, nil
+	case len(y.pre) == 0:
+		return -1, nil
+	}
+	for i := range min(len(x.pre), len(y.pre)) {
+		p, q := x.pre[i], y.pre[i]
+		var c int
+		switch numP, numQ := numericIdentifier(p), numericIdentifier(q); {
+		case numP && numQ:
+			c = compareNumbers(p, q)
+		case numP:
+			c = -1
+		case numQ:
+			c = 1
+		default:
+			c = strings.Compare(p, q)
+		}
+		if c != 0 {
+			return c, nil
+		}
+	}
+	return len(x.pre) - len(y.pre), nil
+}
+
+func runSelfUpdate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	channel := fs.String("channel", ChannelStable, "release channel, stable or beta")
+	check := fs.Bool("check", false, "only tell whether a newer release is out")
+	force := fs.Bool("force", false, "install the latest release even if it is not newer")
+	source := fs.String("source", UpdateSource, "releases to pick from, in the JSON of the GitHub releases API")
+	keyFlag := fs.String("key", UpdateKey, "Ed25519 public key in base64 the checksums must be signed with")
+	insecure := fs.Bool("insecure", false, "install without a signing key, checking the published checksum only")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return downloader.ExitUsage
+	}
+	var key ed25519.PublicKey
+	if *keyFlag != "" {
+		b, err := base64.StdEncoding.DecodeString(*keyFlag)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			fmt.Fprintln(os.Stderr, "invalid Ed25519 public key")
+			return downloader.ExitUsage
+		}
+		key = b
+	}
+	ctx := context.Background()
+	release, err := LatestRelease(ctx, *source, *channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitCode(err)
+	}
+	// A build that is not a release, like dev, takes any release.
+	c, err := compareVersions(release.Tag, Version)
+	newer := err != nil || c > 0
+	switch {
+	case !newer && !*force:
+		fmt.Fprintf(out, "cdm %s is up to date\n", Version)
+		return downloader.ExitOK
+	case *check:
+		fmt.Fprintf(out, "cdm %s is available, this is %s\n", release.Tag, Version)
+		return downloader.ExitOK
+	}
+	if key == nil && !*insecure {
+		fmt.Fprintln(os.Stderr, "no signing key to check the release with: this build has none, give one with -key, or -insecure to trust the published checksum alone")
+		return downloader.ExitFailure
+	}
+	if key == nil {
+		fmt.Fprintln(os.Stderr, "warning: no signing key, checking the published checksum only")
+	}
+	if err := SelfUpdate(ctx, release, key); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return downloader.ExitCode(err)
+	}
+	fmt.Fprintf(out, "updated cdm from %s to %s\n", Version, release.Tag)
+	return downloader.ExitOK
+}
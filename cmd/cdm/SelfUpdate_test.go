@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	downloader "github.com/rasoulkhaksari/Concurrent_Download_Manager"
+)
+
+func TestCompareVersions(t *testing.T) {
+	// In increasing order, as in the semantic versioning specification.
+	ordered := []string{
+		"v1.0.0-alpha", "v1.0.0-alpha.1", "v1.0.0-alpha.beta", "v1.0.0-beta",
+		"v1.0.0-beta.2", "v1.0.0-beta.11", "v1.0.0-rc.1", "v1.0.0",
+		"v1.0.1", "v1.1", "v1.2.0-9", "v1.2.0-10", "v1.2.0-a", "v1.2.0", "v1.10.0", "v2.0.0",
+	}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			c, err := compareVersions(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < j && c >= 0 || i > j && c <= 0 || i == j && c != 0 {
+				t.Errorf("compareVersions(%s, %s) = %d", a, b, c)
+			}
+		}
+	}
+	for _, equal := range [][2]string{
+		{"v1.4", "1.4.0"},
+		{"v1.4.0+build.7", "v1.4.0"},
+		{"v1.04.0", "v1.4.0"},
+		{"v1.5.0-beta.02", "v1.5.0-beta.2"},
+	} {
+		if c, err := compareVersions(equal[0], equal[1]); c != 0 || err != nil {
+			t.Errorf("compareVersions(%s, %s) = %d, %v", equal[0], equal[1], c, err)
+		}
+	}
+	for _, invalid := range []string{"dev", "v1.x", "v1..2", "v1.2.3-", "v1.2.3-beta..1", "", "v+1.2", "v1.-2"} {
+		if _, err := compareVersions(invalid, "v1.0.0"); !errors.Is(err, ErrVersionFormat) {
+			t.Errorf("compareVersions(%q) = %v, want %v", invalid, err, ErrVersionFormat)
+		}
+	}
+}
+
+// releaseServer serves the assets of a release, by name.
+func releaseServer(t *testing.T, assets map[string]string) Release {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := assets[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	release := Release{Tag: "v1.5.0"}
+	for name := range assets {
+		release.Assets = append(release.Assets, ReleaseAsset{Name: name, Url: server.URL + "/" + name})
+	}
+	return release
+}
+
+func TestReleaseSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	sum := sha256.Sum256([]byte("binary"))
+	sums := hex.EncodeToString(sum[:]) + "  cdm-linux-amd64\n"
+	signature := ed25519.Sign(private, []byte(sums))
+	asset := ReleaseAsset{Name: "cdm-linux-amd64"}
+
+	for _, test := range []struct {
+		name   string
+		assets map[string]string
+		key    ed25519.PublicKey
+		err    error
+	}{
+		{"signed", map[string]string{"SHA256SUMS": sums, "SHA256SUMS.sig": string(signature)}, public, nil},
+		{"signed in base64", map[string]string{"SHA256SUMS": sums, "SHA256SUMS.sig": base64.StdEncoding.EncodeToString(signature) + "\n"}, public, nil},
+		{"without a key", map[string]string{"SHA256SUMS": sums}, nil, nil},
+		{"another key", map[string]string{"SHA256SUMS": sums, "SHA256SUMS.sig": string(signature)}, other, downloader.ErrChecksumMismatch},
+		{"changed checksums", map[string]string{"SHA256SUMS": strings.Replace(sums, sums[:4], "0000", 1), "SHA256SUMS.sig": string(signature)}, public, downloader.ErrChecksumMismatch},
+		{"unsigned", map[string]string{"SHA256SUMS": sums}, public, errors.New("does not sign")},
+	} {
+		release := releaseServer(t, test.assets)
+		got, err := release.checksum(context.Background(), asset, test.key)
+		switch {
+		case test.err == nil && (err != nil || got != hex.EncodeToString(sum[:])):
+			t.Errorf("%s: checksum %q, %v", test.name, got, err)
+		case test.err != nil && err == nil:
+			t.Errorf("%s: accepted checksum %q", test.name, got)
+		case test.err != nil && !errors.Is(err, test.err) && !strings.Contains(err.Error(), test.err.Error()):
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLatestRelease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"tag_name": "v1.9.0"},
+			{"tag_name": "v1.10.0-beta.2", "prerelease": true},
+			{"tag_name": "v1.10.0-beta.11", "prerelease": true},
+			{"tag_name": "v2.0.0", "draft": true},
+			{"tag_name": "nightly"},
+			{"tag_name": "v1.10.0-rc.1", "prerelease": true}
+		]`))
+	}))
+	defer server.Close()
+	for channel, want := range map[string]string{ChannelStable: "v1.9.0", ChannelBeta: "v1.10.0-rc.1"} {
+		release, err := LatestRelease(context.Background(), server.URL, channel)
+		if err != nil || release.Tag != want {
+			t.Errorf("%s: %s, %v, want %s", channel, release.Tag, err, want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+var ErrNotService = errors.New("windows services are not supported on " + runtime.GOOS)
+
+func startService(name string) (<-chan struct{}, func(), error) {
+	return nil, nil, ErrNotService
+}
+
+func installService(name string, args []string) error {
+	return ErrNotService
+}
+
+func uninstallService(name string) error {
+	return ErrNotService
+}
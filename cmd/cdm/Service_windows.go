@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorFailedServiceControllerConnect = 1063
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+var ErrNotService = errors.New("not started by the service control manager")
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+type windowsService struct {
+	name    *uint16
+	handle  uintptr
+	stop    chan struct{}
+	once    sync.Once
+	started chan struct{}
+	done    chan struct{}
+}
+
+var service *windowsService
+
+func (s *windowsService) setStatus(state uint32) {
+	status := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state}
+	if state == serviceRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		service.setStatus(serviceStopPending)
+		service.once.Do(func() { close(service.stop) })
+	case serviceControlInterrogate:
+	default:
+		return 120
+	}
+	return 0
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	handle, _, _ := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(service.name)), syscall.NewCallback(serviceHandler), 0)
+	service.handle = handle
+	service.setStatus(serviceRunning)
+	close(service.started)
+	<-service.done
+	service.setStatus(serviceStopped)
+	return 0
+}
+
+func startService(name string) (<-chan struct{}, func(), error) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	service = &windowsService{
+		name:    namePtr,
+		stop:    make(chan struct{}),
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	failed := make(chan error, 1)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{name: namePtr, proc: syscall.NewCallback(serviceMain)}, {}}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			if errno, ok := err.(syscall.Errno); ok && errno == errorFailedServiceControllerConnect {
+				err = ErrNotService
+			}
+			failed <- err
+		}
+	}()
+	select {
+	case err := <-failed:
+		return nil, nil, err
+	case <-service.started:
+	}
+	return service.stop, func() {
+		close(service.done)
+		<-exited
+	}, nil
+}
+
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := []string{syscall.EscapeArg(exe), "-daemon", "-service"}
+	for _, arg := range args {
+		command = append(command, syscall.EscapeArg(arg))
+	}
+	return exec.Command("sc.exe", "create", name, "binPath=", strings.Join(command, " "), "start=", "auto", "DisplayName=", "Concurrent Download Manager").Run()
+}
+
+func uninstallService(name string) error {
+	exec.Command("sc.exe", "stop", name).Run()
+	return exec.Command("sc.exe", "delete", name).Run()
+}
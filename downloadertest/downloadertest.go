@@ -0,0 +1,285 @@
+// Package downloadertest provides fake HTTP origins for testing code that
+// downloads files: range-supporting, flaky, slow and redirecting servers
+// whose behavior is deterministic and whose requests can be inspected.
+package downloadertest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request is a request received by an Origin.
+type Request struct {
+	Method string
+	Path   string
+	Range  string
+	Header http.Header
+	Status int
+}
+
+// Origin is a test server serving one file at URL.
+type Origin struct {
+	URL    string
+	Server *httptest.Server
+	Data   []byte
+
+	noRanges  bool
+	noLength  bool
+	etag      string
+	modTime   time.Time
+	latency   time.Duration
+	bandwidth int64
+	failFirst int
+	failEvery int
+	failCode  int
+	failRate  float64
+	failRand  *rand.Rand
+	dropAfter int64
+	dropFirst int
+	redirects int
+
+	mu       sync.Mutex
+	requests []Request
+	served   int
+}
+
+// Option configures an Origin.
+type Option func(*Origin)
+
+// WithoutRanges ignores Range headers and always answers with the whole file.
+func WithoutRanges() Option {
+	return func(o *Origin) { o.noRanges = true }
+}
+
+// WithoutLength streams the file without a Content-Length and without range
+// support.
+func WithoutLength() Option {
+	return func(o *Origin) { o.noRanges, o.noLength = true, true }
+}
+
+// WithETag sends the ETag and honors If-Range and If-None-Match.
+func WithETag(etag string) Option {
+	return func(o *Origin) { o.etag = etag }
+}
+
+// WithLastModified sends Last-Modified and honors If-Modified-Since.
+func WithLastModified(t time.Time) Option {
+	return func(o *Origin) { o.modTime = t }
+}
+
+// WithLatency delays every response.
+func WithLatency(d time.Duration) Option {
+	return func(o *Origin) { o.latency = d }
+}
+
+// WithBandwidth limits every response to bytesPerSecond.
+func WithBandwidth(bytesPerSecond int64) Option {
+	return func(o *Origin) { o.bandwidth = bytesPerSecond }
+}
+
+// WithFailures answers the first n requests for the file with status.
+func WithFailures(n, status int) Option {
+	return func(o *Origin) { o.failFirst, o.failCode = n, status }
+}
+
+// WithFailEvery answers every nth request for the file with status.
+func WithFailEvery(n, status int) Option {
+	return func(o *Origin) { o.failEvery, o.failCode = n, status }
+}
+
+// WithErrorRate answers a random fraction rate of the requests for the
+// file with status. The same requests fail from one run to the next.
+func WithErrorRate(rate float64, status int) Option {
+	return func(o *Origin) { o.failRate, o.failCode, o.failRand = rate, status, rand.New(rand.NewSource(1)) }
+}
+
+// WithDrop closes the connection after sending bytes of the body, for the
+// first n requests for the file.
+func WithDrop(n int, bytes int64) Option {
+	return func(o *Origin) { o.dropFirst, o.dropAfter = n, bytes }
+}
+
+// WithRedirects makes URL a chain of n redirects in front of the file.
+func WithRedirects(n int) Option {
+	return func(o *Origin) { o.redirects = n }
+}
+
+// NewOrigin starts an Origin serving data. Close it when done.
+func NewOrigin(data []byte, opts ...Option) *Origin {
+	o := &Origin{Data: data}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.Server = httptest.NewServer(o)
+	o.URL = o.Server.URL + "/file"
+	if o.redirects > 0 {
+		o.URL = o.Server.URL + "/redirect/" + strconv.Itoa(o.redirects)
+	}
+	return o
+}
+
+// RandomData returns size bytes of pseudo-random data, the same for the
+// same seed.
+func RandomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Close shuts the Origin down.
+func (o *Origin) Close() {
+	o.Server.Close()
+}
+
+// Requests returns the requests received so far.
+func (o *Origin) Requests() []Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Request(nil), o.requests...)
+}
+
+// Ranges returns the Range headers of the requests for the file, empty for
+// requests of the whole file.
+func (o *Origin) Ranges() []string {
+	var ranges []string
+	for _, r := range o.Requests() {
+		if r.Path == "/file" {
+			ranges = append(ranges, r.Range)
+		}
+	}
+	return ranges
+}
+
+func (o *Origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.latency > 0 {
+		time.Sleep(o.latency)
+	}
+	status := o.serve(w, r)
+	o.mu.Lock()
+	o.requests = append(o.requests, Request{Method: r.Method, Path: r.URL.Path, Range: r.Header.Get("Range"), Header: r.Header.Clone(), Status: status})
+	o.mu.Unlock()
+}
+
+func (o *Origin) serve(w http.ResponseWriter, r *http.Request) int {
+	var n int
+	if _, err := fmt.Sscanf(r.URL.Path, "/redirect/%d", &n); err == nil {
+		next := "/file"
+		if n > 1 {
+			next = "/redirect/" + strconv.Itoa(n-1)
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+		return http.StatusFound
+	}
+	if r.URL.Path != "/file" {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+
+	o.mu.Lock()
+	o.served++
+	served := o.served
+	unlucky := o.failRate > 0 && o.failRand.Float64() < o.failRate
+	o.mu.Unlock()
+	if served <= o.failFirst || (o.failEvery > 0 && served%o.failEvery == 0) || unlucky {
+		http.Error(w, "injected failure", o.failCode)
+		return o.failCode
+	}
+	raw := w
+	if o.bandwidth > 0 {
+		w = &throttledWriter{ResponseWriter: w, rate: o.bandwidth, start: time.Now()}
+	}
+	if served <= o.dropFirst {
+		w = &droppingWriter{ResponseWriter: w, raw: raw, left: o.dropAfter}
+	}
+	if o.etag != "" {
+		w.Header().Set("ETag", o.etag)
+	}
+
+	if o.noRanges {
+		if o.noLength {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusOK)
+			if f, ok := raw.(http.Flusher); ok {
+				f.Flush()
+			}
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(o.Data)))
+			w.WriteHeader(http.StatusOK)
+		}
+		if r.Method != http.MethodHead {
+			w.Write(o.Data)
+		}
+		return http.StatusOK
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(rec, r, "file", o.modTime, bytes.NewReader(o.Data))
+	return rec.status
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		m, err := w.ResponseWriter.Write(p[:min(len(p), 4<<10)])
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		if wait := time.Duration(w.written)*time.Second/time.Duration(w.rate) - time.Since(w.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, nil
+}
+
+type droppingWriter struct {
+	http.ResponseWriter
+	raw  http.ResponseWriter
+	left int64
+}
+
+func (w *droppingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.left {
+		w.left -= int64(len(p))
+		return w.ResponseWriter.Write(p)
+	}
+	n, _ := w.ResponseWriter.Write(p[:w.left])
+	w.left = 0
+	if f, ok := w.raw.(http.Flusher); ok {
+		f.Flush()
+	}
+	if h, ok := w.raw.(http.Hijacker); ok {
+		if conn, _, err := h.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+	return n, net.ErrClosed
+}
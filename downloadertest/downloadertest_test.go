@@ -0,0 +1,144 @@
+package downloadertest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func get(t *testing.T, url, rangeHeader string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestRandomData(t *testing.T) {
+	if !bytes.Equal(RandomData(100, 1), RandomData(100, 1)) {
+		t.Fatal("the same seed made different data")
+	}
+	if bytes.Equal(RandomData(100, 1), RandomData(100, 2)) {
+		t.Fatal("different seeds made the same data")
+	}
+}
+
+func TestRanges(t *testing.T) {
+	data := RandomData(1000, 1)
+	o := NewOrigin(data, WithETag(`"v1"`))
+	defer o.Close()
+	resp, body := get(t, o.URL, "bytes=100-199")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[100:200]) {
+		t.Fatalf("range request got %s and %d bytes", resp.Status, len(body))
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"v1"` {
+		t.Fatalf("ETag %q", etag)
+	}
+	if ranges := o.Ranges(); len(ranges) != 1 || ranges[0] != "bytes=100-199" {
+		t.Fatalf("Ranges returned %q", ranges)
+	}
+}
+
+func TestWithoutRanges(t *testing.T) {
+	data := RandomData(1000, 1)
+	for _, opts := range [][]Option{{WithoutRanges()}, {WithoutRanges(), WithoutLength()}} {
+		o := NewOrigin(data, opts...)
+		resp, body := get(t, o.URL, "bytes=100-199")
+		o.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+			t.Fatalf("range request got %s and %d bytes, want the whole file", resp.Status, len(body))
+		}
+		if resp.Header.Get("Accept-Ranges") != "" {
+			t.Fatal("Accept-Ranges sent without range support")
+		}
+	}
+}
+
+func TestFailures(t *testing.T) {
+	o := NewOrigin(RandomData(10, 1), WithFailures(2, http.StatusServiceUnavailable), WithFailEvery(4, http.StatusServiceUnavailable))
+	defer o.Close()
+	var statuses []int
+	for range 5 {
+		resp, _ := get(t, o.URL, "")
+		statuses = append(statuses, resp.StatusCode)
+	}
+	want := []int{503, 503, 200, 503, 200}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("statuses %v, want %v", statuses, want)
+		}
+	}
+	for i, r := range o.Requests() {
+		if r.Status != want[i] {
+			t.Fatalf("request %d recorded as %d, want %d", i, r.Status, want[i])
+		}
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	statuses := func() []int {
+		o := NewOrigin(RandomData(10, 1), WithErrorRate(0.25, http.StatusInternalServerError))
+		defer o.Close()
+		var statuses []int
+		for range 200 {
+			resp, _ := get(t, o.URL, "")
+			statuses = append(statuses, resp.StatusCode)
+		}
+		return statuses
+	}
+	first, failed := statuses(), 0
+	for _, status := range first {
+		if status == http.StatusInternalServerError {
+			failed++
+		}
+	}
+	if failed < 25 || failed > 75 {
+		t.Fatalf("%d of 200 requests failed at a rate of 0.25", failed)
+	}
+	if second := statuses(); !slices.Equal(first, second) {
+		t.Fatal("other requests failed in the second run")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	data := RandomData(100, 1)
+	o := NewOrigin(data, WithRedirects(3))
+	defer o.Close()
+	_, body := get(t, o.URL, "")
+	if !bytes.Equal(body, data) {
+		t.Fatal("redirects did not end at the file")
+	}
+	if n := len(o.Requests()); n != 4 {
+		t.Fatalf("%d requests, want 4", n)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	o := NewOrigin(RandomData(1<<20, 1), WithDrop(1, 1000))
+	defer o.Close()
+	req, _ := http.NewRequest(http.MethodGet, o.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil || n >= 1<<20 {
+		t.Fatalf("read %d bytes of a dropped response, error %v", n, err)
+	}
+	if _, body := get(t, o.URL, ""); len(body) != 1<<20 {
+		t.Fatalf("the second response has %d bytes", len(body))
+	}
+}